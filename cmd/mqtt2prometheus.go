@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
@@ -126,20 +127,56 @@ func main() {
 		mqttClientOptions.SetTLSConfig(tlsconfig)
 	}
 
-	collector := metrics.NewCollector(cfg.Cache.Timeout, cfg.Metrics, logger)
-	extractor, err := setupExtractor(cfg)
+	var collectorOpts []metrics.CollectorOption
+	if cfg.Cache.StalenessMarkers {
+		collectorOpts = append(collectorOpts, metrics.WithStalenessMarkers())
+	}
+	collector := metrics.NewCollector(cfg.Cache.Timeout, cfg.Metrics, logger, collectorOpts...)
+	parser, err := setupParser(cfg, logger)
+	if err != nil {
+		logger.Fatal("could not setup a metric parser", zap.Error(err))
+	}
+	if err := parser.MigrateRenamedStates(); err != nil {
+		logger.Warn("could not migrate the states of renamed metrics", zap.Error(err))
+	}
+	if err := parser.WarmState(); err != nil {
+		logger.Warn("could not warm up the metric states", zap.Error(err))
+	}
+	for deviceID, collection := range parser.LastValues() {
+		collector.Observe(deviceID, collection)
+	}
+	extractor, err := setupExtractor(cfg, parser)
 	if err != nil {
 		logger.Fatal("could not setup a metric extractor", zap.Error(err))
 	}
 
-	ingest := metrics.NewIngest(collector, extractor, cfg.MQTT.DeviceIDRegex)
+	ingestOpts := []metrics.IngestOption{metrics.WithDeviceIDNormalize(cfg.MQTT.DeviceIDNormalize)}
+	if cfg.MQTT.ErrorTopic != "" {
+		ingestOpts = append(ingestOpts, metrics.WithErrorTopic(cfg.MQTT.ErrorTopic))
+	}
+	if cfg.MQTT.DeviceIDField != "" {
+		ingestOpts = append(ingestOpts, metrics.WithDeviceIDField(cfg.MQTT.DeviceIDField, cfg.JsonParsing.Separator))
+	}
+	var liveness *metrics.LivenessCollector
+	if cfg.MQTT.Liveness != nil {
+		liveness = metrics.NewLivenessCollector(*cfg.MQTT.Liveness)
+		ingestOpts = append(ingestOpts, metrics.WithLiveness(liveness))
+	}
+	if cfg.OTLP != nil {
+		exporter := metrics.NewOTLPExporter(*cfg.OTLP, cfg.Metrics, logger)
+		go exporter.Run(context.Background())
+		ingestOpts = append(ingestOpts, metrics.WithOutput(exporter))
+	}
+	ingest := metrics.NewIngest(collector, extractor, cfg.MQTT.DeviceIDRegex, ingestOpts...)
 	mqttClientOptions.SetOnConnectHandler(ingest.OnConnectHandler)
 	mqttClientOptions.SetConnectionLostHandler(ingest.ConnectionLostHandler)
 	errorChan := make(chan error, 1)
 
+	topics := cfg.SubscriptionTopics()
+
 	for {
 		err = mqttclient.Subscribe(mqttClientOptions, mqttclient.SubscribeOptions{
-			Topic:             cfg.MQTT.TopicPath,
+			Topics:            topics,
 			QoS:               cfg.MQTT.QoS,
 			OnMessageReceived: ingest.SetupSubscriptionHandler(errorChan),
 			Logger:            logger,
@@ -159,9 +196,43 @@ func main() {
 		reg := prometheus.NewRegistry()
 		reg.MustRegister(ingest.Collector())
 		reg.MustRegister(collector)
+		reg.MustRegister(collector.ActiveSeriesCollector())
+		reg.MustRegister(parser.StateCollector())
+		reg.MustRegister(cfg.InfoCollector())
+		if liveness != nil {
+			reg.MustRegister(liveness)
+		}
 		gatherer = reg
 	}
 	http.Handle("/metrics", promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{}))
+	http.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
+		if !ingest.Connected() {
+			http.Error(w, "not connected to the MQTT broker", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	// Parsing is paused for controlled cutovers, e.g. to another instance sharing the state store.
+	http.HandleFunc("/pause", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := parser.Pause(); err != nil {
+			logger.Warn("could not flush the metric states on pause", zap.Error(err))
+			http.Error(w, fmt.Sprintf("paused, but could not flush the metric states: %s", err), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintln(w, "paused")
+	})
+	http.HandleFunc("/resume", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		parser.Resume()
+		fmt.Fprintln(w, "resumed")
+	})
 	s := &http.Server{
 		Addr:    getListenAddress(),
 		Handler: http.DefaultServeMux,
@@ -234,12 +305,49 @@ func setupGoKitLogger(l *zap.Logger) log.Logger {
 	return kitzap.NewZapSugarLogger(l, zap.NewAtomicLevelAt(*logLevelFlag).Level())
 }
 
-func setupExtractor(cfg config.Config) (metrics.Extractor, error) {
-	parser := metrics.NewParser(cfg.Metrics, cfg.JsonParsing.Separator, cfg.Cache.StateDir)
+func setupStateStore(cfg config.Config) (metrics.StateStore, error) {
+	switch cfg.Cache.StateBackend {
+	case config.StateBackendRedis:
+		return metrics.NewRedisStateStore(cfg.Cache.StateRedisURL)
+	case config.StateBackendMemory:
+		return metrics.NewMemoryStateStore(), nil
+	default:
+		var opts []metrics.FileStateStoreOption
+		if cfg.Cache.StateFileLocking {
+			opts = append(opts, metrics.WithFileLocking())
+		}
+		return metrics.NewFileStateStore(cfg.Cache.StateDir, opts...), nil
+	}
+}
+
+func setupParser(cfg config.Config, logger *zap.Logger) (metrics.Parser, error) {
+	store, err := setupStateStore(cfg)
+	if err != nil {
+		return metrics.Parser{}, fmt.Errorf("could not setup state store: %w", err)
+	}
+	return metrics.NewParser(cfg.Metrics, cfg.JsonParsing.Separator, cfg.Cache.StateDir,
+		metrics.WithExpressionTimeout(cfg.Cache.ExpressionTimeout),
+		metrics.WithAvailabilityWindow(cfg.Cache.Timeout),
+		metrics.WithStateStore(store),
+		metrics.WithLogger(logger.Named("parser")),
+	), nil
+}
+
+func setupExtractor(cfg config.Config, parser metrics.Parser) (metrics.Extractor, error) {
 	if cfg.MQTT.ObjectPerTopicConfig != nil {
 		switch cfg.MQTT.ObjectPerTopicConfig.Encoding {
 		case config.EncodingJSON:
-			return metrics.NewJSONObjectExtractor(parser, cfg.MQTT.MetricPerTopicConfig.MetricNameRegex), nil
+			extractor := metrics.NewJSONObjectExtractor(parser, cfg.MQTT.MetricPerTopicConfig.MetricNameRegex)
+			if o := cfg.MQTT.ObjectPerTopicConfig; o.HasPayloadSchema() {
+				extractor = metrics.NewSchemaValidatingExtractor(o.PayloadSchemaFor, extractor)
+			}
+			return extractor, nil
+		case config.EncodingXML:
+			return metrics.NewXMLObjectExtractor(parser, cfg.MQTT.MetricPerTopicConfig.MetricNameRegex), nil
+		case config.EncodingCSV:
+			return metrics.NewCSVObjectExtractor(parser, cfg.MQTT.MetricPerTopicConfig.MetricNameRegex, cfg.MQTT.ObjectPerTopicConfig), nil
+		case config.EncodingProtobuf:
+			return metrics.NewProtobufObjectExtractor(parser, cfg.MQTT.MetricPerTopicConfig.MetricNameRegex, cfg.MQTT.ObjectPerTopicConfig.MessageDescriptor()), nil
 		default:
 			return nil, fmt.Errorf("unsupported object format: %s", cfg.MQTT.ObjectPerTopicConfig.Encoding)
 		}
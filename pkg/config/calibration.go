@@ -0,0 +1,93 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// CalibrationTable maps raw values to calibrated values by linear interpolation between its points. Values beyond
+// the first or the last point are clamped to the calibrated value of that point.
+type CalibrationTable struct {
+	// Raw values of the points in strictly ascending order and their calibrated values
+	raw        []float64
+	calibrated []float64
+}
+
+// NewCalibrationTable returns the table of the given points of raw and calibrated value. There must be at least two
+// points, sorted by strictly ascending raw values.
+func NewCalibrationTable(points [][2]float64) (*CalibrationTable, error) {
+	if len(points) < 2 {
+		return nil, fmt.Errorf("a calibration table needs at least two points, got %d", len(points))
+	}
+	t := &CalibrationTable{raw: make([]float64, len(points)), calibrated: make([]float64, len(points))}
+	for i, p := range points {
+		if math.IsNaN(p[0]) || math.IsInf(p[0], 0) || math.IsNaN(p[1]) || math.IsInf(p[1], 0) {
+			return nil, fmt.Errorf("point %d: values must be finite", i+1)
+		}
+		if i > 0 && p[0] <= points[i-1][0] {
+			return nil, fmt.Errorf("point %d: raw value %v is not greater than the one of the previous point", i+1, p[0])
+		}
+		t.raw[i], t.calibrated[i] = p[0], p[1]
+	}
+	return t, nil
+}
+
+// loadCalibrationTable reads a calibration table from a file with one point per line, the raw and the calibrated
+// value separated by a comma. Empty lines and lines starting with # are ignored.
+func loadCalibrationTable(path string) (*CalibrationTable, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var points [][2]float64
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Split(text, ",")
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: want raw and calibrated value separated by a comma, got %q", line, text)
+		}
+		var p [2]float64
+		for i, field := range fields {
+			if p[i], err = strconv.ParseFloat(strings.TrimSpace(field), 64); err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+		}
+		points = append(points, p)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return NewCalibrationTable(points)
+}
+
+// Interpolate returns the calibrated value of the raw value.
+func (t *CalibrationTable) Interpolate(raw float64) float64 {
+	if math.IsNaN(raw) {
+		return raw
+	}
+	last := len(t.raw) - 1
+	if raw <= t.raw[0] {
+		return t.calibrated[0]
+	}
+	if raw >= t.raw[last] {
+		return t.calibrated[last]
+	}
+	// The index of the first point with a greater raw value, the raw value lies between it and the one before.
+	i := sort.SearchFloat64s(t.raw, raw)
+	if t.raw[i] == raw {
+		return t.calibrated[i]
+	}
+	fraction := (raw - t.raw[i-1]) / (t.raw[i] - t.raw[i-1])
+	return t.calibrated[i-1] + fraction*(t.calibrated[i]-t.calibrated[i-1])
+}
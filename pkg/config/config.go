@@ -1,27 +1,61 @@
 package config
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io/ioutil"
+	"net/url"
 	"os"
 	"reflect"
 	"regexp"
+	"runtime"
 	"sort"
+	"strings"
+	"text/template"
 	"time"
+	"unicode/utf8"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
 	"go.uber.org/zap"
-	"gopkg.in/yaml.v2"
+	"google.golang.org/protobuf/reflect/protoreflect"
 )
 
 const (
 	GaugeValueType   = "gauge"
 	CounterValueType = "counter"
+	UntypedValueType = "untyped"
 
 	DeviceIDRegexGroup   = "deviceid"
 	MetricNameRegexGroup = "metricname"
+
+	PipelineExpression      = "expression"
+	PipelineWhen            = "when"
+	PipelineForceMonotonicy = "force_monotonicy"
+	PipelineScale           = "scale"
+
+	DeriveAdd      = "add"
+	DeriveSubtract = "subtract"
+	DeriveMultiply = "multiply"
+	DeriveDivide   = "divide"
+
+	DespikeMedian3 = "median3"
+
+	DefaultTextLabel = "value"
+
+	TimestampAgeOmit  = "omit"
+	TimestampAgeClamp = "clamp"
+	TimestampAgeDrop  = "drop"
+
+	DeviceIDNormalizeNone  = "none"
+	DeviceIDNormalizeLower = "lower"
+	DeviceIDNormalizeUpper = "upper"
 )
 
+// DefaultPipeline is the order in which the steps after the value conversion are applied, unless configured otherwise.
+var DefaultPipeline = []string{PipelineExpression, PipelineWhen, PipelineForceMonotonicy, PipelineScale}
+
 var MetricConfigDefaults = MetricConfig{
 	TopicPathFilter: MustNewRegexp(".*"),
 }
@@ -34,14 +68,39 @@ var MQTTConfigDefaults = MQTTConfig{
 }
 
 var CacheConfigDefaults = CacheConfig{
-	Timeout:  2 * time.Minute,
-	StateDir: "/var/lib/mqtt2prometheus",
+	Timeout:           2 * time.Minute,
+	StateDir:          "/var/lib/mqtt2prometheus",
+	ExpressionTimeout: time.Second,
+}
+
+var OTLPConfigDefaults = OTLPConfig{
+	Interval: 15 * time.Second,
+	Timeout:  10 * time.Second,
+}
+
+var LivenessConfigDefaults = LivenessConfig{
+	BirthPayloads: []string{"online"},
+	DeathPayloads: []string{"offline"},
+	MetricName:    "device_up",
 }
 
 var JsonParsingConfigDefaults = JsonParsingConfig{
 	Separator: ".",
 }
 
+// goos is the operating system checked for the support of state_file_locking, overridden by tests.
+var goos = runtime.GOOS
+
+// fileLockingSupported reports whether state files can be locked on the operating system, matching the build
+// constraints of the flock implementation in package metrics.
+func fileLockingSupported(system string) bool {
+	switch system {
+	case "linux", "darwin", "freebsd", "netbsd", "openbsd", "dragonfly":
+		return true
+	}
+	return false
+}
+
 type Regexp struct {
 	r       *regexp.Regexp
 	pattern string
@@ -84,6 +143,14 @@ func (rf *Regexp) GroupValue(s string, groupName string) string {
 	return groupValues[groupName]
 }
 
+// String returns the pattern of the regexp, or the empty string if it is unset.
+func (rf *Regexp) String() string {
+	if rf == nil {
+		return ""
+	}
+	return rf.pattern
+}
+
 func (rf *Regexp) RegEx() *regexp.Regexp {
 	return rf.r
 }
@@ -95,21 +162,140 @@ func MustNewRegexp(pattern string) *Regexp {
 	}
 }
 
+// Template is a text/template which can be loaded from YAML.
+type Template struct {
+	t    *template.Template
+	text string
+}
+
+func (tf *Template) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var text string
+	if err := unmarshal(&text); err != nil {
+		return err
+	}
+	t, err := template.New("").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return err
+	}
+	tf.t = t
+	tf.text = text
+	return nil
+}
+
+func (tf *Template) MarshalYAML() (interface{}, error) {
+	if tf == nil {
+		return "", nil
+	}
+	return tf.text, nil
+}
+
+// Execute renders the template with the given data.
+func (tf *Template) Execute(data interface{}) (string, error) {
+	var b strings.Builder
+	if err := tf.t.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+func MustNewTemplate(text string) *Template {
+	return &Template{
+		t:    template.Must(template.New("").Option("missingkey=error").Parse(text)),
+		text: text,
+	}
+}
+
+// StateKeyFields are the fields available in a state_key template.
+type StateKeyFields struct {
+	DeviceID       string
+	Topic          string
+	MetricName     string
+	PrometheusName string
+}
+
 type Config struct {
 	JsonParsing     *JsonParsingConfig `yaml:"json_parsing,omitempty"`
 	Metrics         []BlockConfig      `yaml:"metrics"`
 	MQTT            *MQTTConfig        `yaml:"mqtt,omitempty"`
 	Cache           *CacheConfig       `yaml:"cache,omitempty"`
 	EnableProfiling bool               `yaml:"enable_profiling_metrics,omitempty"`
+	// OTLP pushes the parsed metrics to an OpenTelemetry collector in addition to exposing them. Disabled if nil.
+	OTLP *OTLPConfig `yaml:"otlp,omitempty"`
+	// DefaultErrorValue is the error_value of all metrics which set none, neither directly nor in their shared block.
+	DefaultErrorValue *float64 `yaml:"default_error_value,omitempty"`
+	// DefaultValueType is the type of all metrics which set none, neither directly nor in their shared block.
+	// Without it, these metrics are untyped.
+	DefaultValueType string `yaml:"default_value_type,omitempty"`
+	// IgnoreUnknownKeys logs unknown keys instead of rejecting the config, e.g. for configs written for newer versions.
+	IgnoreUnknownKeys bool `yaml:"ignore_unknown_keys,omitempty"`
+	// IgnoreDeprecatedStringErrorValue treats the deprecated string_value_mapping.error_value as unset, e.g. to verify
+	// a migration to error_value.
+	IgnoreDeprecatedStringErrorValue bool `yaml:"ignore_deprecated_string_error_value,omitempty"`
+	// Hash is the hex encoded SHA-256 of the loaded config file.
+	Hash string `yaml:"-"`
 }
 
 type CacheConfig struct {
 	Timeout  time.Duration `yaml:"timeout"`
 	StateDir string        `yaml:"state_directory"`
+	// ExpressionTimeout bounds a single expression evaluation. A negative value disables the limit.
+	ExpressionTimeout time.Duration `yaml:"expression_timeout"`
+	// StateBackend selects where the state is kept, either in StateDir or in redis at StateRedisURL.
+	StateBackend  string `yaml:"state_backend"`
+	StateRedisURL string `yaml:"state_redis_url"`
+	// StalenessMarkers emits a staleness marker once for every series which timed out. It requires Prometheus to
+	// scrape the protobuf exposition format, the text formats turn the markers into ordinary NaN samples.
+	StalenessMarkers bool `yaml:"staleness_markers"`
+	// StateDirFailOpen keeps the state in memory only, if the file backend's StateDir is not usable. By default,
+	// loading the config fails.
+	StateDirFailOpen bool `yaml:"state_dir_fail_open"`
+	// StateFileLocking locks each state file of the file backend while it is read or written, for replicas sharing
+	// StateDir.
+	StateFileLocking bool `yaml:"state_file_locking"`
+}
+
+// OTLPConfig configures the push of the parsed metrics via OTLP/HTTP with JSON encoding.
+type OTLPConfig struct {
+	// Endpoint is the URL the metrics are posted to, e.g. http://localhost:4318/v1/metrics.
+	Endpoint string `yaml:"endpoint"`
+	// Interval between two pushes. All samples received in between are sent at once.
+	Interval time.Duration `yaml:"interval"`
+	// Timeout of a single push.
+	Timeout time.Duration `yaml:"timeout"`
+	// Headers are added to each request, e.g. for authentication.
+	Headers map[string]string `yaml:"headers"`
+	// ServiceName is the service.name resource attribute, mqtt2prometheus if empty.
+	ServiceName string `yaml:"service_name"`
+}
+
+// LivenessConfig maps the birth and death messages devices publish on a dedicated, usually retained, status topic to
+// a gauge per device, which is 1 after a birth and 0 after a death message.
+type LivenessConfig struct {
+	// Topic is the topic filter of the status messages. Messages on matching topics are not passed to the extractor.
+	Topic string `yaml:"topic"`
+	// BirthPayloads and DeathPayloads are the payloads of the status messages, compared case-insensitively after
+	// trimming white space.
+	BirthPayloads []string `yaml:"birth_payloads"`
+	DeathPayloads []string `yaml:"death_payloads"`
+	// MetricName is the name of the gauge, device_up by default.
+	MetricName string `yaml:"metric_name"`
+}
+
+// DeviceID returns the level of the status topic at the single "+" level of Topic, which holds the device id.
+func (l *LivenessConfig) DeviceID(topic string) string {
+	filter, levels := strings.Split(l.Topic, topicLevelSeparator), strings.Split(topic, topicLevelSeparator)
+	for i, level := range filter {
+		if level == singleLevelWildcard && i < len(levels) {
+			return levels[i]
+		}
+	}
+	return ""
 }
 
 type JsonParsingConfig struct {
 	Separator string `yaml:"separator"`
+	// DecimalSeparator is the decimal_separator of all metrics which set none.
+	DecimalSeparator string `yaml:"decimal_separator"`
 }
 
 type MQTTConfig struct {
@@ -125,12 +311,92 @@ type MQTTConfig struct {
 	ClientCert           string                `yaml:"client_cert"`
 	ClientKey            string                `yaml:"client_key"`
 	ClientID             string                `yaml:"client_id"`
+	// DeriveTopicFilters subscribes to the topic filters derived by Config.TopicFilters instead of the plain TopicPath.
+	DeriveTopicFilters bool `yaml:"derive_topic_filters"`
+	// DeviceIDNormalize changes the case of extracted device ids. Valid values are "none", "lower" and "upper".
+	DeviceIDNormalize string `yaml:"device_id_normalize"`
+	// ErrorTopic receives a JSON event with topic, payload and error for each message which could not be processed.
+	ErrorTopic string `yaml:"error_topic"`
+	// DeviceIDField takes the device id from this field of JSON payloads instead of the topic.
+	DeviceIDField string `yaml:"device_id_field"`
+	// Liveness maps birth and death messages to a gauge per device.
+	Liveness *LivenessConfig `yaml:"liveness"`
 }
 
-const EncodingJSON = "JSON"
+const (
+	EncodingJSON     = "JSON"
+	EncodingProtobuf = "protobuf"
+	EncodingXML      = "XML"
+	EncodingCSV      = "CSV"
+)
+
+const (
+	StateBackendFile   = "file"
+	StateBackendRedis  = "redis"
+	StateBackendMemory = "memory"
+)
+
+const PayloadEncodingBase64 = "base64"
+
+// BinaryFormats maps the valid binary_format values to the number of bytes they decode.
+var BinaryFormats = map[string]int{
+	"int8":       1,
+	"uint8":      1,
+	"int16_be":   2,
+	"int16_le":   2,
+	"uint16_be":  2,
+	"uint16_le":  2,
+	"int32_be":   4,
+	"int32_le":   4,
+	"uint32_be":  4,
+	"uint32_le":  4,
+	"float32_be": 4,
+	"float32_le": 4,
+	"float64_be": 8,
+	"float64_le": 8,
+}
 
 type ObjectPerTopicConfig struct {
-	Encoding string `yaml:"encoding"` // Currently only JSON is a valid value
+	Encoding string `yaml:"encoding"` // JSON, protobuf, XML or CSV
+	// ProtobufDescriptor is the path to a binary FileDescriptorSet, as written by protoc --descriptor_set_out.
+	ProtobufDescriptor string `yaml:"protobuf_descriptor"`
+	// ProtobufMessage is the full name of the message type of the payloads, e.g. "sensors.v1.Reading".
+	ProtobufMessage string `yaml:"protobuf_message"`
+	// CSVColumns are the field names of the CSV columns by index. Columns with an empty name are ignored.
+	CSVColumns []string `yaml:"csv_columns"`
+	// CSVHeader takes the field names from the first row of the payload, for all columns without a name in CSVColumns.
+	CSVHeader bool `yaml:"csv_header"`
+	// CSVDelimiter separates the CSV columns, defaults to ",".
+	CSVDelimiter string `yaml:"csv_delimiter"`
+	// PayloadSchemaFile is the path to a JSON Schema all JSON payloads must satisfy, unless PayloadSchemas has one for
+	// their topic.
+	PayloadSchemaFile string `yaml:"payload_schema"`
+	// PayloadSchemas are the JSON Schemas of the payloads of specific topics. The first matching entry applies.
+	PayloadSchemas []PayloadSchemaConfig `yaml:"payload_schemas"`
+
+	messageDescriptor protoreflect.MessageDescriptor
+	payloadSchema     *JSONSchema
+}
+
+// MessageDescriptor returns the protobuf message descriptor resolved while loading the config.
+func (o *ObjectPerTopicConfig) MessageDescriptor() protoreflect.MessageDescriptor {
+	return o.messageDescriptor
+}
+
+// PayloadSchemaFor returns the JSON Schema compiled while loading the config for the payloads of the topic: the one of
+// the first matching payload_schemas entry or the payload_schema. It is nil if none applies.
+func (o *ObjectPerTopicConfig) PayloadSchemaFor(topic string) *JSONSchema {
+	for _, ps := range o.PayloadSchemas {
+		if TopicFilterCovers(ps.Topic, topic) {
+			return ps.schema
+		}
+	}
+	return o.payloadSchema
+}
+
+// HasPayloadSchema reports whether the payloads of any topic are validated against a JSON Schema.
+func (o *ObjectPerTopicConfig) HasPayloadSchema() bool {
+	return o.payloadSchema != nil || len(o.PayloadSchemas) > 0
 }
 
 type MetricPerTopicConfig struct {
@@ -140,22 +406,158 @@ type MetricPerTopicConfig struct {
 // Metrics Config is a mapping between a metric send on mqtt to a prometheus metric
 
 type MetricConfig struct {
-	PrometheusName     string                    `yaml:"prom_name"`
-	MQTTName           string                    `yaml:"mqtt_name"`
-	PayloadField       string                    `yaml:"payload_field"`
-	SensorNameFilter   Regexp                    `yaml:"sensor_name_filter"`
-	TopicPathFilter    *Regexp                   `yaml:"topic_path_filter"`
-	Help               string                    `yaml:"help"`
-	ValueType          string                    `yaml:"type"`
-	OmitTimestamp      bool                      `yaml:"omit_timestamp"`
-	RawExpression      string                    `yaml:"raw_expression"`
-	Expression         string                    `yaml:"expression"`
-	ForceMonotonicy    bool                      `yaml:"force_monotonicy"`
-	ConstantLabels     map[string]string         `yaml:"const_labels"`
-	DynamicLabels      map[string]string         `yaml:"dynamic_labels"`
-	StringValueMapping *StringValueMappingConfig `yaml:"string_value_mapping"`
-	MQTTValueScale     float64                   `yaml:"mqtt_value_scale"`
-	ErrorValue         *float64                  `yaml:"error_value"`
+	PrometheusName       string                       `yaml:"prom_name"`
+	MQTTName             string                       `yaml:"mqtt_name"`
+	MQTTNamePattern      *Regexp                      `yaml:"mqtt_name_pattern"`
+	MQTTNameLabel        string                       `yaml:"mqtt_name_label"`
+	PayloadField         string                       `yaml:"payload_field"`
+	SensorNameFilter     Regexp                       `yaml:"sensor_name_filter"`
+	TopicPathFilter      *Regexp                      `yaml:"topic_path_filter"`
+	Help                 string                       `yaml:"help"`
+	ValueType            string                       `yaml:"type"`
+	OmitTimestamp        bool                         `yaml:"omit_timestamp"`
+	RawExpression        string                       `yaml:"raw_expression"`
+	Expression           string                       `yaml:"expression"`
+	When                 string                       `yaml:"when"`
+	ForceMonotonicy      bool                         `yaml:"force_monotonicy"`
+	ConstantLabels       map[string]string            `yaml:"const_labels"`
+	DynamicLabels        map[string]string            `yaml:"dynamic_labels"`
+	LabelValueMapping    map[string]map[string]string `yaml:"label_value_mapping"`
+	StringValueMapping   *StringValueMappingConfig    `yaml:"string_value_mapping"`
+	MQTTValueScale       float64                      `yaml:"mqtt_value_scale"`
+	ErrorValue           *float64                     `yaml:"error_value"`
+	PayloadEncoding      string                       `yaml:"payload_encoding"`
+	BinaryFormat         string                       `yaml:"binary_format"`
+	StateKey             *Template                    `yaml:"state_key"`
+	RenamedFrom          string                       `yaml:"renamed_from"`
+	FixedValue           *float64                     `yaml:"fixed_value"`
+	TopicValueGroup      string                       `yaml:"topic_value_group"`
+	WindowSize           int                          `yaml:"window_size"`
+	IgnoreRetained       bool                         `yaml:"ignore_retained"`
+	IntegerValue         bool                         `yaml:"integer_value"`
+	ClampNegative        bool                         `yaml:"clamp_negative"`
+	RoundTo              *int                         `yaml:"round_to"`
+	LabelThresholds      map[string][]LabelThreshold  `yaml:"label_thresholds"`
+	Pipeline             []string                     `yaml:"pipeline"`
+	StrictMapping        bool                         `yaml:"strict_mapping"`
+	InitialOffset        float64                      `yaml:"initial_offset"`
+	TopicLabels          []TopicLabels                `yaml:"topic_labels"`
+	SyncOnReset          bool                         `yaml:"sync_on_reset"`
+	FieldLabels          map[string]string            `yaml:"field_labels"`
+	NameExpression       string                       `yaml:"name_expression"`
+	Names                []string                     `yaml:"names"`
+	ClampMonotonicOffset float64                      `yaml:"clamp_monotonic_offset"`
+	ValueFormatRegex     *Regexp                      `yaml:"value_format_regex"`
+	EmitAge              bool                         `yaml:"emit_age"`
+	TrueValue            *float64                     `yaml:"true_value"`
+	FalseValue           *float64                     `yaml:"false_value"`
+	TopicGroupLabels     bool                         `yaml:"topic_group_labels"`
+	ResetInterval        time.Duration                `yaml:"reset_interval"`
+	Derive               *DeriveConfig                `yaml:"derive"`
+	DecimalSeparator     string                       `yaml:"decimal_separator"`
+	NaNLabelValue        *string                      `yaml:"nan_label_value"`
+	EmitRaw              bool                         `yaml:"emit_raw"`
+	StripSuffixes        []StripSuffix                `yaml:"strip_suffixes"`
+	SubscribeTopic       string                       `yaml:"subscribe_topic"`
+	Despike              string                       `yaml:"despike"`
+	ErrorExpression      string                       `yaml:"error_expression"`
+	PersistLastValue     bool                         `yaml:"persist_last_value"`
+	MinChange            *float64                     `yaml:"min_change"`
+	HeartbeatInterval    time.Duration                `yaml:"heartbeat_interval"`
+	ResetFlushWindow     time.Duration                `yaml:"reset_flush_window"`
+	ExpectedInterval     time.Duration                `yaml:"expected_interval"`
+	MaxTimestampAge      time.Duration                `yaml:"max_timestamp_age"`
+	TimestampAgeAction   string                       `yaml:"timestamp_age_action"`
+	TimestampField       string                       `yaml:"timestamp_field"`
+	TimestampGrace       time.Duration                `yaml:"timestamp_grace"`
+	Transforms           []TransformConfig            `yaml:"transforms"`
+	EmitRate             bool                         `yaml:"emit_rate"`
+	EmitDelta            bool                         `yaml:"emit_delta"`
+	LabelOrder           []string                     `yaml:"label_order"`
+	ArrayCount           bool                         `yaml:"array_count"`
+	Filter               string                       `yaml:"filter"`
+	MaxValueAge          time.Duration                `yaml:"max_value_age"`
+	AbsentValue          *float64                     `yaml:"absent_value"`
+	CalibrationTable     string                       `yaml:"calibration_table"`
+	TextMetric           bool                         `yaml:"text_metric"`
+	TextLabel            string                       `yaml:"text_label"`
+	// Calibration is the table loaded from calibration_table.
+	Calibration *CalibrationTable `yaml:"-"`
+	// topicPath is the topic_path of the config for metrics without a subscribe_topic, set by LoadConfig.
+	topicPath string
+	// defaultErrorValue is set by LoadConfig if the ErrorValue is the default_error_value, neither the metric nor its
+	// shared block set one.
+	defaultErrorValue bool
+}
+
+// mergeConstantLabels returns the const_labels of a metric inheriting the shared ones. Keys of the metric override
+// the shared ones, the empty value removes a key.
+func mergeConstantLabels(shared, own map[string]string) map[string]string {
+	if len(shared) == 0 && len(own) == 0 {
+		return own
+	}
+	merged := make(map[string]string, len(shared)+len(own))
+	for k, v := range shared {
+		merged[k] = v
+	}
+	for k, v := range own {
+		merged[k] = v
+	}
+	for k, v := range merged {
+		if v == "" {
+			delete(merged, k)
+		}
+	}
+	return merged
+}
+
+// validDecimalSeparator reports whether the decimal_separator is unset or one of the supported separators.
+func validDecimalSeparator(sep string) bool {
+	return sep == "" || sep == "." || sep == ","
+}
+
+// StripSuffix is a unit suffix removed from string values before they are parsed as float. The parsed value is
+// multiplied by Scale, if set, e.g. 0.01 for "%".
+type StripSuffix struct {
+	Suffix string  `yaml:"suffix"`
+	Scale  float64 `yaml:"scale"`
+}
+
+// DeriveConfig computes the value of a metric from the last values of two sources, e.g. the difference of an inlet
+// and an outlet reading. The value is derived whenever one of the sources is updated, once both have been seen.
+type DeriveConfig struct {
+	Operation string         `yaml:"operation"`
+	Sources   []DeriveSource `yaml:"sources"`
+}
+
+// DeriveSource matches the values of a metric with the given MQTT name, optionally only on topics matching Topic.
+type DeriveSource struct {
+	MQTTName string  `yaml:"mqtt_name"`
+	Topic    *Regexp `yaml:"topic"`
+}
+
+// SourceIndex returns the index of the first source matching the metric name and topic, or -1 if there is none.
+func (dc *DeriveConfig) SourceIndex(metric, topic string) int {
+	for i, src := range dc.Sources {
+		if src.MQTTName == metric && src.Topic.Match(topic) {
+			return i
+		}
+	}
+	return -1
+}
+
+// TopicLabels are added to metrics received on a topic matching Topic. The labels of all matching entries are
+// merged, later entries take precedence. Metrics on other topics have empty values for these labels.
+type TopicLabels struct {
+	Topic  *Regexp           `yaml:"topic"`
+	Labels map[string]string `yaml:"labels"`
+}
+
+// LabelThreshold sets a label to Value if the metric value is below the threshold. Thresholds are checked in order,
+// the last one may omit Below to match all remaining values.
+type LabelThreshold struct {
+	Below *float64 `yaml:"below"`
+	Value string   `yaml:"value"`
 }
 
 type BlockConfig struct {
@@ -169,15 +571,172 @@ type StringValueMappingConfig struct {
 	// deprecated, a warning will be issued to migrate to metric level
 	ErrorValue *float64           `yaml:"error_value"`
 	Map        map[string]float64 `yaml:"map"`
+	// Groups map several synonymous strings to the same value. They are merged into Map when the config is loaded.
+	Groups []StringValueGroup `yaml:"groups"`
+}
+
+// StringValueGroup maps all of its strings to a single value.
+type StringValueGroup struct {
+	Strings []string `yaml:"strings"`
+	Value   float64  `yaml:"value"`
+}
+
+// expandGroups merges the groups into the map. Every string must be mapped only once.
+func (s *StringValueMappingConfig) expandGroups() error {
+	if len(s.Groups) == 0 {
+		return nil
+	}
+	m := make(map[string]float64, len(s.Map))
+	for k, v := range s.Map {
+		m[k] = v
+	}
+	for _, g := range s.Groups {
+		for _, str := range g.Strings {
+			if _, ok := m[str]; ok {
+				return fmt.Errorf("string %q is mapped more than once", str)
+			}
+			m[str] = g.Value
+		}
+	}
+	s.Map = m
+	s.Groups = nil
+	return nil
 }
 
 func (mc *MetricConfig) PrometheusDescription() *prometheus.Desc {
-	labels := append([]string{"sensor", "topic"}, mc.DynamicLabelsKeys()...)
+	return mc.PrometheusDescriptionFor(mc.PrometheusName)
+}
+
+// PrometheusDescriptionFor returns the description of the metric exported with the given name.
+func (mc *MetricConfig) PrometheusDescriptionFor(name string) *prometheus.Desc {
 	return prometheus.NewDesc(
-		mc.PrometheusName, mc.Help, labels, mc.ConstantLabels,
+		name, mc.Help, mc.LabelNames(), mc.ConstantLabels,
 	)
 }
 
+// companionMetric is a metric exported next to each name of a config, named by the name and the suffix.
+type companionMetric struct {
+	suffix  string
+	enabled func(mc *MetricConfig) bool
+	help    func(mc *MetricConfig, name string) string
+}
+
+var (
+	ageCompanion = companionMetric{
+		suffix:  "_age_seconds",
+		enabled: func(mc *MetricConfig) bool { return mc.EmitAge },
+		help: func(mc *MetricConfig, name string) string {
+			return fmt.Sprintf("Seconds since the last sample of %s", name)
+		},
+	}
+	rawCompanion = companionMetric{
+		suffix:  "_raw",
+		enabled: func(mc *MetricConfig) bool { return mc.EmitRaw },
+		help: func(mc *MetricConfig, name string) string {
+			return fmt.Sprintf("Value of %s before the expression and the other processing steps", name)
+		},
+	}
+	availabilityCompanion = companionMetric{
+		suffix:  "_availability",
+		enabled: func(mc *MetricConfig) bool { return mc.ExpectedInterval > 0 },
+		help: func(mc *MetricConfig, name string) string {
+			return fmt.Sprintf("Fraction of the samples of %s expected every %s received within the cache timeout", name, mc.ExpectedInterval)
+		},
+	}
+	rateCompanion = companionMetric{
+		suffix:  "_rate",
+		enabled: func(mc *MetricConfig) bool { return mc.EmitRate },
+		help: func(mc *MetricConfig, name string) string {
+			return fmt.Sprintf("Per-second rate of %s since the previous sample", name)
+		},
+	}
+	deltaCompanion = companionMetric{
+		suffix:  "_delta",
+		enabled: func(mc *MetricConfig) bool { return mc.EmitDelta },
+		help: func(mc *MetricConfig, name string) string {
+			return fmt.Sprintf("Increase of %s since the previous sample", name)
+		},
+	}
+	// companionMetrics are all companion metrics in the order of PrometheusDescriptions.
+	companionMetrics = []companionMetric{ageCompanion, rawCompanion, availabilityCompanion, rateCompanion, deltaCompanion}
+)
+
+// companionDescriptionFor returns the description of the companion metric of the metric exported with the given name.
+func (mc *MetricConfig) companionDescriptionFor(c companionMetric, name string) *prometheus.Desc {
+	return prometheus.NewDesc(name+c.suffix, c.help(mc, name), mc.LabelNames(), mc.ConstantLabels)
+}
+
+// AgeDescriptionFor returns the description of the companion metric holding the age of the metric exported with the
+// given name.
+func (mc *MetricConfig) AgeDescriptionFor(name string) *prometheus.Desc {
+	return mc.companionDescriptionFor(ageCompanion, name)
+}
+
+// RawDescriptionFor returns the description of the companion metric holding the value of the metric exported with
+// the given name before it was processed.
+func (mc *MetricConfig) RawDescriptionFor(name string) *prometheus.Desc {
+	return mc.companionDescriptionFor(rawCompanion, name)
+}
+
+// AvailabilityDescriptionFor returns the description of the companion gauge holding the fraction of the expected
+// samples received for the metric exported with the given name.
+func (mc *MetricConfig) AvailabilityDescriptionFor(name string) *prometheus.Desc {
+	return mc.companionDescriptionFor(availabilityCompanion, name)
+}
+
+// RateDescriptionFor returns the description of the companion gauge holding the per-second rate of the counter
+// exported with the given name.
+func (mc *MetricConfig) RateDescriptionFor(name string) *prometheus.Desc {
+	return mc.companionDescriptionFor(rateCompanion, name)
+}
+
+// DeltaDescriptionFor returns the description of the companion gauge holding the increase of the counter exported
+// with the given name since the previous sample.
+func (mc *MetricConfig) DeltaDescriptionFor(name string) *prometheus.Desc {
+	return mc.companionDescriptionFor(deltaCompanion, name)
+}
+
+// PrometheusDescriptions returns the descriptions of all metrics exported for this config. These are the names
+// a name_expression may select, or prom_name otherwise, their age with emit_age, their raw value with emit_raw,
+// their availability with expected_interval, their rate with emit_rate and their delta with emit_delta.
+func (mc *MetricConfig) PrometheusDescriptions() []*prometheus.Desc {
+	var descs []*prometheus.Desc
+	for _, name := range mc.PrometheusNames() {
+		descs = append(descs, mc.PrometheusDescriptionFor(name))
+		for _, c := range companionMetrics {
+			if c.enabled(mc) {
+				descs = append(descs, mc.companionDescriptionFor(c, name))
+			}
+		}
+	}
+	return descs
+}
+
+// exportsName reports whether the config exports a metric or a companion metric with the given name, see
+// PrometheusDescriptions.
+func (mc *MetricConfig) exportsName(name string) bool {
+	for _, n := range mc.PrometheusNames() {
+		if name == n {
+			return true
+		}
+		for _, c := range companionMetrics {
+			if c.enabled(mc) && name == n+c.suffix {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// PrometheusNames returns the names of the metrics exported for this config, the names a name_expression may select
+// or prom_name otherwise.
+func (mc *MetricConfig) PrometheusNames() []string {
+	if mc.NameExpression != "" {
+		return mc.Names
+	}
+	return []string{mc.PrometheusName}
+}
+
 func (mc *MetricConfig) PrometheusValueType() prometheus.ValueType {
 	switch mc.ValueType {
 	case GaugeValueType:
@@ -189,24 +748,182 @@ func (mc *MetricConfig) PrometheusValueType() prometheus.ValueType {
 	}
 }
 
+// SubscribedTo reports whether the topic matches the subscribe_topic of the metric. Metrics without a
+// subscribe_topic match the topic_path, which covers the filters derived from it, so they do not receive the
+// messages of the subscribe_topic of other metrics. Metrics not loaded by LoadConfig match all topics.
+func (mc *MetricConfig) SubscribedTo(topic string) bool {
+	if mc.SubscribeTopic != "" {
+		return TopicFilterCovers(mc.SubscribeTopic, topic)
+	}
+	return mc.topicPath == "" || TopicFilterCovers(mc.topicPath, topic)
+}
+
+// TopicGroupNames returns the named groups of the topic_path_filter, if they are exported as labels.
+func (mc *MetricConfig) TopicGroupNames() []string {
+	if !mc.TopicGroupLabels || mc.TopicPathFilter == nil || mc.TopicPathFilter.RegEx() == nil {
+		return nil
+	}
+	var names []string
+	for _, name := range mc.TopicPathFilter.RegEx().SubexpNames() {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// PipelineSteps returns the order in which the steps after the value conversion are applied.
+func (mc *MetricConfig) PipelineSteps() []string {
+	if len(mc.Pipeline) == 0 {
+		return DefaultPipeline
+	}
+	return mc.Pipeline
+}
+
 func (mc *MetricConfig) DynamicLabelsKeys() []string {
 	var labels []string
 	for k := range mc.DynamicLabels {
 		labels = append(labels, k)
 	}
+	for k := range mc.LabelThresholds {
+		labels = append(labels, k)
+	}
+	for k := range mc.FieldLabels {
+		labels = append(labels, k)
+	}
+	if mc.TextMetric {
+		labels = append(labels, mc.TextLabelName())
+	}
+	labels = append(labels, mc.TopicGroupNames()...)
+	seen := make(map[string]bool)
+	for _, tl := range mc.TopicLabels {
+		for k := range tl.Labels {
+			if !seen[k] {
+				seen[k] = true
+				labels = append(labels, k)
+			}
+		}
+	}
 	sort.Strings(labels)
+	// The label holding the name matched by MQTTNamePattern comes last.
+	if mc.MQTTNameLabel != "" {
+		labels = append(labels, mc.MQTTNameLabel)
+	}
 	return labels
 }
 
+// LabelNames returns the names of the variable labels of the metrics exported for this config. By default these are
+// "sensor" and "topic" followed by the DynamicLabelsKeys. The labels listed in label_order come first, in that order.
+func (mc *MetricConfig) LabelNames() []string {
+	labels := append([]string{"sensor", "topic"}, mc.DynamicLabelsKeys()...)
+	if len(mc.LabelOrder) == 0 {
+		return labels
+	}
+	ordered := make([]string, 0, len(labels))
+	listed := make(map[string]bool, len(mc.LabelOrder))
+	for _, label := range mc.LabelOrder {
+		ordered = append(ordered, label)
+		listed[label] = true
+	}
+	for _, label := range labels {
+		if !listed[label] {
+			ordered = append(ordered, label)
+		}
+	}
+	return ordered
+}
+
+// TextLabelName returns the label holding the value of a text_metric, text_label or "value" by default.
+func (mc *MetricConfig) TextLabelName() string {
+	if mc.TextLabel == "" {
+		return DefaultTextLabel
+	}
+	return mc.TextLabel
+}
+
+// labelSources returns the number of sources defining the label: "sensor" and "topic", dynamic_labels,
+// label_thresholds, field_labels, const_labels, text_label, mqtt_name_label, the topic_path_filter groups and
+// topic_labels. The topic_labels count once, however many of them set the label. Every label needs exactly one
+// source, the metric description would have duplicate label names otherwise.
+func (mc *MetricConfig) labelSources(label string) int {
+	n := 0
+	if label == "sensor" || label == "topic" {
+		n++
+	}
+	for _, labels := range []map[string]string{mc.DynamicLabels, mc.FieldLabels, mc.ConstantLabels} {
+		if _, ok := labels[label]; ok {
+			n++
+		}
+	}
+	if _, ok := mc.LabelThresholds[label]; ok {
+		n++
+	}
+	if mc.TextMetric && mc.TextLabelName() == label {
+		n++
+	}
+	if mc.MQTTNameLabel == label {
+		n++
+	}
+	for _, group := range mc.TopicGroupNames() {
+		if group == label {
+			n++
+		}
+	}
+	for _, tl := range mc.TopicLabels {
+		if _, ok := tl.Labels[label]; ok {
+			n++
+			break
+		}
+	}
+	return n
+}
+
+// prepareStateDir creates the state directory, if necessary, and checks that files can be written to it.
+func prepareStateDir(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create directory %q: %w", dir, err)
+	}
+	probe, err := os.CreateTemp(dir, ".write-test")
+	if err != nil {
+		return fmt.Errorf("directory %q is not writable: %w", dir, err)
+	}
+	probe.Close()
+	return os.Remove(probe.Name())
+}
+
+// validatePipeline checks that the pipeline contains every step exactly once.
+func validatePipeline(pipeline []string) error {
+	seen := make(map[string]bool, len(pipeline))
+	for _, step := range pipeline {
+		known := false
+		for _, s := range DefaultPipeline {
+			known = known || s == step
+		}
+		if !known {
+			return fmt.Errorf("unknown step %q, valid steps are %s", step, strings.Join(DefaultPipeline, ", "))
+		}
+		if seen[step] {
+			return fmt.Errorf("step %q is listed more than once", step)
+		}
+		seen[step] = true
+	}
+	if len(seen) != len(DefaultPipeline) {
+		return fmt.Errorf("all steps %s must be listed", strings.Join(DefaultPipeline, ", "))
+	}
+	return nil
+}
+
 func LoadConfig(configFile string, logger *zap.Logger) (Config, error) {
 	configData, err := ioutil.ReadFile(configFile)
 	if err != nil {
 		return Config{}, err
 	}
-	var cfg Config
-	if err = yaml.UnmarshalStrict(configData, &cfg); err != nil {
+	cfg, err := unmarshalConfig(configData, logger)
+	if err != nil {
 		return cfg, err
 	}
+	hash := sha256.Sum256(configData)
+	cfg.Hash = hex.EncodeToString(hash[:])
 
 	if cfg.MQTT == nil {
 		cfg.MQTT = &MQTTConfigDefaults
@@ -217,9 +934,83 @@ func LoadConfig(configFile string, logger *zap.Logger) (Config, error) {
 	if cfg.Cache.StateDir == "" {
 		cfg.Cache.StateDir = CacheConfigDefaults.StateDir
 	}
+	if cfg.Cache.ExpressionTimeout == 0 {
+		cfg.Cache.ExpressionTimeout = CacheConfigDefaults.ExpressionTimeout
+	}
+	switch cfg.Cache.StateBackend {
+	case "":
+		cfg.Cache.StateBackend = StateBackendFile
+	case StateBackendFile, StateBackendMemory:
+	case StateBackendRedis:
+		if cfg.Cache.StateRedisURL == "" {
+			return Config{}, fmt.Errorf("state backend %q requires state_redis_url", StateBackendRedis)
+		}
+	default:
+		return Config{}, fmt.Errorf("unsupported state backend %q", cfg.Cache.StateBackend)
+	}
+	if cfg.Cache.StateFileLocking && cfg.Cache.StateBackend != StateBackendFile {
+		return Config{}, fmt.Errorf("state_file_locking requires the state backend %q", StateBackendFile)
+	}
+	if cfg.Cache.StateFileLocking && !fileLockingSupported(goos) {
+		return Config{}, fmt.Errorf("state_file_locking is not supported on %s", goos)
+	}
+	if cfg.OTLP != nil {
+		u, err := url.Parse(cfg.OTLP.Endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return Config{}, fmt.Errorf("invalid otlp endpoint %q, must be an http or https URL", cfg.OTLP.Endpoint)
+		}
+		if cfg.OTLP.Interval < 0 || cfg.OTLP.Timeout < 0 {
+			return Config{}, fmt.Errorf("otlp interval and timeout must not be negative")
+		}
+		if cfg.OTLP.Interval == 0 {
+			cfg.OTLP.Interval = OTLPConfigDefaults.Interval
+		}
+		if cfg.OTLP.Timeout == 0 {
+			cfg.OTLP.Timeout = OTLPConfigDefaults.Timeout
+		}
+	}
+	if l := cfg.MQTT.Liveness; l != nil {
+		if !ValidTopicFilter(l.Topic) {
+			return Config{}, fmt.Errorf("liveness topic %q is no valid MQTT topic filter", l.Topic)
+		}
+		wildcards := 0
+		for _, level := range strings.Split(l.Topic, topicLevelSeparator) {
+			if level == singleLevelWildcard {
+				wildcards++
+			}
+		}
+		if wildcards != 1 {
+			return Config{}, fmt.Errorf("liveness topic %q must have exactly one %q level holding the device id", l.Topic, singleLevelWildcard)
+		}
+		if len(l.BirthPayloads) == 0 {
+			l.BirthPayloads = LivenessConfigDefaults.BirthPayloads
+		}
+		if len(l.DeathPayloads) == 0 {
+			l.DeathPayloads = LivenessConfigDefaults.DeathPayloads
+		}
+		if l.MetricName == "" {
+			l.MetricName = LivenessConfigDefaults.MetricName
+		}
+		if !model.IsValidMetricName(model.LabelValue(l.MetricName)) {
+			return Config{}, fmt.Errorf("invalid liveness metric_name %q", l.MetricName)
+		}
+		for _, birth := range l.BirthPayloads {
+			for _, death := range l.DeathPayloads {
+				if strings.EqualFold(strings.TrimSpace(birth), strings.TrimSpace(death)) {
+					return Config{}, fmt.Errorf("liveness payload %q is both a birth and a death payload", birth)
+				}
+			}
+		}
+	}
 	if cfg.JsonParsing == nil {
 		cfg.JsonParsing = &JsonParsingConfigDefaults
 	}
+	if cfg.JsonParsing.Separator == "" {
+		cfg.JsonParsing.Separator = JsonParsingConfigDefaults.Separator
+	}
+	if !validDecimalSeparator(cfg.JsonParsing.DecimalSeparator) {
+		return Config{}, fmt.Errorf("invalid json_parsing decimal_separator %q, must be \".\" or \",\"", cfg.JsonParsing.DecimalSeparator)
+	}
 	if cfg.MQTT.DeviceIDRegex == nil {
 		cfg.MQTT.DeviceIDRegex = MQTTConfigDefaults.DeviceIDRegex
 	}
@@ -232,6 +1023,13 @@ func LoadConfig(configFile string, logger *zap.Logger) (Config, error) {
 	if !validRegex {
 		return Config{}, fmt.Errorf("device id regex %q does not contain required regex group %q", cfg.MQTT.DeviceIDRegex.pattern, DeviceIDRegexGroup)
 	}
+	switch cfg.MQTT.DeviceIDNormalize {
+	case "":
+		cfg.MQTT.DeviceIDNormalize = DeviceIDNormalizeNone
+	case DeviceIDNormalizeNone, DeviceIDNormalizeLower, DeviceIDNormalizeUpper:
+	default:
+		return Config{}, fmt.Errorf("unsupported device id normalization %q", cfg.MQTT.DeviceIDNormalize)
+	}
 
 	if cfg.MQTT.ObjectPerTopicConfig == nil && cfg.MQTT.MetricPerTopicConfig == nil {
 		cfg.MQTT.ObjectPerTopicConfig = &ObjectPerTopicConfig{
@@ -239,6 +1037,54 @@ func LoadConfig(configFile string, logger *zap.Logger) (Config, error) {
 		}
 	}
 
+	if o := cfg.MQTT.ObjectPerTopicConfig; o != nil {
+		switch o.Encoding {
+		case EncodingJSON, EncodingXML:
+		case EncodingCSV:
+			if len(o.CSVColumns) == 0 && !o.CSVHeader {
+				return Config{}, fmt.Errorf("CSV encoding requires csv_columns or csv_header")
+			}
+			if utf8.RuneCountInString(o.CSVDelimiter) > 1 || o.CSVDelimiter == "\"" || o.CSVDelimiter == "\n" {
+				return Config{}, fmt.Errorf("invalid csv_delimiter %q, must be a single character", o.CSVDelimiter)
+			}
+		case EncodingProtobuf:
+			desc, err := loadMessageDescriptor(o.ProtobufDescriptor, o.ProtobufMessage)
+			if err != nil {
+				return Config{}, fmt.Errorf("invalid protobuf config: %w", err)
+			}
+			o.messageDescriptor = desc
+		default:
+			return Config{}, fmt.Errorf("unsupported object encoding %q", o.Encoding)
+		}
+		if o.PayloadSchemaFile != "" {
+			if o.Encoding != EncodingJSON {
+				return Config{}, fmt.Errorf("payload_schema requires JSON payloads, the object encoding is %q", o.Encoding)
+			}
+			schema, err := loadJSONSchema(o.PayloadSchemaFile)
+			if err != nil {
+				return Config{}, fmt.Errorf("invalid payload_schema %q: %w", o.PayloadSchemaFile, err)
+			}
+			o.payloadSchema = schema
+		}
+		for i, ps := range o.PayloadSchemas {
+			if o.Encoding != EncodingJSON {
+				return Config{}, fmt.Errorf("payload_schemas require JSON payloads, the object encoding is %q", o.Encoding)
+			}
+			if !ValidTopicFilter(ps.Topic) {
+				return Config{}, fmt.Errorf("payload_schemas topic %q is no valid MQTT topic filter", ps.Topic)
+			}
+			schema, err := loadJSONSchema(ps.SchemaFile)
+			if err != nil {
+				return Config{}, fmt.Errorf("invalid payload_schemas schema %q: %w", ps.SchemaFile, err)
+			}
+			o.PayloadSchemas[i].schema = schema
+		}
+	}
+
+	if o := cfg.MQTT.ObjectPerTopicConfig; cfg.MQTT.DeviceIDField != "" && o != nil && o.Encoding != EncodingJSON {
+		return Config{}, fmt.Errorf("device_id_field requires JSON payloads, the object encoding is %q", o.Encoding)
+	}
+
 	if cfg.MQTT.MetricPerTopicConfig != nil {
 		validRegex = false
 		for _, name := range cfg.MQTT.MetricPerTopicConfig.MetricNameRegex.RegEx().SubexpNames() {
@@ -251,14 +1097,30 @@ func LoadConfig(configFile string, logger *zap.Logger) (Config, error) {
 		}
 	}
 
+	switch cfg.DefaultValueType {
+	case "", GaugeValueType, CounterValueType, UntypedValueType:
+	default:
+		return Config{}, fmt.Errorf("invalid default_value_type %q", cfg.DefaultValueType)
+	}
+
 	for _, metric := range cfg.Metrics {
 		targets := metric.Metrics
-		sources := []MetricConfig{metric.SharedValues, MetricConfigDefaults}
+		for i := range targets {
+			targets[i].ConstantLabels = mergeConstantLabels(metric.SharedValues.ConstantLabels, targets[i].ConstantLabels)
+			targets[i].defaultErrorValue = targets[i].ErrorValue == nil && metric.SharedValues.ErrorValue == nil && cfg.DefaultErrorValue != nil
+		}
+		// Pointer fields are only set if they are nil in the target, so an explicit zero value is kept. The sources are
+		// applied in order of precedence, e.g. a topic_path_filter of the shared block wins over the global ".*".
+		sources := []MetricConfig{metric.SharedValues, {ErrorValue: cfg.DefaultErrorValue, ValueType: cfg.DefaultValueType, DecimalSeparator: cfg.JsonParsing.DecimalSeparator}, MetricConfigDefaults}
 		for _, source := range sources {
 			for i := range targets {
 				tgt := reflect.ValueOf(&targets[i]).Elem()
 				src := reflect.ValueOf(&source).Elem()
 				for i := 0; i < src.NumField(); i++ {
+					if src.Type().Field(i).Name == "ConstantLabels" {
+						// Merged key by key above.
+						continue
+					}
 					dstField := tgt.FieldByName(src.Type().Field(i).Name)
 					if dstField.IsValid() && dstField.CanSet() && dstField.IsZero() &&
 						dstField.Type() == src.Field(i).Type() && !src.Field(i).IsZero() {
@@ -277,13 +1139,24 @@ func LoadConfig(configFile string, logger *zap.Logger) (Config, error) {
 				forcesMonotonicy = true
 			}
 
+			if m.StringValueMapping != nil && m.StringValueMapping.ErrorValue != nil && cfg.IgnoreDeprecatedStringErrorValue {
+				logger.Warn("Ignoring deprecated string_value_mapping.error_value.", zap.String("prometheusName", m.PrometheusName), zap.String("MQTTName", m.MQTTName))
+				m.StringValueMapping.ErrorValue = nil
+			}
 			if m.StringValueMapping != nil && m.StringValueMapping.ErrorValue != nil {
-				if m.ErrorValue != nil {
+				// The deprecated error value takes precedence over the default.
+				if m.ErrorValue != nil && !m.defaultErrorValue {
 					return Config{}, fmt.Errorf("metric %s/%s: cannot set both string_value_mapping.error_value and error_value (string_value_mapping.error_value is deprecated).", m.MQTTName, m.PrometheusName)
 				}
 				logger.Warn("string_value_mapping.error_value is deprecated: please use error_value at the metric level.", zap.String("prometheusName", m.PrometheusName), zap.String("MQTTName", m.MQTTName))
 			}
 
+			if m.StringValueMapping != nil {
+				if err := m.StringValueMapping.expandGroups(); err != nil {
+					return Config{}, fmt.Errorf("metric %s/%s: invalid string_value_mapping: %w", m.MQTTName, m.PrometheusName, err)
+				}
+			}
+
 			// Default for omitted MQTTName
 			if m.MQTTName == "" {
 				blocks.Metrics[i].MQTTName = m.PrometheusName
@@ -292,11 +1165,355 @@ func LoadConfig(configFile string, logger *zap.Logger) (Config, error) {
 			if m.Expression != "" && m.RawExpression != "" {
 				return Config{}, fmt.Errorf("metric %s/%s: expression and raw_expression are mutually exclusive.", m.MQTTName, m.PrometheusName)
 			}
+
+			switch m.PayloadEncoding {
+			case "":
+			case PayloadEncodingBase64:
+				if _, ok := BinaryFormats[m.BinaryFormat]; !ok {
+					return Config{}, fmt.Errorf("metric %s/%s: invalid binary_format %q.", m.MQTTName, m.PrometheusName, m.BinaryFormat)
+				}
+			default:
+				return Config{}, fmt.Errorf("metric %s/%s: unsupported payload_encoding %q.", m.MQTTName, m.PrometheusName, m.PayloadEncoding)
+			}
+
+			if m.FixedValue != nil || m.TopicValueGroup != "" {
+				if cfg.MQTT.MetricPerTopicConfig == nil {
+					return Config{}, fmt.Errorf("metric %s/%s: fixed_value and topic_value_group require metric_per_topic_config.", m.MQTTName, m.PrometheusName)
+				}
+				if m.FixedValue != nil && m.TopicValueGroup != "" {
+					return Config{}, fmt.Errorf("metric %s/%s: fixed_value and topic_value_group are mutually exclusive.", m.MQTTName, m.PrometheusName)
+				}
+				if m.PayloadField != "" {
+					return Config{}, fmt.Errorf("metric %s/%s: payload_field can not be used together with fixed_value or topic_value_group.", m.MQTTName, m.PrometheusName)
+				}
+				if m.TopicValueGroup != "" && cfg.MQTT.MetricPerTopicConfig.MetricNameRegex.RegEx().SubexpIndex(m.TopicValueGroup) < 0 {
+					return Config{}, fmt.Errorf("metric %s/%s: metric name regex does not contain the topic_value_group %q.", m.MQTTName, m.PrometheusName, m.TopicValueGroup)
+				}
+			}
+
+			if m.AbsentValue != nil && (cfg.MQTT.ObjectPerTopicConfig == nil || m.MQTTNamePattern != nil) {
+				return Config{}, fmt.Errorf("metric %s/%s: absent_value requires object_per_topic_config and can not be used together with mqtt_name_pattern.", m.MQTTName, m.PrometheusName)
+			}
+
+			if m.MQTTNameLabel != "" {
+				if m.MQTTNamePattern == nil {
+					return Config{}, fmt.Errorf("metric %s/%s: mqtt_name_label requires mqtt_name_pattern.", m.MQTTName, m.PrometheusName)
+				}
+				if m.labelSources(m.MQTTNameLabel) > 1 {
+					return Config{}, fmt.Errorf("metric %s/%s: mqtt_name_label %q collides with another label.", m.MQTTName, m.PrometheusName, m.MQTTNameLabel)
+				}
+			}
+
+			for label, thresholds := range m.LabelThresholds {
+				if m.labelSources(label) > 1 {
+					return Config{}, fmt.Errorf("metric %s/%s: label_thresholds for %q collides with another label.", m.MQTTName, m.PrometheusName, label)
+				}
+				for i, th := range thresholds {
+					if th.Below == nil && i != len(thresholds)-1 {
+						return Config{}, fmt.Errorf("metric %s/%s: only the last label_thresholds for %q may omit below.", m.MQTTName, m.PrometheusName, label)
+					}
+					if i > 0 && th.Below != nil && *th.Below <= *thresholds[i-1].Below {
+						return Config{}, fmt.Errorf("metric %s/%s: label_thresholds for %q must be sorted ascending.", m.MQTTName, m.PrometheusName, label)
+					}
+				}
+			}
+
+			if len(m.Pipeline) > 0 {
+				if err := validatePipeline(m.Pipeline); err != nil {
+					return Config{}, fmt.Errorf("metric %s/%s: invalid pipeline: %w", m.MQTTName, m.PrometheusName, err)
+				}
+			}
+
+			if len(m.Transforms) > 0 {
+				if m.IntegerValue {
+					return Config{}, fmt.Errorf("metric %s/%s: transforms can not be used together with integer_value.", m.MQTTName, m.PrometheusName)
+				}
+				if _, err := m.CompileTransforms(); err != nil {
+					return Config{}, fmt.Errorf("metric %s/%s: invalid transforms: %w", m.MQTTName, m.PrometheusName, err)
+				}
+			}
+
+			if m.CalibrationTable != "" {
+				if m.IntegerValue {
+					return Config{}, fmt.Errorf("metric %s/%s: calibration_table can not be used together with integer_value.", m.MQTTName, m.PrometheusName)
+				}
+				table, err := loadCalibrationTable(m.CalibrationTable)
+				if err != nil {
+					return Config{}, fmt.Errorf("metric %s/%s: invalid calibration_table %q: %w", m.MQTTName, m.PrometheusName, m.CalibrationTable, err)
+				}
+				blocks.Metrics[i].Calibration = table
+			}
+
+			if (m.InitialOffset != 0 || m.SyncOnReset || m.ClampMonotonicOffset != 0 || m.ResetFlushWindow != 0) && !m.ForceMonotonicy {
+				return Config{}, fmt.Errorf("metric %s/%s: initial_offset, sync_on_reset, clamp_monotonic_offset and reset_flush_window require force_monotonicy.", m.MQTTName, m.PrometheusName)
+			}
+			if m.ResetFlushWindow < 0 {
+				return Config{}, fmt.Errorf("metric %s/%s: reset_flush_window must not be negative.", m.MQTTName, m.PrometheusName)
+			}
+			if m.ClampMonotonicOffset < 0 {
+				return Config{}, fmt.Errorf("metric %s/%s: clamp_monotonic_offset must not be negative.", m.MQTTName, m.PrometheusName)
+			}
+
+			if m.StrictMapping && m.StringValueMapping == nil {
+				return Config{}, fmt.Errorf("metric %s/%s: strict_mapping requires a string_value_mapping.", m.MQTTName, m.PrometheusName)
+			}
+
+			if m.RoundTo != nil && *m.RoundTo < 0 {
+				return Config{}, fmt.Errorf("metric %s/%s: round_to must not be negative.", m.MQTTName, m.PrometheusName)
+			}
+
+			if m.WindowSize < 0 {
+				return Config{}, fmt.Errorf("metric %s/%s: window_size must not be negative.", m.MQTTName, m.PrometheusName)
+			}
+
+			if m.IntegerValue && (m.ForceMonotonicy || m.MQTTValueScale != 0 || m.WindowSize > 0) {
+				return Config{}, fmt.Errorf("metric %s/%s: integer_value can not be used together with force_monotonicy, mqtt_value_scale or window_size.", m.MQTTName, m.PrometheusName)
+			}
+
+			if !validDecimalSeparator(m.DecimalSeparator) {
+				return Config{}, fmt.Errorf("metric %s/%s: invalid decimal_separator %q, must be \".\" or \",\".", m.MQTTName, m.PrometheusName, m.DecimalSeparator)
+			}
+
+			if m.ErrorExpression != "" && (m.IntegerValue || m.RawExpression != "") {
+				return Config{}, fmt.Errorf("metric %s/%s: error_expression can not be used together with integer_value or raw_expression.", m.MQTTName, m.PrometheusName)
+			}
+
+			if m.Despike != "" && m.Despike != DespikeMedian3 {
+				return Config{}, fmt.Errorf("metric %s/%s: invalid despike %q, must be %q.", m.MQTTName, m.PrometheusName, m.Despike, DespikeMedian3)
+			}
+			if m.Despike != "" && m.IntegerValue {
+				return Config{}, fmt.Errorf("metric %s/%s: despike can not be used together with integer_value.", m.MQTTName, m.PrometheusName)
+			}
+
+			if m.MinChange != nil && !(*m.MinChange >= 0) {
+				return Config{}, fmt.Errorf("metric %s/%s: min_change must not be negative.", m.MQTTName, m.PrometheusName)
+			}
+			if m.HeartbeatInterval < 0 || (m.HeartbeatInterval > 0 && m.MinChange == nil) {
+				return Config{}, fmt.Errorf("metric %s/%s: heartbeat_interval must not be negative and requires min_change.", m.MQTTName, m.PrometheusName)
+			}
+
+			// A cache timeout which is not positive disables the deletion from the cache and leaves no upper bound.
+			if m.ExpectedInterval < 0 || (cfg.Cache.Timeout > 0 && m.ExpectedInterval > cfg.Cache.Timeout) {
+				return Config{}, fmt.Errorf("metric %s/%s: expected_interval must be positive and at most the cache timeout %s.", m.MQTTName, m.PrometheusName, cfg.Cache.Timeout)
+			}
+
+			if m.EmitRate && m.PrometheusValueType() != prometheus.CounterValue {
+				return Config{}, fmt.Errorf("metric %s/%s: emit_rate requires a counter.", m.MQTTName, m.PrometheusName)
+			}
+			if m.EmitDelta && m.PrometheusValueType() != prometheus.CounterValue {
+				return Config{}, fmt.Errorf("metric %s/%s: emit_delta requires a counter.", m.MQTTName, m.PrometheusName)
+			}
+
+			if m.MaxValueAge < 0 {
+				return Config{}, fmt.Errorf("metric %s/%s: max_value_age must not be negative.", m.MQTTName, m.PrometheusName)
+			}
+
+			if m.MaxTimestampAge < 0 {
+				return Config{}, fmt.Errorf("metric %s/%s: max_timestamp_age must not be negative.", m.MQTTName, m.PrometheusName)
+			}
+			switch m.TimestampAgeAction {
+			case "":
+			case TimestampAgeOmit, TimestampAgeClamp, TimestampAgeDrop:
+				if m.MaxTimestampAge == 0 {
+					return Config{}, fmt.Errorf("metric %s/%s: timestamp_age_action requires max_timestamp_age.", m.MQTTName, m.PrometheusName)
+				}
+			default:
+				return Config{}, fmt.Errorf("metric %s/%s: invalid timestamp_age_action %q, must be %q, %q or %q.", m.MQTTName, m.PrometheusName, m.TimestampAgeAction, TimestampAgeOmit, TimestampAgeClamp, TimestampAgeDrop)
+			}
+			if m.TimestampField != "" && (cfg.MQTT.ObjectPerTopicConfig == nil || m.OmitTimestamp) {
+				return Config{}, fmt.Errorf("metric %s/%s: timestamp_field requires object_per_topic_config and can not be used together with omit_timestamp.", m.MQTTName, m.PrometheusName)
+			}
+			if m.TimestampGrace < 0 {
+				return Config{}, fmt.Errorf("metric %s/%s: timestamp_grace must not be negative.", m.MQTTName, m.PrometheusName)
+			}
+			if m.TimestampGrace > 0 && m.TimestampField == "" {
+				return Config{}, fmt.Errorf("metric %s/%s: timestamp_grace requires timestamp_field.", m.MQTTName, m.PrometheusName)
+			}
+
+			if m.SubscribeTopic != "" && !ValidTopicFilter(m.SubscribeTopic) {
+				return Config{}, fmt.Errorf("metric %s/%s: subscribe_topic %q is no valid MQTT topic filter.", m.MQTTName, m.PrometheusName, m.SubscribeTopic)
+			}
+			if m.SubscribeTopic == "" {
+				blocks.Metrics[i].topicPath = cfg.MQTT.TopicPath
+			}
+
+			seenSuffixes := make(map[string]bool, len(m.StripSuffixes))
+			for _, ss := range m.StripSuffixes {
+				if ss.Suffix == "" || strings.ContainsAny(ss.Suffix, "0123456789") {
+					return Config{}, fmt.Errorf("metric %s/%s: strip_suffixes suffix %q must be set and must not contain digits.", m.MQTTName, m.PrometheusName, ss.Suffix)
+				}
+				if seenSuffixes[ss.Suffix] {
+					return Config{}, fmt.Errorf("metric %s/%s: duplicate strip_suffixes suffix %q.", m.MQTTName, m.PrometheusName, ss.Suffix)
+				}
+				seenSuffixes[ss.Suffix] = true
+				if ss.Scale < 0 {
+					return Config{}, fmt.Errorf("metric %s/%s: scale of strip_suffixes suffix %q must not be negative.", m.MQTTName, m.PrometheusName, ss.Suffix)
+				}
+			}
+
+			if m.ResetInterval < 0 {
+				return Config{}, fmt.Errorf("metric %s/%s: reset_interval must not be negative.", m.MQTTName, m.PrometheusName)
+			}
+
+			if m.ResetInterval > 0 && m.IntegerValue {
+				return Config{}, fmt.Errorf("metric %s/%s: reset_interval can not be used together with integer_value.", m.MQTTName, m.PrometheusName)
+			}
+
+			if m.Derive != nil {
+				switch m.Derive.Operation {
+				case DeriveAdd, DeriveSubtract, DeriveMultiply, DeriveDivide:
+				default:
+					return Config{}, fmt.Errorf("metric %s/%s: invalid derive operation %q.", m.MQTTName, m.PrometheusName, m.Derive.Operation)
+				}
+				if len(m.Derive.Sources) != 2 {
+					return Config{}, fmt.Errorf("metric %s/%s: derive requires exactly two sources.", m.MQTTName, m.PrometheusName)
+				}
+				for _, src := range m.Derive.Sources {
+					if src.MQTTName == "" {
+						return Config{}, fmt.Errorf("metric %s/%s: derive sources require a mqtt_name.", m.MQTTName, m.PrometheusName)
+					}
+				}
+				if m.MQTTNamePattern != nil || m.IntegerValue {
+					return Config{}, fmt.Errorf("metric %s/%s: derive can not be used together with mqtt_name_pattern or integer_value.", m.MQTTName, m.PrometheusName)
+				}
+			}
+
+			if m.StateKey != nil {
+				if _, err := m.StateKey.Execute(StateKeyFields{}); err != nil {
+					return Config{}, fmt.Errorf("metric %s/%s: invalid state_key: %w", m.MQTTName, m.PrometheusName, err)
+				}
+			}
+
+			if m.RenamedFrom != "" {
+				if !model.IsValidMetricName(model.LabelValue(m.RenamedFrom)) || m.RenamedFrom == m.PrometheusName {
+					return Config{}, fmt.Errorf("metric %s/%s: invalid renamed_from %q, must be a metric name other than prom_name.", m.MQTTName, m.PrometheusName, m.RenamedFrom)
+				}
+				// The states of a state_key template are not named after the prom_name.
+				if m.StateKey != nil {
+					return Config{}, fmt.Errorf("metric %s/%s: renamed_from can not be used together with state_key.", m.MQTTName, m.PrometheusName)
+				}
+			}
+
+			if m.NameExpression != "" {
+				if len(m.Names) == 0 {
+					return Config{}, fmt.Errorf("metric %s/%s: name_expression requires the list of possible names.", m.MQTTName, m.PrometheusName)
+				}
+				for _, name := range m.Names {
+					if !model.IsValidMetricName(model.LabelValue(name)) {
+						return Config{}, fmt.Errorf("metric %s/%s: invalid metric name %q in names.", m.MQTTName, m.PrometheusName, name)
+					}
+				}
+			} else if len(m.Names) > 0 {
+				return Config{}, fmt.Errorf("metric %s/%s: names requires a name_expression.", m.MQTTName, m.PrometheusName)
+			}
+
+			for label := range m.FieldLabels {
+				if m.labelSources(label) > 1 {
+					return Config{}, fmt.Errorf("metric %s/%s: field_labels for %q collides with another label.", m.MQTTName, m.PrometheusName, label)
+				}
+			}
+
+			if m.ArrayCount {
+				if m.IntegerValue || m.RawExpression != "" || m.StringValueMapping != nil || m.PayloadEncoding != "" || m.TextMetric {
+					return Config{}, fmt.Errorf("metric %s/%s: array_count can not be used together with integer_value, raw_expression, string_value_mapping, payload_encoding or text_metric.", m.MQTTName, m.PrometheusName)
+				}
+			} else if m.Filter != "" {
+				return Config{}, fmt.Errorf("metric %s/%s: filter requires array_count.", m.MQTTName, m.PrometheusName)
+			}
+
+			if m.TextMetric {
+				if m.IntegerValue || m.Expression != "" || m.RawExpression != "" || m.StringValueMapping != nil ||
+					m.PayloadEncoding != "" || m.WindowSize > 0 || m.Despike != "" || m.ForceMonotonicy ||
+					len(m.Transforms) > 0 || m.CalibrationTable != "" || m.ErrorExpression != "" || m.MQTTValueScale != 0 ||
+					m.When != "" || m.MinChange != nil || m.RoundTo != nil || (m.ErrorValue != nil && !m.defaultErrorValue) {
+					return Config{}, fmt.Errorf("metric %s/%s: text_metric can not be used together with integer_value, expression, raw_expression, string_value_mapping, payload_encoding, window_size, despike, force_monotonicy, transforms, calibration_table, error_expression, mqtt_value_scale, when, min_change, round_to or error_value.", m.MQTTName, m.PrometheusName)
+				}
+				if m.ValueType != "" && m.ValueType != GaugeValueType {
+					return Config{}, fmt.Errorf("metric %s/%s: text_metric requires type gauge.", m.MQTTName, m.PrometheusName)
+				}
+				blocks.Metrics[i].ValueType = GaugeValueType
+				label := m.TextLabelName()
+				if !model.LabelName(label).IsValid() {
+					return Config{}, fmt.Errorf("metric %s/%s: invalid text_label %q.", m.MQTTName, m.PrometheusName, label)
+				}
+				if m.labelSources(label) > 1 {
+					return Config{}, fmt.Errorf("metric %s/%s: text_label %q collides with another label.", m.MQTTName, m.PrometheusName, label)
+				}
+			} else if m.TextLabel != "" {
+				return Config{}, fmt.Errorf("metric %s/%s: text_label requires text_metric.", m.MQTTName, m.PrometheusName)
+			}
+
+			if len(m.LabelOrder) > 0 {
+				known := make(map[string]bool)
+				for _, label := range append([]string{"sensor", "topic"}, m.DynamicLabelsKeys()...) {
+					known[label] = true
+				}
+				listed := make(map[string]bool, len(m.LabelOrder))
+				for _, label := range m.LabelOrder {
+					if !known[label] {
+						return Config{}, fmt.Errorf("metric %s/%s: label_order lists %q, which is not a label of the metric.", m.MQTTName, m.PrometheusName, label)
+					}
+					if listed[label] {
+						return Config{}, fmt.Errorf("metric %s/%s: label_order lists %q twice.", m.MQTTName, m.PrometheusName, label)
+					}
+					listed[label] = true
+				}
+			}
+
+			for _, tl := range m.TopicLabels {
+				if tl.Topic == nil {
+					return Config{}, fmt.Errorf("metric %s/%s: topic_labels require a topic.", m.MQTTName, m.PrometheusName)
+				}
+				for label := range tl.Labels {
+					if m.labelSources(label) > 1 {
+						return Config{}, fmt.Errorf("metric %s/%s: topic_labels for %q collides with another label.", m.MQTTName, m.PrometheusName, label)
+					}
+				}
+			}
+
+			if m.TopicGroupLabels {
+				groups := m.TopicGroupNames()
+				if len(groups) == 0 {
+					return Config{}, fmt.Errorf("metric %s/%s: topic_group_labels requires named groups in the topic_path_filter.", m.MQTTName, m.PrometheusName)
+				}
+				for _, label := range groups {
+					if m.labelSources(label) > 1 {
+						return Config{}, fmt.Errorf("metric %s/%s: topic_path_filter group %q collides with another label.", m.MQTTName, m.PrometheusName, label)
+					}
+				}
+			}
+
+			for label := range m.DynamicLabels {
+				if m.labelSources(label) > 1 {
+					return Config{}, fmt.Errorf("metric %s/%s: dynamic_labels for %q collides with another label.", m.MQTTName, m.PrometheusName, label)
+				}
+			}
+			for label := range m.ConstantLabels {
+				if m.labelSources(label) > 1 {
+					return Config{}, fmt.Errorf("metric %s/%s: const_labels for %q collides with another label.", m.MQTTName, m.PrometheusName, label)
+				}
+			}
+
+			for label := range m.LabelValueMapping {
+				_, dynamic := m.DynamicLabels[label]
+				_, field := m.FieldLabels[label]
+				if !dynamic && !field {
+					return Config{}, fmt.Errorf("metric %s/%s: label_value_mapping for %q requires a dynamic label or field label of the same name.", m.MQTTName, m.PrometheusName, label)
+				}
+			}
+
+			if l := cfg.MQTT.Liveness; l != nil && m.exportsName(l.MetricName) {
+				return Config{}, fmt.Errorf("metric %s/%s: exports a metric named like the liveness metric_name %q.", m.MQTTName, m.PrometheusName, l.MetricName)
+			}
 		}
 	}
-	if forcesMonotonicy {
-		if err := os.MkdirAll(cfg.Cache.StateDir, 0755); err != nil {
-			return Config{}, fmt.Errorf("failed to create directory %q: %w", cfg.Cache.StateDir, err)
+	if forcesMonotonicy && cfg.Cache.StateBackend == StateBackendFile {
+		if err := prepareStateDir(cfg.Cache.StateDir); err != nil {
+			if !cfg.Cache.StateDirFailOpen {
+				return Config{}, err
+			}
+			logger.Warn("State directory is not usable, the state is kept in memory only and lost on restart", zap.String("directory", cfg.Cache.StateDir), zap.Error(err))
+			cfg.Cache.StateBackend = StateBackendMemory
 		}
 	}
 
@@ -1,8 +1,24 @@
 package config
 
 import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
 	"reflect"
+	"sort"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"gopkg.in/yaml.v2"
 )
 
 func TestRegexp_GroupValue(t *testing.T) {
@@ -148,3 +164,1961 @@ func TestRegexp_MarshalYAML(t *testing.T) {
 		})
 	}
 }
+
+func TestConfig_TopicFilters(t *testing.T) {
+	tests := []struct {
+		name      string
+		topicPath string
+		filters   []string
+		want      []string
+	}{
+		{
+			name:      "unrestricted metric falls back to topic path",
+			topicPath: "devices/#",
+			filters:   []string{"^devices/home/.*", ".*status"},
+			want:      []string{"devices/#"},
+		},
+		{
+			name:      "prefix filters are narrowed to the topic path",
+			topicPath: "devices/+/sensors/#",
+			filters:   []string{"^devices/home/sensors/.*", "^devices/workshop/"},
+			want:      []string{"devices/home/sensors/#", "devices/workshop/sensors/#"},
+		},
+		{
+			name:      "covered and duplicate filters are removed",
+			topicPath: "#",
+			filters:   []string{"^devices/home/kitchen/.*", "^devices/home/", "^devices/home/.*", "^devices/office$"},
+			want:      []string{"devices/home/#", "devices/office"},
+		},
+		{
+			name:      "partial topic levels are widened",
+			topicPath: "#",
+			filters:   []string{"^devices/home-.*"},
+			want:      []string{"devices/#"},
+		},
+		{
+			name:      "filters outside of the topic path are dropped",
+			topicPath: "tele/+/SENSOR",
+			filters:   []string{"^tele/plug/SENSOR$", "^devices/"},
+			want:      []string{"tele/plug/SENSOR"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var metrics []MetricConfig
+			for _, f := range tt.filters {
+				metrics = append(metrics, MetricConfig{TopicPathFilter: MustNewRegexp(f)})
+			}
+			cfg := Config{
+				MQTT:    &MQTTConfig{TopicPath: tt.topicPath},
+				Metrics: []BlockConfig{{Metrics: metrics}},
+			}
+			if got := cfg.TopicFilters(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("TopicFilters() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfig_MetricPerTopicFilters(t *testing.T) {
+	tests := []struct {
+		name      string
+		topicPath string
+		nameRegex string
+		metrics   []MetricConfig
+		want      []string
+	}{
+		{
+			name:      "metric name in the last level",
+			topicPath: "devices/+/+",
+			nameRegex: "(?P<deviceid>.*)/(?P<metricname>.*)",
+			metrics:   []MetricConfig{{MQTTName: "temperature"}, {MQTTName: "humidity"}, {MQTTName: "temperature"}},
+			want:      []string{"devices/+/humidity", "devices/+/temperature"},
+		},
+		{
+			name:      "metric name in a middle level",
+			topicPath: "shellies/+/sensor/+",
+			nameRegex: "shellies/(?P<deviceid>[^/]+)/sensor/(?P<metricname>[^/]+)",
+			metrics:   []MetricConfig{{MQTTName: "power"}},
+			want:      []string{"shellies/+/sensor/power"},
+		},
+		{
+			name:      "sources of derived metrics",
+			topicPath: "+/+",
+			nameRegex: "(.*/)?(?P<metricname>.*)",
+			metrics:   []MetricConfig{{MQTTName: "delta", Derive: &DeriveConfig{Sources: []DeriveSource{{MQTTName: "inlet"}, {MQTTName: "outlet"}}}}},
+			want:      []string{"+/inlet", "+/outlet"},
+		},
+		{
+			name:      "multi level wildcard",
+			topicPath: "devices/#",
+			nameRegex: "(.*/)?(?P<metricname>.*)",
+			metrics:   []MetricConfig{{MQTTName: "temperature"}},
+			want:      []string{"devices/#"},
+		},
+		{
+			name:      "metric name pattern",
+			topicPath: "devices/+/+",
+			nameRegex: "(.*/)?(?P<metricname>.*)",
+			metrics:   []MetricConfig{{MQTTName: "temperature"}, {MQTTNamePattern: MustNewRegexp("^temp")}},
+			want:      []string{"devices/+/+"},
+		},
+		{
+			name:      "metrics with own topic",
+			topicPath: "devices/+/+",
+			nameRegex: "(.*/)?(?P<metricname>.*)",
+			metrics:   []MetricConfig{{MQTTName: "temperature"}, {MQTTNamePattern: MustNewRegexp("^power"), SubscribeTopic: "plugs/+/power"}},
+			want:      []string{"devices/+/temperature"},
+		},
+		{
+			name:      "name not extracted by the regex",
+			topicPath: "devices/+/+",
+			nameRegex: "(.*/)?(?P<metricname>[a-z]+)$",
+			metrics:   []MetricConfig{{MQTTName: "temperature"}, {MQTTName: "pm2_5"}},
+			want:      []string{"devices/+/+"},
+		},
+		{
+			name:      "metric name in no wildcard level",
+			topicPath: "devices/+/temperature",
+			nameRegex: "(.*/)?(?P<metricname>.*)",
+			metrics:   []MetricConfig{{MQTTName: "temperature"}},
+			want:      []string{"devices/+/temperature"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Config{
+				MQTT: &MQTTConfig{
+					TopicPath:            tt.topicPath,
+					MetricPerTopicConfig: &MetricPerTopicConfig{MetricNameRegex: MustNewRegexp(tt.nameRegex)},
+				},
+				Metrics: []BlockConfig{{Metrics: tt.metrics}},
+			}
+			if got := cfg.TopicFilters(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("TopicFilters() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfig_SubscriptionTopics(t *testing.T) {
+	tests := []struct {
+		name    string
+		topics  []string
+		derive  bool
+		filters []string
+		want    []string
+	}{
+		{
+			name:   "all metrics with own topic",
+			topics: []string{"devices/+/energy", "devices/+/power", "devices/+/energy"},
+			want:   []string{"devices/+/energy", "devices/+/power"},
+		},
+		{
+			name:   "metrics without own topic share the topic path",
+			topics: []string{"other/energy", ""},
+			want:   []string{"devices/#", "other/energy"},
+		},
+		{
+			name:   "own topics covered by the topic path",
+			topics: []string{"devices/plug/energy", ""},
+			want:   []string{"devices/#"},
+		},
+		{
+			name:    "derived topic filters",
+			topics:  []string{"other/energy", ""},
+			derive:  true,
+			filters: []string{"", "^devices/kitchen/"},
+			want:    []string{"devices/kitchen/#", "other/energy"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var metrics []MetricConfig
+			for i, topic := range tt.topics {
+				m := MetricConfig{SubscribeTopic: topic}
+				if i < len(tt.filters) && tt.filters[i] != "" {
+					m.TopicPathFilter = MustNewRegexp(tt.filters[i])
+				}
+				metrics = append(metrics, m)
+			}
+			cfg := Config{
+				MQTT:    &MQTTConfig{TopicPath: "devices/#", DeriveTopicFilters: tt.derive},
+				Metrics: []BlockConfig{{Metrics: metrics}},
+			}
+			if got := cfg.SubscriptionTopics(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("SubscriptionTopics() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_subscribedTo(t *testing.T) {
+	cfg, err := LoadConfig(writeConfig(t, `
+mqtt:
+  topic_path: devices/#
+  object_per_topic_config:
+    encoding: JSON
+metrics:
+  - metrics:
+      - prom_name: temperature
+        mqtt_name: temperature
+        type: gauge
+      - prom_name: power
+        mqtt_name: power
+        type: gauge
+        subscribe_topic: plugs/+/power
+`), zap.NewNop())
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	temperature, power := cfg.Metrics[0].Metrics[0], cfg.Metrics[0].Metrics[1]
+	for _, tt := range []struct {
+		metric MetricConfig
+		topic  string
+		want   bool
+	}{
+		{metric: temperature, topic: "devices/kitchen", want: true},
+		// Messages of the subscribe_topic of another metric do not leak into metrics without one.
+		{metric: temperature, topic: "plugs/kitchen/power", want: false},
+		{metric: power, topic: "plugs/kitchen/power", want: true},
+		{metric: power, topic: "devices/kitchen", want: false},
+	} {
+		if got := tt.metric.SubscribedTo(tt.topic); got != tt.want {
+			t.Errorf("%s.SubscribedTo(%q) = %v, want %v", tt.metric.PrometheusName, tt.topic, got, tt.want)
+		}
+	}
+}
+
+func TestValidTopicFilter(t *testing.T) {
+	for filter, want := range map[string]bool{
+		"devices/+/energy": true,
+		"devices/#":        true,
+		"#":                true,
+		"":                 false,
+		"devices/#/energy": false,
+		"devices/plug+":    false,
+		"devices/#x":       false,
+	} {
+		if got := ValidTopicFilter(filter); got != want {
+			t.Errorf("ValidTopicFilter(%q) = %v, want %v", filter, got, want)
+		}
+	}
+}
+
+func TestIntersectTopicFilters(t *testing.T) {
+	tests := []struct {
+		a, b   string
+		want   string
+		wantOk bool
+	}{
+		{a: "a/#", b: "a/b/c", want: "a/b/c", wantOk: true},
+		{a: "a/#", b: "a", want: "a", wantOk: true},
+		{a: "+/b", b: "x/#", want: "x/b", wantOk: true},
+		{a: "a/+", b: "a/b/c", wantOk: false},
+		{a: "a/b/#", b: "a", wantOk: false},
+		{a: "a/b", b: "a/c", wantOk: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.a+" "+tt.b, func(t *testing.T) {
+			got, ok := IntersectTopicFilters(tt.a, tt.b)
+			if ok != tt.wantOk || got != tt.want {
+				t.Errorf("IntersectTopicFilters() = %q, %v, want %q, %v", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
+
+func TestStringValueMappingConfig_expandGroups(t *testing.T) {
+	tests := []struct {
+		name    string
+		yaml    string
+		want    map[string]float64
+		wantErr bool
+	}{
+		{
+			name: "groups and map",
+			yaml: `
+map:
+  unknown: -1
+groups:
+  - strings: ["off", "disabled", "inactive"]
+    value: 0
+  - strings: ["on", "enabled"]
+    value: 1
+`,
+			want: map[string]float64{"unknown": -1, "off": 0, "disabled": 0, "inactive": 0, "on": 1, "enabled": 1},
+		},
+		{
+			name: "duplicate across groups",
+			yaml: `
+groups:
+  - strings: ["off", "disabled"]
+    value: 0
+  - strings: ["on", "disabled"]
+    value: 1
+`,
+			wantErr: true,
+		},
+		{
+			name: "duplicate of map key",
+			yaml: `
+map:
+  off: 0
+groups:
+  - strings: ["off"]
+    value: 0
+`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var m StringValueMappingConfig
+			if err := yaml.UnmarshalStrict([]byte(tt.yaml), &m); err != nil {
+				t.Fatal(err)
+			}
+			err := m.expandGroups()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expandGroups() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			for str, want := range tt.want {
+				if got, ok := m.Map[str]; !ok || got != want {
+					t.Errorf("Map[%q] = %v, want %v", str, got, want)
+				}
+			}
+			if !reflect.DeepEqual(m.Map, tt.want) {
+				t.Errorf("Map = %v, want %v", m.Map, tt.want)
+			}
+			if m.Groups != nil {
+				t.Errorf("Groups were not cleared: %v", m.Groups)
+			}
+		})
+	}
+}
+
+// writeConfig writes the config to a temporary file and returns its name.
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	file, err := os.CreateTemp("", "config_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Remove(file.Name()) })
+	defer file.Close()
+	if _, err := file.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+	return file.Name()
+}
+
+func TestLoadConfig_defaultErrorValue(t *testing.T) {
+	name := writeConfig(t, `
+mqtt:
+  object_per_topic_config:
+    encoding: JSON
+default_error_value: -1
+metrics:
+  - metrics:
+      - prom_name: temperature
+        type: gauge
+      - prom_name: humidity
+        type: gauge
+        error_value: 0
+      - prom_name: state
+        type: gauge
+        string_value_mapping:
+          error_value: 3
+          map:
+            on: 1
+  - shared:
+      error_value: -2
+    metrics:
+      - prom_name: pressure
+        type: gauge
+`)
+
+	cfg, err := LoadConfig(name, zap.NewNop())
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	want := map[string]float64{
+		"temperature": -1,
+		"humidity":    0,
+		"state":       -1,
+		"pressure":    -2,
+	}
+	for _, block := range cfg.Metrics {
+		for _, m := range block.Metrics {
+			if m.ErrorValue == nil {
+				t.Errorf("metric %s has no error value", m.PrometheusName)
+				continue
+			}
+			if *m.ErrorValue != want[m.PrometheusName] {
+				t.Errorf("metric %s has error value %v, want %v", m.PrometheusName, *m.ErrorValue, want[m.PrometheusName])
+			}
+		}
+	}
+}
+
+func TestLoadConfig_explicitErrorValueEqualsDefault(t *testing.T) {
+	tests := []struct {
+		name    string
+		metric  string
+		wantErr string
+	}{
+		{name: "text_metric inherits the default", metric: "text_metric: true"},
+		{name: "text_metric sets the default", metric: "text_metric: true\n        error_value: -1", wantErr: "text_metric can not be used together with"},
+		{name: "deprecated error_value inherits the default", metric: "string_value_mapping:\n          error_value: 2\n          map:\n            on: 1"},
+		{name: "deprecated error_value and the default", metric: "error_value: -1\n        string_value_mapping:\n          error_value: 2\n          map:\n            on: 1", wantErr: "cannot set both"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadConfig(writeConfig(t, `
+mqtt:
+  object_per_topic_config:
+    encoding: JSON
+default_error_value: -1
+metrics:
+  - metrics:
+      - prom_name: state
+        type: gauge
+        `+tt.metric+`
+`), zap.NewNop())
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("LoadConfig() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("LoadConfig() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_unknownKeys(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   string
+		wantErr  string
+		wantWarn int
+	}{
+		{
+			name: "unknown metric key",
+			config: `
+mqtt:
+  object_per_topic_config:
+    encoding: JSON
+metrics:
+  - metrics:
+      - prom_name: temperature
+        type: gauge
+        promname: typo
+`,
+			wantErr: `invalid config: line 9: unknown key "promname" in MetricConfig`,
+		},
+		{
+			name: "unknown keys in several sections",
+			config: `
+mqtt:
+  server: tcp://localhost:1883
+  keepalive: 30
+  object_per_topic_config:
+    encoding: JSON
+cache:
+  ttl: 1m
+metrics: []
+`,
+			wantErr: `invalid config: line 4: unknown key "keepalive" in MQTTConfig; line 8: unknown key "ttl" in CacheConfig`,
+		},
+		{
+			name: "type errors are kept",
+			config: `
+mqtt:
+  qos: high
+  object_per_topic_config:
+    encoding: JSON
+metrics: []
+`,
+			wantErr: "cannot unmarshal",
+		},
+		{
+			name: "unknown keys ignored",
+			config: `
+ignore_unknown_keys: true
+mqtt:
+  keepalive: 30
+  object_per_topic_config:
+    encoding: JSON
+metrics:
+  - metrics:
+      - prom_name: temperature
+        type: gauge
+        promname: typo
+`,
+			wantWarn: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			core, logs := observer.New(zapcore.WarnLevel)
+			_, err := LoadConfig(writeConfig(t, tt.config), zap.New(core))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("LoadConfig() error = %v", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("LoadConfig() error = %v, want %q", err, tt.wantErr)
+			}
+			if got := logs.FilterMessage("Ignoring unknown config key").Len(); got != tt.wantWarn {
+				t.Errorf("got %d warnings, want %d", got, tt.wantWarn)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_labelThresholds(t *testing.T) {
+	tests := []struct {
+		name       string
+		thresholds string
+		wantErr    string
+	}{
+		{
+			name: "sorted",
+			thresholds: `
+          - below: 50
+            value: ok
+          - below: 80
+            value: warn
+          - value: crit
+`,
+		},
+		{
+			name: "unsorted",
+			thresholds: `
+          - below: 80
+            value: warn
+          - below: 50
+            value: ok
+`,
+			wantErr: "must be sorted ascending",
+		},
+		{
+			name: "catch all in the middle",
+			thresholds: `
+          - value: crit
+          - below: 50
+            value: ok
+`,
+			wantErr: "may omit below",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadConfig(writeConfig(t, `
+mqtt:
+  object_per_topic_config:
+    encoding: JSON
+metrics:
+  - metrics:
+      - prom_name: cpu_usage
+        type: gauge
+        label_thresholds:
+          severity:`+tt.thresholds), zap.NewNop())
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("LoadConfig() error = %v", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("LoadConfig() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_pipeline(t *testing.T) {
+	tests := []struct {
+		name     string
+		pipeline string
+		wantErr  string
+	}{
+		{name: "unset"},
+		{name: "reordered", pipeline: "[scale, expression, when, force_monotonicy]"},
+		{name: "unknown step", pipeline: "[scale, expression, when, monotonic]", wantErr: `unknown step "monotonic"`},
+		{name: "duplicate step", pipeline: "[scale, scale, when, force_monotonicy]", wantErr: "more than once"},
+		{name: "missing step", pipeline: "[scale, expression, when]", wantErr: "must be listed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pipeline := ""
+			if tt.pipeline != "" {
+				pipeline = "\n        pipeline: " + tt.pipeline
+			}
+			_, err := LoadConfig(writeConfig(t, `
+mqtt:
+  object_per_topic_config:
+    encoding: JSON
+metrics:
+  - metrics:
+      - prom_name: temperature
+        type: gauge`+pipeline+"\n"), zap.NewNop())
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("LoadConfig() error = %v", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("LoadConfig() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_protobuf(t *testing.T) {
+	set, err := proto.Marshal(&descriptorpb.FileDescriptorSet{
+		File: []*descriptorpb.FileDescriptorProto{{
+			Name:    proto.String("reading.proto"),
+			Package: proto.String("sensors"),
+			Syntax:  proto.String("proto3"),
+			MessageType: []*descriptorpb.DescriptorProto{{
+				Name: proto.String("Reading"),
+				Field: []*descriptorpb.FieldDescriptorProto{{
+					Name:   proto.String("temperature"),
+					Number: proto.Int32(1),
+					Label:  descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+					Type:   descriptorpb.FieldDescriptorProto_TYPE_DOUBLE.Enum(),
+				}},
+			}},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	descriptor := writeConfig(t, string(set))
+
+	tests := []struct {
+		name       string
+		descriptor string
+		message    string
+		wantErr    string
+	}{
+		{name: "valid", descriptor: descriptor, message: "sensors.Reading"},
+		{name: "unknown message", descriptor: descriptor, message: "sensors.Missing", wantErr: "not found"},
+		{name: "missing message", descriptor: descriptor, wantErr: "protobuf_message is required"},
+		{name: "missing descriptor", message: "sensors.Reading", wantErr: "protobuf_descriptor is required"},
+		{name: "invalid descriptor", descriptor: writeConfig(t, "no protobuf"), message: "sensors.Reading", wantErr: "failed to parse descriptor set"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := LoadConfig(writeConfig(t, `
+mqtt:
+  object_per_topic_config:
+    encoding: protobuf
+    protobuf_descriptor: "`+tt.descriptor+`"
+    protobuf_message: "`+tt.message+`"
+metrics:
+  - metrics:
+      - prom_name: temperature
+        type: gauge
+`), zap.NewNop())
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("LoadConfig() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadConfig() error = %v", err)
+			}
+			desc := cfg.MQTT.ObjectPerTopicConfig.MessageDescriptor()
+			if desc == nil || desc.FullName() != "sensors.Reading" {
+				t.Errorf("MessageDescriptor() = %v, want sensors.Reading", desc)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_initialOffset(t *testing.T) {
+	_, err := LoadConfig(writeConfig(t, `
+mqtt:
+  object_per_topic_config:
+    encoding: JSON
+metrics:
+  - metrics:
+      - prom_name: energy
+        type: counter
+        initial_offset: 1000
+`), zap.NewNop())
+	if err == nil || !strings.Contains(err.Error(), "require force_monotonicy") {
+		t.Fatalf("LoadConfig() error = %v, want initial_offset requires force_monotonicy", err)
+	}
+}
+
+func TestLoadConfig_topicLabels(t *testing.T) {
+	tests := []struct {
+		name    string
+		labels  string
+		wantErr string
+	}{
+		{name: "valid", labels: `
+          - topic: "^buildingA/"
+            labels:
+              building: A`},
+		{name: "missing topic", labels: `
+          - labels:
+              building: A`, wantErr: "require a topic"},
+		{name: "collides with a dynamic label", labels: `
+          - topic: "^buildingA/"
+            labels:
+              room: A`, wantErr: "collides with another label"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadConfig(writeConfig(t, `
+mqtt:
+  object_per_topic_config:
+    encoding: JSON
+metrics:
+  - metrics:
+      - prom_name: temperature
+        type: gauge
+        dynamic_labels:
+          room: '"office"'
+        topic_labels:`+tt.labels+"\n"), zap.NewNop())
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("LoadConfig() error = %v", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("LoadConfig() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_fieldLabels(t *testing.T) {
+	tests := []struct {
+		name    string
+		labels  string
+		wantErr string
+	}{
+		{name: "valid", labels: "firmware: info.firmware"},
+		{name: "collides with a dynamic label", labels: "room: location", wantErr: `field_labels for "room" collides with another label`},
+		{name: "collides with a constant label", labels: "building: location", wantErr: `field_labels for "building" collides with another label`},
+		{name: "collides with sensor", labels: "sensor: id", wantErr: `field_labels for "sensor" collides with another label`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadConfig(writeConfig(t, `
+mqtt:
+  object_per_topic_config:
+    encoding: JSON
+metrics:
+  - metrics:
+      - prom_name: temperature
+        type: gauge
+        const_labels:
+          building: A
+        dynamic_labels:
+          room: '"office"'
+        field_labels:
+          `+tt.labels+"\n"), zap.NewNop())
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("LoadConfig() error = %v", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("LoadConfig() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_objectEncoding(t *testing.T) {
+	for encoding, wantErr := range map[string]bool{"JSON": false, "XML": false, "YAML": true} {
+		t.Run(encoding, func(t *testing.T) {
+			_, err := LoadConfig(writeConfig(t, `
+mqtt:
+  object_per_topic_config:
+    encoding: `+encoding+`
+metrics:
+  - metrics:
+      - prom_name: temperature
+        type: gauge
+`), zap.NewNop())
+			if (err != nil) != wantErr {
+				t.Fatalf("LoadConfig() error = %v, wantErr %v", err, wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_stateDirFailOpen(t *testing.T) {
+	// A directory below a regular file can not be created, not even by root.
+	stateDir := writeConfig(t, "") + "/state"
+	for _, failOpen := range []bool{false, true} {
+		t.Run(fmt.Sprintf("fail open %v", failOpen), func(t *testing.T) {
+			core, logs := observer.New(zapcore.WarnLevel)
+			cfg, err := LoadConfig(writeConfig(t, fmt.Sprintf(`
+mqtt:
+  object_per_topic_config:
+    encoding: JSON
+cache:
+  state_directory: %s
+  state_dir_fail_open: %v
+metrics:
+  - metrics:
+      - prom_name: energy
+        type: counter
+        force_monotonicy: true
+`, stateDir, failOpen)), zap.New(core))
+			if !failOpen {
+				if err == nil || !strings.Contains(err.Error(), "failed to create directory") {
+					t.Fatalf("LoadConfig() error = %v, want failed to create directory", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadConfig() error = %v", err)
+			}
+			if cfg.Cache.StateBackend != StateBackendMemory {
+				t.Errorf("state backend = %q, want %q", cfg.Cache.StateBackend, StateBackendMemory)
+			}
+			if logs.FilterMessageSnippet("State directory is not usable").Len() != 1 {
+				t.Errorf("expected a warning about the state directory, got %v", logs.All())
+			}
+		})
+	}
+}
+
+func TestLoadConfig_stateFileLocking(t *testing.T) {
+	defer func(g string) { goos = g }(goos)
+	tests := []struct {
+		name    string
+		goos    string
+		backend string
+		wantErr string
+	}{
+		{name: "linux", goos: "linux", backend: StateBackendFile},
+		{name: "darwin", goos: "darwin", backend: StateBackendFile},
+		{name: "memory backend", goos: "linux", backend: StateBackendMemory, wantErr: `state_file_locking requires the state backend "file"`},
+		{name: "windows", goos: "windows", backend: StateBackendFile, wantErr: "state_file_locking is not supported on windows"},
+		{name: "plan9", goos: "plan9", backend: StateBackendFile, wantErr: "state_file_locking is not supported on plan9"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			goos = tt.goos
+			_, err := LoadConfig(writeConfig(t, fmt.Sprintf(`
+mqtt:
+  object_per_topic_config:
+    encoding: JSON
+cache:
+  state_directory: %s
+  state_backend: %s
+  state_file_locking: true
+metrics:
+  - metrics:
+      - prom_name: temperature
+        type: gauge
+`, t.TempDir(), tt.backend)), zap.NewNop())
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("LoadConfig() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("LoadConfig() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_nameExpression(t *testing.T) {
+	tests := []struct {
+		name    string
+		options string
+		wantErr string
+	}{
+		{name: "valid", options: `
+        name_expression: 'field("type")'
+        names: [temperature, humidity]`},
+		{name: "without names", options: `
+        name_expression: 'field("type")'`, wantErr: "requires the list of possible names"},
+		{name: "invalid name", options: `
+        name_expression: 'field("type")'
+        names: [temperature, "relative humidity"]`, wantErr: "invalid metric name"},
+		{name: "names without expression", options: `
+        names: [temperature, humidity]`, wantErr: "names requires a name_expression"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadConfig(writeConfig(t, `
+mqtt:
+  object_per_topic_config:
+    encoding: JSON
+metrics:
+  - metrics:
+      - prom_name: reading
+        mqtt_name: value
+        type: gauge`+tt.options+"\n"), zap.NewNop())
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("LoadConfig() error = %v", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("LoadConfig() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_deviceIDField(t *testing.T) {
+	for encoding, wantErr := range map[string]bool{"JSON": false, "XML": true} {
+		t.Run(encoding, func(t *testing.T) {
+			_, err := LoadConfig(writeConfig(t, `
+mqtt:
+  device_id_field: meta.device
+  object_per_topic_config:
+    encoding: `+encoding+`
+metrics:
+  - metrics:
+      - prom_name: temperature
+        type: gauge
+`), zap.NewNop())
+			if (err != nil) != wantErr {
+				t.Fatalf("LoadConfig() error = %v, wantErr %v", err, wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_topicGroupLabels(t *testing.T) {
+	tests := []struct {
+		name    string
+		filter  string
+		wantErr string
+	}{
+		{name: "valid", filter: `^site/(?P<site>[^/]+)/room/(?P<room>[^/]+)/`},
+		{name: "without named groups", filter: `^site/([^/]+)/`, wantErr: "requires named groups"},
+		{name: "collides with a dynamic label", filter: `^site/(?P<site>[^/]+)/(?P<kind>[^/]+)`, wantErr: `group "kind" collides with another label`},
+		{name: "collides with the sensor label", filter: `^site/(?P<sensor>[^/]+)/`, wantErr: `group "sensor" collides with another label`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadConfig(writeConfig(t, `
+mqtt:
+  object_per_topic_config:
+    encoding: JSON
+metrics:
+  - metrics:
+      - prom_name: temperature
+        type: gauge
+        topic_path_filter: '`+tt.filter+`'
+        topic_group_labels: true
+        dynamic_labels:
+          kind: '"room"'
+`), zap.NewNop())
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("LoadConfig() error = %v", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("LoadConfig() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_derive(t *testing.T) {
+	tests := []struct {
+		name    string
+		derive  string
+		wantErr string
+	}{
+		{name: "valid", derive: `{operation: subtract, sources: [{mqtt_name: inlet}, {mqtt_name: outlet}]}`},
+		{name: "same name on different topics", derive: `{operation: divide, sources: [{mqtt_name: flow, topic: "^a/"}, {mqtt_name: flow, topic: "^b/"}]}`},
+		{name: "invalid operation", derive: `{operation: modulo, sources: [{mqtt_name: inlet}, {mqtt_name: outlet}]}`, wantErr: `invalid derive operation "modulo"`},
+		{name: "one source", derive: `{operation: add, sources: [{mqtt_name: inlet}]}`, wantErr: "exactly two sources"},
+		{name: "source without name", derive: `{operation: add, sources: [{mqtt_name: inlet}, {topic: "^b/"}]}`, wantErr: "require a mqtt_name"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadConfig(writeConfig(t, `
+mqtt:
+  object_per_topic_config:
+    encoding: JSON
+metrics:
+  - metrics:
+      - prom_name: flow_difference
+        type: gauge
+        derive: `+tt.derive+`
+`), zap.NewNop())
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("LoadConfig() error = %v", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("LoadConfig() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_defaultValueType(t *testing.T) {
+	load := func(defaultType string) (Config, error) {
+		return LoadConfig(writeConfig(t, `
+mqtt:
+  object_per_topic_config:
+    encoding: JSON
+default_value_type: "`+defaultType+`"
+metrics:
+  - metrics:
+      - prom_name: temperature
+      - prom_name: energy
+        type: counter
+      - prom_name: reading
+        type: untyped
+  - shared:
+      type: counter
+    metrics:
+      - prom_name: pulses
+`), zap.NewNop())
+	}
+	tests := []struct {
+		defaultType string
+		want        map[string]prometheus.ValueType
+	}{
+		{
+			defaultType: "",
+			want: map[string]prometheus.ValueType{
+				"temperature": prometheus.UntypedValue,
+				"energy":      prometheus.CounterValue,
+				"reading":     prometheus.UntypedValue,
+				"pulses":      prometheus.CounterValue,
+			},
+		},
+		{
+			defaultType: "gauge",
+			want: map[string]prometheus.ValueType{
+				"temperature": prometheus.GaugeValue,
+				"energy":      prometheus.CounterValue,
+				"reading":     prometheus.UntypedValue,
+				"pulses":      prometheus.CounterValue,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.defaultType, func(t *testing.T) {
+			cfg, err := load(tt.defaultType)
+			if err != nil {
+				t.Fatalf("LoadConfig() error = %v", err)
+			}
+			for _, block := range cfg.Metrics {
+				for _, m := range block.Metrics {
+					if got := m.PrometheusValueType(); got != tt.want[m.PrometheusName] {
+						t.Errorf("metric %s has type %v, want %v", m.PrometheusName, got, tt.want[m.PrometheusName])
+					}
+				}
+			}
+		})
+	}
+
+	if _, err := load("summary"); err == nil || !strings.Contains(err.Error(), `invalid default_value_type "summary"`) {
+		t.Errorf("LoadConfig() error = %v, want invalid default_value_type", err)
+	}
+}
+
+func TestLoadConfig_decimalSeparator(t *testing.T) {
+	cfg, err := LoadConfig(writeConfig(t, `
+mqtt:
+  object_per_topic_config:
+    encoding: JSON
+json_parsing:
+  decimal_separator: ","
+metrics:
+  - metrics:
+      - prom_name: temperature
+        type: gauge
+      - prom_name: humidity
+        type: gauge
+        decimal_separator: "."
+`), zap.NewNop())
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	if cfg.JsonParsing.Separator != "." {
+		t.Errorf("got json_parsing separator %q, want the default %q", cfg.JsonParsing.Separator, ".")
+	}
+	want := map[string]string{"temperature": ",", "humidity": "."}
+	for _, m := range cfg.Metrics[0].Metrics {
+		if m.DecimalSeparator != want[m.PrometheusName] {
+			t.Errorf("metric %s has decimal_separator %q, want %q", m.PrometheusName, m.DecimalSeparator, want[m.PrometheusName])
+		}
+	}
+
+	_, err = LoadConfig(writeConfig(t, `
+mqtt:
+  object_per_topic_config:
+    encoding: JSON
+metrics:
+  - metrics:
+      - prom_name: temperature
+        type: gauge
+        decimal_separator: "'"
+`), zap.NewNop())
+	if err == nil || !strings.Contains(err.Error(), "invalid decimal_separator") {
+		t.Errorf("LoadConfig() error = %v, want invalid decimal_separator", err)
+	}
+}
+
+func TestLoadConfig_ignoreDeprecatedStringErrorValue(t *testing.T) {
+	for _, ignore := range []bool{false, true} {
+		t.Run(fmt.Sprint(ignore), func(t *testing.T) {
+			cfg, err := LoadConfig(writeConfig(t, fmt.Sprintf(`
+mqtt:
+  object_per_topic_config:
+    encoding: JSON
+ignore_deprecated_string_error_value: %v
+default_error_value: -1
+metrics:
+  - metrics:
+      - prom_name: state
+        type: gauge
+        string_value_mapping:
+          error_value: 2
+          map:
+            on: 1
+`, ignore)), zap.NewNop())
+			if err != nil {
+				t.Fatalf("LoadConfig() error = %v", err)
+			}
+			m := cfg.Metrics[0].Metrics[0]
+			if got := m.StringValueMapping.ErrorValue != nil; got == ignore {
+				t.Errorf("got deprecated error_value %v, want it ignored %v", m.StringValueMapping.ErrorValue, ignore)
+			}
+			if m.ErrorValue == nil || *m.ErrorValue != -1 {
+				t.Errorf("got error_value %v, want the default -1", m.ErrorValue)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_csvEncoding(t *testing.T) {
+	tests := []struct {
+		name    string
+		object  string
+		wantErr string
+	}{
+		{name: "columns", object: "csv_columns: [temperature, humidity]"},
+		{name: "header", object: "csv_header: true\n    csv_delimiter: \";\""},
+		{name: "no columns", object: "csv_delimiter: \";\"", wantErr: "requires csv_columns or csv_header"},
+		{name: "long delimiter", object: "csv_header: true\n    csv_delimiter: \";;\"", wantErr: "invalid csv_delimiter"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadConfig(writeConfig(t, `
+mqtt:
+  object_per_topic_config:
+    encoding: CSV
+    `+tt.object+`
+metrics:
+  - metrics:
+      - prom_name: temperature
+        type: gauge
+`), zap.NewNop())
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("LoadConfig() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("LoadConfig() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_metricOptions(t *testing.T) {
+	// One row per option of a metric, the valid configs first. Options with further checks of the loaded config have
+	// their own tests.
+	tests := []struct {
+		name    string
+		metric  string
+		wantErr string
+	}{
+		{name: "despike median3", metric: "despike: median3"},
+		{name: "despike unknown filter", metric: "despike: mean", wantErr: "invalid despike"},
+		{name: "despike integer value", metric: "despike: median3\n        integer_value: true", wantErr: "integer_value"},
+
+		{name: "strip_suffixes valid", metric: `strip_suffixes: [{suffix: "%", scale: 0.01}, {suffix: ms}]`},
+		{name: "strip_suffixes empty suffix", metric: `strip_suffixes: [{scale: 0.01}]`, wantErr: "must be set"},
+		{name: "strip_suffixes digits", metric: `strip_suffixes: [{suffix: "e3"}]`, wantErr: "must not contain digits"},
+		{name: "strip_suffixes duplicate", metric: `strip_suffixes: [{suffix: ms}, {suffix: ms, scale: 0.001}]`, wantErr: "duplicate strip_suffixes"},
+		{name: "strip_suffixes negative scale", metric: `strip_suffixes: [{suffix: "%", scale: -0.01}]`, wantErr: "must not be negative"},
+
+		{name: "min_change", metric: "min_change: 0.5"},
+		{name: "min_change heartbeat", metric: "min_change: 0\n        heartbeat_interval: 5m"},
+		{name: "min_change negative", metric: "min_change: -1", wantErr: "min_change must not be negative"},
+		{name: "heartbeat_interval without min_change", metric: "heartbeat_interval: 5m", wantErr: "requires min_change"},
+
+		{name: "reset_flush_window", metric: "type: counter\n        force_monotonicy: true\n        reset_flush_window: 1m"},
+		{name: "reset_flush_window without force_monotonicy", metric: "type: counter\n        reset_flush_window: 1m", wantErr: "require force_monotonicy"},
+		{name: "reset_flush_window negative", metric: "type: counter\n        force_monotonicy: true\n        reset_flush_window: -1m", wantErr: "must not be negative"},
+
+		{name: "clamp_monotonic_offset", metric: "type: counter\n        force_monotonicy: true\n        clamp_monotonic_offset: 1e9"},
+		{name: "clamp_monotonic_offset negative", metric: "type: counter\n        force_monotonicy: true\n        clamp_monotonic_offset: -1", wantErr: "clamp_monotonic_offset must not be negative"},
+		{name: "clamp_monotonic_offset without force_monotonicy", metric: "type: counter\n        clamp_monotonic_offset: 1e9", wantErr: "require force_monotonicy"},
+
+		{name: "expected_interval negative", metric: "expected_interval: -30s", wantErr: "expected_interval must be positive"},
+		{name: "expected_interval longer than cache timeout", metric: "expected_interval: 5m", wantErr: "at most the cache timeout 2m0s"},
+
+		{name: "max_timestamp_age", metric: "max_timestamp_age: 1h"},
+		{name: "max_timestamp_age clamp", metric: "max_timestamp_age: 1h\n        timestamp_age_action: clamp"},
+		{name: "max_timestamp_age negative", metric: "max_timestamp_age: -1h", wantErr: "max_timestamp_age must not be negative"},
+		{name: "timestamp_age_action without max age", metric: "timestamp_age_action: drop", wantErr: "timestamp_age_action requires max_timestamp_age"},
+		{name: "timestamp_age_action invalid", metric: "max_timestamp_age: 1h\n        timestamp_age_action: skip", wantErr: `invalid timestamp_age_action "skip"`},
+		{name: "timestamp_field", metric: "timestamp_field: ts\n        timestamp_grace: 30s"},
+		{name: "timestamp_field omit_timestamp", metric: "timestamp_field: ts\n        omit_timestamp: true", wantErr: "timestamp_field requires object_per_topic_config"},
+		{name: "timestamp_grace negative", metric: "timestamp_field: ts\n        timestamp_grace: -1s", wantErr: "timestamp_grace must not be negative"},
+		{name: "timestamp_grace without field", metric: "timestamp_grace: 30s", wantErr: "timestamp_grace requires timestamp_field"},
+
+		{name: "emit_rate counter", metric: "type: counter\n        emit_rate: true"},
+		{name: "emit_rate gauge", metric: "type: gauge\n        emit_rate: true", wantErr: "emit_rate requires a counter"},
+		{name: "emit_delta counter", metric: "type: counter\n        emit_rate: true\n        emit_delta: true"},
+		{name: "emit_delta gauge", metric: "type: gauge\n        emit_delta: true", wantErr: "emit_delta requires a counter"},
+
+		{name: "max_value_age", metric: "max_value_age: 5m"},
+		{name: "max_value_age negative", metric: "max_value_age: -5m", wantErr: "max_value_age must not be negative"},
+
+		{name: "absent_value", metric: "absent_value: 0"},
+		{name: "absent_value mqtt_name_pattern", metric: "mqtt_name_pattern: alarm_.*\n        absent_value: 0", wantErr: "absent_value requires object_per_topic_config and can not be used together with mqtt_name_pattern"},
+
+		{name: "text_metric counter", metric: "text_metric: true\n        type: counter", wantErr: "text_metric requires type gauge"},
+		{name: "text_metric string_value_mapping", metric: "text_metric: true\n        string_value_mapping:\n          map:\n            on: 1", wantErr: "text_metric can not be used together with"},
+		{name: "text_metric expression", metric: "text_metric: true\n        expression: value * 2", wantErr: "text_metric can not be used together with"},
+		{name: "text_metric mqtt_value_scale", metric: "text_metric: true\n        mqtt_value_scale: 10", wantErr: "text_metric can not be used together with"},
+		{name: "text_metric when", metric: "text_metric: true\n        when: value > 0", wantErr: "text_metric can not be used together with"},
+		{name: "text_metric min_change", metric: "text_metric: true\n        min_change: 1", wantErr: "text_metric can not be used together with"},
+		{name: "text_metric round_to", metric: "text_metric: true\n        round_to: 1", wantErr: "text_metric can not be used together with"},
+		{name: "text_metric error_value", metric: "text_metric: true\n        error_value: -1", wantErr: "text_metric can not be used together with"},
+		{name: "text_label invalid", metric: "text_metric: true\n        text_label: serial-number", wantErr: `invalid text_label "serial-number"`},
+		{name: "text_label collision", metric: "text_metric: true\n        text_label: model\n        field_labels:\n          model: model", wantErr: `"model" collides with another label`},
+		{name: "text_label without text_metric", metric: "text_label: serial", wantErr: "text_label requires text_metric"},
+
+		{name: "label_order unknown label", metric: "label_order: [room]", wantErr: `label_order lists "room", which is not a label of the metric`},
+		{name: "label_order duplicate", metric: "label_order: [topic, topic]", wantErr: `label_order lists "topic" twice`},
+
+		{name: "renamed_from", metric: "renamed_from: old_reading"},
+		{name: "renamed_from prom_name", metric: "renamed_from: reading", wantErr: `invalid renamed_from "reading"`},
+		{name: "renamed_from invalid", metric: "renamed_from: old-reading", wantErr: `invalid renamed_from "old-reading"`},
+		{name: "renamed_from state_key", metric: "renamed_from: old_reading\n        state_key: \"{{.DeviceID}}\"", wantErr: "renamed_from can not be used together with state_key"},
+
+		{name: "array_count", metric: "array_count: true"},
+		{name: "array_count filter", metric: "array_count: true\n        filter: field(\"severity\") == \"critical\""},
+		{name: "filter without array_count", metric: "filter: value > 1", wantErr: "filter requires array_count"},
+		{name: "array_count integer_value", metric: "array_count: true\n        integer_value: true", wantErr: "array_count can not be used together with"},
+		{name: "array_count string_value_mapping", metric: "array_count: true\n        string_value_mapping:\n          map:\n            on: 1", wantErr: "array_count can not be used together with"},
+	}
+	// Every label source collides with every other one and with the sensor and topic labels.
+	labelSources := []struct{ name, metric string }{
+		{name: "dynamic_labels", metric: "dynamic_labels:\n          LABEL: '\"kitchen\"'"},
+		{name: "label_thresholds", metric: "label_thresholds:\n          LABEL:\n            - below: 50\n              value: ok\n            - value: warn"},
+		{name: "field_labels", metric: "field_labels:\n          LABEL: location"},
+		{name: "const_labels", metric: "const_labels:\n          LABEL: kitchen"},
+		{name: "text_label", metric: "text_metric: true\n        text_label: LABEL"},
+		{name: "mqtt_name_label", metric: "mqtt_name_pattern: reading_.*\n        mqtt_name_label: LABEL"},
+		{name: "topic group", metric: "topic_path_filter: '^site/(?P<LABEL>[^/]+)/'\n        topic_group_labels: true"},
+		{name: "topic_labels", metric: "topic_labels:\n          - topic: '^site/'\n            labels:\n              LABEL: kitchen"},
+	}
+	for i, a := range labelSources {
+		tests = append(tests, struct{ name, metric, wantErr string }{
+			name:    a.name + " sensor",
+			metric:  strings.ReplaceAll(a.metric, "LABEL", "sensor"),
+			wantErr: `"sensor" collides with another label`,
+		})
+		for _, b := range labelSources[i+1:] {
+			tests = append(tests, struct{ name, metric, wantErr string }{
+				name:    a.name + " " + b.name,
+				metric:  strings.ReplaceAll(a.metric+"\n        "+b.metric, "LABEL", "room"),
+				wantErr: `"room" collides with another label`,
+			})
+		}
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadConfig(writeConfig(t, `
+mqtt:
+  object_per_topic_config:
+    encoding: JSON
+metrics:
+  - metrics:
+      - prom_name: reading
+        mqtt_name: reading
+        `+tt.metric+`
+`), zap.NewNop())
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("LoadConfig() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("LoadConfig() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_constLabelsMerge(t *testing.T) {
+	cfg, err := LoadConfig(writeConfig(t, `
+mqtt:
+  object_per_topic_config:
+    encoding: JSON
+metrics:
+  - shared:
+      type: gauge
+      const_labels:
+        site: hq
+        floor: "1"
+    metrics:
+      - prom_name: inherit
+      - prom_name: override
+        const_labels:
+          floor: "2"
+          room: kitchen
+      - prom_name: remove
+        const_labels:
+          site: ""
+      - prom_name: remove_all
+        const_labels:
+          site: ""
+          floor: ""
+  - metrics:
+      - prom_name: unshared
+        type: gauge
+        const_labels:
+          room: garage
+      - prom_name: none
+        type: gauge
+`), zap.NewNop())
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	want := map[string]map[string]string{
+		"inherit":    {"site": "hq", "floor": "1"},
+		"override":   {"site": "hq", "floor": "2", "room": "kitchen"},
+		"remove":     {"floor": "1"},
+		"remove_all": {},
+		"unshared":   {"room": "garage"},
+		"none":       nil,
+	}
+	for _, block := range cfg.Metrics {
+		for _, m := range block.Metrics {
+			if !reflect.DeepEqual(m.ConstantLabels, want[m.PrometheusName]) {
+				t.Errorf("metric %s has const_labels %v, want %v", m.PrometheusName, m.ConstantLabels, want[m.PrometheusName])
+			}
+		}
+	}
+}
+
+func TestConfig_InfoCollector(t *testing.T) {
+	content := `
+mqtt:
+  object_per_topic_config:
+    encoding: JSON
+metrics:
+  - metrics:
+      - prom_name: temperature
+        type: gauge
+      - prom_name: humidity
+        type: gauge
+`
+	cfg, err := LoadConfig(writeConfig(t, content), zap.NewNop())
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	want := `
+# HELP mqtt2prometheus_config_info Information about the loaded config, always 1
+# TYPE mqtt2prometheus_config_info gauge
+mqtt2prometheus_config_info{config_hash="` + cfg.Hash + `",metrics="2",mode="object_per_topic"} 1
+`
+	if err := testutil.CollectAndCompare(cfg.InfoCollector(), strings.NewReader(want)); err != nil {
+		t.Error(err)
+	}
+
+	same, err := LoadConfig(writeConfig(t, content), zap.NewNop())
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	if same.Hash != cfg.Hash {
+		t.Errorf("got hash %s for the same config, want %s", same.Hash, cfg.Hash)
+	}
+	changed, err := LoadConfig(writeConfig(t, strings.Replace(content, "humidity", "pressure", 1)), zap.NewNop())
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	if changed.Hash == cfg.Hash {
+		t.Errorf("got the same hash %s for a changed config", changed.Hash)
+	}
+}
+
+func TestLoadConfig_topicPathFilterPrecedence(t *testing.T) {
+	cfg, err := LoadConfig(writeConfig(t, `
+mqtt:
+  object_per_topic_config:
+    encoding: JSON
+metrics:
+  - shared:
+      type: gauge
+      topic_path_filter: "^devices/"
+    metrics:
+      - prom_name: inherit
+      - prom_name: override
+        topic_path_filter: "^sensors/"
+  - metrics:
+      - prom_name: default
+        type: gauge
+`), zap.NewNop())
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	want := map[string]string{
+		"inherit":  "^devices/",
+		"override": "^sensors/",
+		"default":  ".*",
+	}
+	for _, block := range cfg.Metrics {
+		for _, m := range block.Metrics {
+			if got := m.TopicPathFilter.String(); got != want[m.PrometheusName] {
+				t.Errorf("metric %s: topic_path_filter = %q, want %q", m.PrometheusName, got, want[m.PrometheusName])
+			}
+		}
+	}
+}
+
+func TestLoadConfig_otlp(t *testing.T) {
+	tests := []struct {
+		name         string
+		otlp         string
+		wantInterval time.Duration
+		wantErr      string
+	}{
+		{name: "defaults", otlp: "endpoint: http://localhost:4318/v1/metrics", wantInterval: 15 * time.Second},
+		{name: "interval", otlp: "endpoint: https://otel.example.com/v1/metrics\n  interval: 1m", wantInterval: time.Minute},
+		{name: "missing endpoint", otlp: "interval: 1m", wantErr: "invalid otlp endpoint"},
+		{name: "grpc endpoint", otlp: "endpoint: localhost:4317", wantErr: "invalid otlp endpoint"},
+		{name: "negative interval", otlp: "endpoint: http://localhost:4318/v1/metrics\n  interval: -1s", wantErr: "must not be negative"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := LoadConfig(writeConfig(t, `
+mqtt:
+  object_per_topic_config:
+    encoding: JSON
+otlp:
+  `+tt.otlp+`
+metrics:
+  - metrics:
+      - prom_name: temperature
+        type: gauge
+`), zap.NewNop())
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("LoadConfig() error = %v", err)
+				}
+				if cfg.OTLP.Interval != tt.wantInterval || cfg.OTLP.Timeout != OTLPConfigDefaults.Timeout {
+					t.Errorf("otlp interval, timeout = %v, %v, want %v, %v", cfg.OTLP.Interval, cfg.OTLP.Timeout, tt.wantInterval, OTLPConfigDefaults.Timeout)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("LoadConfig() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_expectedInterval(t *testing.T) {
+	tests := []struct {
+		name   string
+		cache  string
+		metric string
+	}{
+		{name: "expected_interval", metric: "expected_interval: 30s"},
+		{name: "cache timeout", metric: "expected_interval: 2m"},
+		{name: "disabled cache timeout", cache: "cache:\n  timeout: -1\n", metric: "expected_interval: 5m"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := LoadConfig(writeConfig(t, tt.cache+`
+mqtt:
+  object_per_topic_config:
+    encoding: JSON
+metrics:
+  - metrics:
+      - prom_name: temperature
+        type: gauge
+        `+tt.metric+`
+`), zap.NewNop())
+			if err != nil {
+				t.Fatalf("LoadConfig() error = %v", err)
+			}
+			descs := cfg.Metrics[0].Metrics[0].PrometheusDescriptions()
+			if len(descs) != 2 || !strings.Contains(descs[1].String(), `"temperature_availability"`) {
+				t.Errorf("PrometheusDescriptions() = %v, want temperature and temperature_availability", descs)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_transforms(t *testing.T) {
+	tests := []struct {
+		name    string
+		metric  string
+		wantErr string
+	}{
+		{name: "chain", metric: "transforms:\n          - {name: scale, params: {factor: 0.1}}\n          - {name: clamp, params: {min: 0}}\n          - {name: round}"},
+		{name: "unknown transform", metric: "transforms: [{name: sqrt}]", wantErr: `transform 0: unknown transform "sqrt", valid transforms are abs, clamp, offset, round, scale`},
+		{name: "unknown parameter", metric: "transforms: [{name: round}, {name: clamp, params: {maximum: 1}}]", wantErr: `transform 1: transform "clamp" has no parameter "maximum"`},
+		{name: "missing parameter", metric: "transforms: [{name: offset}]", wantErr: `transform "offset" requires the parameter "value"`},
+		{name: "integer_value", metric: "integer_value: true\n        transforms: [{name: abs}]", wantErr: "can not be used together with integer_value"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadConfig(writeConfig(t, `
+mqtt:
+  object_per_topic_config:
+    encoding: JSON
+metrics:
+  - metrics:
+      - prom_name: temperature
+        type: gauge
+        `+tt.metric+`
+`), zap.NewNop())
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("LoadConfig() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("LoadConfig() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_liveness(t *testing.T) {
+	tests := []struct {
+		name     string
+		liveness string
+		want     *LivenessConfig
+		wantErr  string
+	}{
+		{
+			name:     "defaults",
+			liveness: "topic: devices/+/status",
+			want:     &LivenessConfig{Topic: "devices/+/status", BirthPayloads: []string{"online"}, DeathPayloads: []string{"offline"}, MetricName: "device_up"},
+		},
+		{
+			name:     "custom",
+			liveness: "topic: devices/+/$state\n    birth_payloads: [ready]\n    death_payloads: [lost, disconnected]\n    metric_name: homie_up",
+			want:     &LivenessConfig{Topic: "devices/+/$state", BirthPayloads: []string{"ready"}, DeathPayloads: []string{"lost", "disconnected"}, MetricName: "homie_up"},
+		},
+		{name: "invalid topic", liveness: "topic: devices/#/status", wantErr: "is no valid MQTT topic filter"},
+		{name: "invalid metric name", liveness: "topic: devices/+/status\n    metric_name: device-up", wantErr: `invalid liveness metric_name "device-up"`},
+		{name: "ambiguous payload", liveness: "topic: devices/+/status\n    birth_payloads: [Online]\n    death_payloads: [online]", wantErr: "is both a birth and a death payload"},
+		{name: "no device id level", liveness: "topic: status", wantErr: `must have exactly one "+" level`},
+		{name: "several device id levels", liveness: "topic: +/+/status", wantErr: `must have exactly one "+" level`},
+		{name: "metric name collides", liveness: "topic: devices/+/status\n    metric_name: temperature", wantErr: `exports a metric named like the liveness metric_name "temperature"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := LoadConfig(writeConfig(t, `
+mqtt:
+  topic_path: devices/+/data
+  liveness:
+    `+tt.liveness+`
+  object_per_topic_config:
+    encoding: JSON
+metrics:
+  - metrics:
+      - prom_name: temperature
+        type: gauge
+`), zap.NewNop())
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("LoadConfig() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadConfig() error = %v", err)
+			}
+			if !reflect.DeepEqual(cfg.MQTT.Liveness, tt.want) {
+				t.Errorf("liveness = %+v, want %+v", cfg.MQTT.Liveness, tt.want)
+			}
+			want := []string{tt.want.Topic, "devices/+/data"}
+			sort.Strings(want)
+			if got := cfg.SubscriptionTopics(); !reflect.DeepEqual(got, want) {
+				t.Errorf("SubscriptionTopics() = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_absentValue(t *testing.T) {
+	_, err := LoadConfig(writeConfig(t, `
+mqtt:
+  metric_per_topic_config:
+    metric_name_regex: "devices/(?P<deviceid>.*)/(?P<metricname>.*)"
+metrics:
+  - metrics:
+      - prom_name: alarms
+        mqtt_name: alarms
+        absent_value: 0
+`), zap.NewNop())
+	if want := "absent_value requires object_per_topic_config"; err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("LoadConfig() error = %v, want %q", err, want)
+	}
+}
+
+func TestLoadConfig_calibrationTable(t *testing.T) {
+	tests := []struct {
+		name    string
+		table   string
+		extra   string
+		wantErr string
+	}{
+		{name: "table", table: "# raw,value\n0,-10\n\n512,20\n1023,50\n"},
+		{name: "unsorted", table: "0,-10\n1023,50\n512,20\n", wantErr: "point 3: raw value 512 is not greater than the one of the previous point"},
+		{name: "duplicate raw value", table: "0,-10\n0,20\n", wantErr: "point 2: raw value 0 is not greater"},
+		{name: "empty", table: "# no points\n", wantErr: "a calibration table needs at least two points, got 0"},
+		{name: "single point", table: "0,-10\n", wantErr: "at least two points, got 1"},
+		{name: "malformed line", table: "0,-10\n512;20\n", wantErr: "line 2: want raw and calibrated value separated by a comma"},
+		{name: "integer_value", table: "0,-10\n1023,50\n", extra: "\n        integer_value: true", wantErr: "calibration_table can not be used together with integer_value"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tableFile := writeConfig(t, tt.table)
+			cfg, err := LoadConfig(writeConfig(t, `
+mqtt:
+  object_per_topic_config:
+    encoding: JSON
+metrics:
+  - metrics:
+      - prom_name: temperature
+        mqtt_name: adc
+        calibration_table: `+tableFile+tt.extra+`
+`), zap.NewNop())
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("LoadConfig() error = %v", err)
+				}
+				table := cfg.Metrics[0].Metrics[0].Calibration
+				if table == nil {
+					t.Fatal("Calibration = nil, want the loaded table")
+				}
+				if got := table.Interpolate(256); got != 5 {
+					t.Errorf("Interpolate(256) = %v, want 5", got)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("LoadConfig() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	_, err := LoadConfig(writeConfig(t, `
+mqtt:
+  object_per_topic_config:
+    encoding: JSON
+metrics:
+  - metrics:
+      - prom_name: temperature
+        mqtt_name: adc
+        calibration_table: /does/not/exist.csv
+`), zap.NewNop())
+	if err == nil || !strings.Contains(err.Error(), "invalid calibration_table") {
+		t.Errorf("LoadConfig() error = %v, want an invalid calibration_table", err)
+	}
+}
+
+func TestCalibrationTable_Interpolate(t *testing.T) {
+	table, err := NewCalibrationTable([][2]float64{{0, -10}, {512, 20}, {1023, 50}})
+	if err != nil {
+		t.Fatalf("NewCalibrationTable() error = %v", err)
+	}
+	tests := []struct {
+		raw  float64
+		want float64
+	}{
+		{raw: -5, want: -10},
+		{raw: 0, want: -10},
+		{raw: 128, want: -2.5},
+		{raw: 512, want: 20},
+		{raw: 767.5, want: 35},
+		{raw: 1023, want: 50},
+		{raw: 4096, want: 50},
+	}
+	for _, tt := range tests {
+		if got := table.Interpolate(tt.raw); got != tt.want {
+			t.Errorf("Interpolate(%v) = %v, want %v", tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestLoadConfig_textMetric(t *testing.T) {
+	tests := []struct {
+		name     string
+		metric   string
+		wantKeys []string
+	}{
+		{name: "default label", metric: "text_metric: true", wantKeys: []string{"value"}},
+		{name: "text_label", metric: "text_metric: true\n        text_label: serial\n        field_labels:\n          model: model", wantKeys: []string{"model", "serial"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := LoadConfig(writeConfig(t, `
+mqtt:
+  object_per_topic_config:
+    encoding: JSON
+metrics:
+  - metrics:
+      - prom_name: serial_info
+        mqtt_name: serial
+        `+tt.metric+`
+`), zap.NewNop())
+			if err != nil {
+				t.Fatalf("LoadConfig() error = %v", err)
+			}
+			m := cfg.Metrics[0].Metrics[0]
+			if m.ValueType != GaugeValueType {
+				t.Errorf("ValueType = %q, want %q", m.ValueType, GaugeValueType)
+			}
+			if got := m.DynamicLabelsKeys(); !reflect.DeepEqual(got, tt.wantKeys) {
+				t.Errorf("DynamicLabelsKeys() = %v, want %v", got, tt.wantKeys)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_labelOrder(t *testing.T) {
+	tests := []struct {
+		name       string
+		metric     string
+		wantLabels []string
+	}{
+		{name: "default", metric: "field_labels:\n          room: room", wantLabels: []string{"sensor", "topic", "room"}},
+		{name: "dynamic labels first", metric: "field_labels:\n          room: room\n        label_order: [room]", wantLabels: []string{"room", "sensor", "topic"}},
+		{name: "all labels", metric: "field_labels:\n          room: room\n        label_order: [topic, room, sensor]", wantLabels: []string{"topic", "room", "sensor"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := LoadConfig(writeConfig(t, `
+mqtt:
+  object_per_topic_config:
+    encoding: JSON
+metrics:
+  - metrics:
+      - prom_name: temperature
+        `+tt.metric+`
+`), zap.NewNop())
+			if err != nil {
+				t.Fatalf("LoadConfig() error = %v", err)
+			}
+			if got := cfg.Metrics[0].Metrics[0].LabelNames(); !reflect.DeepEqual(got, tt.wantLabels) {
+				t.Errorf("LabelNames() = %v, want %v", got, tt.wantLabels)
+			}
+		})
+	}
+}
+
+func TestJSONSchema_Validate(t *testing.T) {
+	schema, err := CompileJSONSchema([]byte(`{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"type": "object",
+		"required": ["temperature"],
+		"properties": {
+			"temperature": {"type": "number", "minimum": -40, "maximum": 85},
+			"battery": {"type": "integer", "exclusiveMinimum": 0},
+			"state": {"enum": ["on", "off"]},
+			"id": {"type": "string", "pattern": "^[a-z]+$", "maxLength": 8},
+			"readings": {"type": "array", "minItems": 1, "items": {"type": "number"}}
+		},
+		"additionalProperties": false
+	}`))
+	if err != nil {
+		t.Fatalf("CompileJSONSchema() error = %v", err)
+	}
+	tests := []struct {
+		payload string
+		wantErr string
+	}{
+		{payload: `{"temperature": 21.5, "battery": 3, "state": "on", "id": "dht", "readings": [1, 2]}`},
+		{payload: `{"battery": 3}`, wantErr: "missing properties: 'temperature'"},
+		{payload: `{"temperature": "warm"}`, wantErr: "'/temperature' does not validate"},
+		{payload: `{"temperature": 100}`, wantErr: "must be <= 85 but found 100"},
+		{payload: `{"temperature": 20, "battery": 2.5}`, wantErr: "'/battery' does not validate"},
+		{payload: `{"temperature": 20, "state": "auto"}`, wantErr: "'/state' does not validate"},
+		{payload: `{"temperature": 20, "id": "DHT"}`, wantErr: "'/id' does not validate"},
+		{payload: `{"temperature": 20, "readings": [1, "2"]}`, wantErr: "'/readings/1' does not validate"},
+		{payload: `{"temperature": 20, "humidity": 40}`, wantErr: "additionalProperties 'humidity' not allowed"},
+		{payload: `[21.5]`, wantErr: "expected object, but got array"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.payload, func(t *testing.T) {
+			var v interface{}
+			if err := json.Unmarshal([]byte(tt.payload), &v); err != nil {
+				t.Fatal(err)
+			}
+			err := schema.Validate(v)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("Validate() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Validate() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_payloadSchema(t *testing.T) {
+	tests := []struct {
+		name     string
+		encoding string
+		schema   string
+		wantErr  string
+	}{
+		{name: "valid", encoding: "JSON", schema: `{"type": "object", "anyOf": [{"required": ["a"]}, {"required": ["b"]}]}`},
+		{name: "local reference", encoding: "JSON", schema: `{"$defs": {"reading": {"type": "number"}}, "properties": {"a": {"$ref": "#/$defs/reading"}}}`},
+		{name: "unknown type", encoding: "JSON", schema: `{"type": "float"}`, wantErr: "invalid payload_schema"},
+		{name: "no JSON", encoding: "JSON", schema: `type: object`, wantErr: "invalid payload_schema"},
+		{name: "XML encoding", encoding: "XML", schema: `{}`, wantErr: "payload_schema requires JSON payloads"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			schemaFile := writeConfig(t, tt.schema)
+			cfg, err := LoadConfig(writeConfig(t, `
+mqtt:
+  object_per_topic_config:
+    encoding: `+tt.encoding+`
+    payload_schema: `+schemaFile+`
+metrics:
+  - metrics:
+      - prom_name: temperature
+        type: gauge
+`), zap.NewNop())
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("LoadConfig() error = %v", err)
+				}
+				if cfg.MQTT.ObjectPerTopicConfig.PayloadSchemaFor("devices/dht22") == nil {
+					t.Errorf("PayloadSchemaFor() = nil, want the compiled schema")
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("LoadConfig() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_payloadSchemas(t *testing.T) {
+	dir := t.TempDir()
+	for name, schema := range map[string]string{
+		"climate.json": `{"required": ["temperature"]}`,
+		"power.json":   `{"required": ["power"]}`,
+		"default.json": `{"type": "object"}`,
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(schema), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	load := func(schemas string) (Config, error) {
+		return LoadConfig(writeConfig(t, `
+mqtt:
+  object_per_topic_config:
+    encoding: JSON
+    payload_schema: `+filepath.Join(dir, "default.json")+`
+    payload_schemas:
+`+schemas+`
+metrics:
+  - metrics:
+      - prom_name: temperature
+        type: gauge
+`), zap.NewNop())
+	}
+
+	cfg, err := load(`      - topic: climate/+
+        schema: ` + filepath.Join(dir, "climate.json") + `
+      - topic: plugs/#
+        schema: ` + filepath.Join(dir, "power.json"))
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	o := cfg.MQTT.ObjectPerTopicConfig
+	for topic, payload := range map[string]string{
+		// The first matching entry applies, other topics get the payload_schema.
+		"climate/livingroom": `{"temperature": 21.5}`,
+		"plugs/kitchen/tv":   `{"power": 80}`,
+		"devices/dht22":      `{"humidity": 40}`,
+	} {
+		var v interface{}
+		if err := json.Unmarshal([]byte(payload), &v); err != nil {
+			t.Fatal(err)
+		}
+		if err := o.PayloadSchemaFor(topic).Validate(v); err != nil {
+			t.Errorf("PayloadSchemaFor(%q).Validate(%s) error = %v", topic, payload, err)
+		}
+		if topic != "devices/dht22" && o.PayloadSchemaFor(topic).Validate(map[string]interface{}{}) == nil {
+			t.Errorf("PayloadSchemaFor(%q) accepts the empty object, want the schema of the topic", topic)
+		}
+	}
+
+	if _, err := load(`      - topic: climate/#/x
+        schema: ` + filepath.Join(dir, "climate.json")); err == nil || !strings.Contains(err.Error(), "is no valid MQTT topic filter") {
+		t.Errorf("LoadConfig() error = %v, want invalid topic filter", err)
+	}
+	if _, err := load(`      - topic: climate/+
+        schema: ` + filepath.Join(dir, "missing.json")); err == nil || !strings.Contains(err.Error(), "invalid payload_schemas schema") {
+		t.Errorf("LoadConfig() error = %v, want invalid schema", err)
+	}
+}
+
+func TestMetricConfig_exportsName(t *testing.T) {
+	mc := &MetricConfig{
+		PrometheusName:   "energy",
+		ValueType:        CounterValueType,
+		EmitAge:          true,
+		EmitRaw:          true,
+		ExpectedInterval: time.Minute,
+		EmitRate:         true,
+		EmitDelta:        true,
+	}
+	descs := mc.PrometheusDescriptions()
+	if len(descs) != 1+len(companionMetrics) {
+		t.Fatalf("PrometheusDescriptions() = %v, want the metric and all companions", descs)
+	}
+	for _, desc := range descs {
+		// Desc has no accessor for its name, String() starts with it.
+		name := strings.SplitN(desc.String(), `"`, 3)[1]
+		if !mc.exportsName(name) {
+			t.Errorf("exportsName(%q) = false for the description %v", name, desc)
+		}
+	}
+	if mc.exportsName("energy_total") {
+		t.Errorf("exportsName(\"energy_total\") = true, want false")
+	}
+}
@@ -0,0 +1,40 @@
+package config
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	ModeObjectPerTopic = "object_per_topic"
+	ModeMetricPerTopic = "metric_per_topic"
+)
+
+// Mode returns how metrics are extracted from MQTT messages, either ModeObjectPerTopic or ModeMetricPerTopic.
+func (c *Config) Mode() string {
+	if c.MQTT == nil || c.MQTT.ObjectPerTopicConfig != nil {
+		return ModeObjectPerTopic
+	}
+	return ModeMetricPerTopic
+}
+
+// InfoCollector returns a collector for the mqtt2prometheus_config_info metric. Its labels describe the loaded
+// config, e.g. to confirm that all replicas loaded the same config file.
+func (c *Config) InfoCollector() prometheus.Collector {
+	metrics := 0
+	for _, block := range c.Metrics {
+		metrics += len(block.Metrics)
+	}
+	info := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "mqtt2prometheus_config_info",
+		Help: "Information about the loaded config, always 1",
+		ConstLabels: prometheus.Labels{
+			"config_hash": c.Hash,
+			"metrics":     strconv.Itoa(metrics),
+			"mode":        c.Mode(),
+		},
+	})
+	info.Set(1)
+	return info
+}
@@ -0,0 +1,42 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// loadMessageDescriptor reads a binary FileDescriptorSet and looks up the message with the given full name.
+func loadMessageDescriptor(path, message string) (protoreflect.MessageDescriptor, error) {
+	if path == "" {
+		return nil, fmt.Errorf("protobuf_descriptor is required")
+	}
+	if message == "" {
+		return nil, fmt.Errorf("protobuf_message is required")
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var set descriptorpb.FileDescriptorSet
+	if err := proto.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("failed to parse descriptor set %q: %w", path, err)
+	}
+	files, err := protodesc.NewFiles(&set)
+	if err != nil {
+		return nil, fmt.Errorf("invalid descriptor set %q: %w", path, err)
+	}
+	desc, err := files.FindDescriptorByName(protoreflect.FullName(message))
+	if err != nil {
+		return nil, fmt.Errorf("message %q not found in %q: %w", message, path, err)
+	}
+	md, ok := desc.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%q in %q is not a message", message, path)
+	}
+	return md, nil
+}
@@ -0,0 +1,60 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// JSONSchema is a compiled JSON Schema for payloads decoded by encoding/json. Schemas without $schema are treated as
+// draft 2020-12. References are resolved relative to the schema file, remote references are not loaded.
+type JSONSchema struct {
+	schema *jsonschema.Schema
+}
+
+// PayloadSchemaConfig applies a JSON Schema to the payloads of the topics matching a topic filter.
+type PayloadSchemaConfig struct {
+	// Topic is the MQTT topic filter of the payloads the schema applies to.
+	Topic string `yaml:"topic"`
+	// SchemaFile is the path to the JSON Schema.
+	SchemaFile string `yaml:"schema"`
+
+	schema *JSONSchema
+}
+
+// newJSONSchemaCompiler returns a compiler which treats schemas without $schema as draft 2020-12.
+func newJSONSchemaCompiler() *jsonschema.Compiler {
+	c := jsonschema.NewCompiler()
+	c.Draft = jsonschema.Draft2020
+	return c
+}
+
+// loadJSONSchema reads and compiles the JSON Schema in the given file.
+func loadJSONSchema(path string) (*JSONSchema, error) {
+	schema, err := newJSONSchemaCompiler().Compile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &JSONSchema{schema: schema}, nil
+}
+
+// CompileJSONSchema compiles the given JSON Schema document.
+func CompileJSONSchema(data []byte) (*JSONSchema, error) {
+	const url = "payload.schema.json"
+	c := newJSONSchemaCompiler()
+	if err := c.AddResource(url, bytes.NewReader(data)); err != nil {
+		return nil, fmt.Errorf("failed to decode schema: %w", err)
+	}
+	schema, err := c.Compile(url)
+	if err != nil {
+		return nil, err
+	}
+	return &JSONSchema{schema: schema}, nil
+}
+
+// Validate checks the value decoded by encoding/json against the schema. The error names the locations of the
+// violations in the value as JSON pointers.
+func (s *JSONSchema) Validate(v interface{}) error {
+	return s.schema.Validate(v)
+}
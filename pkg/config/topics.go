@@ -0,0 +1,253 @@
+package config
+
+import (
+	"fmt"
+	"regexp/syntax"
+	"sort"
+	"strings"
+)
+
+const (
+	singleLevelWildcard = "+"
+	multiLevelWildcard  = "#"
+	topicLevelSeparator = "/"
+)
+
+// TopicFilters returns the minimal set of MQTT topic filters required to receive every message any configured metric
+// could be extracted from. Filters are derived from the topic_path_filter of each metric and narrowed down to the
+// configured topic_path. If a single metric accepts any topic, the topic_path itself is returned.
+// In the metric-per-topic mode, the filters are derived from the metric_name_regex instead, see MetricPerTopicFilters.
+func (c *Config) TopicFilters() []string {
+	if c.MQTT.ObjectPerTopicConfig == nil && c.MQTT.MetricPerTopicConfig != nil && c.MQTT.MetricPerTopicConfig.MetricNameRegex != nil {
+		return c.MetricPerTopicFilters()
+	}
+	var filters []string
+	for _, block := range c.Metrics {
+		for _, m := range block.Metrics {
+			if m.SubscribeTopic != "" {
+				// Subscribed separately, see SubscriptionTopics.
+				continue
+			}
+			filter, ok := topicFilterFromRegexp(m.TopicPathFilter)
+			if !ok {
+				return []string{c.MQTT.TopicPath}
+			}
+			if filter, ok = IntersectTopicFilters(c.MQTT.TopicPath, filter); ok {
+				filters = append(filters, filter)
+			}
+		}
+	}
+	if len(filters) == 0 {
+		return []string{c.MQTT.TopicPath}
+	}
+	return MinimalTopicFilters(filters)
+}
+
+// SubscriptionTopics returns the topic filters to subscribe to. These are the subscribe_topic of all metrics, or,
+// if any metric has none, the topic_path or the derived TopicFilters with derive_topic_filters, and the liveness
+// topic. Duplicates and covered filters are removed.
+func (c *Config) SubscriptionTopics() []string {
+	var topics []string
+	shared := false
+	for _, block := range c.Metrics {
+		for _, m := range block.Metrics {
+			if m.SubscribeTopic == "" {
+				shared = true
+				continue
+			}
+			topics = append(topics, m.SubscribeTopic)
+		}
+	}
+	if shared || len(topics) == 0 {
+		if c.MQTT.DeriveTopicFilters {
+			topics = append(topics, c.TopicFilters()...)
+		} else {
+			topics = append(topics, c.MQTT.TopicPath)
+		}
+	}
+	if c.MQTT.Liveness != nil {
+		topics = append(topics, c.MQTT.Liveness.Topic)
+	}
+	return MinimalTopicFilters(topics)
+}
+
+// ValidTopicFilter reports whether f is a valid MQTT topic filter. Wildcards must span a whole topic level, and "#"
+// must be the last level.
+func ValidTopicFilter(f string) bool {
+	if f == "" {
+		return false
+	}
+	levels := strings.Split(f, topicLevelSeparator)
+	for i, level := range levels {
+		if level == multiLevelWildcard && i == len(levels)-1 || level == singleLevelWildcard {
+			continue
+		}
+		if strings.ContainsAny(level, singleLevelWildcard+multiLevelWildcard) {
+			return false
+		}
+	}
+	return true
+}
+
+// MetricPerTopicFilters returns the topic filters required to receive the topics of all configured metrics in the
+// metric-per-topic mode. The topic level holding the metric name is found by matching the metric_name_regex against
+// the topic_path with a placeholder for each wildcard level. This level is then replaced by each configured
+// mqtt_name, e.g. "devices/+/+" with "(?P<deviceid>.*)/(?P<metricname>.*)" yields "devices/+/temperature".
+// The topic_path itself is returned if this is not possible, e.g. for a topic_path ending with "#" or metrics with a
+// mqtt_name_pattern.
+func (c *Config) MetricPerTopicFilters() []string {
+	fallback := []string{c.MQTT.TopicPath}
+	nameRegex := c.MQTT.MetricPerTopicConfig.MetricNameRegex
+	levels := strings.Split(c.MQTT.TopicPath, topicLevelSeparator)
+	probe := make([]string, len(levels))
+	for i, level := range levels {
+		switch level {
+		case multiLevelWildcard:
+			return fallback
+		case singleLevelWildcard:
+			probe[i] = fmt.Sprintf("level%d", i)
+		default:
+			probe[i] = level
+		}
+	}
+	name := nameRegex.GroupValue(strings.Join(probe, topicLevelSeparator), MetricNameRegexGroup)
+	nameLevel := -1
+	for i := range levels {
+		if levels[i] == singleLevelWildcard && probe[i] == name {
+			nameLevel = i
+		}
+	}
+	if nameLevel < 0 {
+		return fallback
+	}
+
+	var filters []string
+	for _, block := range c.Metrics {
+		for _, m := range block.Metrics {
+			if m.SubscribeTopic != "" {
+				// Subscribed separately, see SubscriptionTopics.
+				continue
+			}
+			if m.MQTTNamePattern != nil {
+				return fallback
+			}
+			names := []string{m.MQTTName}
+			if m.Derive != nil {
+				names = names[:0]
+				for _, src := range m.Derive.Sources {
+					names = append(names, src.MQTTName)
+				}
+			}
+			for _, name := range names {
+				// The name must be a single topic level which the metric_name_regex extracts again.
+				probe[nameLevel] = name
+				if name == "" || strings.ContainsAny(name, topicLevelSeparator+singleLevelWildcard+multiLevelWildcard) ||
+					nameRegex.GroupValue(strings.Join(probe, topicLevelSeparator), MetricNameRegexGroup) != name {
+					return fallback
+				}
+				filter := append([]string(nil), levels...)
+				filter[nameLevel] = name
+				filters = append(filters, strings.Join(filter, topicLevelSeparator))
+			}
+		}
+	}
+	if len(filters) == 0 {
+		return fallback
+	}
+	return MinimalTopicFilters(filters)
+}
+
+// MinimalTopicFilters removes duplicates and all filters which are already covered by another filter of the list.
+// The result is sorted.
+func MinimalTopicFilters(filters []string) []string {
+	sorted := append([]string(nil), filters...)
+	sort.Strings(sorted)
+	var minimal []string
+	for i, f := range sorted {
+		covered := false
+		for j, other := range sorted {
+			if i == j {
+				continue
+			}
+			// Among duplicates, keep the first one only.
+			if other == f && j > i {
+				continue
+			}
+			if TopicFilterCovers(other, f) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			minimal = append(minimal, f)
+		}
+	}
+	return minimal
+}
+
+// TopicFilterCovers reports whether every topic matched by filter inner is also matched by filter outer.
+func TopicFilterCovers(outer, inner string) bool {
+	intersection, ok := IntersectTopicFilters(outer, inner)
+	return ok && intersection == inner
+}
+
+// IntersectTopicFilters returns the filter matching exactly the topics matched by both a and b. If no topic
+// can match both, false is returned.
+func IntersectTopicFilters(a, b string) (string, bool) {
+	al, bl := strings.Split(a, topicLevelSeparator), strings.Split(b, topicLevelSeparator)
+	var levels []string
+	for i := 0; ; i++ {
+		switch {
+		case i < len(al) && al[i] == multiLevelWildcard:
+			return strings.Join(append(levels, bl[i:]...), topicLevelSeparator), true
+		case i < len(bl) && bl[i] == multiLevelWildcard:
+			return strings.Join(append(levels, al[i:]...), topicLevelSeparator), true
+		case i == len(al) || i == len(bl):
+			if len(al) != len(bl) {
+				return "", false
+			}
+			return strings.Join(levels, topicLevelSeparator), true
+		case al[i] == singleLevelWildcard:
+			levels = append(levels, bl[i])
+		case bl[i] == singleLevelWildcard, al[i] == bl[i]:
+			levels = append(levels, al[i])
+		default:
+			return "", false
+		}
+	}
+}
+
+// topicFilterFromRegexp derives a MQTT topic filter which matches at least all topics matched by the given regular
+// expression. This is possible for expressions anchored at the beginning with a literal prefix only. An expression
+// consisting of a single literal anchored on both ends yields the exact topic.
+func topicFilterFromRegexp(r *Regexp) (string, bool) {
+	if r == nil || r.r == nil {
+		return "", false
+	}
+	re, err := syntax.Parse(r.pattern, syntax.Perl)
+	if err != nil {
+		return "", false
+	}
+	re = re.Simplify()
+	if re.Op != syntax.OpConcat || re.Sub[0].Op != syntax.OpBeginText {
+		return "", false
+	}
+	var prefix strings.Builder
+	rest := re.Sub[1:]
+	for len(rest) > 0 && rest[0].Op == syntax.OpLiteral && rest[0].Flags&syntax.FoldCase == 0 {
+		prefix.WriteString(string(rest[0].Rune))
+		rest = rest[1:]
+	}
+	topic := prefix.String()
+	if strings.ContainsAny(topic, singleLevelWildcard+multiLevelWildcard) {
+		return "", false
+	}
+	if len(rest) == 1 && rest[0].Op == syntax.OpEndText && topic != "" {
+		return topic, true
+	}
+	idx := strings.LastIndex(topic, topicLevelSeparator)
+	if idx < 0 {
+		return "", false
+	}
+	return topic[:idx+1] + multiLevelWildcard, true
+}
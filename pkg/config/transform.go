@@ -0,0 +1,139 @@
+package config
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// TransformConfig is one step of the transforms of a metric: the named transform applied with the given parameters.
+type TransformConfig struct {
+	Name   string             `yaml:"name"`
+	Params map[string]float64 `yaml:"params"`
+}
+
+// Transform is a named function of the value of a metric, see RegisterTransform.
+type Transform struct {
+	// Parameters by name with their default, nil if the parameter is required
+	Params map[string]*float64
+	// Apply returns the transformed value. The params contain all parameters, the defaults included.
+	Apply func(value float64, params map[string]float64) float64
+}
+
+var (
+	transformsMu sync.RWMutex
+	transforms   = map[string]Transform{
+		// Multiplies the value with factor, then adds offset.
+		"scale": {
+			Params: map[string]*float64{"factor": nil, "offset": floatPtr(0)},
+			Apply: func(value float64, params map[string]float64) float64 {
+				return value*params["factor"] + params["offset"]
+			},
+		},
+		// Adds value to the value.
+		"offset": {
+			Params: map[string]*float64{"value": nil},
+			Apply: func(value float64, params map[string]float64) float64 {
+				return value + params["value"]
+			},
+		},
+		// Limits the value to [min, max], both are optional.
+		"clamp": {
+			Params: map[string]*float64{"min": floatPtr(math.Inf(-1)), "max": floatPtr(math.Inf(1))},
+			Apply: func(value float64, params map[string]float64) float64 {
+				return math.Max(params["min"], math.Min(params["max"], value))
+			},
+		},
+		// Rounds half away from zero to the given number of decimal places, like round_to.
+		"round": {
+			Params: map[string]*float64{"places": floatPtr(0)},
+			Apply: func(value float64, params map[string]float64) float64 {
+				factor := math.Pow(10, params["places"])
+				return math.Round(value*factor) / factor
+			},
+		},
+		"abs": {
+			Apply: func(value float64, _ map[string]float64) float64 {
+				return math.Abs(value)
+			},
+		},
+	}
+)
+
+func floatPtr(f float64) *float64 {
+	return &f
+}
+
+// RegisterTransform makes the transform available to the transforms of all metrics configs loaded afterwards. A
+// transform registered before with the same name is replaced.
+func RegisterTransform(name string, t Transform) {
+	transformsMu.Lock()
+	defer transformsMu.Unlock()
+	transforms[name] = t
+}
+
+func lookupTransform(name string) (Transform, bool) {
+	transformsMu.RLock()
+	defer transformsMu.RUnlock()
+	t, ok := transforms[name]
+	return t, ok
+}
+
+// transformNames returns the names of all registered transforms in lexical order.
+func transformNames() []string {
+	transformsMu.RLock()
+	defer transformsMu.RUnlock()
+	names := make([]string, 0, len(transforms))
+	for name := range transforms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Compile checks the parameters of the transform and returns the function applying it with the defaults filled in.
+func (tc TransformConfig) Compile() (func(float64) float64, error) {
+	t, ok := lookupTransform(tc.Name)
+	if !ok {
+		return nil, fmt.Errorf("unknown transform %q, valid transforms are %s", tc.Name, strings.Join(transformNames(), ", "))
+	}
+	params := make(map[string]float64, len(t.Params))
+	for name, value := range tc.Params {
+		if _, ok := t.Params[name]; !ok {
+			return nil, fmt.Errorf("transform %q has no parameter %q", tc.Name, name)
+		}
+		params[name] = value
+	}
+	for name, def := range t.Params {
+		if _, ok := params[name]; ok {
+			continue
+		}
+		if def == nil {
+			return nil, fmt.Errorf("transform %q requires the parameter %q", tc.Name, name)
+		}
+		params[name] = *def
+	}
+	return func(value float64) float64 {
+		return t.Apply(value, params)
+	}, nil
+}
+
+// CompileTransforms compiles the transforms of the metric into one function applying them in order.
+func (mc *MetricConfig) CompileTransforms() (func(float64) float64, error) {
+	steps := make([]func(float64) float64, 0, len(mc.Transforms))
+	for i, tc := range mc.Transforms {
+		step, err := tc.Compile()
+		if err != nil {
+			return nil, fmt.Errorf("transform %d: %w", i, err)
+		}
+		steps = append(steps, step)
+	}
+	return func(value float64) float64 {
+		for _, step := range steps {
+			value = step(value)
+		}
+		return value
+	}, nil
+}
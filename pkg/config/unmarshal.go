@@ -0,0 +1,42 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v2"
+)
+
+// unknownKeyError matches the errors reported by yaml.UnmarshalStrict for keys without a matching struct field.
+var unknownKeyError = regexp.MustCompile(`^line (\d+): field (\S+) not found in type (?:\w+\.)?(\w+)$`)
+
+// unmarshalConfig decodes the config strictly. Unknown keys are reported with their line and the section they
+// appear in. If the config sets ignore_unknown_keys, unknown keys are logged as warnings instead.
+func unmarshalConfig(data []byte, logger *zap.Logger) (Config, error) {
+	var cfg Config
+	err := yaml.UnmarshalStrict(data, &cfg)
+	var typeErr *yaml.TypeError
+	if err == nil || !errors.As(err, &typeErr) {
+		return cfg, err
+	}
+
+	var unknown, other []string
+	for _, e := range typeErr.Errors {
+		if m := unknownKeyError.FindStringSubmatch(e); m != nil {
+			unknown = append(unknown, fmt.Sprintf("line %s: unknown key %q in %s", m[1], m[2], m[3]))
+		} else {
+			other = append(other, e)
+		}
+	}
+	// The remaining config is decoded regardless of unknown keys.
+	if len(other) == 0 && cfg.IgnoreUnknownKeys {
+		for _, u := range unknown {
+			logger.Warn("Ignoring unknown config key", zap.String("key", u))
+		}
+		return cfg, nil
+	}
+	return cfg, fmt.Errorf("invalid config: %s", strings.Join(append(unknown, other...), "; "))
+}
@@ -0,0 +1,62 @@
+package metrics
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// availability tracks the receive times of the samples of a series configured with expected_interval. It is shared
+// between the parser and the collector, which computes the ratio on each scrape.
+type availability struct {
+	mu       sync.Mutex
+	window   time.Duration
+	interval time.Duration
+	// The time of the first sample, the ratio refers to the time since then until a full window passed
+	first time.Time
+	// Receive times of the latest samples, oldest first. At most as many as expected within the window are kept.
+	received []time.Time
+}
+
+// newAvailability returns the tracker of samples expected every interval. The window spans at least one interval.
+func newAvailability(window, interval time.Duration) *availability {
+	if window < interval {
+		window = interval
+	}
+	return &availability{window: window, interval: interval}
+}
+
+// observe records a sample received at the given time.
+func (a *availability) observe(t time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.first.IsZero() {
+		a.first = t
+	}
+	a.received = append(a.received, t)
+	if limit := int(a.window/a.interval) + 1; len(a.received) > limit {
+		a.received = append(a.received[:0], a.received[len(a.received)-limit:]...)
+	}
+}
+
+// Ratio returns the fraction of the expected samples received within the window before the given time, at most 1.
+func (a *availability) Ratio(t time.Time) float64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.first.IsZero() {
+		return 0
+	}
+	span := t.Sub(a.first)
+	if span > a.window {
+		span = a.window
+	}
+	start := t.Add(-span)
+	var count int
+	for _, r := range a.received {
+		if !r.Before(start) {
+			count++
+		}
+	}
+	expected := math.Min(math.Floor(float64(span)/float64(a.interval))+1, float64(a.window)/float64(a.interval))
+	return math.Min(float64(count)/expected, 1)
+}
@@ -0,0 +1,101 @@
+package metrics
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/hikhvar/mqtt2prometheus/pkg/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+func TestAvailability_Ratio(t *testing.T) {
+	start := testNow()
+	a := newAvailability(10*time.Minute, time.Minute)
+	if got := a.Ratio(start); got != 0 {
+		t.Errorf("Ratio() without samples = %v, want 0", got)
+	}
+	a.observe(start)
+	if got := a.Ratio(start); got != 1 {
+		t.Errorf("Ratio() after the first sample = %v, want 1", got)
+	}
+	// A sample every minute for 20 minutes, except for the minutes 12 to 15.
+	for i := 1; i <= 20; i++ {
+		if i >= 12 && i <= 15 {
+			continue
+		}
+		a.observe(start.Add(time.Duration(i) * time.Minute))
+	}
+	tests := []struct {
+		name string
+		at   time.Duration
+		want float64
+	}{
+		{name: "all missed samples within window", at: 20 * time.Minute, want: 0.7},
+		{name: "missed samples leaving the window", at: 25*time.Minute + 30*time.Second, want: 0.5},
+		{name: "all samples outside window", at: 31 * time.Minute, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := a.Ratio(start.Add(tt.at)); math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("Ratio() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAvailability_RatioShortWindow(t *testing.T) {
+	// A window shorter than the interval, as the default one with a disabled cache timeout, spans one interval.
+	start := testNow()
+	a := newAvailability(2*time.Minute, 5*time.Minute)
+	a.observe(start)
+	a.observe(start.Add(5 * time.Minute))
+	for at, want := range map[time.Duration]float64{5 * time.Minute: 1, 11 * time.Minute: 0} {
+		if got := a.Ratio(start.Add(at)); got != want {
+			t.Errorf("Ratio() after %s = %v, want %v", at, got, want)
+		}
+	}
+}
+
+func TestMemoryCachedCollector_availability(t *testing.T) {
+	now = testNow
+	defer func() { testNowElapsed = 0 }()
+	cfg := config.MetricConfig{
+		PrometheusName:   "temperature",
+		ValueType:        "gauge",
+		OmitTimestamp:    true,
+		ExpectedInterval: time.Minute,
+	}
+	p := NewParser(nil, ".", "", WithStateStore(NewMemoryStateStore()), WithAvailabilityWindow(10*time.Minute))
+	c := NewCollector(time.Hour, []config.BlockConfig{{Metrics: []config.MetricConfig{cfg}}}, zap.NewNop())
+	// Samples at the minutes 0 to 4 and 8 to 9, the ones in between were missed.
+	for _, minute := range []int{0, 1, 2, 3, 4, 8, 9} {
+		testNowElapsed = time.Duration(minute) * time.Minute
+		m, err := p.parseMetric(&cfg, "temperature", "21.5", nil)
+		if err != nil {
+			t.Fatalf("parseMetric() error = %v", err)
+		}
+		c.Observe("dht22", MetricCollection{m})
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(c)
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got *float64
+	for _, mf := range families {
+		if mf.GetName() == "temperature_availability" {
+			v := mf.GetMetric()[0].GetGauge().GetValue()
+			got = &v
+		}
+	}
+	if got == nil {
+		t.Fatal("temperature_availability was not collected")
+	}
+	if want := 0.7; math.Abs(*got-want) > 1e-9 {
+		t.Errorf("temperature_availability = %v, want %v", *got, want)
+	}
+}
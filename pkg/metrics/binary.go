@@ -0,0 +1,52 @@
+package metrics
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/hikhvar/mqtt2prometheus/pkg/config"
+)
+
+// decodeBinaryValue decodes the base64 encoded string value and interprets the resulting bytes according to the
+// given binary format.
+func decodeBinaryValue(format string, value interface{}) (float64, error) {
+	encoded, ok := value.(string)
+	if !ok {
+		return 0, fmt.Errorf("got data with unexpectd type: %T ('%v') but expected a base64 string", value, value)
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return 0, fmt.Errorf("failed to decode base64 value '%s': %w", encoded, err)
+	}
+	if size := config.BinaryFormats[format]; len(data) != size {
+		return 0, fmt.Errorf("got %d bytes but binary format %q requires %d", len(data), format, size)
+	}
+
+	var order binary.ByteOrder = binary.BigEndian
+	if strings.HasSuffix(format, "_le") {
+		order = binary.LittleEndian
+	}
+	switch strings.TrimSuffix(strings.TrimSuffix(format, "_le"), "_be") {
+	case "int8":
+		return float64(int8(data[0])), nil
+	case "uint8":
+		return float64(data[0]), nil
+	case "int16":
+		return float64(int16(order.Uint16(data))), nil
+	case "uint16":
+		return float64(order.Uint16(data)), nil
+	case "int32":
+		return float64(int32(order.Uint32(data))), nil
+	case "uint32":
+		return float64(order.Uint32(data)), nil
+	case "float32":
+		return float64(math.Float32frombits(order.Uint32(data))), nil
+	case "float64":
+		return math.Float64frombits(order.Uint64(data)), nil
+	default:
+		return 0, fmt.Errorf("unsupported binary format %q", format)
+	}
+}
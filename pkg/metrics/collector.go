@@ -1,7 +1,9 @@
 package metrics
 
 import (
-	"fmt"
+	"math"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/hikhvar/mqtt2prometheus/pkg/config"
@@ -13,12 +15,39 @@ import (
 type Collector interface {
 	prometheus.Collector
 	Observe(deviceID string, collection MetricCollection)
+	// ActiveSeriesCollector returns a collector for the number of series currently exposed.
+	ActiveSeriesCollector() prometheus.Collector
 }
 
+// staleNaN is the value Prometheus uses to mark a series as stale.
+var staleNaN = math.Float64frombits(0x7ff0000000000002)
+
+var activeSeriesDesc = prometheus.NewDesc("mqtt2prometheus_active_series", "Number of series which did not expire yet", nil, nil)
+
 type MemoryCachedCollector struct {
 	cache        *gocache.Cache
+	timeout      time.Duration
 	descriptions []*prometheus.Desc
 	logger       *zap.Logger
+	// Emit a staleness marker once for every expired series
+	stalenessMarkers bool
+	mu               sync.Mutex
+	// Series which expired since the last scrape by cache key, guarded by mu. A series observed again before the
+	// scrape is removed, it is exposed with its new value instead of a marker.
+	expired map[string]CacheItem
+}
+
+// CollectorOption configures optional behaviour of a MemoryCachedCollector.
+type CollectorOption func(*MemoryCachedCollector)
+
+// WithStalenessMarkers makes the collector emit a staleness marker for each series on the first collection after it
+// expired, so it is considered absent right away instead of after the lookback window of the query. The marker is a
+// NaN with a special bit pattern, which only the protobuf exposition format keeps. The text formats write any NaN as
+// "NaN", so scrapers using them receive an ordinary NaN sample instead.
+func WithStalenessMarkers() CollectorOption {
+	return func(c *MemoryCachedCollector) {
+		c.stalenessMarkers = true
+	}
 }
 
 type Metric struct {
@@ -29,28 +58,97 @@ type Metric struct {
 	Topic       string
 	Labels      map[string]string
 	LabelsKeys  []string
+	// LabelOrder are the names of all labels in the order of the description, if the config sets label_order. By
+	// default the order is "sensor", "topic" and the LabelsKeys.
+	LabelOrder []string
+	// Exact value of metrics configured with integer_value. Value holds the same value, possibly rounded.
+	IntValue *int64
+	// ReceiveTime is the time the sample was received, even with omit_timestamp. Only set with emit_age or
+	// max_value_age.
+	ReceiveTime time.Time
+	// Companions are the additional series exported with the metric, e.g. its age with emit_age.
+	Companions []Companion
+	// MaxValueAge of the config, samples received longer ago are exposed with StaleValue, the error_value of the
+	// config, or not at all if it has none. Disabled if zero.
+	MaxValueAge time.Duration
+	StaleValue  *float64
+	// MaxTimestampAge and TimestampAgeAction of the config, applied to IngestTime on each scrape, see timestamp.
+	MaxTimestampAge    time.Duration
+	TimestampAgeAction string
+}
+
+// Companion is an additional gauge exported with the labels of a metric.
+type Companion struct {
+	Description *prometheus.Desc
+	// Value returns the value of the companion at scrape time.
+	Value func(scraped time.Time) float64
+	// Timestamped companions are exposed with the timestamp of the sample, and only while the sample itself is
+	// exposed with its value. The others are exposed on each scrape without timestamp.
+	Timestamped bool
+}
+
+// constValue returns the value function of a companion with a fixed value.
+func constValue(v float64) func(time.Time) float64 {
+	return func(time.Time) float64 { return v }
+}
+
+// stale reports whether the sample was received longer than MaxValueAge before t.
+func (m Metric) stale(t time.Time) bool {
+	return m.MaxValueAge > 0 && t.Sub(m.ReceiveTime) > m.MaxValueAge
+}
+
+// timestamp returns the timestamp to expose the metric with at time t, zero to expose it without one. If IngestTime
+// is older than MaxTimestampAge, it is handled according to TimestampAgeAction: it is omitted, clamped to the oldest
+// allowed timestamp, or the sample is dropped.
+func (m Metric) timestamp(t time.Time) (ts time.Time, drop bool) {
+	if m.IngestTime.IsZero() || m.MaxTimestampAge <= 0 || t.Sub(m.IngestTime) <= m.MaxTimestampAge {
+		return m.IngestTime, false
+	}
+	switch m.TimestampAgeAction {
+	case config.TimestampAgeClamp:
+		return t.Add(-m.MaxTimestampAge), false
+	case config.TimestampAgeDrop:
+		return time.Time{}, true
+	default:
+		return time.Time{}, false
+	}
 }
 
 type CacheItem struct {
 	DeviceID string
 	Metric   Metric
+	// When the item was observed, by the clock of the package
+	observed time.Time
 }
 
 type MetricCollection []Metric
 
-func NewCollector(defaultTimeout time.Duration, possibleMetrics []config.BlockConfig, logger *zap.Logger) Collector {
+func NewCollector(defaultTimeout time.Duration, possibleMetrics []config.BlockConfig, logger *zap.Logger, opts ...CollectorOption) Collector {
 	var descs []*prometheus.Desc
 
 	for _, blocks := range possibleMetrics {
 		for _, m := range blocks.Metrics {
-			descs = append(descs, m.PrometheusDescription())
+			descs = append(descs, m.PrometheusDescriptions()...)
 		}
 	}
-	return &MemoryCachedCollector{
+	c := &MemoryCachedCollector{
 		cache:        gocache.New(defaultTimeout, defaultTimeout*10),
+		timeout:      defaultTimeout,
 		descriptions: descs,
 		logger:       logger,
+		expired:      make(map[string]CacheItem),
+	}
+	for _, opt := range opts {
+		opt(c)
 	}
+	if c.stalenessMarkers {
+		c.cache.OnEvicted(func(key string, v interface{}) {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			c.expired[key] = v.(CacheItem)
+		})
+	}
+	return c
 }
 
 func (c *MemoryCachedCollector) Observe(deviceID string, collection MetricCollection) {
@@ -58,8 +156,15 @@ func (c *MemoryCachedCollector) Observe(deviceID string, collection MetricCollec
 		item := CacheItem{
 			DeviceID: deviceID,
 			Metric:   m,
+			observed: now(),
+		}
+		key := item.key()
+		c.cache.Set(key, item, gocache.DefaultExpiration)
+		if c.stalenessMarkers {
+			c.mu.Lock()
+			delete(c.expired, key)
+			c.mu.Unlock()
 		}
-		c.cache.Set(fmt.Sprintf("%s-%s", deviceID, m.Description.String()), item, gocache.DefaultExpiration)
 	}
 }
 
@@ -72,29 +177,143 @@ func (c *MemoryCachedCollector) Describe(ch chan<- *prometheus.Desc) {
 func (c *MemoryCachedCollector) Collect(mc chan<- prometheus.Metric) {
 	for _, metricsRaw := range c.cache.Items() {
 		item := metricsRaw.Object.(CacheItem)
-		device, metric := item.DeviceID, item.Metric
+		metric := item.Metric
 		if metric.Description == nil {
 			c.logger.Warn("empty description", zap.String("topic", metric.Topic), zap.Float64("value", metric.Value))
 		}
 
-		// set dynamic labels with the right order starting with "sensor" and "topic"
-		labels := []string{device, metric.Topic}
-		for _, k := range metric.LabelsKeys {
-			labels = append(labels, metric.Labels[k])
+		ts, drop := metric.timestamp(now())
+		value, stale := metric.Value, metric.stale(now())
+		if stale {
+			// The sample is replaced at scrape time, so it has no timestamp of its own.
+			if metric.StaleValue == nil {
+				drop = true
+			} else {
+				value, ts = *metric.StaleValue, time.Time{}
+			}
 		}
+		if !drop {
+			m := prometheus.MustNewConstMetric(
+				metric.Description,
+				metric.ValueType,
+				value,
+				item.labelValues()...,
+			)
 
-		m := prometheus.MustNewConstMetric(
-			metric.Description,
-			metric.ValueType,
-			metric.Value,
-			labels...,
-		)
-
-		if metric.IngestTime.IsZero() {
+			if ts.IsZero() {
+				mc <- m
+			} else {
+				mc <- prometheus.NewMetricWithTimestamp(ts, m)
+			}
+		}
+		for _, companion := range metric.Companions {
+			if companion.Timestamped && (drop || stale) {
+				continue
+			}
+			m := prometheus.MustNewConstMetric(
+				companion.Description,
+				prometheus.GaugeValue,
+				companion.Value(now()),
+				item.labelValues()...,
+			)
+			if companion.Timestamped && !ts.IsZero() {
+				m = prometheus.NewMetricWithTimestamp(ts, m)
+			}
 			mc <- m
-		} else {
-			mc <- prometheus.NewMetricWithTimestamp(metric.IngestTime, m)
 		}
+	}
+	if c.stalenessMarkers {
+		for _, m := range c.StalenessMarkers() {
+			mc <- m
+		}
+	}
+}
+
+// StalenessMarkers removes all expired series from the cache and returns a staleness marker for each series which
+// expired since the last call.
+func (c *MemoryCachedCollector) StalenessMarkers() []prometheus.Metric {
+	c.cache.DeleteExpired()
+	c.mu.Lock()
+	expired := c.expired
+	c.expired = make(map[string]CacheItem)
+	c.mu.Unlock()
+
+	markers := make([]prometheus.Metric, 0, len(expired))
+	for _, item := range expired {
+		if item.Metric.Description == nil {
+			continue
+		}
+		markers = append(markers, prometheus.MustNewConstMetric(
+			item.Metric.Description,
+			item.Metric.ValueType,
+			staleNaN,
+			item.labelValues()...,
+		))
+		for _, companion := range item.Metric.Companions {
+			markers = append(markers, prometheus.MustNewConstMetric(
+				companion.Description,
+				prometheus.GaugeValue,
+				staleNaN,
+				item.labelValues()...,
+			))
+		}
+	}
+	return markers
+}
 
+// key returns the key of the series in the cache. Series of the same metric differ in their label values, e.g. the
+// values taken from the topic, the payload or the topic_labels.
+func (c CacheItem) key() string {
+	return c.Metric.Description.String() + "\xff" + strings.Join(c.labelValues(), "\xff")
+}
+
+// labelValues returns the label values in the order of the description, starting with "sensor" and "topic"
+// followed by the dynamic labels, or in the LabelOrder of the metric.
+func (c CacheItem) labelValues() []string {
+	if c.Metric.LabelOrder != nil {
+		labels := make([]string, 0, len(c.Metric.LabelOrder))
+		for _, k := range c.Metric.LabelOrder {
+			switch k {
+			case "sensor":
+				labels = append(labels, c.DeviceID)
+			case "topic":
+				labels = append(labels, c.Metric.Topic)
+			default:
+				labels = append(labels, c.Metric.Labels[k])
+			}
+		}
+		return labels
+	}
+	labels := []string{c.DeviceID, c.Metric.Topic}
+	for _, k := range c.Metric.LabelsKeys {
+		labels = append(labels, c.Metric.Labels[k])
+	}
+	return labels
+}
+
+// activeSeriesCollector reports the number of unexpired series in the cache of a MemoryCachedCollector.
+type activeSeriesCollector struct {
+	cache *gocache.Cache
+	// A timeout which is not positive disables the expiry
+	timeout time.Duration
+}
+
+func (c *MemoryCachedCollector) ActiveSeriesCollector() prometheus.Collector {
+	return &activeSeriesCollector{cache: c.cache, timeout: c.timeout}
+}
+
+func (c *activeSeriesCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- activeSeriesDesc
+}
+
+func (c *activeSeriesCollector) Collect(ch chan<- prometheus.Metric) {
+	// Items skips expired series, even if they were not deleted yet. The age is checked against the clock of the
+	// package as well, the cache itself expires by the wall clock.
+	var active int
+	for _, v := range c.cache.Items() {
+		if c.timeout <= 0 || now().Sub(v.Object.(CacheItem).observed) < c.timeout {
+			active++
+		}
 	}
+	ch <- prometheus.MustNewConstMetric(activeSeriesDesc, prometheus.GaugeValue, float64(active))
 }
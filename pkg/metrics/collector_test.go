@@ -0,0 +1,627 @@
+package metrics
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hikhvar/mqtt2prometheus/pkg/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"go.uber.org/zap"
+)
+
+func TestMemoryCachedCollector_stalenessMarkers(t *testing.T) {
+	timeout := 20 * time.Millisecond
+	desc := prometheus.NewDesc("temperature", "", []string{"sensor", "topic"}, nil)
+
+	tests := []struct {
+		name        string
+		opts        []CollectorOption
+		wantMarkers int
+	}{
+		{
+			name:        "enabled",
+			opts:        []CollectorOption{WithStalenessMarkers()},
+			wantMarkers: 1,
+		},
+		{
+			name:        "disabled",
+			wantMarkers: 0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewCollector(timeout, nil, zap.NewNop(), tt.opts...)
+			c.Observe("dht22", MetricCollection{{
+				Description: desc,
+				Value:       21,
+				ValueType:   prometheus.GaugeValue,
+				Topic:       "livingroom/dht22",
+			}})
+
+			reg := prometheus.NewPedanticRegistry()
+			reg.MustRegister(c)
+			gather := func() []float64 {
+				families, err := reg.Gather()
+				if err != nil {
+					t.Fatal(err)
+				}
+				var values []float64
+				for _, mf := range families {
+					for _, m := range mf.GetMetric() {
+						values = append(values, m.GetGauge().GetValue())
+					}
+				}
+				return values
+			}
+
+			if got := gather(); len(got) != 1 || got[0] != 21 {
+				t.Fatalf("before timeout got %v, want [21]", got)
+			}
+			time.Sleep(2 * timeout)
+
+			got := gather()
+			if len(got) != tt.wantMarkers {
+				t.Fatalf("after timeout got %v, want %d staleness markers", got, tt.wantMarkers)
+			}
+			for _, v := range got {
+				if math.Float64bits(v) != math.Float64bits(staleNaN) {
+					t.Errorf("got value %v, want staleness marker", v)
+				}
+			}
+			// Each marker is emitted once only.
+			if got := gather(); len(got) != 0 {
+				t.Errorf("second collection after timeout got %v, want nothing", got)
+			}
+		})
+	}
+}
+
+func TestMemoryCachedCollector_stalenessMarkersExposition(t *testing.T) {
+	timeout := 20 * time.Millisecond
+	desc := prometheus.NewDesc("temperature", "", []string{"sensor", "topic"}, nil)
+	c := NewCollector(timeout, nil, zap.NewNop(), WithStalenessMarkers())
+	c.Observe("dht22", MetricCollection{{
+		Description: desc,
+		Value:       21,
+		ValueType:   prometheus.GaugeValue,
+		Topic:       "livingroom/dht22",
+	}})
+	time.Sleep(2 * timeout)
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(c)
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// scrape encodes the families as the exporter does and decodes them as Prometheus does.
+	scrape := func(format expfmt.Format) float64 {
+		t.Helper()
+		var b bytes.Buffer
+		enc := expfmt.NewEncoder(&b, format)
+		for _, mf := range families {
+			if err := enc.Encode(mf); err != nil {
+				t.Fatal(err)
+			}
+		}
+		dec := expfmt.NewDecoder(&b, format)
+		var mf dto.MetricFamily
+		if err := dec.Decode(&mf); err != nil {
+			t.Fatal(err)
+		}
+		if len(mf.GetMetric()) != 1 {
+			t.Fatalf("%s: got %v, want one sample", format, mf.GetMetric())
+		}
+		return mf.GetMetric()[0].GetGauge().GetValue()
+	}
+
+	if got := scrape(expfmt.FmtProtoDelim); math.Float64bits(got) != math.Float64bits(staleNaN) {
+		t.Errorf("protobuf exposition got %v (%#x), want staleness marker", got, math.Float64bits(got))
+	}
+	// The text format writes NaN, the marker arrives as an ordinary NaN sample.
+	if got := scrape(expfmt.FmtText); !math.IsNaN(got) || math.Float64bits(got) == math.Float64bits(staleNaN) {
+		t.Errorf("text exposition got %v (%#x), want an ordinary NaN", got, math.Float64bits(got))
+	}
+}
+
+func TestMemoryCachedCollector_stalenessMarkersReobserved(t *testing.T) {
+	timeout := 20 * time.Millisecond
+	desc := prometheus.NewDesc("temperature", "", []string{"sensor", "topic"}, nil)
+	rawDesc := prometheus.NewDesc("temperature_raw", "", []string{"sensor", "topic"}, nil)
+	observe := func(c Collector, value float64) {
+		c.Observe("dht22", MetricCollection{{
+			Description: desc,
+			Value:       value,
+			ValueType:   prometheus.GaugeValue,
+			Companions:  []Companion{{Description: rawDesc, Value: constValue(value), Timestamped: true}},
+			Topic:       "livingroom/dht22",
+		}})
+	}
+	c := NewCollector(timeout, nil, zap.NewNop(), WithStalenessMarkers())
+	observe(c, 21)
+	time.Sleep(2 * timeout)
+	// The janitor evicts the series before the next scrape.
+	c.(*MemoryCachedCollector).cache.DeleteExpired()
+	observe(c, 22)
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(c)
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var values []float64
+	for _, mf := range families {
+		for _, m := range mf.GetMetric() {
+			values = append(values, m.GetGauge().GetValue())
+		}
+	}
+	if len(values) != 2 || values[0] != 22 || values[1] != 22 {
+		t.Errorf("got %v, want the new value of the series and its companion without markers", values)
+	}
+}
+
+func TestMemoryCachedCollector_activeSeries(t *testing.T) {
+	now = testNow
+	defer func() { testNowElapsed = 0 }()
+	timeout := time.Hour
+	c := NewCollector(timeout, nil, zap.NewNop())
+	active := c.ActiveSeriesCollector()
+	observe := func(deviceID, name string) {
+		c.Observe(deviceID, MetricCollection{{
+			Description: prometheus.NewDesc(name, "", []string{"sensor", "topic"}, nil),
+			Value:       21,
+			ValueType:   prometheus.GaugeValue,
+			Topic:       deviceID + "/" + name,
+		}})
+	}
+
+	if got := testutil.ToFloat64(active); got != 0 {
+		t.Errorf("initially got %v active series, want 0", got)
+	}
+	observe("dht22", "temperature")
+	observe("dht22", "humidity")
+	observe("bme280", "temperature")
+	// Updating a series does not add a new one.
+	observe("dht22", "temperature")
+	if got := testutil.ToFloat64(active); got != 3 {
+		t.Errorf("got %v active series, want 3", got)
+	}
+
+	testNowElapsed = timeout * 6 / 10
+	observe("bme280", "temperature")
+	testNowElapsed = timeout * 12 / 10
+	if got := testutil.ToFloat64(active); got != 1 {
+		t.Errorf("after the timeout got %v active series, want 1", got)
+	}
+}
+
+func TestMemoryCachedCollector_emitAge(t *testing.T) {
+	now = testNow
+	defer func() { testNowElapsed = 0 }()
+	cfg := config.MetricConfig{
+		PrometheusName: "temperature",
+		ValueType:      "gauge",
+		OmitTimestamp:  true,
+		EmitAge:        true,
+	}
+	p := NewParser(nil, ".", "", WithStateStore(NewMemoryStateStore()))
+	m, err := p.parseMetric(&cfg, "temperature", 21.0, nil)
+	if err != nil {
+		t.Fatalf("parseMetric() error = %v", err)
+	}
+	m.Topic = "livingroom/dht22"
+
+	c := NewCollector(time.Hour, []config.BlockConfig{{Metrics: []config.MetricConfig{cfg}}}, zap.NewNop())
+	c.Observe("dht22", MetricCollection{m})
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(c)
+	age := func() float64 {
+		families, err := reg.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, mf := range families {
+			if mf.GetName() == "temperature_age_seconds" {
+				return mf.GetMetric()[0].GetGauge().GetValue()
+			}
+		}
+		t.Fatalf("no temperature_age_seconds in %v", families)
+		return 0
+	}
+
+	if got := age(); got != 0 {
+		t.Errorf("age right after the sample = %v, want 0", got)
+	}
+	testNowElapsed = 90 * time.Second
+	if got := age(); got != 90 {
+		t.Errorf("age after 90s = %v, want 90", got)
+	}
+}
+
+func TestMemoryCachedCollector_emitRaw(t *testing.T) {
+	now = testNow
+	cfg := config.MetricConfig{
+		PrometheusName: "temperature",
+		ValueType:      "gauge",
+		OmitTimestamp:  true,
+		Expression:     "value / 10",
+		MQTTValueScale: 2,
+		EmitRaw:        true,
+	}
+	p := NewParser(nil, ".", "", WithStateStore(NewMemoryStateStore()))
+	m, err := p.parseMetric(&cfg, "temperature", "215", nil)
+	if err != nil {
+		t.Fatalf("parseMetric() error = %v", err)
+	}
+	m.Topic = "livingroom/dht22"
+
+	c := NewCollector(time.Hour, []config.BlockConfig{{Metrics: []config.MetricConfig{cfg}}}, zap.NewNop())
+	c.Observe("dht22", MetricCollection{m})
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(c)
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]float64{}
+	for _, mf := range families {
+		got[mf.GetName()] = mf.GetMetric()[0].GetGauge().GetValue()
+	}
+	want := map[string]float64{"temperature": 43, "temperature_raw": 215}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestMemoryCachedCollector_emitRate(t *testing.T) {
+	now = testNow
+	defer func() { testNowElapsed = 0 }()
+	cfg := config.MetricConfig{
+		PrometheusName: "energy_total",
+		ValueType:      "counter",
+		OmitTimestamp:  true,
+		EmitRate:       true,
+	}
+	p := NewParser(nil, ".", "", WithStateStore(NewMemoryStateStore()))
+	c := NewCollector(time.Hour, []config.BlockConfig{{Metrics: []config.MetricConfig{cfg}}}, zap.NewNop())
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(c)
+
+	scrapes := []struct {
+		elapsed  time.Duration
+		value    string
+		wantRate *float64
+	}{
+		// There is no previous sample to compute the rate from.
+		{elapsed: 0, value: "100"},
+		{elapsed: time.Minute, value: "160", wantRate: floatP(1)},
+		{elapsed: 90 * time.Second, value: "175", wantRate: floatP(0.5)},
+		// The counter was reset, the value is the increase.
+		{elapsed: 2 * time.Minute, value: "60", wantRate: floatP(2)},
+	}
+	for _, s := range scrapes {
+		testNowElapsed = s.elapsed
+		m, err := p.parseMetric(&cfg, "energy", s.value, nil)
+		if err != nil {
+			t.Fatalf("parseMetric() error = %v", err)
+		}
+		c.Observe("meter", MetricCollection{m})
+		// The rate refers to the previous sample, further scrapes in between do not change it.
+		for scrape := 0; scrape < 3; scrape++ {
+			testNowElapsed = s.elapsed + time.Duration(scrape)*10*time.Second
+			families, err := reg.Gather()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var gotRate *float64
+			for _, mf := range families {
+				if mf.GetName() == "energy_total_rate" {
+					gotRate = floatP(mf.GetMetric()[0].GetGauge().GetValue())
+				}
+			}
+			switch {
+			case s.wantRate == nil && gotRate != nil:
+				t.Errorf("scrape %d after %s: got rate %v, want none", scrape, s.elapsed, *gotRate)
+			case s.wantRate != nil && (gotRate == nil || *gotRate != *s.wantRate):
+				t.Errorf("scrape %d after %s: got rate %v, want %v", scrape, s.elapsed, gotRate, *s.wantRate)
+			}
+		}
+	}
+}
+
+func TestMemoryCachedCollector_emitDelta(t *testing.T) {
+	now = testNow
+	defer func() { testNowElapsed = 0 }()
+	// One source counter exported as total, delta and rate.
+	cfg := config.MetricConfig{
+		PrometheusName:  "energy_total",
+		ValueType:       "counter",
+		OmitTimestamp:   true,
+		ForceMonotonicy: true,
+		EmitDelta:       true,
+		EmitRate:        true,
+	}
+	p := NewParser(nil, ".", "", WithStateStore(NewMemoryStateStore()))
+	c := NewCollector(time.Hour, []config.BlockConfig{{Metrics: []config.MetricConfig{cfg}}}, zap.NewNop())
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(c)
+
+	scrapes := []struct {
+		elapsed   time.Duration
+		value     string
+		wantTotal float64
+		wantDelta float64
+		wantRate  *float64
+	}{
+		{elapsed: 0, value: "100", wantTotal: 100, wantDelta: 0},
+		{elapsed: time.Minute, value: "160", wantTotal: 160, wantDelta: 60, wantRate: floatP(1)},
+		{elapsed: 90 * time.Second, value: "175", wantTotal: 175, wantDelta: 15, wantRate: floatP(0.5)},
+		// The source was reset, force_monotonicy keeps the total increasing.
+		{elapsed: 2 * time.Minute, value: "60", wantTotal: 235, wantDelta: 60, wantRate: floatP(2)},
+	}
+	for _, s := range scrapes {
+		testNowElapsed = s.elapsed
+		m, err := p.parseMetric(&cfg, "energy", s.value, nil)
+		if err != nil {
+			t.Fatalf("parseMetric() error = %v", err)
+		}
+		c.Observe("meter", MetricCollection{m})
+		families, err := reg.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var gotTotal, gotDelta, gotRate *float64
+		for _, mf := range families {
+			switch mf.GetName() {
+			case "energy_total":
+				gotTotal = floatP(mf.GetMetric()[0].GetCounter().GetValue())
+			case "energy_total_delta":
+				gotDelta = floatP(mf.GetMetric()[0].GetGauge().GetValue())
+			case "energy_total_rate":
+				gotRate = floatP(mf.GetMetric()[0].GetGauge().GetValue())
+			}
+		}
+		if gotTotal == nil || *gotTotal != s.wantTotal {
+			t.Errorf("scrape after %s: got total %v, want %v", s.elapsed, gotTotal, s.wantTotal)
+		}
+		if gotDelta == nil || *gotDelta != s.wantDelta {
+			t.Errorf("scrape after %s: got delta %v, want %v", s.elapsed, gotDelta, s.wantDelta)
+		}
+		switch {
+		case s.wantRate == nil && gotRate != nil:
+			t.Errorf("scrape after %s: got rate %v, want none", s.elapsed, *gotRate)
+		case s.wantRate != nil && (gotRate == nil || *gotRate != *s.wantRate):
+			t.Errorf("scrape after %s: got rate %v, want %v", s.elapsed, gotRate, *s.wantRate)
+		}
+	}
+}
+
+func TestMemoryCachedCollector_maxValueAge(t *testing.T) {
+	now = testNow
+	defer func() { testNowElapsed = 0 }()
+	tests := []struct {
+		name       string
+		errorValue *float64
+		elapsed    time.Duration
+		want       *float64
+	}{
+		{name: "fresh", errorValue: floatP(-1), elapsed: 5 * time.Minute, want: floatP(21.5)},
+		{name: "stale with error_value", errorValue: floatP(-1), elapsed: 6 * time.Minute, want: floatP(-1)},
+		{name: "stale without error_value", elapsed: 6 * time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testNowElapsed = 0
+			cfg := config.MetricConfig{
+				PrometheusName: "temperature",
+				ValueType:      "gauge",
+				ErrorValue:     tt.errorValue,
+				EmitRaw:        true,
+				MaxValueAge:    5 * time.Minute,
+			}
+			p := NewParser(nil, ".", "", WithStateStore(NewMemoryStateStore()))
+			m, err := p.parseMetric(&cfg, "temperature", "21.5", nil)
+			if err != nil {
+				t.Fatalf("parseMetric() error = %v", err)
+			}
+			c := NewCollector(time.Hour, []config.BlockConfig{{Metrics: []config.MetricConfig{cfg}}}, zap.NewNop())
+			c.Observe("dht22", MetricCollection{m})
+
+			testNowElapsed = tt.elapsed
+			reg := prometheus.NewPedanticRegistry()
+			reg.MustRegister(c)
+			families, err := reg.Gather()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := map[string]float64{}
+			var gotTimestamp bool
+			for _, mf := range families {
+				got[mf.GetName()] = mf.GetMetric()[0].GetGauge().GetValue()
+				gotTimestamp = gotTimestamp || mf.GetMetric()[0].TimestampMs != nil
+			}
+			want := map[string]float64{}
+			if tt.want != nil {
+				want["temperature"] = *tt.want
+			}
+			if tt.elapsed <= cfg.MaxValueAge {
+				want["temperature_raw"] = 21.5
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+			if stale := tt.elapsed > cfg.MaxValueAge; stale && gotTimestamp {
+				t.Error("the stale value was exposed with the timestamp of the sample")
+			}
+		})
+	}
+}
+
+func TestMemoryCachedCollector_maxTimestampAge(t *testing.T) {
+	now = testNow
+	ancient := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+	recent := testNow().Add(-time.Minute)
+	maxAge := time.Hour
+
+	tests := []struct {
+		name       string
+		action     string
+		ingestTime time.Time
+		wantTS     time.Time
+		wantDrop   bool
+	}{
+		{name: "recent", action: config.TimestampAgeDrop, ingestTime: recent, wantTS: recent},
+		{name: "ancient default", ingestTime: ancient},
+		{name: "ancient omit", action: config.TimestampAgeOmit, ingestTime: ancient},
+		{name: "ancient clamp", action: config.TimestampAgeClamp, ingestTime: ancient, wantTS: testNow().Add(-maxAge)},
+		{name: "ancient drop", action: config.TimestampAgeDrop, ingestTime: ancient, wantDrop: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.MetricConfig{
+				PrometheusName:     "temperature",
+				ValueType:          "gauge",
+				EmitRaw:            true,
+				MaxTimestampAge:    maxAge,
+				TimestampAgeAction: tt.action,
+			}
+			c := NewCollector(time.Hour, []config.BlockConfig{{Metrics: []config.MetricConfig{cfg}}}, zap.NewNop())
+			c.Observe("dht22", MetricCollection{{
+				Description:        cfg.PrometheusDescription(),
+				Value:              21.5,
+				ValueType:          prometheus.GaugeValue,
+				IngestTime:         tt.ingestTime,
+				Topic:              "livingroom/dht22",
+				Companions:         []Companion{{Description: cfg.RawDescriptionFor("temperature"), Value: constValue(215), Timestamped: true}},
+				MaxTimestampAge:    cfg.MaxTimestampAge,
+				TimestampAgeAction: cfg.TimestampAgeAction,
+			}})
+			reg := prometheus.NewPedanticRegistry()
+			reg.MustRegister(c)
+			families, err := reg.Gather()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantDrop {
+				if len(families) != 0 {
+					t.Errorf("got %d metric families, want the sample dropped", len(families))
+				}
+				return
+			}
+			if len(families) != 2 {
+				t.Fatalf("got %d metric families, want temperature and temperature_raw", len(families))
+			}
+			var wantMs int64
+			if !tt.wantTS.IsZero() {
+				wantMs = tt.wantTS.UnixNano() / int64(time.Millisecond)
+			}
+			for _, mf := range families {
+				if got := mf.GetMetric()[0].GetTimestampMs(); got != wantMs {
+					t.Errorf("%s timestamp = %d, want %d", mf.GetName(), got, wantMs)
+				}
+			}
+		})
+	}
+}
+
+func TestMemoryCachedCollector_labelOrder(t *testing.T) {
+	now = testNow
+	cfg := config.MetricConfig{
+		PrometheusName: "temperature",
+		ValueType:      "gauge",
+		OmitTimestamp:  true,
+		FieldLabels:    map[string]string{"model": "model", "room": "room"},
+		LabelOrder:     []string{"room", "topic", "model"},
+		EmitRaw:        true,
+	}
+	wantOrder := []string{"room", "topic", "model", "sensor"}
+	if got := cfg.LabelNames(); !reflect.DeepEqual(got, wantOrder) {
+		t.Fatalf("LabelNames() = %v, want %v", got, wantOrder)
+	}
+
+	p := NewParser(nil, ".", "", WithStateStore(NewMemoryStateStore()))
+	m, err := p.parseMetric(&cfg, "temperature", 21.5, map[string]interface{}{"model": "dht22", "room": "kitchen"})
+	if err != nil {
+		t.Fatalf("parseMetric() error = %v", err)
+	}
+	m.Topic = "home/kitchen"
+	item := CacheItem{DeviceID: "sensor1", Metric: m}
+	if got, want := item.labelValues(), []string{"kitchen", "home/kitchen", "dht22", "sensor1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("labelValues() = %v, want %v", got, want)
+	}
+
+	c := NewCollector(time.Hour, []config.BlockConfig{{Metrics: []config.MetricConfig{cfg}}}, zap.NewNop())
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(c)
+	c.Observe("sensor1", MetricCollection{m})
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(families) != 2 {
+		t.Fatalf("Gather() got %d families, want the metric and its raw value", len(families))
+	}
+	want := map[string]string{"sensor": "sensor1", "topic": "home/kitchen", "model": "dht22", "room": "kitchen"}
+	for _, mf := range families {
+		got := map[string]string{}
+		for _, lp := range mf.GetMetric()[0].GetLabel() {
+			got[lp.GetName()] = lp.GetValue()
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got labels %v, want %v", mf.GetName(), got, want)
+		}
+	}
+}
+
+func TestMemoryCachedCollector_seriesByLabels(t *testing.T) {
+	now = testNow
+	metrics := []config.BlockConfig{{
+		Metrics: []config.MetricConfig{{
+			PrometheusName:   "temperature",
+			MQTTName:         "temperature",
+			ValueType:        "gauge",
+			OmitTimestamp:    true,
+			TopicPathFilter:  config.MustNewRegexp(`^site/(?P<site>[^/]+)/room/(?P<room>[^/]+)/temp$`),
+			TopicGroupLabels: true,
+		}},
+	}}
+	p := NewParser(metrics, ".", "", WithStateStore(NewMemoryStateStore()))
+	c := NewCollector(time.Hour, metrics, zap.NewNop())
+	// The default device_id_regex takes the last topic level, both rooms have the device id temp.
+	ingest := NewIngest(c, NewJSONObjectExtractor(p, nil), config.MQTTConfigDefaults.DeviceIDRegex)
+	for _, m := range []struct{ topic, payload string }{
+		{topic: "site/berlin/room/kitchen/temp", payload: `{"temperature": 21}`},
+		{topic: "site/berlin/room/office/temp", payload: `{"temperature": 19}`},
+	} {
+		if err := ingest.store(m.topic, []byte(m.payload), MessageInfo{}); err != nil {
+			t.Fatalf("store() error = %v", err)
+		}
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(c)
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]float64{}
+	for _, mf := range families {
+		for _, m := range mf.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "room" {
+					got[l.GetValue()] = m.GetGauge().GetValue()
+				}
+			}
+		}
+	}
+	if want := map[string]float64{"kitchen": 21, "office": 19}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got temperatures by room %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,96 @@
+package metrics
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/hikhvar/mqtt2prometheus/pkg/config"
+	"go.uber.org/zap"
+)
+
+// NewCSVObjectExtractor decodes CSV payloads and hands each row as JSON object to the JSON object extractor. The
+// fields of the object are named by csv_columns or the header row. Empty values are left out. Malformed rows and rows
+// with another number of columns than named are skipped.
+func NewCSVObjectExtractor(p Parser, metricNameRegex *config.Regexp, cfg *config.ObjectPerTopicConfig) Extractor {
+	extract := NewJSONObjectExtractor(p, metricNameRegex)
+	return func(topic string, payload []byte, deviceID string, info MessageInfo) (MetricCollection, error) {
+		rows, err := decodeCSV(payload, cfg, p.logger)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode csv payload: %w", err)
+		}
+		var mc MetricCollection
+		for _, row := range rows {
+			obj, err := json.Marshal(row)
+			if err != nil {
+				return nil, fmt.Errorf("failed to convert csv payload: %w", err)
+			}
+			metrics, err := extract(topic, obj, deviceID, info)
+			if err != nil {
+				return nil, err
+			}
+			mc = append(mc, metrics...)
+		}
+		return mc, nil
+	}
+}
+
+// decodeCSV returns the valid rows of the payload as objects of the named columns.
+func decodeCSV(payload []byte, cfg *config.ObjectPerTopicConfig, logger *zap.Logger) ([]map[string]interface{}, error) {
+	r := csv.NewReader(bytes.NewReader(payload))
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	if cfg.CSVDelimiter != "" {
+		r.Comma, _ = utf8.DecodeRuneInString(cfg.CSVDelimiter)
+	}
+	columns := cfg.CSVColumns
+	header := cfg.CSVHeader
+	var rows []map[string]interface{}
+	for line := 1; ; line++ {
+		record, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			logger.Debug("Skipped malformed csv row", zap.Int("line", line), zap.Error(err))
+			continue
+		}
+		if header {
+			header = false
+			columns = csvHeaderColumns(cfg.CSVColumns, record)
+			continue
+		}
+		if len(record) != len(columns) {
+			logger.Debug("Skipped csv row with unexpected number of columns", zap.Int("line", line), zap.Int("columns", len(record)))
+			continue
+		}
+		row := make(map[string]interface{}, len(columns))
+		for i, name := range columns {
+			if value := strings.TrimSpace(record[i]); name != "" && value != "" {
+				row[name] = value
+			}
+		}
+		rows = append(rows, row)
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("no valid row found")
+	}
+	return rows, nil
+}
+
+// csvHeaderColumns names the columns by the header row, unless a name is configured for the column.
+func csvHeaderColumns(configured, header []string) []string {
+	columns := make([]string, len(header))
+	for i, name := range header {
+		columns[i] = strings.TrimSpace(name)
+		if i < len(configured) && configured[i] != "" {
+			columns[i] = configured[i]
+		}
+	}
+	return columns
+}
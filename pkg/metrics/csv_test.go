@@ -0,0 +1,84 @@
+package metrics
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hikhvar/mqtt2prometheus/pkg/config"
+	"go.uber.org/zap"
+)
+
+func TestDecodeCSV(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     config.ObjectPerTopicConfig
+		payload string
+		want    []map[string]interface{}
+		wantErr bool
+	}{
+		{
+			name:    "columns by index",
+			cfg:     config.ObjectPerTopicConfig{CSVColumns: []string{"temperature", "", "pressure"}},
+			payload: "23.5, 45.2, 1013\n",
+			want:    []map[string]interface{}{{"temperature": "23.5", "pressure": "1013"}},
+		},
+		{
+			name:    "header",
+			cfg:     config.ObjectPerTopicConfig{CSVHeader: true, CSVColumns: []string{"", "humidity"}, CSVDelimiter: ";"},
+			payload: "temp;hum;pressure\n23,5;45;\n",
+			want:    []map[string]interface{}{{"temp": "23,5", "humidity": "45"}},
+		},
+		{
+			name:    "malformed rows are skipped",
+			cfg:     config.ObjectPerTopicConfig{CSVColumns: []string{"temperature", "humidity"}},
+			payload: "23.5,45.2\n23.6\n\"23.7,45.3\n",
+			want:    []map[string]interface{}{{"temperature": "23.5", "humidity": "45.2"}},
+		},
+		{
+			name:    "no valid row",
+			cfg:     config.ObjectPerTopicConfig{CSVColumns: []string{"temperature", "humidity"}},
+			payload: "23.5\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeCSV([]byte(tt.payload), &tt.cfg, zap.NewNop())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("decodeCSV() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("decodeCSV() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewCSVObjectExtractor(t *testing.T) {
+	now = testNow
+	p := NewParser([]config.BlockConfig{{
+		Metrics: []config.MetricConfig{
+			{PrometheusName: "temperature", MQTTName: "temperature", ValueType: "gauge", OmitTimestamp: true},
+			{PrometheusName: "humidity", MQTTName: "humidity", ValueType: "gauge", OmitTimestamp: true},
+			{PrometheusName: "pressure", MQTTName: "pressure", ValueType: "gauge", OmitTimestamp: true},
+		},
+	}}, ".", "", WithStateStore(NewMemoryStateStore()))
+	cfg := &config.ObjectPerTopicConfig{Encoding: config.EncodingCSV, CSVColumns: []string{"temperature", "humidity", "pressure"}}
+
+	got, err := NewCSVObjectExtractor(p, nil, cfg)("weather/station", []byte("23.5,45.2,1013"), "station", MessageInfo{})
+	if err != nil {
+		t.Fatalf("extractor() error = %v", err)
+	}
+	values := map[string]float64{}
+	for _, m := range got {
+		values[m.Description.String()] = m.Value
+	}
+	want := map[string]float64{
+		p.metricConfigs["temperature"][0].PrometheusDescription().String(): 23.5,
+		p.metricConfigs["humidity"][0].PrometheusDescription().String():    45.2,
+		p.metricConfigs["pressure"][0].PrometheusDescription().String():    1013,
+	}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("extractor() got = %v, want %v", values, want)
+	}
+}
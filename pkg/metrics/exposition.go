@@ -0,0 +1,45 @@
+package metrics
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hikhvar/mqtt2prometheus/pkg/config"
+	gocache "github.com/patrickmn/go-cache"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+	"go.uber.org/zap"
+)
+
+// RenderOpenMetrics runs the extractor on a single payload received on the given topic and returns the resulting
+// metrics in the OpenMetrics text format, as they would be exposed on the metrics endpoint. This allows to check a
+// configuration against sample payloads without a broker.
+func RenderOpenMetrics(metrics []config.BlockConfig, extractor Extractor, topic, deviceID string, payload []byte) (string, error) {
+	mc, err := extractor(topic, payload, deviceID, MessageInfo{})
+	if err != nil {
+		return "", fmt.Errorf("failed to extract metric values from topic: %w", err)
+	}
+	collector := NewCollector(gocache.NoExpiration, metrics, zap.NewNop())
+	collector.Observe(deviceID, mc)
+
+	reg := prometheus.NewRegistry()
+	if err := reg.Register(collector); err != nil {
+		return "", err
+	}
+	families, err := reg.Gather()
+	if err != nil {
+		return "", fmt.Errorf("failed to gather metrics: %w", err)
+	}
+
+	var b strings.Builder
+	enc := expfmt.NewEncoder(&b, expfmt.FmtOpenMetrics)
+	for _, mf := range families {
+		if err := enc.Encode(mf); err != nil {
+			return "", fmt.Errorf("failed to encode metric family %q: %w", mf.GetName(), err)
+		}
+	}
+	if _, err := expfmt.FinalizeOpenMetrics(&b); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,64 @@
+package metrics
+
+import (
+	"os"
+	"testing"
+
+	"github.com/hikhvar/mqtt2prometheus/pkg/config"
+)
+
+func TestRenderOpenMetrics(t *testing.T) {
+	stateDir, err := os.MkdirTemp("", "exposition_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(stateDir)
+	now = testNow
+
+	metrics := []config.BlockConfig{{
+		Metrics: []config.MetricConfig{
+			{
+				PrometheusName: "temperature",
+				MQTTName:       "temperature",
+				Help:           "DHT22 temperature reading",
+				ValueType:      "gauge",
+				ConstantLabels: map[string]string{"sensor_type": "dht22"},
+			},
+			{
+				PrometheusName: "heat_index",
+				MQTTName:       "computed.heat_index",
+				ValueType:      "gauge",
+				OmitTimestamp:  true,
+			},
+			{
+				PrometheusName: "uptime_seconds_total",
+				MQTTName:       "uptime",
+				ValueType:      "counter",
+				OmitTimestamp:  true,
+			},
+		},
+	}}
+	p := NewParser(metrics, ".", stateDir)
+	extractor := NewJSONObjectExtractor(p, nil)
+
+	payload := `{"temperature":23.20,"humidity":51.60,"uptime":3600,"computed":{"heat_index":22.92}}`
+	got, err := RenderOpenMetrics(metrics, extractor, "devices/home/livingroom", "livingroom", []byte(payload))
+	if err != nil {
+		t.Fatalf("RenderOpenMetrics() error = %v", err)
+	}
+
+	want := `# HELP heat_index 
+# TYPE heat_index gauge
+heat_index{sensor="livingroom",topic="devices/home/livingroom"} 22.92
+# HELP temperature DHT22 temperature reading
+# TYPE temperature gauge
+temperature{sensor="livingroom",sensor_type="dht22",topic="devices/home/livingroom"} 23.2 1.604268521e+09
+# HELP uptime_seconds 
+# TYPE uptime_seconds counter
+uptime_seconds_total{sensor="livingroom",topic="devices/home/livingroom"} 3600.0
+# EOF
+`
+	if got != want {
+		t.Errorf("RenderOpenMetrics() got =\n%s\nwant\n%s", got, want)
+	}
+}
@@ -1,37 +1,159 @@
 package metrics
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"regexp"
+	"strings"
 
 	"github.com/hikhvar/mqtt2prometheus/pkg/config"
 	gojsonq "github.com/thedevsaddam/gojsonq/v2"
+	"go.uber.org/zap"
 )
 
-type Extractor func(topic string, payload []byte, deviceID string) (MetricCollection, error)
+// MessageInfo holds the metadata of the MQTT message a payload was received with.
+type MessageInfo struct {
+	// Retained is set for messages replayed by the broker on subscribe.
+	Retained bool
+}
+
+type Extractor func(topic string, payload []byte, deviceID string, info MessageInfo) (MetricCollection, error)
 
 // metricID returns a deterministic identifier per metic config which is safe to use in a file path.
 func metricID(topic, metric, deviceID, promName string) string {
-	re := regexp.MustCompile(`[^a-zA-Z0-9]`)
-	deviceID = re.ReplaceAllString(deviceID, "_")
-	topic = re.ReplaceAllString(topic, "_")
-	metric = re.ReplaceAllString(metric, "_")
-	promName = re.ReplaceAllString(promName, "_")
+	deviceID = safeMetricIDPart(deviceID)
+	topic = safeMetricIDPart(topic)
+	metric = safeMetricIDPart(metric)
+	promName = safeMetricIDPart(promName)
 	return fmt.Sprintf("%s-%s-%s-%s", deviceID, topic, metric, promName)
 }
 
+// safeMetricIDPart replaces all characters except ASCII letters and digits by an underscore. This runs for every
+// sample, so it avoids the overhead of a regular expression.
+func safeMetricIDPart(s string) string {
+	return strings.Map(func(r rune) rune {
+		if ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') || ('0' <= r && r <= '9') {
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+// unsafeStateKeyChars matches all characters which must not be part of a rendered state key.
+var unsafeStateKeyChars = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+// stateKey returns the identifier of the state of the given metric config. By default, this is the metricID.
+// A configured state_key template allows to share state between topics or to separate it deliberately.
+// Derived metrics share their state between both sources, so topic and metric name are not part of their key.
+func stateKey(cfg *config.MetricConfig, topic, metric, deviceID string) (string, error) {
+	if cfg.Derive != nil {
+		topic, metric = "", ""
+	}
+	if cfg.StateKey == nil {
+		return metricID(topic, metric, deviceID, cfg.PrometheusName), nil
+	}
+	key, err := cfg.StateKey.Execute(config.StateKeyFields{
+		DeviceID:       deviceID,
+		Topic:          topic,
+		MetricName:     metric,
+		PrometheusName: cfg.PrometheusName,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to render state key for metric %q: %w", cfg.PrometheusName, err)
+	}
+	return unsafeStateKeyChars.ReplaceAllString(key, "_"), nil
+}
+
+// setNameLabel adds the matched metric name as label, if the config asks for it.
+func setNameLabel(m *Metric, cfg *config.MetricConfig, name string) {
+	if cfg.MQTTNameLabel == "" {
+		return
+	}
+	if m.Labels == nil {
+		m.Labels = make(map[string]string, 1)
+	}
+	m.Labels[cfg.MQTTNameLabel] = name
+}
+
+// setTopicLabels adds the topic_labels of all entries matching the topic and the named groups of the
+// topic_path_filter.
+func setTopicLabels(m *Metric, cfg *config.MetricConfig, topic string) {
+	for _, name := range cfg.TopicGroupNames() {
+		if m.Labels == nil {
+			m.Labels = make(map[string]string)
+		}
+		m.Labels[name] = cfg.TopicPathFilter.GroupValue(topic, name)
+	}
+	for _, tl := range cfg.TopicLabels {
+		if !tl.Topic.Match(topic) {
+			continue
+		}
+		if m.Labels == nil {
+			m.Labels = make(map[string]string, len(tl.Labels))
+		}
+		for k, v := range tl.Labels {
+			m.Labels[k] = v
+		}
+	}
+}
+
+// completeSample sets the topic of a parsed metric and the labels derived from the topic and the metric name. Metrics
+// of configs with persist_last_value are remembered in the state of the metric, see Parser.LastValues.
+func (p *Parser) completeSample(m *Metric, cfg *config.MetricConfig, metricID, deviceID, topic, metric string) error {
+	// Derived metrics combine the values of several sources, so they are exposed as one series without the topic and
+	// metric name of the source which was updated last.
+	if cfg.Derive != nil {
+		topic, metric = "", ""
+	}
+	m.Topic = topic
+	setNameLabel(m, cfg, metric)
+	setTopicLabels(m, cfg, topic)
+	if cfg.PersistLastValue {
+		return p.persistLastValue(metricID, deviceID, *m)
+	}
+	return nil
+}
+
+// hasAbsentValue reports whether any of the configs sets an absent_value.
+func hasAbsentValue(cfgs []*config.MetricConfig) bool {
+	for _, cfg := range cfgs {
+		if cfg.AbsentValue != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// exactDecoder decodes JSON numbers as json.Number instead of float64, so large integers keep their precision.
+type exactDecoder struct{}
+
+func (exactDecoder) Decode(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+func newExactJSONQ(separator string, payload []byte) *gojsonq.JSONQ {
+	return gojsonq.New(gojsonq.SetSeparator(separator), gojsonq.WithDecoder(exactDecoder{})).FromString(string(payload))
+}
+
 func NewJSONObjectExtractor(p Parser, metricNameRegex *config.Regexp) Extractor {
-	return func(topic string, payload []byte, deviceID string) (MetricCollection, error) {
+	return func(topic string, payload []byte, deviceID string, info MessageInfo) (MetricCollection, error) {
 		var mc MetricCollection
 		parsed := gojsonq.New(gojsonq.SetSeparator(p.separator)).FromString(string(payload))
-		for path := range p.config() {
+		var exact *gojsonq.JSONQ
+		for _, path := range p.metricNames(parsed.Get()) {
+			parsed.Reset()
 			rawPayload := parsed.Get()
 			rawValue := parsed.Find(path)
 			parsed.Reset()
 
-			_, ok := rawPayload.(map[string]interface{})
+			_, object := rawPayload.(map[string]interface{})
+			lone := !object && metricNameRegex != nil
 			// Handle lone values too
-			if !ok && metricNameRegex != nil {
+			if lone {
 				rawValue = rawPayload
 				path = metricNameRegex.GroupValue(topic, config.MetricNameRegexGroup)
 				if path == "" {
@@ -39,23 +161,53 @@ func NewJSONObjectExtractor(p Parser, metricNameRegex *config.Regexp) Extractor
 				}
 			}
 
-			if rawValue == nil {
+			// Missing fields are skipped, unless a config asks for their absent_value. Payloads which are no JSON
+			// object, e.g. plain text or arrays, have no fields which could be missing.
+			absent := rawValue == nil
+			if absent && (!object || !hasAbsentValue(p.metricConfigs[path])) {
 				continue
 			}
 
 			// Find all valid metric configs
 			for _, config := range p.findMetricConfigs(path, deviceID) {
 
-				if !config.TopicPathFilter.Match(topic) {
+				if !config.TopicPathFilter.Match(topic) || !config.SubscribedTo(topic) || (config.IgnoreRetained && info.Retained) {
+					continue
+				}
+				if absent && config.AbsentValue == nil {
 					continue
 				}
 
-				id := metricID(topic, path, deviceID, config.PrometheusName)
-				m, err := p.parseMetric(config, id, rawValue)
+				id, err := stateKey(config, topic, path, deviceID)
+				if err != nil {
+					return nil, err
+				}
+				value := rawValue
+				if absent {
+					value = *config.AbsentValue
+				} else if config.IntegerValue {
+					// Decode the payload again, this time keeping numbers exact.
+					if exact == nil {
+						exact = newExactJSONQ(p.separator, payload)
+					}
+					if lone {
+						value = exact.Get()
+					} else {
+						value = exact.Find(path)
+					}
+					exact.Reset()
+				}
+				m, err := p.parseSample(config, id, topic, path, value, rawPayload)
+				if errors.Is(err, errSkipSample) {
+					p.logger.Debug("Skipped sample", zap.String("metricID", id), zap.String("topic", topic))
+					continue
+				}
 				if err != nil {
 					return nil, fmt.Errorf("failed to parse valid value from '%v' for metric %q: %w", rawValue, config.PrometheusName, err)
 				}
-				m.Topic = topic
+				if err := p.completeSample(&m, config, id, deviceID, topic, path); err != nil {
+					return nil, err
+				}
 				mc = append(mc, m)
 			}
 		}
@@ -64,7 +216,7 @@ func NewJSONObjectExtractor(p Parser, metricNameRegex *config.Regexp) Extractor
 }
 
 func NewMetricPerTopicExtractor(p Parser, metricNameRegex *config.Regexp) Extractor {
-	return func(topic string, payload []byte, deviceID string) (MetricCollection, error) {
+	return func(topic string, payload []byte, deviceID string, info MessageInfo) (MetricCollection, error) {
 		var mc MetricCollection
 		metricName := metricNameRegex.GroupValue(topic, config.MetricNameRegexGroup)
 		if metricName == "" {
@@ -73,24 +225,53 @@ func NewMetricPerTopicExtractor(p Parser, metricNameRegex *config.Regexp) Extrac
 
 		// Find all valid metric configs
 		for _, config := range p.findMetricConfigs(metricName, deviceID) {
-			var rawValue interface{}
-			if config.PayloadField != "" {
-				parsed := gojsonq.New(gojsonq.SetSeparator(p.separator)).FromString(string(payload))
+			if !config.SubscribedTo(topic) || (config.IgnoreRetained && info.Retained) {
+				continue
+			}
+			var rawValue, decoded interface{}
+			if config.FixedValue != nil {
+				// The payload is not decoded at all.
+				rawValue = *config.FixedValue
+			} else if config.TopicValueGroup != "" {
+				rawValue = metricNameRegex.GroupValue(topic, config.TopicValueGroup)
+			} else if config.PayloadField != "" {
+				var parsed *gojsonq.JSONQ
+				if config.IntegerValue {
+					parsed = newExactJSONQ(p.separator, payload)
+				} else {
+					parsed = gojsonq.New(gojsonq.SetSeparator(p.separator)).FromString(string(payload))
+				}
 				rawValue = parsed.Find(config.PayloadField)
 				parsed.Reset()
+				decoded = parsed.Get()
 				if rawValue == nil {
 					return nil, fmt.Errorf("failed to extract field %q from payload %q for metric %q", config.PayloadField, payload, metricName)
 				}
+			} else if config.ArrayCount {
+				// The payload is the array, anything else fails like a field which is no array.
+				if err := json.Unmarshal(payload, &rawValue); err != nil {
+					rawValue = string(payload)
+				}
+				decoded = rawValue
 			} else {
 				rawValue = string(payload)
 			}
 
-			id := metricID(topic, metricName, deviceID, config.PrometheusName)
-			m, err := p.parseMetric(config, id, rawValue)
+			id, err := stateKey(config, topic, metricName, deviceID)
+			if err != nil {
+				return nil, err
+			}
+			m, err := p.parseSample(config, id, topic, metricName, rawValue, decoded)
+			if errors.Is(err, errSkipSample) {
+				p.logger.Debug("Skipped sample", zap.String("metricID", id), zap.String("topic", topic))
+				continue
+			}
 			if err != nil {
 				return nil, fmt.Errorf("failed to parse valid value from '%v' for metric %q: %w", rawValue, config.PrometheusName, err)
 			}
-			m.Topic = topic
+			if err := p.completeSample(&m, config, id, deviceID, topic, metricName); err != nil {
+				return nil, err
+			}
 			mc = append(mc, m)
 		}
 		return mc, nil
@@ -1,7 +1,9 @@
 package metrics
 
 import (
+	"os"
 	"reflect"
+	"sort"
 	"testing"
 
 	"github.com/hikhvar/mqtt2prometheus/pkg/config"
@@ -9,6 +11,12 @@ import (
 )
 
 func TestNewJSONObjectExtractor_parseMetric(t *testing.T) {
+	stateDir, err := os.MkdirTemp("", "extractor_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(stateDir)
+
 	now = testNow
 	type fields struct {
 		metricConfigs map[string][]*config.MetricConfig
@@ -129,16 +137,64 @@ func TestNewJSONObjectExtractor_parseMetric(t *testing.T) {
 			want:    Metric{},
 			noValue: true,
 		},
+		{
+			name:      "metric with satisfied condition",
+			separator: ".",
+			fields: fields{
+				map[string][]*config.MetricConfig{
+					"temperature": {
+						{
+							PrometheusName: "temperature",
+							MQTTName:       "temperature",
+							ValueType:      "gauge",
+							When:           "value > 0",
+						},
+					},
+				},
+			},
+			args: args{
+				metricPath: "topic",
+				deviceID:   "dht22",
+				value:      "{\"temperature\": 8.5}",
+			},
+			want: Metric{
+				Description: prometheus.NewDesc("temperature", "", []string{"sensor", "topic"}, nil),
+				ValueType:   prometheus.GaugeValue,
+				Value:       8.5,
+				IngestTime:  testNow(),
+				Topic:       "topic",
+			},
+		}, {
+			name:      "metric with unsatisfied condition",
+			separator: ".",
+			fields: fields{
+				map[string][]*config.MetricConfig{
+					"temperature": {
+						{
+							PrometheusName: "temperature",
+							MQTTName:       "temperature",
+							ValueType:      "gauge",
+							When:           "value > 0",
+						},
+					},
+				},
+			},
+			args: args{
+				metricPath: "topic",
+				deviceID:   "dht22",
+				value:      "{\"temperature\": -8.5}",
+			},
+			want:    Metric{},
+			noValue: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			p := Parser{
-				separator:     tt.separator,
-				metricConfigs: tt.fields.metricConfigs,
-			}
-			extractor := NewJSONObjectExtractor(p)
+			p := NewParser(nil, tt.separator, stateDir)
+			p.metricConfigs = tt.fields.metricConfigs
+			extractor := NewJSONObjectExtractor(p, nil)
 
-			got, err := extractor(tt.args.metricPath, []byte(tt.args.value), tt.args.deviceID)
+			got, err := extractor(tt.args.metricPath, []byte(tt.args.value), tt.args.deviceID, MessageInfo{})
 			if (err != nil) != tt.wantErr {
 				t.Errorf("parseMetric() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -156,3 +212,772 @@ func TestNewJSONObjectExtractor_parseMetric(t *testing.T) {
 		})
 	}
 }
+
+func TestNewJSONObjectExtractor_stateKey(t *testing.T) {
+	now = testNow
+	tests := []struct {
+		name     string
+		stateKey *config.Template
+		want     []float64
+	}{
+		{
+			name: "separate state per topic",
+			want: []float64{5, 3, 6},
+		},
+		{
+			name:     "shared state across topics",
+			stateKey: config.MustNewTemplate("{{.DeviceID}}/{{.PrometheusName}}"),
+			want:     []float64{5, 8, 11},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stateDir, err := os.MkdirTemp("", "extractor_test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(stateDir)
+
+			p := NewParser([]config.BlockConfig{{
+				Metrics: []config.MetricConfig{{
+					PrometheusName:  "energy",
+					MQTTName:        "energy",
+					ValueType:       "counter",
+					ForceMonotonicy: true,
+					StateKey:        tt.stateKey,
+				}},
+			}}, ".", stateDir)
+			extractor := NewJSONObjectExtractor(p, nil)
+
+			samples := []struct {
+				topic   string
+				payload string
+			}{
+				{topic: "primary/meter", payload: `{"energy": 5}`},
+				{topic: "backup/meter", payload: `{"energy": 3}`},
+				{topic: "primary/meter", payload: `{"energy": 6}`},
+			}
+			for i, s := range samples {
+				got, err := extractor(s.topic, []byte(s.payload), "meter", MessageInfo{})
+				if err != nil {
+					t.Fatalf("extractor() error = %v", err)
+				}
+				if len(got) != 1 || got[0].Value != tt.want[i] {
+					t.Errorf("sample %d: extractor() got = %v, want value %v", i, got, tt.want[i])
+				}
+			}
+			if tt.stateKey != nil {
+				if _, ok := p.states["meter_energy"]; !ok {
+					t.Errorf("shared state key not used, got states %v", p.states)
+				}
+			}
+		})
+	}
+}
+
+func TestNewMetricPerTopicExtractor_topicOnly(t *testing.T) {
+	stateDir, err := os.MkdirTemp("", "extractor_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(stateDir)
+	now = testNow
+
+	p := NewParser([]config.BlockConfig{{
+		Metrics: []config.MetricConfig{
+			{
+				PrometheusName: "heartbeat",
+				MQTTName:       "heartbeat",
+				ValueType:      "gauge",
+				OmitTimestamp:  true,
+				FixedValue:     floatP(1),
+			},
+			{
+				PrometheusName:  "rssi",
+				MQTTName:        "rssi",
+				ValueType:       "gauge",
+				OmitTimestamp:   true,
+				TopicValueGroup: "level",
+			},
+		},
+	}}, ".", stateDir)
+	extractor := NewMetricPerTopicExtractor(p, config.MustNewRegexp(`devices/[^/]+/(?P<metricname>[^/]+)(/(?P<level>.*))?`))
+
+	tests := []struct {
+		topic   string
+		payload string
+		want    Metric
+	}{
+		{
+			topic:   "devices/sensor1/heartbeat",
+			payload: "",
+			want: Metric{
+				Description: prometheus.NewDesc("heartbeat", "", []string{"sensor", "topic"}, nil),
+				ValueType:   prometheus.GaugeValue,
+				Value:       1,
+				Topic:       "devices/sensor1/heartbeat",
+			},
+		},
+		{
+			topic:   "devices/sensor1/rssi/-70",
+			payload: "{not json}",
+			want: Metric{
+				Description: prometheus.NewDesc("rssi", "", []string{"sensor", "topic"}, nil),
+				ValueType:   prometheus.GaugeValue,
+				Value:       -70,
+				Topic:       "devices/sensor1/rssi/-70",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.topic, func(t *testing.T) {
+			got, err := extractor(tt.topic, []byte(tt.payload), "sensor1", MessageInfo{})
+			if err != nil {
+				t.Fatalf("extractor() error = %v", err)
+			}
+			if len(got) != 1 || !reflect.DeepEqual(got[0], tt.want) {
+				t.Errorf("extractor() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewJSONObjectExtractor_ignoreRetained(t *testing.T) {
+	stateDir, err := os.MkdirTemp("", "extractor_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(stateDir)
+	now = testNow
+
+	p := NewParser([]config.BlockConfig{{
+		Metrics: []config.MetricConfig{
+			{
+				PrometheusName:  "energy",
+				MQTTName:        "energy",
+				ValueType:       "counter",
+				OmitTimestamp:   true,
+				IgnoreRetained:  true,
+				ForceMonotonicy: true,
+			},
+			{
+				PrometheusName: "temperature",
+				MQTTName:       "temperature",
+				ValueType:      "gauge",
+				OmitTimestamp:  true,
+			},
+		},
+	}}, ".", stateDir)
+	extractor := NewJSONObjectExtractor(p, nil)
+
+	got, err := extractor("meter", []byte(`{"energy": 1, "temperature": 20}`), "meter", MessageInfo{Retained: true})
+	if err != nil {
+		t.Fatalf("extractor() error = %v", err)
+	}
+	if len(got) != 1 || got[0].Value != 20 {
+		t.Errorf("retained message: got = %v, want only temperature 20", got)
+	}
+
+	got, err = extractor("meter", []byte(`{"energy": 5, "temperature": 21}`), "meter", MessageInfo{})
+	if err != nil {
+		t.Fatalf("extractor() error = %v", err)
+	}
+	var values []float64
+	for _, m := range got {
+		values = append(values, m.Value)
+	}
+	sort.Float64s(values)
+	if want := []float64{5, 21}; !reflect.DeepEqual(values, want) {
+		t.Errorf("live message: got = %v, want %v", values, want)
+	}
+}
+
+func TestExtractor_integerValue(t *testing.T) {
+	stateDir, err := os.MkdirTemp("", "extractor_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(stateDir)
+	now = testNow
+
+	// 2^53 + 1 is the smallest positive integer which can not be represented as float64.
+	const large = int64(9007199254740993)
+	metrics := []config.BlockConfig{{
+		Metrics: []config.MetricConfig{
+			{
+				PrometheusName: "rx_bytes",
+				MQTTName:       "rx_bytes",
+				ValueType:      "counter",
+				OmitTimestamp:  true,
+				IntegerValue:   true,
+			},
+			{
+				PrometheusName: "tx_bytes",
+				MQTTName:       "tx_bytes",
+				ValueType:      "counter",
+				OmitTimestamp:  true,
+				IntegerValue:   true,
+				Expression:     "value + 2",
+			},
+		},
+	}}
+	p := NewParser(metrics, ".", stateDir)
+
+	tests := []struct {
+		name      string
+		extractor Extractor
+		topic     string
+		payload   string
+		want      []int64
+	}{
+		{
+			name:      "json object",
+			extractor: NewJSONObjectExtractor(p, nil),
+			topic:     "router",
+			payload:   `{"rx_bytes": 9007199254740993, "tx_bytes": 9007199254740993}`,
+			want:      []int64{large, large + 2},
+		},
+		{
+			name:      "metric per topic",
+			extractor: NewMetricPerTopicExtractor(p, config.MustNewRegexp("router/(?P<metricname>.*)")),
+			topic:     "router/tx_bytes",
+			payload:   "9007199254740993",
+			want:      []int64{large + 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.extractor(tt.topic, []byte(tt.payload), "router", MessageInfo{})
+			if err != nil {
+				t.Fatalf("extractor() error = %v", err)
+			}
+			var values []int64
+			for _, m := range got {
+				if m.IntValue == nil {
+					t.Fatalf("metric %v has no integer value", m)
+				}
+				values = append(values, *m.IntValue)
+			}
+			sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+			if !reflect.DeepEqual(values, tt.want) {
+				t.Errorf("extractor() got = %v, want %v", values, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewJSONObjectExtractor_mqttNamePattern(t *testing.T) {
+	stateDir, err := os.MkdirTemp("", "extractor_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(stateDir)
+	now = testNow
+
+	p := NewParser([]config.BlockConfig{{
+		Metrics: []config.MetricConfig{
+			{
+				PrometheusName:  "temperature",
+				MQTTName:        "temperature",
+				MQTTNamePattern: config.MustNewRegexp(`^(temperature_\d+|probes\.[^.]+)$`),
+				MQTTNameLabel:   "field",
+				ValueType:       "gauge",
+				OmitTimestamp:   true,
+			},
+			{
+				PrometheusName: "humidity",
+				MQTTName:       "humidity",
+				ValueType:      "gauge",
+				OmitTimestamp:  true,
+			},
+		},
+	}}, ".", stateDir)
+	extractor := NewJSONObjectExtractor(p, nil)
+
+	got, err := extractor("sensors", []byte(`{"temperature_1": 20, "temperature_2": 21, "temperature": 5, "humidity": 50, "probes": {"outside": 3}}`), "sensors", MessageInfo{})
+	if err != nil {
+		t.Fatalf("extractor() error = %v", err)
+	}
+	values := make(map[string]float64)
+	for _, m := range got {
+		values[m.Description.String()+"/"+m.Labels["field"]] = m.Value
+	}
+	temperature := prometheus.NewDesc("temperature", "", []string{"sensor", "topic", "field"}, nil).String()
+	humidity := prometheus.NewDesc("humidity", "", []string{"sensor", "topic"}, nil).String()
+	want := map[string]float64{
+		temperature + "/temperature_1":  20,
+		temperature + "/temperature_2":  21,
+		temperature + "/probes.outside": 3,
+		humidity + "/":                  50,
+	}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("extractor() got = %v, want %v", values, want)
+	}
+}
+
+func TestNewJSONObjectExtractor_field(t *testing.T) {
+	now = testNow
+
+	tests := []struct {
+		name       string
+		expression string
+		errorValue *float64
+		payload    string
+		want       float64
+		wantErr    bool
+	}{
+		{
+			name:       "product of two fields",
+			expression: `field("v") * field("i")`,
+			payload:    `{"v": 230, "i": 2}`,
+			want:       460,
+		},
+		{
+			name:       "nested field",
+			expression: `value * field("phase.i")`,
+			payload:    `{"v": 230, "phase": {"i": 0.5}}`,
+			want:       115,
+		},
+		{
+			name:       "missing field with default",
+			expression: `field("v") * field("i", 0)`,
+			payload:    `{"v": 230}`,
+			want:       0,
+		},
+		{
+			name:       "missing field",
+			expression: `field("v") * field("i")`,
+			payload:    `{"v": 230}`,
+			wantErr:    true,
+		},
+		{
+			name:       "missing field with error value",
+			expression: `field("v") * field("i")`,
+			errorValue: floatP(-1),
+			payload:    `{"v": 230}`,
+			want:       -1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stateDir, err := os.MkdirTemp("", "extractor_test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(stateDir)
+
+			p := NewParser([]config.BlockConfig{{
+				Metrics: []config.MetricConfig{{
+					PrometheusName: "power",
+					MQTTName:       "v",
+					ValueType:      "gauge",
+					OmitTimestamp:  true,
+					Expression:     tt.expression,
+					ErrorValue:     tt.errorValue,
+				}},
+			}}, ".", stateDir)
+			got, err := NewJSONObjectExtractor(p, nil)("meter", []byte(tt.payload), "meter", MessageInfo{})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("extractor() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if len(got) != 1 || got[0].Value != tt.want {
+				t.Errorf("extractor() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewJSONObjectExtractor_topicLabels(t *testing.T) {
+	now = testNow
+	p := NewParser([]config.BlockConfig{{
+		Metrics: []config.MetricConfig{{
+			PrometheusName: "temperature",
+			MQTTName:       "temperature",
+			ValueType:      "gauge",
+			OmitTimestamp:  true,
+			TopicLabels: []config.TopicLabels{
+				{Topic: config.MustNewRegexp("^buildingA/"), Labels: map[string]string{"building": "A"}},
+				{Topic: config.MustNewRegexp("^buildingB/"), Labels: map[string]string{"building": "B"}},
+				{Topic: config.MustNewRegexp("/basement/"), Labels: map[string]string{"floor": "basement"}},
+			},
+		}},
+	}}, ".", "", WithStateStore(NewMemoryStateStore()))
+	extract := NewJSONObjectExtractor(p, nil)
+
+	tests := []struct {
+		topic string
+		want  map[string]string
+	}{
+		{topic: "buildingA/office/dht22", want: map[string]string{"building": "A"}},
+		{topic: "buildingB/basement/dht22", want: map[string]string{"building": "B", "floor": "basement"}},
+		{topic: "garage/dht22", want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.topic, func(t *testing.T) {
+			got, err := extract(tt.topic, []byte(`{"temperature": 21}`), "dht22", MessageInfo{})
+			if err != nil {
+				t.Fatalf("extractor() error = %v", err)
+			}
+			if len(got) != 1 {
+				t.Fatalf("extractor() got %d metrics, want 1", len(got))
+			}
+			if !reflect.DeepEqual(got[0].Labels, tt.want) {
+				t.Errorf("extractor() got labels %v, want %v", got[0].Labels, tt.want)
+			}
+			if want := []string{"building", "floor"}; !reflect.DeepEqual(got[0].LabelsKeys, want) {
+				t.Errorf("extractor() got label keys %v, want %v", got[0].LabelsKeys, want)
+			}
+		})
+	}
+}
+
+func TestNewJSONObjectExtractor_fieldLabels(t *testing.T) {
+	now = testNow
+	p := NewParser([]config.BlockConfig{{
+		Metrics: []config.MetricConfig{{
+			PrometheusName: "temperature",
+			MQTTName:       "temperature",
+			ValueType:      "gauge",
+			OmitTimestamp:  true,
+			FieldLabels: map[string]string{
+				"firmware": "info.firmware",
+				"build":    "info.build",
+				"missing":  "info.missing",
+			},
+			LabelValueMapping: map[string]map[string]string{"firmware": {"1.2.3-rc1": "1.2.3"}},
+		}},
+	}}, ".", "", WithStateStore(NewMemoryStateStore()))
+
+	got, err := NewJSONObjectExtractor(p, nil)("livingroom/dht22", []byte(`{"temperature": 21, "info": {"firmware": "1.2.3-rc1", "build": 1042}}`), "dht22", MessageInfo{})
+	if err != nil {
+		t.Fatalf("extractor() error = %v", err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("extractor() got %d metrics, want 1", len(got))
+	}
+	want := map[string]string{"firmware": "1.2.3", "build": "1042", "missing": ""}
+	if !reflect.DeepEqual(got[0].Labels, want) {
+		t.Errorf("extractor() got labels %v, want %v", got[0].Labels, want)
+	}
+}
+
+func TestNewJSONObjectExtractor_nameExpression(t *testing.T) {
+	now = testNow
+	metrics := []config.BlockConfig{{
+		Metrics: []config.MetricConfig{{
+			PrometheusName: "reading",
+			MQTTName:       "value",
+			ValueType:      "gauge",
+			OmitTimestamp:  true,
+			NameExpression: `field("type") == "temp" ? "temperature" : "humidity"`,
+			Names:          []string{"temperature", "humidity"},
+		}},
+	}}
+	p := NewParser(metrics, ".", "", WithStateStore(NewMemoryStateStore()))
+	extract := NewJSONObjectExtractor(p, nil)
+	cfg := &metrics[0].Metrics[0]
+
+	tests := []struct {
+		payload string
+		want    string
+	}{
+		{payload: `{"type": "temp", "value": 21}`, want: "temperature"},
+		{payload: `{"type": "hum", "value": 55}`, want: "humidity"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			got, err := extract("livingroom/sensor", []byte(tt.payload), "sensor", MessageInfo{})
+			if err != nil {
+				t.Fatalf("extractor() error = %v", err)
+			}
+			if len(got) != 1 {
+				t.Fatalf("extractor() got %d metrics, want 1", len(got))
+			}
+			if want := cfg.PrometheusDescriptionFor(tt.want).String(); got[0].Description.String() != want {
+				t.Errorf("extractor() got description %v, want %v", got[0].Description, want)
+			}
+		})
+	}
+
+	if got := len(p.Descriptions()); got != 2 {
+		t.Errorf("Descriptions() got %d descriptions, want 2", got)
+	}
+
+	unlisted := *cfg
+	unlisted.NameExpression = `"pressure"`
+	if _, err := p.parseMetric(&unlisted, "unlisted", 1.0, nil); err == nil {
+		t.Errorf("parseMetric() expected an error for a name which is not listed")
+	}
+}
+
+func TestNewJSONObjectExtractor_topicGroupLabels(t *testing.T) {
+	now = testNow
+	p := NewParser([]config.BlockConfig{{
+		Metrics: []config.MetricConfig{{
+			PrometheusName:   "temperature",
+			MQTTName:         "temperature",
+			ValueType:        "gauge",
+			OmitTimestamp:    true,
+			TopicPathFilter:  config.MustNewRegexp(`^site/(?P<site>[^/]+)/room/(?P<room>[^/]+)/temp$`),
+			TopicGroupLabels: true,
+		}},
+	}}, ".", "", WithStateStore(NewMemoryStateStore()))
+
+	got, err := NewJSONObjectExtractor(p, nil)("site/berlin/room/kitchen/temp", []byte(`{"temperature": 21}`), "temp", MessageInfo{})
+	if err != nil {
+		t.Fatalf("extractor() error = %v", err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("extractor() got %d metrics, want 1", len(got))
+	}
+	if want := map[string]string{"site": "berlin", "room": "kitchen"}; !reflect.DeepEqual(got[0].Labels, want) {
+		t.Errorf("extractor() got labels %v, want %v", got[0].Labels, want)
+	}
+	if want := []string{"room", "site"}; !reflect.DeepEqual(got[0].LabelsKeys, want) {
+		t.Errorf("extractor() got label keys %v, want %v", got[0].LabelsKeys, want)
+	}
+}
+
+func TestNewJSONObjectExtractor_derive(t *testing.T) {
+	now = testNow
+	p := NewParser([]config.BlockConfig{{
+		Metrics: []config.MetricConfig{{
+			PrometheusName: "temperature_drop",
+			MQTTName:       "temperature_drop",
+			ValueType:      "gauge",
+			OmitTimestamp:  true,
+			Derive: &config.DeriveConfig{
+				Operation: config.DeriveSubtract,
+				Sources: []config.DeriveSource{
+					{MQTTName: "temperature", Topic: config.MustNewRegexp("^inlet/")},
+					{MQTTName: "temperature", Topic: config.MustNewRegexp("^outlet/")},
+				},
+			},
+		}},
+	}}, ".", "", WithStateStore(NewMemoryStateStore()))
+	extract := NewJSONObjectExtractor(p, nil)
+
+	steps := []struct {
+		topic   string
+		payload string
+		want    []float64
+	}{
+		{topic: "inlet/pump", payload: `{"temperature": 30}`},
+		{topic: "return/pump", payload: `{"temperature": 10}`},
+		{topic: "outlet/pump", payload: `{"temperature": 22.5}`, want: []float64{7.5}},
+		{topic: "inlet/pump", payload: `{"temperature": 35}`, want: []float64{12.5}},
+		{topic: "outlet/pump", payload: `{"temperature": "25"}`, want: []float64{10}},
+	}
+	for _, s := range steps {
+		got, err := extract(s.topic, []byte(s.payload), "pump", MessageInfo{})
+		if err != nil {
+			t.Fatalf("extractor(%q) error = %v", s.topic, err)
+		}
+		var values []float64
+		for _, m := range got {
+			values = append(values, m.Value)
+			// The series is the same whichever source was updated.
+			if m.Topic != "" || len(m.Labels) != 0 {
+				t.Errorf("extractor(%q) got topic %q and labels %v, want none", s.topic, m.Topic, m.Labels)
+			}
+		}
+		if !reflect.DeepEqual(values, s.want) {
+			t.Errorf("extractor(%q, %s) got %v, want %v", s.topic, s.payload, values, s.want)
+		}
+	}
+}
+
+func TestNewJSONObjectExtractor_subscribeTopic(t *testing.T) {
+	now = testNow
+	p := NewParser([]config.BlockConfig{{
+		Metrics: []config.MetricConfig{
+			{
+				PrometheusName: "energy",
+				MQTTName:       "value",
+				ValueType:      "counter",
+				OmitTimestamp:  true,
+				SubscribeTopic: "devices/+/energy",
+			},
+			{
+				PrometheusName: "power",
+				MQTTName:       "value",
+				ValueType:      "gauge",
+				OmitTimestamp:  true,
+				SubscribeTopic: "devices/+/power",
+			},
+		},
+	}}, ".", "", WithStateStore(NewMemoryStateStore()))
+	extractor := NewJSONObjectExtractor(p, nil)
+
+	for topic, want := range map[string]prometheus.ValueType{
+		"devices/plug/energy": prometheus.CounterValue,
+		"devices/plug/power":  prometheus.GaugeValue,
+	} {
+		got, err := extractor(topic, []byte(`{"value": 12}`), "plug", MessageInfo{})
+		if err != nil {
+			t.Fatalf("extractor() error = %v", err)
+		}
+		if len(got) != 1 || got[0].ValueType != want {
+			t.Errorf("extractor() on %s got %v, want a single metric of type %v", topic, got, want)
+		}
+	}
+}
+
+func TestNewJSONObjectExtractor_absentValue(t *testing.T) {
+	p := NewParser([]config.BlockConfig{{
+		Metrics: []config.MetricConfig{
+			{
+				PrometheusName: "alarms",
+				MQTTName:       "alarms",
+				ValueType:      "gauge",
+				OmitTimestamp:  true,
+				AbsentValue:    floatP(0),
+			},
+			{
+				PrometheusName: "temperature",
+				MQTTName:       "temperature",
+				ValueType:      "gauge",
+				OmitTimestamp:  true,
+			},
+		},
+	}}, ".", "", WithStateStore(NewMemoryStateStore()))
+	extractor := NewJSONObjectExtractor(p, nil)
+
+	tests := []struct {
+		name    string
+		payload string
+		want    map[string]float64
+	}{
+		{name: "present", payload: `{"alarms": 3, "temperature": 21.5}`, want: map[string]float64{"alarms": 3, "temperature": 21.5}},
+		// Only the config with an absent_value yields a metric for the missing field.
+		{name: "absent", payload: `{"humidity": 40}`, want: map[string]float64{"alarms": 0}},
+		{name: "null", payload: `{"alarms": null, "temperature": 21.5}`, want: map[string]float64{"alarms": 0, "temperature": 21.5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := extractor("devices/sensor1", []byte(tt.payload), "sensor1", MessageInfo{})
+			if err != nil {
+				t.Fatalf("extractor() error = %v", err)
+			}
+			gotValues := map[string]float64{}
+			for _, m := range got {
+				gotValues[m.Description.String()] = m.Value
+			}
+			want := map[string]float64{}
+			for name, v := range tt.want {
+				want[prometheus.NewDesc(name, "", []string{"sensor", "topic"}, nil).String()] = v
+			}
+			if !reflect.DeepEqual(gotValues, want) {
+				t.Errorf("extractor() got = %v, want %v", gotValues, want)
+			}
+
+			// ParseObjectPayload treats missing fields the same way.
+			parsed, err := p.ParseObjectPayload("devices/sensor1", "sensor1", []byte(tt.payload))
+			if err != nil {
+				t.Fatalf("ParseObjectPayload() error = %v", err)
+			}
+			parsedValues := map[string]float64{}
+			for _, m := range parsed {
+				parsedValues[m.Description.String()] = m.Value
+			}
+			if !reflect.DeepEqual(parsedValues, want) {
+				t.Errorf("ParseObjectPayload() got = %v, want %v", parsedValues, want)
+			}
+		})
+	}
+
+	// Payloads which are no JSON object have no missing fields.
+	for _, payload := range []string{`offline`, `not json{`, `[1,2]`, `42`} {
+		t.Run(payload, func(t *testing.T) {
+			got, err := extractor("devices/sensor1", []byte(payload), "sensor1", MessageInfo{})
+			if err != nil {
+				t.Fatalf("extractor() error = %v", err)
+			}
+			if len(got) != 0 {
+				t.Errorf("extractor() got = %v, want no metrics", got)
+			}
+			if _, err := p.ParseObjectPayload("devices/sensor1", "sensor1", []byte(payload)); err == nil {
+				t.Errorf("ParseObjectPayload() want error for payload %q", payload)
+			}
+		})
+	}
+}
+
+func TestNewJSONObjectExtractor_textMetric(t *testing.T) {
+	now = testNow
+	p := NewParser([]config.BlockConfig{{
+		Metrics: []config.MetricConfig{
+			{
+				PrometheusName: "serial_info",
+				MQTTName:       "serial",
+				ValueType:      "gauge",
+				TextMetric:     true,
+			},
+			{
+				PrometheusName: "mode_info",
+				MQTTName:       "mode",
+				ValueType:      "gauge",
+				TextMetric:     true,
+				TextLabel:      "mode",
+			},
+		},
+	}}, ".", "", WithStateStore(NewMemoryStateStore()))
+	extractor := NewJSONObjectExtractor(p, nil)
+
+	tests := []struct {
+		name    string
+		payload string
+		want    map[string]map[string]string
+	}{
+		{
+			name:    "strings",
+			payload: `{"serial": "AB-123", "mode": "eco", "temperature": 21.5}`,
+			want: map[string]map[string]string{
+				"serial_info": {"value": "AB-123"},
+				"mode_info":   {"mode": "eco"},
+			},
+		},
+		{
+			name:    "number",
+			payload: `{"serial": 4711}`,
+			want:    map[string]map[string]string{"serial_info": {"value": "4711"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := extractor("devices/sensor1", []byte(tt.payload), "sensor1", MessageInfo{})
+			if err != nil {
+				t.Fatalf("extractor() error = %v", err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("extractor() got %d metrics, want %d", len(got), len(tt.want))
+			}
+			for _, m := range got {
+				var name string
+				var wantLabels map[string]string
+				for n, labels := range tt.want {
+					for k := range labels {
+						if m.Description.String() == prometheus.NewDesc(n, "", []string{"sensor", "topic", k}, nil).String() {
+							name, wantLabels = n, labels
+						}
+					}
+				}
+				if name == "" {
+					t.Errorf("extractor() got unexpected metric %v", m.Description)
+					continue
+				}
+				if m.Value != 1 || m.ValueType != prometheus.GaugeValue {
+					t.Errorf("%s: got value %v of type %v, want the gauge 1", name, m.Value, m.ValueType)
+				}
+				for k, v := range wantLabels {
+					if m.Labels[k] != v {
+						t.Errorf("%s: got label %s=%q, want %q", name, k, m.Labels[k], v)
+					}
+				}
+			}
+		})
+	}
+}
@@ -1,47 +1,147 @@
 package metrics
 
 import (
+	"encoding/json"
 	"fmt"
+	"strings"
+	"sync/atomic"
+
 	"go.uber.org/zap"
 
 	"github.com/eclipse/paho.mqtt.golang"
 	"github.com/hikhvar/mqtt2prometheus/pkg/config"
+	gojsonq "github.com/thedevsaddam/gojsonq/v2"
 )
 
 type Ingest struct {
 	instrumentation
 	extractor     Extractor
 	deviceIDRegex *config.Regexp
+	normalize     string
 	collector     Collector
 	logger        *zap.Logger
+	// Topic to publish an ErrorEvent to for each message which could not be stored, disabled if empty
+	errorTopic string
+	// Payload field holding the device id, the topic is used if empty
+	deviceIDField string
+	separator     string
+	// Outputs receiving all stored metrics in addition to the collector
+	outputs []Output
+	// Receives the messages on the status topic instead of the extractor, if set
+	liveness *LivenessCollector
+	// Set to 1 while connected to the broker, accessed atomically
+	connected int32
+}
+
+// IngestOption configures optional behaviour of an Ingest.
+type IngestOption func(*Ingest)
+
+// WithErrorTopic publishes an ErrorEvent to the given MQTT topic for each message which could not be stored.
+func WithErrorTopic(topic string) IngestOption {
+	return func(i *Ingest) {
+		i.errorTopic = topic
+	}
+}
+
+// WithDeviceIDField takes the device id from the given field of JSON payloads. Nested fields are accessed by their
+// path, joined with the separator. The device id is extracted from the topic if the field is missing.
+func WithDeviceIDField(field, separator string) IngestOption {
+	return func(i *Ingest) {
+		i.deviceIDField = field
+		i.separator = separator
+	}
+}
+
+// WithDeviceIDNormalize changes the case of extracted device ids, one of the config.DeviceIDNormalize* modes.
+func WithDeviceIDNormalize(mode string) IngestOption {
+	return func(i *Ingest) {
+		i.normalize = mode
+	}
+}
+
+// WithLiveness passes the messages on the status topic of the liveness collector to it instead of the extractor.
+func WithLiveness(l *LivenessCollector) IngestOption {
+	return func(i *Ingest) {
+		i.liveness = l
+	}
+}
+
+// WithOutput passes all stored metrics to the output too, e.g. an OTLPExporter.
+func WithOutput(o Output) IngestOption {
+	return func(i *Ingest) {
+		i.outputs = append(i.outputs, o)
+	}
 }
 
-func NewIngest(collector Collector, extractor Extractor, deviceIDRegex *config.Regexp) *Ingest {
+// ErrorEvent describes a message which could not be stored.
+type ErrorEvent struct {
+	Topic   string `json:"topic"`
+	Payload string `json:"payload"`
+	Error   string `json:"error"`
+}
 
-	return &Ingest{
+func NewIngest(collector Collector, extractor Extractor, deviceIDRegex *config.Regexp, opts ...IngestOption) *Ingest {
+
+	i := &Ingest{
 		instrumentation: defaultInstrumentation,
 		extractor:       extractor,
 		deviceIDRegex:   deviceIDRegex,
 		collector:       collector,
 		logger:          config.ProcessContext.Logger(),
 	}
+	for _, opt := range opts {
+		opt(i)
+	}
+	return i
 }
 
-func (i *Ingest) store(topic string, payload []byte) error {
-	deviceID := i.deviceID(topic)
-	mc, err := i.extractor(topic, payload, deviceID)
+// OnConnectHandler marks the ingest as connected to the broker.
+func (i *Ingest) OnConnectHandler(client mqtt.Client) {
+	atomic.StoreInt32(&i.connected, 1)
+	i.instrumentation.OnConnectHandler(client)
+}
+
+// ConnectionLostHandler marks the ingest as disconnected from the broker.
+func (i *Ingest) ConnectionLostHandler(client mqtt.Client, err error) {
+	atomic.StoreInt32(&i.connected, 0)
+	i.instrumentation.ConnectionLostHandler(client, err)
+}
+
+// Connected reports whether the ingest is currently connected to the broker. It is safe for concurrent use.
+func (i *Ingest) Connected() bool {
+	return atomic.LoadInt32(&i.connected) == 1
+}
+
+func (i *Ingest) store(topic string, payload []byte, info MessageInfo) error {
+	if i.liveness != nil && i.liveness.Matches(topic) {
+		// The device id is taken from the status topic, other topics may be structured differently.
+		if err := i.liveness.Observe(i.normalizeDeviceID(i.liveness.DeviceID(topic)), topic, payload); err != nil {
+			return fmt.Errorf("failed to parse status message: %w", err)
+		}
+		return nil
+	}
+	deviceID := i.deviceID(topic, payload)
+	mc, err := i.extractor(topic, payload, deviceID, info)
 	if err != nil {
 		return fmt.Errorf("failed to extract metric values from topic: %w", err)
 	}
 	i.collector.Observe(deviceID, mc)
+	for _, o := range i.outputs {
+		o.Observe(deviceID, mc)
+	}
 	return nil
 }
 
 func (i *Ingest) SetupSubscriptionHandler(errChan chan<- error) mqtt.MessageHandler {
 	return func(c mqtt.Client, m mqtt.Message) {
+		// Never process our own error events, a subscription covering the error topic would loop forever otherwise.
+		if i.errorTopic != "" && m.Topic() == i.errorTopic {
+			return
+		}
 		i.logger.Debug("Got message", zap.String("topic", m.Topic()), zap.String("payload", string(m.Payload())))
-		err := i.store(m.Topic(), m.Payload())
+		err := i.store(m.Topic(), m.Payload(), MessageInfo{Retained: m.Retained()})
 		if err != nil {
+			i.publishError(c, m, err)
 			errChan <- fmt.Errorf("could not store metrics '%s' on topic %s: %s", string(m.Payload()), m.Topic(), err.Error())
 			i.CountStoreError(m.Topic())
 			return
@@ -50,7 +150,45 @@ func (i *Ingest) SetupSubscriptionHandler(errChan chan<- error) mqtt.MessageHand
 	}
 }
 
-// deviceID uses the configured DeviceIDRegex to extract the device ID from the given mqtt topic path.
-func (i *Ingest) deviceID(topic string) string {
-	return i.deviceIDRegex.GroupValue(topic, config.DeviceIDRegexGroup)
+// publishError publishes an ErrorEvent for the message to the error topic, if configured. The publication is not
+// awaited, since this would block the handling of incoming messages.
+func (i *Ingest) publishError(c mqtt.Client, m mqtt.Message, err error) {
+	if i.errorTopic == "" {
+		return
+	}
+	event, jsonErr := json.Marshal(ErrorEvent{
+		Topic:   m.Topic(),
+		Payload: string(m.Payload()),
+		Error:   err.Error(),
+	})
+	if jsonErr != nil {
+		i.logger.Warn("Failed to encode error event", zap.Error(jsonErr))
+		return
+	}
+	c.Publish(i.errorTopic, 0, false, event)
+}
+
+// deviceID extracts the device ID from the configured payload field or, if there is none, uses the configured
+// DeviceIDRegex to extract it from the given mqtt topic path. The extracted id is normalized as configured, so topics
+// differing only in the case of the device id result in the same series.
+func (i *Ingest) deviceID(topic string, payload []byte) string {
+	var id string
+	if i.deviceIDField != "" {
+		id = rawString(gojsonq.New(gojsonq.SetSeparator(i.separator)).FromString(string(payload)).Find(i.deviceIDField))
+	}
+	if id == "" {
+		id = i.deviceIDRegex.GroupValue(topic, config.DeviceIDRegexGroup)
+	}
+	return i.normalizeDeviceID(id)
+}
+
+// normalizeDeviceID applies the device_id_normalize setting to the device id.
+func (i *Ingest) normalizeDeviceID(id string) string {
+	switch i.normalize {
+	case config.DeviceIDNormalizeLower:
+		return strings.ToLower(id)
+	case config.DeviceIDNormalizeUpper:
+		return strings.ToUpper(id)
+	}
+	return id
 }
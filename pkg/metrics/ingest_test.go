@@ -0,0 +1,343 @@
+package metrics
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/hikhvar/mqtt2prometheus/pkg/config"
+	gocache "github.com/patrickmn/go-cache"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+)
+
+func TestIngest_deviceIDNormalize(t *testing.T) {
+	now = testNow
+	metrics := []config.BlockConfig{{
+		Metrics: []config.MetricConfig{
+			{
+				PrometheusName:  "energy",
+				MQTTName:        "energy",
+				ValueType:       "counter",
+				OmitTimestamp:   true,
+				ForceMonotonicy: true,
+			},
+		},
+	}}
+	tests := []struct {
+		normalize  string
+		wantSensor []string
+		wantKeys   []string
+	}{
+		{
+			normalize:  config.DeviceIDNormalizeNone,
+			wantSensor: []string{"SensorA", "sensora"},
+			wantKeys:   []string{"SensorA-devices_SensorA-energy-energy", "sensora-devices_sensora-energy-energy"},
+		},
+		{
+			normalize:  config.DeviceIDNormalizeLower,
+			wantSensor: []string{"sensora"},
+			wantKeys:   []string{"sensora-devices_SensorA-energy-energy", "sensora-devices_sensora-energy-energy"},
+		},
+		{
+			normalize:  config.DeviceIDNormalizeUpper,
+			wantSensor: []string{"SENSORA"},
+			wantKeys:   []string{"SENSORA-devices_SensorA-energy-energy", "SENSORA-devices_sensora-energy-energy"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.normalize, func(t *testing.T) {
+			store := NewMemoryStateStore()
+			p := NewParser(metrics, ".", "", WithStateStore(store))
+			collector := NewCollector(gocache.NoExpiration, metrics, zap.NewNop())
+			ingest := NewIngest(collector, NewJSONObjectExtractor(p, nil), config.MQTTConfigDefaults.DeviceIDRegex, WithDeviceIDNormalize(tt.normalize))
+
+			for _, topic := range []string{"devices/SensorA", "devices/sensora"} {
+				if err := ingest.store(topic, []byte(`{"energy": 1}`), MessageInfo{}); err != nil {
+					t.Fatalf("store() error = %v", err)
+				}
+			}
+
+			reg := prometheus.NewRegistry()
+			reg.MustRegister(collector)
+			families, err := reg.Gather()
+			if err != nil {
+				t.Fatal(err)
+			}
+			sensors := map[string]bool{}
+			for _, mf := range families {
+				for _, m := range mf.GetMetric() {
+					for _, l := range m.GetLabel() {
+						if l.GetName() == "sensor" {
+							sensors[l.GetValue()] = true
+						}
+					}
+				}
+			}
+			var gotSensor []string
+			for s := range sensors {
+				gotSensor = append(gotSensor, s)
+			}
+			sort.Strings(gotSensor)
+			if !reflect.DeepEqual(gotSensor, tt.wantSensor) {
+				t.Errorf("sensor labels = %v, want %v", gotSensor, tt.wantSensor)
+			}
+
+			keys, err := store.List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(keys, tt.wantKeys) {
+				t.Errorf("state keys = %v, want %v", keys, tt.wantKeys)
+			}
+		})
+	}
+}
+
+type fakeMessage struct {
+	mqtt.Message
+	topic   string
+	payload []byte
+}
+
+func (m fakeMessage) Topic() string   { return m.topic }
+func (m fakeMessage) Payload() []byte { return m.payload }
+func (m fakeMessage) Retained() bool  { return false }
+
+type publication struct {
+	topic   string
+	payload []byte
+}
+
+// fakePublisher records all publications. All other client methods are not implemented.
+type fakePublisher struct {
+	mqtt.Client
+	published []publication
+}
+
+func (f *fakePublisher) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	f.published = append(f.published, publication{topic: topic, payload: payload.([]byte)})
+	return &mqtt.DummyToken{}
+}
+
+func TestIngest_errorTopic(t *testing.T) {
+	now = testNow
+	config.SetProcessContext(zap.NewNop())
+	metrics := []config.BlockConfig{{
+		Metrics: []config.MetricConfig{{
+			PrometheusName: "temperature",
+			MQTTName:       "temperature",
+			ValueType:      "gauge",
+		}},
+	}}
+
+	tests := []struct {
+		name       string
+		errorTopic string
+		topic      string
+		payload    string
+		want       []ErrorEvent
+	}{
+		{
+			name:       "bad payload",
+			errorTopic: "mqtt2prometheus/errors",
+			topic:      "devices/dht22",
+			payload:    `{"temperature": "hot"}`,
+			want: []ErrorEvent{{
+				Topic:   "devices/dht22",
+				Payload: `{"temperature": "hot"}`,
+				Error:   `failed to extract metric values from topic: failed to parse valid value from 'hot' for metric "temperature": got data with unexpectd type: string ('hot') and failed to parse to float`,
+			}},
+		},
+		{
+			name:       "valid payload",
+			errorTopic: "mqtt2prometheus/errors",
+			topic:      "devices/dht22",
+			payload:    `{"temperature": 21}`,
+		},
+		{
+			name:    "disabled",
+			topic:   "devices/dht22",
+			payload: `{"temperature": "hot"}`,
+		},
+		{
+			name:       "own error events",
+			errorTopic: "mqtt2prometheus/errors",
+			topic:      "mqtt2prometheus/errors",
+			payload:    `{"temperature": "hot"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewParser(metrics, ".", "", WithStateStore(NewMemoryStateStore()))
+			collector := NewCollector(gocache.NoExpiration, metrics, zap.NewNop())
+			ingest := NewIngest(collector, NewJSONObjectExtractor(p, nil), config.MQTTConfigDefaults.DeviceIDRegex, WithErrorTopic(tt.errorTopic))
+			ingest.instrumentation.messageMetric = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test"}, []string{"status", "topic"})
+
+			client := &fakePublisher{}
+			errChan := make(chan error, 1)
+			ingest.SetupSubscriptionHandler(errChan)(client, fakeMessage{topic: tt.topic, payload: []byte(tt.payload)})
+
+			var got []ErrorEvent
+			for _, pub := range client.published {
+				if pub.topic != tt.errorTopic {
+					t.Errorf("published to %q, want %q", pub.topic, tt.errorTopic)
+				}
+				var event ErrorEvent
+				if err := json.Unmarshal(pub.payload, &event); err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, event)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got error events %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIngest_deviceIDField(t *testing.T) {
+	now = testNow
+	metrics := []config.BlockConfig{{
+		Metrics: []config.MetricConfig{{
+			PrometheusName:  "energy",
+			MQTTName:        "energy",
+			ValueType:       "counter",
+			OmitTimestamp:   true,
+			ForceMonotonicy: true,
+		}},
+	}}
+	store := NewMemoryStateStore()
+	p := NewParser(metrics, ".", "", WithStateStore(store))
+	collector := NewCollector(gocache.NoExpiration, metrics, zap.NewNop())
+	ingest := NewIngest(collector, NewJSONObjectExtractor(p, nil), config.MQTTConfigDefaults.DeviceIDRegex, WithDeviceIDField("meta.device", "."))
+
+	for _, payload := range []string{
+		`{"meta": {"device": "boiler"}, "energy": 1}`,
+		`{"meta": {"device": 42}, "energy": 1}`,
+		// Without the field, the device id is taken from the topic.
+		`{"energy": 1}`,
+	} {
+		if err := ingest.store("flat/telemetry", []byte(payload), MessageInfo{}); err != nil {
+			t.Fatalf("store() error = %v", err)
+		}
+	}
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(collector)
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gotSensor []string
+	for _, mf := range families {
+		for _, m := range mf.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "sensor" {
+					gotSensor = append(gotSensor, l.GetValue())
+				}
+			}
+		}
+	}
+	sort.Strings(gotSensor)
+	if want := []string{"42", "boiler", "telemetry"}; !reflect.DeepEqual(gotSensor, want) {
+		t.Errorf("sensor labels = %v, want %v", gotSensor, want)
+	}
+
+	keys, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(keys)
+	if want := []string{"42-flat_telemetry-energy-energy", "boiler-flat_telemetry-energy-energy", "telemetry-flat_telemetry-energy-energy"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("state keys = %v, want %v", keys, want)
+	}
+}
+
+func TestIngest_connected(t *testing.T) {
+	config.SetProcessContext(zap.NewNop())
+	ingest := NewIngest(nil, nil, config.MQTTConfigDefaults.DeviceIDRegex)
+	ingest.instrumentation.connectedMetric = prometheus.NewGauge(prometheus.GaugeOpts{Name: "test"})
+	client := &fakePublisher{}
+
+	steps := []struct {
+		name string
+		run  func()
+		want bool
+	}{
+		{name: "initial", run: func() {}, want: false},
+		{name: "connect", run: func() { ingest.OnConnectHandler(client) }, want: true},
+		{name: "connection lost", run: func() { ingest.ConnectionLostHandler(client, errors.New("EOF")) }, want: false},
+		{name: "reconnect", run: func() { ingest.OnConnectHandler(client) }, want: true},
+	}
+	for _, s := range steps {
+		s.run()
+		if got := ingest.Connected(); got != s.want {
+			t.Errorf("%s: Connected() = %v, want %v", s.name, got, s.want)
+		}
+		want := 0.0
+		if s.want {
+			want = 1
+		}
+		if got := testutil.ToFloat64(ingest.instrumentation.connectedMetric); got != want {
+			t.Errorf("%s: connected gauge = %v, want %v", s.name, got, want)
+		}
+	}
+}
+
+func TestIngest_liveness(t *testing.T) {
+	now = testNow
+	metrics := []config.BlockConfig{{
+		Metrics: []config.MetricConfig{{
+			PrometheusName: "temperature",
+			MQTTName:       "temperature",
+			ValueType:      "gauge",
+			OmitTimestamp:  true,
+		}},
+	}}
+	p := NewParser(metrics, ".", "", WithStateStore(NewMemoryStateStore()))
+	collector := NewCollector(gocache.NoExpiration, metrics, zap.NewNop())
+	liveness := NewLivenessCollector(config.LivenessConfig{
+		Topic:         "devices/+/status",
+		BirthPayloads: []string{"online", "ready"},
+		DeathPayloads: []string{"offline", "lost"},
+		MetricName:    "device_up",
+	})
+	// The default device_id_regex takes the last topic level, the device id of status messages is the "+" level of
+	// the status topic instead.
+	ingest := NewIngest(collector, NewJSONObjectExtractor(p, nil), config.MQTTConfigDefaults.DeviceIDRegex, WithLiveness(liveness))
+
+	for _, m := range []struct{ topic, payload string }{
+		{"devices/dht22/status", "Online\n"},
+		{"devices/bme280/status", "ready"},
+		{"devices/bme280/status", "lost"},
+		{"devices/dht22", `{"temperature": 21.5}`},
+	} {
+		if err := ingest.store(m.topic, []byte(m.payload), MessageInfo{Retained: true}); err != nil {
+			t.Fatalf("store(%s, %s) error = %v", m.topic, m.payload, err)
+		}
+	}
+	err := ingest.store("devices/dht22/status", []byte("rebooting"), MessageInfo{})
+	if err == nil {
+		t.Error("store() of an unknown status payload succeeded")
+	}
+
+	want := `
+# HELP device_up 1 if the last status message of the device was a birth, 0 if it was a death message
+# TYPE device_up gauge
+device_up{sensor="bme280",topic="devices/bme280/status"} 0
+device_up{sensor="dht22",topic="devices/dht22/status"} 1
+`
+	if err := testutil.CollectAndCompare(liveness, strings.NewReader(want)); err != nil {
+		t.Error(err)
+	}
+	// Status messages are not passed to the extractor.
+	if got := testutil.CollectAndCount(collector); got != 1 {
+		t.Errorf("collector has %d series, want only the temperature", got)
+	}
+}
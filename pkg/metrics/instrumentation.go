@@ -17,6 +17,36 @@ var defaultInstrumentation = instrumentation{
 			Help: "Total number of messages received per topic and status",
 		}, []string{"status", "topic"},
 	),
+	stateIOErrorMetric: prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mqtt2prometheus_state_io_errors_total",
+			Help: "Total number of failed state file operations per operation",
+		}, []string{"operation"},
+	),
+	negativeCounterMetric: prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mqtt2prometheus_negative_counter_values_total",
+			Help: "Total number of negative values parsed for counter metrics per metric",
+		}, []string{"metric"},
+	),
+	precisionLostMetric: prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mqtt2prometheus_counter_precision_lost_total",
+			Help: "Total number of counter values too large to be exact as float per metric",
+		}, []string{"metric"},
+	),
+	schemaValidationErrorMetric: prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mqtt2prometheus_schema_validation_errors_total",
+			Help: "Total number of payloads dropped for violating the payload_schema per topic",
+		}, []string{"topic"},
+	),
+	pausedMetric: prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "mqtt2prometheus_parser_paused",
+			Help: "Whether parsing is paused, see Parser.Pause",
+		},
+	),
 	connectedMetric: prometheus.NewGauge(
 		prometheus.GaugeOpts{
 			Name: "mqtt2prometheus_connected",
@@ -26,8 +56,13 @@ var defaultInstrumentation = instrumentation{
 }
 
 type instrumentation struct {
-	messageMetric   *prometheus.CounterVec
-	connectedMetric prometheus.Gauge
+	messageMetric               *prometheus.CounterVec
+	stateIOErrorMetric          *prometheus.CounterVec
+	negativeCounterMetric       *prometheus.CounterVec
+	precisionLostMetric         *prometheus.CounterVec
+	schemaValidationErrorMetric *prometheus.CounterVec
+	pausedMetric                prometheus.Gauge
+	connectedMetric             prometheus.Gauge
 }
 
 func (i *instrumentation) Collector() prometheus.Collector {
@@ -41,6 +76,11 @@ func (i *instrumentation) Describe(desc chan<- *prometheus.Desc) {
 func (i *instrumentation) Collect(metrics chan<- prometheus.Metric) {
 	i.connectedMetric.Collect(metrics)
 	i.messageMetric.Collect(metrics)
+	i.stateIOErrorMetric.Collect(metrics)
+	i.negativeCounterMetric.Collect(metrics)
+	i.precisionLostMetric.Collect(metrics)
+	i.schemaValidationErrorMetric.Collect(metrics)
+	i.pausedMetric.Collect(metrics)
 }
 
 func (i *instrumentation) CountSuccess(topic string) {
@@ -0,0 +1,94 @@
+package metrics
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/hikhvar/mqtt2prometheus/pkg/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// LivenessCollector exposes the state of the devices publishing birth and death messages, see config.LivenessConfig.
+// Unlike the samples of the MemoryCachedCollector, the state never expires, since status messages are usually sent
+// only on changes.
+type LivenessCollector struct {
+	cfg  config.LivenessConfig
+	desc *prometheus.Desc
+
+	mu      sync.Mutex
+	devices map[string]deviceLiveness
+}
+
+type deviceLiveness struct {
+	topic string
+	up    bool
+}
+
+func NewLivenessCollector(cfg config.LivenessConfig) *LivenessCollector {
+	return &LivenessCollector{
+		cfg:     cfg,
+		desc:    prometheus.NewDesc(cfg.MetricName, "1 if the last status message of the device was a birth, 0 if it was a death message", []string{"sensor", "topic"}, nil),
+		devices: make(map[string]deviceLiveness),
+	}
+}
+
+// Matches reports whether the topic is a status topic.
+func (l *LivenessCollector) Matches(topic string) bool {
+	return config.TopicFilterCovers(l.cfg.Topic, topic)
+}
+
+// DeviceID returns the device id of the status topic, see config.LivenessConfig.DeviceID.
+func (l *LivenessCollector) DeviceID(topic string) string {
+	return l.cfg.DeviceID(topic)
+}
+
+// Observe records the status message of the device. Payloads which are neither a birth nor a death are an error.
+func (l *LivenessCollector) Observe(deviceID, topic string, payload []byte) error {
+	up, err := l.parse(payload)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.devices[deviceID] = deviceLiveness{topic: topic, up: up}
+	return nil
+}
+
+func (l *LivenessCollector) parse(payload []byte) (bool, error) {
+	p := strings.TrimSpace(string(payload))
+	for _, birth := range l.cfg.BirthPayloads {
+		if strings.EqualFold(p, strings.TrimSpace(birth)) {
+			return true, nil
+		}
+	}
+	for _, death := range l.cfg.DeathPayloads {
+		if strings.EqualFold(p, strings.TrimSpace(death)) {
+			return false, nil
+		}
+	}
+	return false, fmt.Errorf("status payload %q is neither a birth nor a death payload", p)
+}
+
+func (l *LivenessCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- l.desc
+}
+
+func (l *LivenessCollector) Collect(ch chan<- prometheus.Metric) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ids := make([]string, 0, len(l.devices))
+	for id := range l.devices {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		d := l.devices[id]
+		var value float64
+		if d.up {
+			value = 1
+		}
+		ch <- prometheus.MustNewConstMetric(l.desc, prometheus.GaugeValue, value, id, d.topic)
+	}
+}
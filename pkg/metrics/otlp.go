@@ -0,0 +1,337 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hikhvar/mqtt2prometheus/pkg/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// Output receives the metrics parsed from each message, in addition to the collector exposing them.
+type Output interface {
+	Observe(deviceID string, collection MetricCollection)
+}
+
+// Values of the OTLP AggregationTemporality enum.
+const otlpTemporalityCumulative = 2
+
+// Default service.name resource attribute of pushed metrics.
+const otlpDefaultServiceName = "mqtt2prometheus"
+
+// The types below mirror the OTLP metrics protobuf messages in their JSON mapping, see
+// https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding. Only the fields used by this exporter are present.
+
+type otlpRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope    `json:"scope"`
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpMetric struct {
+	Name        string     `json:"name"`
+	Description string     `json:"description,omitempty"`
+	Gauge       *otlpGauge `json:"gauge,omitempty"`
+	Sum         *otlpSum   `json:"sum,omitempty"`
+}
+
+type otlpGauge struct {
+	DataPoints []otlpDataPoint `json:"dataPoints"`
+}
+
+type otlpSum struct {
+	DataPoints             []otlpDataPoint `json:"dataPoints"`
+	AggregationTemporality int             `json:"aggregationTemporality"`
+	IsMonotonic            bool            `json:"isMonotonic"`
+}
+
+type otlpDataPoint struct {
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano,omitempty"`
+	TimeUnixNano      string          `json:"timeUnixNano"`
+	AsDouble          *otlpDouble     `json:"asDouble,omitempty"`
+	AsInt             string          `json:"asInt,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+// otlpDouble encodes the special float values as strings, like the protobuf JSON mapping does.
+type otlpDouble float64
+
+func (d otlpDouble) MarshalJSON() ([]byte, error) {
+	f := float64(d)
+	switch {
+	case math.IsNaN(f):
+		return []byte(`"NaN"`), nil
+	case math.IsInf(f, 1):
+		return []byte(`"Infinity"`), nil
+	case math.IsInf(f, -1):
+		return []byte(`"-Infinity"`), nil
+	}
+	return json.Marshal(f)
+}
+
+// otlpDesc holds the parts of a prometheus.Desc needed for the conversion, which the Desc does not expose.
+type otlpDesc struct {
+	name        string
+	help        string
+	valueType   prometheus.ValueType
+	constLabels []otlpAttribute
+}
+
+// OTLPExporter pushes the observed metrics to an OpenTelemetry collector via OTLP/HTTP with JSON encoding. The samples
+// observed between two pushes are sent at once, samples of a failed push are dropped.
+type OTLPExporter struct {
+	cfg    config.OTLPConfig
+	client *http.Client
+	logger *zap.Logger
+	// Descriptions of all possible metrics by the string representation of their prometheus.Desc.
+	descs map[string]otlpDesc
+
+	// Start of the cumulative sums of series first seen since, see startTime.
+	started time.Time
+
+	mu      sync.Mutex
+	pending map[string][]otlpDataPoint
+	// The start time and the last value of the cumulative sums by series, see startTime.
+	sums map[string]otlpSumSeries
+}
+
+// otlpSumSeries is the state of the cumulative sum of a counter series.
+type otlpSumSeries struct {
+	start time.Time
+	last  float64
+	time  time.Time
+}
+
+func NewOTLPExporter(cfg config.OTLPConfig, possibleMetrics []config.BlockConfig, logger *zap.Logger) *OTLPExporter {
+	descs := make(map[string]otlpDesc)
+	for _, blocks := range possibleMetrics {
+		for i := range blocks.Metrics {
+			m := &blocks.Metrics[i]
+			constLabels := make([]otlpAttribute, 0, len(m.ConstantLabels))
+			for k, v := range m.ConstantLabels {
+				constLabels = append(constLabels, otlpAttribute{Key: k, Value: otlpAnyValue{StringValue: v}})
+			}
+			sort.Slice(constLabels, func(i, j int) bool { return constLabels[i].Key < constLabels[j].Key })
+			for _, name := range m.PrometheusNames() {
+				descs[m.PrometheusDescriptionFor(name).String()] = otlpDesc{
+					name:        name,
+					help:        m.Help,
+					valueType:   m.PrometheusValueType(),
+					constLabels: constLabels,
+				}
+			}
+		}
+	}
+	return &OTLPExporter{
+		cfg:     cfg,
+		client:  &http.Client{Timeout: cfg.Timeout},
+		logger:  logger,
+		descs:   descs,
+		started: now(),
+		pending: make(map[string][]otlpDataPoint),
+		sums:    make(map[string]otlpSumSeries),
+	}
+}
+
+// Observe queues the metrics for the next push. Only the metric itself is pushed, none of its companion series like
+// the age, raw value, availability, rate or delta.
+func (e *OTLPExporter) Observe(deviceID string, collection MetricCollection) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, m := range collection {
+		if m.Description == nil {
+			continue
+		}
+		key := m.Description.String()
+		desc, ok := e.descs[key]
+		if !ok {
+			e.logger.Debug("No OTLP description for metric", zap.String("description", key))
+			continue
+		}
+		// Metrics without a timestamp, e.g. with omit_timestamp, are stamped with the current time.
+		ts := m.IngestTime
+		if ts.IsZero() {
+			ts = now()
+		}
+		dp := desc.dataPoint(deviceID, m, ts)
+		if desc.valueType == prometheus.CounterValue {
+			dp.StartTimeUnixNano = strconv.FormatInt(e.startTime(key, dp, m, ts).UnixNano(), 10)
+		}
+		e.pending[key] = append(e.pending[key], dp)
+	}
+}
+
+// startTime returns the start of the cumulative sum of the series of the data point, the start of the exporter for
+// series first seen since. A decreasing value is a counter reset, the sum starts anew at the time of the previous data
+// point then. The start is never later than the data point itself.
+func (e *OTLPExporter) startTime(key string, dp otlpDataPoint, m Metric, ts time.Time) time.Time {
+	for _, a := range dp.Attributes {
+		key += "\xff" + a.Value.StringValue
+	}
+	value := m.Value
+	if m.IntValue != nil {
+		value = float64(*m.IntValue)
+	}
+	series, ok := e.sums[key]
+	if !ok {
+		series.start = e.started
+	} else if value < series.last {
+		series.start = series.time
+	}
+	if ts.Before(series.start) {
+		series.start = ts
+	}
+	series.last, series.time = value, ts
+	e.sums[key] = series
+	return series.start
+}
+
+// dataPoint converts the metric into an OTLP data point at the given time. The labels become attributes, the
+// const_labels last.
+func (d otlpDesc) dataPoint(deviceID string, m Metric, ts time.Time) otlpDataPoint {
+	attributes := make([]otlpAttribute, 0, 2+len(m.LabelsKeys)+len(d.constLabels))
+	attributes = append(attributes,
+		otlpAttribute{Key: "sensor", Value: otlpAnyValue{StringValue: deviceID}},
+		otlpAttribute{Key: "topic", Value: otlpAnyValue{StringValue: m.Topic}},
+	)
+	for _, k := range m.LabelsKeys {
+		attributes = append(attributes, otlpAttribute{Key: k, Value: otlpAnyValue{StringValue: m.Labels[k]}})
+	}
+	attributes = append(attributes, d.constLabels...)
+
+	dp := otlpDataPoint{
+		Attributes:   attributes,
+		TimeUnixNano: strconv.FormatInt(ts.UnixNano(), 10),
+	}
+	if m.IntValue != nil {
+		dp.AsInt = strconv.FormatInt(*m.IntValue, 10)
+	} else {
+		v := otlpDouble(m.Value)
+		dp.AsDouble = &v
+	}
+	return dp
+}
+
+// metric returns the OTLP metric holding the data points. Counters are cumulative monotonic sums, gauges and untyped
+// metrics are gauges.
+func (d otlpDesc) metric(dataPoints []otlpDataPoint) otlpMetric {
+	m := otlpMetric{Name: d.name, Description: d.help}
+	if d.valueType == prometheus.CounterValue {
+		m.Sum = &otlpSum{DataPoints: dataPoints, AggregationTemporality: otlpTemporalityCumulative, IsMonotonic: true}
+	} else {
+		m.Gauge = &otlpGauge{DataPoints: dataPoints}
+	}
+	return m
+}
+
+// request takes all pending data points and returns the request pushing them, nil if there are none.
+func (e *OTLPExporter) request() *otlpRequest {
+	e.mu.Lock()
+	pending := e.pending
+	e.pending = make(map[string][]otlpDataPoint)
+	e.mu.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	ms := make([]otlpMetric, 0, len(pending))
+	for key, dataPoints := range pending {
+		ms = append(ms, e.descs[key].metric(dataPoints))
+	}
+	sort.SliceStable(ms, func(i, j int) bool { return ms[i].Name < ms[j].Name })
+
+	serviceName := e.cfg.ServiceName
+	if serviceName == "" {
+		serviceName = otlpDefaultServiceName
+	}
+	return &otlpRequest{ResourceMetrics: []otlpResourceMetrics{{
+		Resource: otlpResource{Attributes: []otlpAttribute{
+			{Key: "service.name", Value: otlpAnyValue{StringValue: serviceName}},
+		}},
+		ScopeMetrics: []otlpScopeMetrics{{
+			Scope:   otlpScope{Name: otlpDefaultServiceName},
+			Metrics: ms,
+		}},
+	}}}
+}
+
+// Push sends all data points observed since the last push.
+func (e *OTLPExporter) Push(ctx context.Context) error {
+	r := e.request()
+	if r == nil {
+		return nil
+	}
+	body, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("failed to encode OTLP request: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.cfg.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to push metrics to %s: %w", e.cfg.Endpoint, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("failed to push metrics to %s: %s: %s", e.cfg.Endpoint, resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// Run pushes the metrics every interval until the context is done. Failed pushes are logged.
+func (e *OTLPExporter) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := e.Push(ctx); err != nil {
+				e.logger.Warn("Could not push metrics via OTLP", zap.Error(err))
+			}
+		}
+	}
+}
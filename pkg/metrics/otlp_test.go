@@ -0,0 +1,196 @@
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hikhvar/mqtt2prometheus/pkg/config"
+	"go.uber.org/zap"
+)
+
+func TestOTLPExporter_Push(t *testing.T) {
+	now = testNow
+	ingestTime := testNow().Add(-time.Minute)
+	temperature := config.MetricConfig{
+		PrometheusName: "temperature",
+		Help:           "Temperature in °C",
+		ValueType:      config.GaugeValueType,
+		ConstantLabels: map[string]string{"site": "hq"},
+		DynamicLabels:  map[string]string{"room": `"kitchen"`},
+	}
+	energy := config.MetricConfig{
+		PrometheusName: "energy_total",
+		ValueType:      config.CounterValueType,
+	}
+	state := config.MetricConfig{
+		PrometheusName: "state",
+	}
+	blocks := []config.BlockConfig{{Metrics: []config.MetricConfig{temperature, energy, state}}}
+	intValue := int64(9007199254740993)
+
+	var gotBody []byte
+	var gotHeader http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotHeader = r.Header
+		gotBody, _ = io.ReadAll(r.Body)
+	}))
+	defer srv.Close()
+
+	e := NewOTLPExporter(config.OTLPConfig{
+		Endpoint: srv.URL,
+		Headers:  map[string]string{"Authorization": "Bearer secret"},
+	}, blocks, zap.NewNop())
+	e.Observe("dht22", MetricCollection{
+		{
+			Description: temperature.PrometheusDescription(),
+			Value:       21.5,
+			IngestTime:  ingestTime,
+			Topic:       "devices/dht22",
+			Labels:      map[string]string{"room": "kitchen"},
+			LabelsKeys:  []string{"room"},
+		},
+		{
+			Description: energy.PrometheusDescription(),
+			Value:       float64(intValue),
+			IntValue:    &intValue,
+			IngestTime:  ingestTime,
+			Topic:       "devices/dht22",
+		},
+		{
+			Description: state.PrometheusDescription(),
+			Value:       math.NaN(),
+			Topic:       "devices/dht22",
+		},
+	})
+	if err := e.Push(context.Background()); err != nil {
+		t.Fatalf("Push() error = %v", err)
+	}
+
+	if got := gotHeader.Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", got)
+	}
+	if got := gotHeader.Get("Authorization"); got != "Bearer secret" {
+		t.Errorf("Authorization = %q, want the configured header", got)
+	}
+	ingestNanos := strconv.FormatInt(ingestTime.UnixNano(), 10)
+	nowNanos := strconv.FormatInt(testNow().UnixNano(), 10)
+	want := `{"resourceMetrics": [{
+		"resource": {"attributes": [{"key": "service.name", "value": {"stringValue": "mqtt2prometheus"}}]},
+		"scopeMetrics": [{
+			"scope": {"name": "mqtt2prometheus"},
+			"metrics": [
+				{"name": "energy_total", "sum": {"aggregationTemporality": 2, "isMonotonic": true, "dataPoints": [{
+					"attributes": [
+						{"key": "sensor", "value": {"stringValue": "dht22"}},
+						{"key": "topic", "value": {"stringValue": "devices/dht22"}}
+					],
+					"startTimeUnixNano": "` + ingestNanos + `",
+					"timeUnixNano": "` + ingestNanos + `",
+					"asInt": "9007199254740993"
+				}]}},
+				{"name": "state", "gauge": {"dataPoints": [{
+					"attributes": [
+						{"key": "sensor", "value": {"stringValue": "dht22"}},
+						{"key": "topic", "value": {"stringValue": "devices/dht22"}}
+					],
+					"timeUnixNano": "` + nowNanos + `",
+					"asDouble": "NaN"
+				}]}},
+				{"name": "temperature", "description": "Temperature in °C", "gauge": {"dataPoints": [{
+					"attributes": [
+						{"key": "sensor", "value": {"stringValue": "dht22"}},
+						{"key": "topic", "value": {"stringValue": "devices/dht22"}},
+						{"key": "room", "value": {"stringValue": "kitchen"}},
+						{"key": "site", "value": {"stringValue": "hq"}}
+					],
+					"timeUnixNano": "` + ingestNanos + `",
+					"asDouble": 21.5
+				}]}}
+			]
+		}]
+	}]}`
+	var gotJSON, wantJSON interface{}
+	if err := json.Unmarshal(gotBody, &gotJSON); err != nil {
+		t.Fatalf("invalid request body %s: %v", gotBody, err)
+	}
+	if err := json.Unmarshal([]byte(want), &wantJSON); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gotJSON, wantJSON) {
+		t.Errorf("request body = %s, want %s", gotBody, want)
+	}
+
+	// The pushed data points are not sent again.
+	gotBody = nil
+	if err := e.Push(context.Background()); err != nil {
+		t.Fatalf("Push() error = %v", err)
+	}
+	if gotBody != nil {
+		t.Errorf("Push() without new samples sent %s", gotBody)
+	}
+}
+
+func TestOTLPExporter_PushError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	}))
+	defer srv.Close()
+	cfg := config.MetricConfig{PrometheusName: "temperature"}
+	e := NewOTLPExporter(config.OTLPConfig{Endpoint: srv.URL}, []config.BlockConfig{{Metrics: []config.MetricConfig{cfg}}}, zap.NewNop())
+	e.Observe("dht22", MetricCollection{{Description: cfg.PrometheusDescription(), Value: 1}})
+
+	err := e.Push(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "401 Unauthorized: unauthorized") {
+		t.Errorf("Push() error = %v, want the status and the response", err)
+	}
+}
+
+func TestOTLPExporter_startTime(t *testing.T) {
+	now = testNow
+	defer func() { testNowElapsed = 0 }()
+	energy := config.MetricConfig{
+		PrometheusName: "energy_total",
+		ValueType:      config.CounterValueType,
+		DynamicLabels:  map[string]string{"room": `"kitchen"`},
+	}
+	e := NewOTLPExporter(config.OTLPConfig{}, []config.BlockConfig{{Metrics: []config.MetricConfig{energy}}}, zap.NewNop())
+	started := testNow()
+	samples := []struct {
+		room      string
+		value     float64
+		elapsed   time.Duration
+		wantStart time.Time
+	}{
+		{room: "kitchen", value: 10, elapsed: time.Minute, wantStart: started},
+		{room: "bath", value: 5, elapsed: 2 * time.Minute, wantStart: started},
+		{room: "kitchen", value: 12, elapsed: 3 * time.Minute, wantStart: started},
+		// A reset starts the sum anew after the previous data point.
+		{room: "kitchen", value: 2, elapsed: 4 * time.Minute, wantStart: started.Add(3 * time.Minute)},
+		{room: "kitchen", value: 3, elapsed: 5 * time.Minute, wantStart: started.Add(3 * time.Minute)},
+		{room: "bath", value: 6, elapsed: 6 * time.Minute, wantStart: started},
+	}
+	key := energy.PrometheusDescription().String()
+	for i, s := range samples {
+		testNowElapsed = s.elapsed
+		e.Observe("meter", MetricCollection{{
+			Description: energy.PrometheusDescription(),
+			Value:       s.value,
+			IngestTime:  testNow(),
+			Labels:      map[string]string{"room": s.room},
+			LabelsKeys:  []string{"room"},
+		}})
+		got := e.pending[key][i].StartTimeUnixNano
+		if want := strconv.FormatInt(s.wantStart.UnixNano(), 10); got != want {
+			t.Errorf("sample %d: startTimeUnixNano = %s, want %s", i, got, want)
+		}
+	}
+}
@@ -1,20 +1,30 @@
 package metrics
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"math"
 	"os"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/expr-lang/expr"
 	"github.com/expr-lang/expr/vm"
 	"github.com/hikhvar/mqtt2prometheus/pkg/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"go.uber.org/zap"
 	"gopkg.in/yaml.v2"
 )
 
+// errSkipSample is returned by parseMetric if the sample must not be exported.
+var errSkipSample = errors.New("sample skipped")
+
 // dynamicState holds the runtime information for dynamic metric configs.
 type dynamicState struct {
 	// Basline value to add to each parsed metric value to maintain monotonicy
@@ -31,6 +41,34 @@ type dynamicState struct {
 	LastExprResultString string `yaml:"last_expr_result_string"`
 	// Last result returned from evaluating the given expression
 	LastExprTimestamp time.Time `yaml:"last_expr_timestamp"`
+	// The last values before evaluating the expression, oldest first
+	Window []float64 `yaml:"window,omitempty"`
+	// Last value that was used for evaluating the given expression of an integer metric
+	LastExprIntValue int64 `yaml:"last_expr_int_value,omitempty"`
+	// Last result returned from evaluating the given expression of an integer metric
+	LastExprIntResult int64 `yaml:"last_expr_int_result,omitempty"`
+	// Last values of the sources of a derived metric, by the index of the source
+	DerivedSources map[int]float64 `yaml:"derived_sources,omitempty"`
+	// Start of the current reset_interval bucket
+	BucketStart time.Time `yaml:"bucket_start,omitempty"`
+	// Value at the start of the current reset_interval bucket, subtracted from all values in the bucket
+	BucketBaseline float64 `yaml:"bucket_baseline,omitempty"`
+	// Last value seen in the current reset_interval bucket, before the baseline was subtracted
+	BucketLastValue float64 `yaml:"bucket_last_value,omitempty"`
+	// The last values before despiking, oldest first
+	DespikeWindow []float64 `yaml:"despike_window,omitempty"`
+	// The last metric emitted for configs with persist_last_value
+	LastEmitted *persistedMetric `yaml:"last_emitted,omitempty"`
+	// The value and the time of the last sample not suppressed by min_change
+	LastEmittedValue *float64  `yaml:"last_emitted_value,omitempty"`
+	LastEmitTime     time.Time `yaml:"last_emit_time,omitempty"`
+	// The value of the last sample of configs with emit_delta
+	LastDeltaValue *float64 `yaml:"last_delta_value,omitempty"`
+	// The value and the time of the last sample of configs with emit_rate
+	LastRateValue *float64  `yaml:"last_rate_value,omitempty"`
+	LastRateTime  time.Time `yaml:"last_rate_time,omitempty"`
+	// The latest timestamp taken from the timestamp_field of a sample
+	LastTimestamp time.Time `yaml:"last_timestamp,omitempty"`
 }
 
 // metricState holds runtime information per metric configuration.
@@ -42,6 +80,19 @@ type metricState struct {
 	program *vm.Program
 	// Environment in which the expression is evaluated
 	env map[string]interface{}
+	// Set if there was no stored state, until force_monotonicy seeded the offset
+	unseeded bool
+	// Receive times of the samples of configs with expected_interval, not persisted
+	availability *availability
+	// The last time a counter reset forced a flush, see resetFlush
+	lastResetFlush time.Time
+	// Error of the last failed compilation, returned until compileRetryAt, see compileProgram
+	compileErr      error
+	compileRetryAt  time.Time
+	compileFailures int
+	// The functions called by the wrappers in env and the deadline of the current evaluation, see interruptible
+	funcs    map[string]reflect.Value
+	deadline time.Time
 }
 
 type Parser struct {
@@ -49,31 +100,118 @@ type Parser struct {
 	// Maps the mqtt metric name to a list of configs
 	// The first that matches SensorNameFilter will be used
 	metricConfigs map[string][]*config.MetricConfig
-	// Directory holding state files
-	stateDir string
+	// Configs matching metric names by the mqtt_name_pattern instead of the exact name
+	patternConfigs []*config.MetricConfig
+	// Set if any config has integer_value
+	integerValues bool
 	// Per-metric state
 	states map[string]*metricState
+	// Whether the configs of the parser are plain, see isPlain
+	plainConfigs map[*config.MetricConfig]bool
+	// Cached descriptions of plain configs, see parsePlainValue
+	plainMetrics map[*config.MetricConfig]plainMetric
+	// Compiled transforms by config, see applyTransforms
+	transforms map[*config.MetricConfig]func(float64) float64
+	// Window of the availability of configs with expected_interval, the cache timeout
+	availabilityWindow time.Duration
+	// Upper bound for a single expression evaluation, disabled if not positive
+	exprTimeout time.Duration
+	// Persists the dynamic state of metrics
+	store StateStore
+	// Sizes of the stored states, shared by all copies of the parser, see StateCollector
+	stateSizes *stateSizes
+	// Failed state store operations waiting for their retry, see retryStateIO
+	stateIORetries map[stateIOKey]*stateIORetry
+	// Counts failed state file operations
+	stateIOErrors *prometheus.CounterVec
+	// Counts negative values of counter metrics
+	negativeCounters *prometheus.CounterVec
+	// Counts counter values beyond the exact integer range of float64
+	precisionLost *prometheus.CounterVec
+	// Shared by all copies of the parser, see Pause
+	pause  *pauseControl
+	logger *zap.Logger
+}
+
+// pauseControl holds whether parsing is paused. Its lock is held while a sample is parsed, so pausing waits for the
+// sample in progress.
+type pauseControl struct {
+	mu     sync.Mutex
+	paused bool
+	gauge  prometheus.Gauge
+}
+
+// ParserOption configures optional behaviour of a Parser.
+type ParserOption func(*Parser)
+
+// WithExpressionTimeout limits the time a single expression evaluation may take.
+// A timeout which is not positive disables the limit.
+func WithExpressionTimeout(timeout time.Duration) ParserOption {
+	return func(p *Parser) {
+		p.exprTimeout = timeout
+	}
+}
+
+// WithAvailabilityWindow sets the window within which the samples of configs with expected_interval are counted. It
+// should be the cache timeout, the default is the one of config.CacheConfigDefaults. A window which is not positive,
+// like a disabled cache timeout, keeps the default.
+func WithAvailabilityWindow(window time.Duration) ParserOption {
+	return func(p *Parser) {
+		if window > 0 {
+			p.availabilityWindow = window
+		}
+	}
+}
+
+// WithLogger sets the logger for skipped samples, failing expressions and state store issues.
+// By default, nothing is logged.
+func WithLogger(logger *zap.Logger) ParserOption {
+	return func(p *Parser) {
+		p.logger = logger
+	}
 }
 
 // Identifiers within the expression evaluation environment.
 const (
 	env_raw_value      = "raw_value"
+	env_raw_string     = "raw_string"
 	env_value          = "value"
 	env_last_value     = "last_value"
 	env_last_raw_value = "last_raw_value"
 	env_last_result    = "last_result"
 	env_elapsed        = "elapsed"
+	env_metric_name    = "metric_name"
 	env_now            = "now"
 	env_int            = "int"
 	env_float          = "float"
 	env_round          = "round"
+	env_round_even     = "round_even"
+	env_round_to       = "round_to"
 	env_ceil           = "ceil"
 	env_floor          = "floor"
 	env_abs            = "abs"
 	env_min            = "min"
 	env_max            = "max"
+	env_c_to_f         = "c_to_f"
+	env_c_to_k         = "c_to_k"
+	env_f_to_c         = "f_to_c"
+	env_f_to_k         = "f_to_k"
+	env_k_to_c         = "k_to_c"
+	env_k_to_f         = "k_to_f"
+	env_percentile     = "percentile"
+	env_bit            = "bit"
+	env_band           = "band"
+	env_bor            = "bor"
+	env_bxor           = "bxor"
+	env_bshl           = "bshl"
+	env_bshr           = "bshr"
+	env_field          = "field"
+	env_offset         = "offset"
 )
 
+// Offset between the Celsius and the Kelvin scale.
+const kelvinOffset = 273.15
+
 var now = time.Now
 
 func toInt64(i interface{}) int64 {
@@ -90,6 +228,12 @@ func toInt64(i interface{}) int64 {
 		return v
 	case time.Duration:
 		return int64(v)
+	case json.Number:
+		value, err := v.Int64()
+		if err != nil {
+			panic(err)
+		}
+		return value
 	case string:
 		value, err := strconv.ParseInt(v, 10, 64)
 		if err != nil {
@@ -101,6 +245,107 @@ func toInt64(i interface{}) int64 {
 	}
 }
 
+// toExactInt64 converts the given value to an int64 without loss of precision. Floating point values must be
+// integral and strings must contain a decimal integer.
+func toExactInt64(i interface{}) (int64, error) {
+	switch v := i.(type) {
+	case json.Number:
+		return v.Int64()
+	case string:
+		return strconv.ParseInt(v, 10, 64)
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	case int:
+		return int64(v), nil
+	case int64:
+		return v, nil
+	case float64:
+		if v != math.Trunc(v) || v < math.MinInt64 || v >= math.MaxInt64 {
+			return 0, fmt.Errorf("got float value %v which is not an exact integer", v)
+		}
+		return int64(v), nil
+	}
+	return 0, fmt.Errorf("got data with unexpectd type: %T ('%v')", i, i)
+}
+
+// thresholdLabel returns the label value of the first threshold the value is below. If there is none, the label
+// is empty.
+func thresholdLabel(thresholds []config.LabelThreshold, value float64) string {
+	for _, th := range thresholds {
+		if th.Below == nil || value < *th.Below {
+			return th.Value
+		}
+	}
+	return ""
+}
+
+// roundTo rounds the value half away from zero to the given number of decimal places.
+func roundTo(value float64, places int) float64 {
+	factor := math.Pow(10, float64(places))
+	return math.Round(value*factor) / factor
+}
+
+// roundToPlaces rounds x half away from zero to the given number of decimal places, for use in expressions.
+func roundToPlaces(x interface{}, places interface{}) float64 {
+	return roundTo(toFloat64(x), int(toInt64(places)))
+}
+
+// normalizeDecimal rewrites a number formatted with the given decimal separator, so strconv.ParseFloat accepts it.
+// The other one of "." and "," is taken as thousands separator and removed, like spaces.
+func normalizeDecimal(s, separator string) string {
+	switch separator {
+	case ",":
+		return strings.NewReplacer(".", "", " ", "", ",", ".").Replace(s)
+	case ".":
+		return strings.NewReplacer(",", "", " ", "").Replace(s)
+	default:
+		return s
+	}
+}
+
+// stripSuffix removes the longest matching unit suffix and surrounding spaces from a string value. It returns the
+// scale of the removed suffix, 1 if it has none or no suffix matched.
+func stripSuffix(s string, suffixes []config.StripSuffix) (string, float64) {
+	s = strings.TrimSpace(s)
+	match := -1
+	for i, ss := range suffixes {
+		if strings.HasSuffix(s, ss.Suffix) && (match < 0 || len(ss.Suffix) > len(suffixes[match].Suffix)) {
+			match = i
+		}
+	}
+	if match < 0 {
+		return s, 1
+	}
+	scale := suffixes[match].Scale
+	if scale == 0 {
+		scale = 1
+	}
+	return strings.TrimSpace(strings.TrimSuffix(s, suffixes[match].Suffix)), scale
+}
+
+// rawString returns the original string form of a raw value. Numbers are formatted without exponent and structured
+// values are encoded as JSON.
+func rawString(i interface{}) string {
+	switch v := i.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case map[string]interface{}, []interface{}:
+		if b, err := json.Marshal(v); err == nil {
+			return string(b)
+		}
+	}
+	return fmt.Sprint(i)
+}
+
 func toFloat64(i interface{}) float64 {
 	switch v := i.(type) {
 	case float32:
@@ -115,6 +360,12 @@ func toFloat64(i interface{}) float64 {
 		return float64(v)
 	case time.Duration:
 		return float64(v)
+	case json.Number:
+		value, err := v.Float64()
+		if err != nil {
+			panic(err)
+		}
+		return value
 	case string:
 		value, err := strconv.ParseFloat(v, 64)
 		if err != nil {
@@ -126,50 +377,262 @@ func toFloat64(i interface{}) float64 {
 	}
 }
 
+// bit returns the n-th bit of x, counting from the least significant bit 0.
+func bit(x interface{}, n interface{}) int64 {
+	return toInt64(x) >> uint64(toInt64(n)) & 1
+}
+
+func band(x interface{}, y interface{}) int64 {
+	return toInt64(x) & toInt64(y)
+}
+
+func bor(x interface{}, y interface{}) int64 {
+	return toInt64(x) | toInt64(y)
+}
+
+func bxor(x interface{}, y interface{}) int64 {
+	return toInt64(x) ^ toInt64(y)
+}
+
+// bshl shifts x left by n bits.
+func bshl(x interface{}, n interface{}) int64 {
+	return toInt64(x) << uint64(toInt64(n))
+}
+
+// bshr shifts x right by n bits, keeping the sign.
+func bshr(x interface{}, n interface{}) int64 {
+	return toInt64(x) >> uint64(toInt64(n))
+}
+
+// minOf returns the smallest of the given numbers.
+func minOf(x interface{}, ys ...interface{}) float64 {
+	result := toFloat64(x)
+	for _, y := range ys {
+		result = math.Min(result, toFloat64(y))
+	}
+	return result
+}
+
+// maxOf returns the largest of the given numbers.
+func maxOf(x interface{}, ys ...interface{}) float64 {
+	result := toFloat64(x)
+	for _, y := range ys {
+		result = math.Max(result, toFloat64(y))
+	}
+	return result
+}
+
+// celsiusToFahrenheit converts the temperature c from degree Celsius to degree Fahrenheit.
+func celsiusToFahrenheit(c interface{}) float64 {
+	return toFloat64(c)*9/5 + 32
+}
+
+// celsiusToKelvin converts the temperature c from degree Celsius to Kelvin.
+func celsiusToKelvin(c interface{}) float64 {
+	return toFloat64(c) + kelvinOffset
+}
+
+// fahrenheitToCelsius converts the temperature f from degree Fahrenheit to degree Celsius.
+func fahrenheitToCelsius(f interface{}) float64 {
+	return (toFloat64(f) - 32) * 5 / 9
+}
+
+// fahrenheitToKelvin converts the temperature f from degree Fahrenheit to Kelvin.
+func fahrenheitToKelvin(f interface{}) float64 {
+	return fahrenheitToCelsius(f) + kelvinOffset
+}
+
+// kelvinToCelsius converts the temperature k from Kelvin to degree Celsius.
+func kelvinToCelsius(k interface{}) float64 {
+	return toFloat64(k) - kelvinOffset
+}
+
+// kelvinToFahrenheit converts the temperature k from Kelvin to degree Fahrenheit.
+func kelvinToFahrenheit(k interface{}) float64 {
+	return celsiusToFahrenheit(kelvinToCelsius(k))
+}
+
+// payloadField returns a function looking up fields of the decoded payload by their path, joined by the separator.
+// For missing fields, the optional default value is returned, or nil if there is none.
+func payloadField(payload interface{}, separator string) func(name string, def ...interface{}) interface{} {
+	return func(name string, def ...interface{}) interface{} {
+		var missing interface{}
+		if len(def) > 0 {
+			missing = def[0]
+		}
+		value := payload
+		for _, key := range strings.Split(name, separator) {
+			obj, ok := value.(map[string]interface{})
+			if !ok {
+				return missing
+			}
+			if value, ok = obj[key]; !ok {
+				return missing
+			}
+		}
+		if value == nil {
+			return missing
+		}
+		return value
+	}
+}
+
+// windowPercentile returns a function computing the p-th percentile of the given window. The percentile is
+// linearly interpolated between the closest ranks. An empty window yields NaN.
+func windowPercentile(window []float64) func(p interface{}) float64 {
+	sorted := append([]float64(nil), window...)
+	sort.Float64s(sorted)
+	return func(p interface{}) float64 {
+		if len(sorted) == 0 {
+			return math.NaN()
+		}
+		rank := math.Max(0, math.Min(100, toFloat64(p))) / 100 * float64(len(sorted)-1)
+		lower, upper := int(math.Floor(rank)), int(math.Ceil(rank))
+		return sorted[lower] + (sorted[upper]-sorted[lower])*(rank-float64(lower))
+	}
+}
+
 // defaultExprEnv returns the default environment for expression evaluation.
 func defaultExprEnv() map[string]interface{} {
 	return map[string]interface{}{
 		// Variables
 		env_raw_value:   nil,
+		env_raw_string:  "",
 		env_value:       0.0,
 		env_last_value:  0.0,
 		env_last_result: 0.0,
 		env_elapsed:     time.Duration(0),
+		env_offset:      0.0,
+		env_metric_name: "",
 		// Functions
-		env_now:   now,
-		env_int:   toInt64,
-		env_float: toFloat64,
-		env_round: math.Round,
-		env_ceil:  math.Ceil,
-		env_floor: math.Floor,
-		env_abs:   math.Abs,
-		env_min:   math.Min,
-		env_max:   math.Max,
+		env_now:        now,
+		env_int:        toInt64,
+		env_float:      toFloat64,
+		env_round:      math.Round,
+		env_round_even: math.RoundToEven,
+		env_round_to:   roundToPlaces,
+		env_ceil:       math.Ceil,
+		env_floor:      math.Floor,
+		env_abs:        math.Abs,
+		env_min:        minOf,
+		env_max:        maxOf,
+		// Functions over the window of the last values
+		env_percentile: windowPercentile(nil),
+		// Access to other fields of the payload
+		env_field: payloadField(nil, ""),
+		// Bit manipulation of integers
+		env_bit:  bit,
+		env_band: band,
+		env_bor:  bor,
+		env_bxor: bxor,
+		env_bshl: bshl,
+		env_bshr: bshr,
+		// Temperature conversions
+		env_c_to_f: celsiusToFahrenheit,
+		env_c_to_k: celsiusToKelvin,
+		env_f_to_c: fahrenheitToCelsius,
+		env_f_to_k: fahrenheitToKelvin,
+		env_k_to_c: kelvinToCelsius,
+		env_k_to_f: kelvinToFahrenheit,
 	}
 }
 
-func NewParser(metric []config.BlockConfig, separator, stateDir string) Parser {
+func NewParser(metric []config.BlockConfig, separator, stateDir string, opts ...ParserOption) Parser {
 	cfgs := make(map[string][]*config.MetricConfig)
+	var patternCfgs []*config.MetricConfig
 	for _, metrics := range metric {
 		for i := range metrics.Metrics {
+			if metrics.Metrics[i].MQTTNamePattern != nil {
+				patternCfgs = append(patternCfgs, &metrics.Metrics[i])
+				continue
+			}
+			if derive := metrics.Metrics[i].Derive; derive != nil {
+				// Derived metrics are parsed for the values of their sources.
+				for j, src := range derive.Sources {
+					if j > 0 && derive.Sources[0].MQTTName == src.MQTTName {
+						continue
+					}
+					cfgs[src.MQTTName] = append(cfgs[src.MQTTName], &metrics.Metrics[i])
+				}
+				continue
+			}
 			key := metrics.Metrics[i].MQTTName
 			cfgs[key] = append(cfgs[key], &metrics.Metrics[i])
 		}
 	}
-	return Parser{
-		separator:     separator,
-		metricConfigs: cfgs,
-		stateDir:      strings.TrimRight(stateDir, "/"),
-		states:        make(map[string]*metricState),
+	integerValues := false
+	for _, metrics := range metric {
+		for _, m := range metrics.Metrics {
+			integerValues = integerValues || m.IntegerValue
+		}
+	}
+	p := Parser{
+		separator:          separator,
+		integerValues:      integerValues,
+		metricConfigs:      cfgs,
+		patternConfigs:     patternCfgs,
+		states:             make(map[string]*metricState),
+		plainConfigs:       make(map[*config.MetricConfig]bool),
+		plainMetrics:       make(map[*config.MetricConfig]plainMetric),
+		transforms:         make(map[*config.MetricConfig]func(float64) float64),
+		store:              NewFileStateStore(stateDir),
+		stateSizes:         newStateSizes(),
+		stateIORetries:     make(map[stateIOKey]*stateIORetry),
+		stateIOErrors:      defaultInstrumentation.stateIOErrorMetric,
+		negativeCounters:   defaultInstrumentation.negativeCounterMetric,
+		precisionLost:      defaultInstrumentation.precisionLostMetric,
+		pause:              &pauseControl{gauge: defaultInstrumentation.pausedMetric},
+		availabilityWindow: config.CacheConfigDefaults.Timeout,
+		logger:             zap.NewNop(),
+	}
+	for _, mcs := range cfgs {
+		for _, mc := range mcs {
+			p.plainConfigs[mc] = isPlainConfig(mc)
+		}
+	}
+	for _, mc := range patternCfgs {
+		p.plainConfigs[mc] = isPlainConfig(mc)
 	}
+	for _, opt := range opts {
+		opt(&p)
+	}
+	return p
 }
 
-// Config returns the underlying metrics config
-func (p *Parser) config() map[string][]*config.MetricConfig {
-	return p.metricConfigs
+// Descriptions returns the descriptors of all metrics the parser may emit, ordered by MQTT name followed by the
+// configs matching a mqtt_name_pattern.
+// Each metric config is described exactly once: dynamic labels are part of the descriptor's variable labels
+// next to "sensor" and "topic", since only their values vary from sample to sample. Configs sharing the
+// same descriptor are reported once.
+func (p *Parser) Descriptions() []*prometheus.Desc {
+	var names []string
+	for name := range p.metricConfigs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var cfgs []*config.MetricConfig
+	for _, name := range names {
+		cfgs = append(cfgs, p.metricConfigs[name]...)
+	}
+	cfgs = append(cfgs, p.patternConfigs...)
+
+	var descs []*prometheus.Desc
+	seen := make(map[string]bool)
+	for _, c := range cfgs {
+		for _, desc := range c.PrometheusDescriptions() {
+			if seen[desc.String()] {
+				continue
+			}
+			seen[desc.String()] = true
+			descs = append(descs, desc)
+		}
+	}
+	return descs
 }
 
-// validMetric returns all configs matching the metric and deviceID.
+// validMetric returns all configs matching the metric and deviceID. Configs with an exact MQTT name are looked up
+// directly, configs with a mqtt_name_pattern are scanned.
 func (p *Parser) findMetricConfigs(metric string, deviceID string) []*config.MetricConfig {
 	configs := []*config.MetricConfig{}
 	for _, c := range p.metricConfigs[metric] {
@@ -177,241 +640,1411 @@ func (p *Parser) findMetricConfigs(metric string, deviceID string) []*config.Met
 			configs = append(configs, c)
 		}
 	}
+	for _, c := range p.patternConfigs {
+		if c.MQTTNamePattern.Match(metric) && c.SensorNameFilter.Match(deviceID) {
+			configs = append(configs, c)
+		}
+	}
 	return configs
 }
 
-// parseMetric parses the given value according to the given deviceID and metricPath. The config allows to
-// parse a metric value according to the device ID.
-func (p *Parser) parseMetric(cfg *config.MetricConfig, metricID string, value interface{}) (Metric, error) {
-	var metricValue float64
-	var err error
+// ConfigMatch is a metric config matching the metric name of an input, see Parser.MatchConfigs.
+type ConfigMatch struct {
+	Config config.MetricConfig
+	// Matched is set if the config applies to the input, which requires the sensor_name_filter to match too.
+	Matched bool
+	// Reason explains how the metric name matched and why the config applies or not.
+	Reason string
+}
 
-	if cfg.RawExpression != "" {
-		if metricValue, err = p.evalExpressionValue(metricID, cfg.RawExpression, value, metricValue); err != nil {
-			if cfg.ErrorValue != nil {
-				metricValue = *cfg.ErrorValue
-			} else {
-				return Metric{}, err
-			}
+// MatchConfigs returns all metric configs whose mqtt_name or mqtt_name_pattern matches the given name, in the order
+// findMetricConfigs applies them. Configs whose sensor_name_filter rejects the device id are returned as well, with
+// Matched unset. This helps to debug why a metric is not produced. The topic_path_filter is not taken into account.
+func (p *Parser) MatchConfigs(mqttName, deviceID string) []ConfigMatch {
+	var matches []ConfigMatch
+	add := func(cfg *config.MetricConfig, name string) {
+		m := ConfigMatch{Config: *cfg, Matched: cfg.SensorNameFilter.Match(deviceID)}
+		switch {
+		case cfg.SensorNameFilter.RegEx() == nil:
+			m.Reason = fmt.Sprintf("%s, no sensor_name_filter", name)
+		case m.Matched:
+			m.Reason = fmt.Sprintf("%s, sensor_name_filter %q matches device %q", name, cfg.SensorNameFilter.String(), deviceID)
+		default:
+			m.Reason = fmt.Sprintf("%s, sensor_name_filter %q does not match device %q", name, cfg.SensorNameFilter.String(), deviceID)
 		}
-	} else {
-
-		if boolValue, ok := value.(bool); ok {
-			if boolValue {
-				metricValue = 1
-			} else {
-				metricValue = 0
-			}
-		} else if strValue, ok := value.(string); ok {
-
-			// If string value mapping is defined, use that
-			if cfg.StringValueMapping != nil {
-
-				floatValue, ok := cfg.StringValueMapping.Map[strValue]
-				if ok {
-					metricValue = floatValue
-
-					// deprecated, replaced by ErrorValue from the upper level
-				} else if cfg.StringValueMapping.ErrorValue != nil {
-					metricValue = *cfg.StringValueMapping.ErrorValue
-				} else if cfg.ErrorValue != nil {
-					metricValue = *cfg.ErrorValue
-				} else {
-					return Metric{}, fmt.Errorf("got unexpected string data '%s'", strValue)
-				}
-
-			} else {
-
-				// otherwise try to parse float
-				floatValue, err := strconv.ParseFloat(strValue, 64)
-				if err != nil {
-					if cfg.ErrorValue != nil {
-						metricValue = *cfg.ErrorValue
-					} else {
-						return Metric{}, fmt.Errorf("got data with unexpectd type: %T ('%v') and failed to parse to float", value, value)
-					}
-				} else {
-					metricValue = floatValue
-				}
-
-			}
-
-		} else if floatValue, ok := value.(float64); ok {
-			metricValue = floatValue
-		} else if cfg.ErrorValue != nil {
-			metricValue = *cfg.ErrorValue
-		} else {
-			return Metric{}, fmt.Errorf("got data with unexpectd type: %T ('%v')", value, value)
+		matches = append(matches, m)
+	}
+	for _, cfg := range p.metricConfigs[mqttName] {
+		if cfg.Derive != nil {
+			add(cfg, fmt.Sprintf("source %q of the derived metric", mqttName))
+			continue
 		}
-
-		if cfg.Expression != "" {
-			if metricValue, err = p.evalExpressionValue(metricID, cfg.Expression, value, metricValue); err != nil {
-				if cfg.ErrorValue != nil {
-					metricValue = *cfg.ErrorValue
-				} else {
-					return Metric{}, err
-				}
-			}
+		add(cfg, fmt.Sprintf("mqtt_name %q", mqttName))
+	}
+	for _, cfg := range p.patternConfigs {
+		if cfg.MQTTNamePattern.Match(mqttName) {
+			add(cfg, fmt.Sprintf("mqtt_name_pattern %q matches %q", cfg.MQTTNamePattern.String(), mqttName))
 		}
 	}
+	return matches
+}
 
-	if cfg.ForceMonotonicy {
-		if metricValue, err = p.enforceMonotonicy(metricID, metricValue); err != nil {
-			if cfg.ErrorValue != nil {
-				metricValue = *cfg.ErrorValue
-			} else {
-				return Metric{}, err
-			}
+// Parse converts a single value received for the given field into metrics, applying all matching metric configs
+// the same way the extractors do. The field is matched against mqtt_name and mqtt_name_pattern, the deviceID
+// against sensor_name_filter and the topic against topic_path_filter. The value is the decoded payload value,
+// e.g. a float64, bool or string. Samples skipped by a when condition are not returned.
+// Expressions referencing the payload see no payload.
+func (p *Parser) Parse(topic, deviceID, field string, value interface{}) ([]Metric, error) {
+	var mc []Metric
+	for _, cfg := range p.findMetricConfigs(field, deviceID) {
+		if !cfg.TopicPathFilter.Match(topic) || !cfg.SubscribedTo(topic) {
+			continue
+		}
+		id, err := stateKey(cfg, topic, field, deviceID)
+		if err != nil {
+			return nil, err
+		}
+		m, err := p.parseSample(cfg, id, topic, field, value, nil)
+		if errors.Is(err, errSkipSample) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse valid value from '%v' for metric %q: %w", value, cfg.PrometheusName, err)
 		}
+		if err := p.completeSample(&m, cfg, id, deviceID, topic, field); err != nil {
+			return nil, err
+		}
+		mc = append(mc, m)
 	}
+	return mc, nil
+}
 
-	if cfg.MQTTValueScale != 0 {
-		metricValue = metricValue * cfg.MQTTValueScale
+// ParseObjectPayload parses all configured fields of a JSON object payload, the same way the JSON object extractor
+// does. The payload is decoded once and each configured field is looked up once, which pays off for large objects
+// with many configured fields. Nested fields are addressed by their path, joined with the separator. Values in arrays
+// are not matched.
+func (p *Parser) ParseObjectPayload(topic, deviceID string, payload []byte) ([]Metric, error) {
+	// Numbers are decoded exactly only if there are integer_value configs, since this is considerably slower.
+	var decoded interface{}
+	var err error
+	if p.integerValues {
+		err = (exactDecoder{}).Decode(payload, &decoded)
+	} else {
+		err = json.Unmarshal(payload, &decoded)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode payload: %w", err)
+	}
+	decodedObj, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("payload is not a JSON object")
+	}
+	values := make(map[string]interface{})
+	flattenValues(decodedObj, "", p.separator, values)
+	// The payload is passed to configs which may access other fields.
+	var obj interface{}
+	if !p.integerValues {
+		obj = decodedObj
 	}
 
-	var ingestTime time.Time
-	if !cfg.OmitTimestamp {
-		ingestTime = now()
+	paths := make([]string, 0, len(values))
+	for path := range values {
+		paths = append(paths, path)
+	}
+	// Missing fields of configs with an absent_value are parsed too.
+	for name, cfgs := range p.metricConfigs {
+		if _, ok := values[name]; !ok && hasAbsentValue(cfgs) {
+			paths = append(paths, name)
+		}
 	}
+	sort.Strings(paths)
 
-	// generate dynamic labels
-	var labels map[string]string
-	if len(cfg.DynamicLabels) > 0 {
-		labels = make(map[string]string, len(cfg.DynamicLabels))
-		for k, v := range cfg.DynamicLabels {
-			value, err := p.evalExpressionLabel(metricID, k, v, value, metricValue)
+	var mc []Metric
+	for _, path := range paths {
+		absent := values[path] == nil
+		if absent && !hasAbsentValue(p.metricConfigs[path]) {
+			continue
+		}
+		for _, cfg := range p.findMetricConfigs(path, deviceID) {
+			if !cfg.TopicPathFilter.Match(topic) || !cfg.SubscribedTo(topic) {
+				continue
+			}
+			if absent && cfg.AbsentValue == nil {
+				continue
+			}
+			id, err := stateKey(cfg, topic, path, deviceID)
 			if err != nil {
-				return Metric{}, err
+				return nil, err
+			}
+			// Only integer_value configs get the exact numbers, like in the extractors.
+			value := values[path]
+			if absent {
+				value = *cfg.AbsentValue
+			} else if !cfg.IntegerValue {
+				value = floatNumbers(value)
+			}
+			if obj == nil && !p.isPlain(cfg) {
+				obj = floatNumbers(decodedObj)
+			}
+			m, err := p.parseSample(cfg, id, topic, path, value, obj)
+			if errors.Is(err, errSkipSample) {
+				continue
 			}
-			labels[k] = value
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse valid value from '%v' for metric %q: %w", value, cfg.PrometheusName, err)
+			}
+			if err := p.completeSample(&m, cfg, id, deviceID, topic, path); err != nil {
+				return nil, err
+			}
+			mc = append(mc, m)
 		}
 	}
-
-	return Metric{
-		Description: cfg.PrometheusDescription(),
-		Value:       metricValue,
-		ValueType:   cfg.PrometheusValueType(),
-		IngestTime:  ingestTime,
-		Labels:      labels,
-		LabelsKeys:  cfg.DynamicLabelsKeys(),
-	}, nil
+	return mc, nil
 }
 
-func (p *Parser) stateFileName(metricID string) string {
-	return fmt.Sprintf("%s/%s.yaml", p.stateDir, metricID)
+// floatNumbers replaces all json.Number values by their float64 value, as if they were decoded without UseNumber.
+func floatNumbers(v interface{}) interface{} {
+	switch value := v.(type) {
+	case json.Number:
+		f, err := value.Float64()
+		if err != nil {
+			// Like encoding/json, which fails to decode numbers exceeding float64.
+			return v
+		}
+		return f
+	case map[string]interface{}:
+		converted := make(map[string]interface{}, len(value))
+		for k, child := range value {
+			converted[k] = floatNumbers(child)
+		}
+		return converted
+	case []interface{}:
+		converted := make([]interface{}, len(value))
+		for i, child := range value {
+			converted[i] = floatNumbers(child)
+		}
+		return converted
+	default:
+		return v
+	}
 }
 
-// readMetricState parses the metric state from the configured path.
-// If the file does not exist, an empty state is returned.
-func (p *Parser) readMetricState(metricID string) (*metricState, error) {
-	state := &metricState{}
-	f, err := os.Open(p.stateFileName(metricID))
-	if err != nil {
-		// The file does not exist for new metrics.
-		if os.IsNotExist(err) {
-			return state, nil
+// flattenValues adds all values in the object which are neither objects nor arrays themselves to the given map,
+// keyed by their path. Nested keys are joined by the separator.
+func flattenValues(obj map[string]interface{}, prefix, separator string, values map[string]interface{}) {
+	for k, v := range obj {
+		switch child := v.(type) {
+		case map[string]interface{}:
+			flattenValues(child, prefix+k+separator, separator, values)
+		case []interface{}:
+		default:
+			values[prefix+k] = v
 		}
-		return state, fmt.Errorf("failed to read file %q: %v", f.Name(), err)
 	}
-	defer f.Close()
+}
 
-	var data []byte
-	if info, err := f.Stat(); err == nil {
-		data = make([]byte, int(info.Size()))
+// metricNames returns the names of all metrics configs may exist for in the given decoded payload. These are all
+// exact MQTT names and, if there are configs with a mqtt_name_pattern, the paths of all values in the payload.
+func (p *Parser) metricNames(payload interface{}) []string {
+	names := make([]string, 0, len(p.metricConfigs))
+	for name := range p.metricConfigs {
+		names = append(names, name)
+	}
+	if len(p.patternConfigs) == 0 {
+		return names
 	}
-	if _, err := f.Read(data); err != nil && err != io.EOF {
-		return state, err
+	obj, ok := payload.(map[string]interface{})
+	if !ok {
+		return names
 	}
+	for _, path := range flattenPaths(obj, "", p.separator) {
+		if _, exact := p.metricConfigs[path]; !exact {
+			names = append(names, path)
+		}
+	}
+	return names
+}
 
-	err = yaml.UnmarshalStrict(data, &state.dynamic)
-	state.lastWritten = now()
-	return state, err
+// flattenPaths returns the sorted paths of all values in the object which are neither objects nor arrays themselves.
+// Nested keys are joined by the separator.
+func flattenPaths(obj map[string]interface{}, prefix, separator string) []string {
+	var paths []string
+	for k, v := range obj {
+		switch child := v.(type) {
+		case map[string]interface{}:
+			paths = append(paths, flattenPaths(child, prefix+k+separator, separator)...)
+		case []interface{}:
+		default:
+			paths = append(paths, prefix+k)
+		}
+	}
+	sort.Strings(paths)
+	return paths
 }
 
-// writeMetricState writes back the metric's current state to the configured path.
-func (p *Parser) writeMetricState(metricID string, state *metricState) error {
-	out, err := yaml.Marshal(state.dynamic)
-	if err != nil {
-		return err
+// plainConfigFields are the fields of config.MetricConfig which a plain config may set: the ones supported by
+// parsePlainValue, the ones applied before or after parsing, and the ones which do not affect float64 values, like
+// the handling of strings or options which require a field not listed here. Options missing from the list make a
+// config take the general path, so new options can not be skipped by the fast path by mistake.
+var plainConfigFields = map[string]bool{
+	// Matching and extraction of the value
+	"PrometheusName": true, "MQTTName": true, "MQTTNamePattern": true, "MQTTNameLabel": true, "PayloadField": true,
+	"SensorNameFilter": true, "TopicPathFilter": true, "SubscribeTopic": true, "topicPath": true, "IgnoreRetained": true,
+	"StateKey": true, "FixedValue": true, "TopicValueGroup": true, "TopicGroupLabels": true, "TopicLabels": true,
+	"AbsentValue": true, "Derive": true, "PersistLastValue": true, "defaultErrorValue": true,
+	// Supported by parsePlainValue
+	"Help": true, "ValueType": true, "OmitTimestamp": true, "ConstantLabels": true, "MQTTValueScale": true,
+	"RoundTo": true, "ClampNegative": true, "MaxTimestampAge": true, "TimestampAgeAction": true, "LabelOrder": true,
+	// Only for strings, booleans, failing values or together with fields not listed here
+	"ErrorValue": true, "StrictMapping": true, "ValueFormatRegex": true, "TrueValue": true, "FalseValue": true,
+	"DecimalSeparator": true, "StripSuffixes": true, "BinaryFormat": true, "LabelValueMapping": true,
+	"NaNLabelValue": true, "Names": true, "Pipeline": true, "InitialOffset": true, "SyncOnReset": true,
+	"ClampMonotonicOffset": true, "ResetFlushWindow": true, "HeartbeatInterval": true, "Filter": true,
+	"TextLabel": true, "CalibrationTable": true, "RenamedFrom": true,
+}
+
+// isPlainConfig reports whether the config takes numbers as they are, apart from scaling and rounding. Such configs
+// need neither the state of the metric nor the payload. All fields not in plainConfigFields must be unset.
+func isPlainConfig(cfg *config.MetricConfig) bool {
+	v := reflect.ValueOf(cfg).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if !plainConfigFields[v.Type().Field(i).Name] && !v.Field(i).IsZero() {
+			return false
+		}
 	}
-	f, err := os.OpenFile(p.stateFileName(metricID), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
-	if err != nil {
-		return err
+	return true
+}
+
+// isPlain reports whether the config is plain, see isPlainConfig. It is computed once for the configs of the parser
+// by NewParser, other configs are checked on each call.
+func (p *Parser) isPlain(cfg *config.MetricConfig) bool {
+	if plain, ok := p.plainConfigs[cfg]; ok {
+		return plain
 	}
-	defer f.Close()
-	if _, err = f.Write(out); err != nil {
-		return fmt.Errorf("failed to write file %q: %v", f.Name(), err)
+	return isPlainConfig(cfg)
+}
+
+// plainMetric caches the parts of the metrics of a plain config which do not change from sample to sample.
+type plainMetric struct {
+	desc       *prometheus.Desc
+	labelsKeys []string
+	labelOrder []string
+}
+
+// labelOrder returns the label names of the config for Metric.LabelOrder, nil if it keeps the default order.
+func labelOrder(cfg *config.MetricConfig) []string {
+	if len(cfg.LabelOrder) == 0 {
+		return nil
 	}
-	return nil
+	return cfg.LabelNames()
+}
+
+// parsePlainValue is the fast path of parseMetric for float64 values of plain configs. The result is the same as the
+// one of the general path, but the description is built only once per config.
+func (p *Parser) parsePlainValue(cfg *config.MetricConfig, value float64) Metric {
+	cached, ok := p.plainMetrics[cfg]
+	if !ok {
+		cached = plainMetric{desc: cfg.PrometheusDescription(), labelsKeys: cfg.DynamicLabelsKeys(), labelOrder: labelOrder(cfg)}
+		p.plainMetrics[cfg] = cached
+	}
+	if cfg.MQTTValueScale != 0 {
+		value = value * cfg.MQTTValueScale
+	}
+	if cfg.RoundTo != nil {
+		value = roundTo(value, *cfg.RoundTo)
+	}
+	if cfg.PrometheusValueType() == prometheus.CounterValue {
+		if value < 0 {
+			p.negativeCounters.WithLabelValues(cfg.PrometheusName).Inc()
+			if cfg.ClampNegative {
+				value = 0
+			}
+		}
+		p.checkCounterPrecision(cfg, value)
+	}
+	var ingestTime time.Time
+	if !cfg.OmitTimestamp {
+		ingestTime = now()
+	}
+	return Metric{
+		Description:        cached.desc,
+		Value:              value,
+		ValueType:          cfg.PrometheusValueType(),
+		IngestTime:         ingestTime,
+		LabelsKeys:         cached.labelsKeys,
+		LabelOrder:         cached.labelOrder,
+		MaxTimestampAge:    cfg.MaxTimestampAge,
+		TimestampAgeAction: cfg.TimestampAgeAction,
+	}
+}
+
+// applyTransforms applies the transforms of the config to the value. They are compiled on first use.
+func (p *Parser) applyTransforms(cfg *config.MetricConfig, value float64) (float64, error) {
+	apply, ok := p.transforms[cfg]
+	if !ok {
+		var err error
+		if apply, err = cfg.CompileTransforms(); err != nil {
+			return 0, err
+		}
+		p.transforms[cfg] = apply
+	}
+	return apply(value), nil
+}
+
+// parseSample parses the value received for the given metric name and topic. The values of the sources of derived
+// metrics are combined first, the derived value is parsed like any other value.
+// While the parser is paused, all samples are skipped.
+func (p *Parser) parseSample(cfg *config.MetricConfig, metricID, topic, metric string, value, payload interface{}) (Metric, error) {
+	p.pause.mu.Lock()
+	defer p.pause.mu.Unlock()
+	if p.pause.paused {
+		return Metric{}, errSkipSample
+	}
+	if cfg.Derive != nil {
+		derived, err := p.deriveValue(cfg, metricID, topic, metric, value)
+		if errors.Is(err, errSkipSample) || (err != nil && cfg.ErrorValue == nil) {
+			return Metric{}, err
+		}
+		if err != nil {
+			derived = *cfg.ErrorValue
+		}
+		value = derived
+	}
+	return p.parseMetric(cfg, metricID, value, payload)
+}
+
+// deriveValue stores the value of the matching source and combines the last values of both sources. Until both
+// sources have been seen, or if the value belongs to no source, the sample is skipped.
+func (p *Parser) deriveValue(cfg *config.MetricConfig, metricID, topic, metric string, value interface{}) (float64, error) {
+	idx := cfg.Derive.SourceIndex(metric, topic)
+	if idx < 0 {
+		return 0, errSkipSample
+	}
+	var sourceValue float64
+	switch v := value.(type) {
+	case float64:
+		sourceValue = v
+	case json.Number:
+		f, err := v.Float64()
+		if err != nil {
+			return 0, fmt.Errorf("got invalid number for derive source %q: %w", metric, err)
+		}
+		sourceValue = f
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return 0, fmt.Errorf("got string '%s' for derive source %q which failed to parse to float: %w", v, metric, err)
+		}
+		sourceValue = f
+	default:
+		return 0, fmt.Errorf("got data with unexpectd type for derive source %q: %T ('%v')", metric, value, value)
+	}
+
+	ms, err := p.getMetricState(metricID)
+	if err != nil {
+		return 0, err
+	}
+	if ms.dynamic.DerivedSources == nil {
+		ms.dynamic.DerivedSources = make(map[int]float64, len(cfg.Derive.Sources))
+	}
+	ms.dynamic.DerivedSources[idx] = sourceValue
+	if len(ms.dynamic.DerivedSources) < len(cfg.Derive.Sources) {
+		return 0, errSkipSample
+	}
+	a, b := ms.dynamic.DerivedSources[0], ms.dynamic.DerivedSources[1]
+	switch cfg.Derive.Operation {
+	case config.DeriveAdd:
+		return a + b, nil
+	case config.DeriveSubtract:
+		return a - b, nil
+	case config.DeriveMultiply:
+		return a * b, nil
+	case config.DeriveDivide:
+		if b == 0 {
+			return 0, fmt.Errorf("derive source %q is zero, can not divide", cfg.Derive.Sources[1].MQTTName)
+		}
+		return a / b, nil
+	default:
+		return 0, fmt.Errorf("unsupported derive operation %q", cfg.Derive.Operation)
+	}
+}
+
+// parseMetric parses the given value according to the given deviceID and metricPath. The config allows to
+// parse a metric value according to the device ID.
+func (p *Parser) parseMetric(cfg *config.MetricConfig, metricID string, value, payload interface{}) (Metric, error) {
+	if floatValue, ok := value.(float64); ok && p.isPlain(cfg) {
+		return p.parsePlainValue(cfg, floatValue), nil
+	}
+
+	var metricValue float64
+	var intValue *int64
+	var err error
+	// Set if the value converted from the payload is to be calibrated, error values are not.
+	var calibrate bool
+	// Set if the value is an error value, which does not count as increase of a counter for emit_rate and emit_delta.
+	var errorSample bool
+
+	// Every received sample counts, even if it is skipped or fails below.
+	var avail *availability
+	if cfg.ExpectedInterval > 0 {
+		if avail, err = p.observeAvailability(cfg, metricID); err != nil {
+			return Metric{}, err
+		}
+	}
+
+	var sampleTime time.Time
+	if cfg.TimestampField != "" {
+		if sampleTime, err = p.sampleTimestamp(cfg, metricID, payload); err != nil {
+			return Metric{}, err
+		}
+	}
+
+	if cfg.TextMetric {
+		// The value is exported as label of the constant 1, see the dynamic labels below.
+		metricValue = 1
+	} else if cfg.ArrayCount {
+		count, err := p.countElements(cfg, metricID, value)
+		if err != nil {
+			if count, err = p.errorValue(cfg, metricID, value, payload, err); err != nil {
+				return Metric{}, err
+			}
+			errorSample = true
+		}
+		metricValue = count
+	} else if cfg.IntegerValue {
+		v, err := p.parseIntegerValue(cfg, metricID, value, payload)
+		if err != nil {
+			return Metric{}, err
+		}
+		intValue = &v
+		metricValue = float64(v)
+	} else if cfg.RawExpression != "" {
+		if metricValue, err = p.evalExpressionValue(metricID, cfg.PrometheusName, cfg.RawExpression, value, metricValue, payload); err != nil {
+			if cfg.ErrorValue != nil {
+				metricValue, errorSample = *cfg.ErrorValue, true
+			} else {
+				return Metric{}, err
+			}
+		}
+	} else {
+
+		if cfg.PayloadEncoding == config.PayloadEncodingBase64 {
+			if decoded, err := decodeBinaryValue(cfg.BinaryFormat, value); err == nil {
+				value = decoded
+			} else if cfg.ErrorValue != nil {
+				value, errorSample = *cfg.ErrorValue, true
+			} else {
+				return Metric{}, err
+			}
+		}
+
+		// Set if the value can not be converted, handled by errorValue below.
+		var parseErr error
+		_, isString := value.(string)
+		if cfg.StrictMapping && cfg.StringValueMapping != nil && !isString {
+			// Only mapped strings are valid values, numbers and booleans are not taken as they are.
+			parseErr = fmt.Errorf("got unmapped data of type %T ('%v') with strict_mapping", value, value)
+		} else if boolValue, ok := value.(bool); ok {
+			if boolValue {
+				metricValue = 1
+				if cfg.TrueValue != nil {
+					metricValue = *cfg.TrueValue
+				}
+			} else {
+				metricValue = 0
+				if cfg.FalseValue != nil {
+					metricValue = *cfg.FalseValue
+				}
+			}
+		} else if strValue, ok := value.(string); ok {
+
+			if cfg.ValueFormatRegex != nil && !cfg.ValueFormatRegex.Match(strValue) {
+				// Garbage is rejected before it is mapped or parsed.
+				parseErr = fmt.Errorf("got data '%s' not matching value_format_regex", strValue)
+			} else if cfg.StringValueMapping != nil {
+				// If string value mapping is defined, use that
+
+				floatValue, ok := cfg.StringValueMapping.Map[strValue]
+				if ok {
+					metricValue = floatValue
+
+					// deprecated, replaced by ErrorValue from the upper level
+				} else if cfg.StringValueMapping.ErrorValue != nil {
+					metricValue = *cfg.StringValueMapping.ErrorValue
+				} else {
+					parseErr = fmt.Errorf("got unexpected string data '%s'", strValue)
+				}
+
+			} else {
+
+				// otherwise try to parse float
+				suffixScale := 1.0
+				if len(cfg.StripSuffixes) > 0 {
+					strValue, suffixScale = stripSuffix(strValue, cfg.StripSuffixes)
+				}
+				floatValue, err := strconv.ParseFloat(normalizeDecimal(strValue, cfg.DecimalSeparator), 64)
+				if err != nil {
+					parseErr = fmt.Errorf("got data with unexpectd type: %T ('%v') and failed to parse to float", value, value)
+				} else {
+					metricValue = floatValue * suffixScale
+				}
+
+			}
+
+		} else if number, ok := value.(json.Number); ok {
+			// Decoded with UseNumber, the number is still in its original form.
+			floatValue, err := number.Float64()
+			if err != nil {
+				parseErr = fmt.Errorf("got number '%s' which failed to parse to float: %w", number, err)
+			} else {
+				metricValue = floatValue
+			}
+		} else if floatValue, ok := value.(float64); ok {
+			metricValue = floatValue
+		} else {
+			parseErr = fmt.Errorf("got data with unexpectd type: %T ('%v')", value, value)
+		}
+
+		if parseErr != nil {
+			if metricValue, err = p.errorValue(cfg, metricID, value, payload, parseErr); err != nil {
+				return Metric{}, err
+			}
+			errorSample = true
+		} else {
+			calibrate = cfg.Calibration != nil && !errorSample
+		}
+		if parseErr == nil && cfg.ErrorExpression != "" {
+			if err = p.storeGoodValue(metricID, metricValue); err != nil {
+				return Metric{}, err
+			}
+		}
+	}
+
+	// The value after the conversion, exported with emit_raw.
+	rawValue := metricValue
+
+	if calibrate {
+		metricValue = cfg.Calibration.Interpolate(metricValue)
+	}
+
+	if cfg.Despike == config.DespikeMedian3 {
+		if metricValue, err = p.median3(metricID, metricValue); err != nil {
+			return Metric{}, err
+		}
+	}
+
+	if cfg.WindowSize > 0 && intValue == nil && cfg.RawExpression == "" {
+		if err = p.pushWindow(metricID, cfg.WindowSize, metricValue); err != nil {
+			return Metric{}, err
+		}
+	}
+
+	for _, step := range cfg.PipelineSteps() {
+		switch step {
+		case config.PipelineExpression:
+			// A raw_expression replaces the conversion and integer values evaluate their expression on their own.
+			if cfg.Expression == "" || cfg.RawExpression != "" || intValue != nil {
+				continue
+			}
+			if metricValue, err = p.evalExpressionValue(metricID, cfg.PrometheusName, cfg.Expression, value, metricValue, payload); err != nil {
+				if cfg.ErrorValue != nil {
+					metricValue = *cfg.ErrorValue
+				} else {
+					return Metric{}, err
+				}
+			}
+		case config.PipelineWhen:
+			if cfg.When == "" {
+				continue
+			}
+			emit, err := p.evalExpressionCondition(metricID, cfg.PrometheusName, cfg.When, value, metricValue, payload)
+			if err != nil {
+				return Metric{}, err
+			}
+			if !emit {
+				return Metric{}, errSkipSample
+			}
+		case config.PipelineForceMonotonicy:
+			if !cfg.ForceMonotonicy {
+				continue
+			}
+			if metricValue, err = p.enforceMonotonicy(cfg, metricID, metricValue); err != nil {
+				if cfg.ErrorValue != nil {
+					metricValue = *cfg.ErrorValue
+				} else {
+					return Metric{}, err
+				}
+			}
+		case config.PipelineScale:
+			if cfg.MQTTValueScale != 0 {
+				metricValue = metricValue * cfg.MQTTValueScale
+			}
+		}
+	}
+
+	if len(cfg.Transforms) > 0 && intValue == nil {
+		if metricValue, err = p.applyTransforms(cfg, metricValue); err != nil {
+			return Metric{}, err
+		}
+	}
+
+	if cfg.ResetInterval > 0 {
+		if metricValue, err = p.bucketValue(cfg, metricID, metricValue); err != nil {
+			return Metric{}, err
+		}
+	}
+
+	if cfg.RoundTo != nil && intValue == nil {
+		metricValue = roundTo(metricValue, *cfg.RoundTo)
+	}
+
+	if cfg.PrometheusValueType() == prometheus.CounterValue {
+		// Counters must not be negative. This usually points to a broken expression or a wrong value type.
+		if metricValue < 0 {
+			p.negativeCounters.WithLabelValues(cfg.PrometheusName).Inc()
+			if cfg.ClampNegative {
+				metricValue = 0
+				if intValue != nil {
+					intValue = new(int64)
+				}
+			}
+		}
+		// Values of integer_value counters are exported exactly.
+		if intValue == nil {
+			p.checkCounterPrecision(cfg, metricValue)
+		}
+	}
+
+	if cfg.MinChange != nil {
+		if err = p.suppressUnchanged(cfg, metricID, metricValue); err != nil {
+			return Metric{}, err
+		}
+	}
+
+	// Error values are no counter readings, the delta and the rate refer to the previous valid sample.
+	var delta *float64
+	if cfg.EmitDelta && !errorSample {
+		d, err := p.deltaValue(metricID, metricValue)
+		if err != nil {
+			return Metric{}, err
+		}
+		delta = &d
+	}
+
+	var rate *float64
+	if cfg.EmitRate && !errorSample {
+		r, ok, err := p.rateValue(metricID, metricValue, now())
+		if err != nil {
+			return Metric{}, err
+		}
+		if ok {
+			rate = &r
+		}
+	}
+
+	var ingestTime time.Time
+	if !cfg.OmitTimestamp {
+		ingestTime = now()
+	}
+	if cfg.TimestampField != "" {
+		ingestTime = sampleTime
+	}
+
+	// generate dynamic labels
+	var labels map[string]string
+	if len(cfg.DynamicLabels) > 0 || len(cfg.LabelThresholds) > 0 || len(cfg.FieldLabels) > 0 || cfg.TextMetric {
+		labels = make(map[string]string, len(cfg.DynamicLabels)+len(cfg.LabelThresholds)+len(cfg.FieldLabels))
+		// Evaluate the labels in a stable order, so errors and state updates are reproducible.
+		for _, k := range cfg.DynamicLabelsKeys() {
+			if thresholds, ok := cfg.LabelThresholds[k]; ok {
+				labels[k] = thresholdLabel(thresholds, metricValue)
+				continue
+			}
+			var labelValue string
+			if cfg.TextMetric && k == cfg.TextLabelName() {
+				labelValue = rawString(value)
+			} else if field, ok := cfg.FieldLabels[k]; ok {
+				// Copied verbatim, missing fields yield an empty label.
+				labelValue = rawString(payloadField(payload, p.separator)(field))
+			} else if v, ok := cfg.DynamicLabels[k]; ok {
+				if labelValue, err = p.evalExpressionLabel(metricID, cfg.PrometheusName, k, v, cfg.NaNLabelValue, value, metricValue, payload); err != nil {
+					return Metric{}, err
+				}
+			} else {
+				// The mqtt_name_label and topic_labels are set by the extractor.
+				continue
+			}
+			if mapped, ok := cfg.LabelValueMapping[k][labelValue]; ok {
+				labelValue = mapped
+			}
+			labels[k] = labelValue
+		}
+	}
+
+	name := cfg.PrometheusName
+	if cfg.NameExpression != "" {
+		// The name is evaluated like a dynamic label, named after the label holding the metric name in Prometheus.
+		if name, err = p.evalExpressionLabel(metricID, cfg.PrometheusName, model.MetricNameLabel, cfg.NameExpression, nil, value, metricValue, payload); err != nil {
+			return Metric{}, fmt.Errorf("failed to evaluate name_expression: %w", err)
+		}
+		listed := false
+		for _, n := range cfg.Names {
+			listed = listed || n == name
+		}
+		if !listed {
+			return Metric{}, fmt.Errorf("name_expression yielded %q, which is not listed in names", name)
+		}
+	}
+
+	var receiveTime time.Time
+	var staleValue *float64
+	if cfg.EmitAge || cfg.MaxValueAge > 0 {
+		receiveTime = now()
+	}
+	if cfg.MaxValueAge > 0 {
+		staleValue = cfg.ErrorValue
+	}
+
+	return Metric{
+		Description:        cfg.PrometheusDescriptionFor(name),
+		Value:              metricValue,
+		ValueType:          cfg.PrometheusValueType(),
+		IngestTime:         ingestTime,
+		Labels:             labels,
+		LabelsKeys:         cfg.DynamicLabelsKeys(),
+		LabelOrder:         labelOrder(cfg),
+		IntValue:           intValue,
+		ReceiveTime:        receiveTime,
+		Companions:         companionsFor(cfg, name, receiveTime, rawValue, avail, rate, delta),
+		MaxValueAge:        cfg.MaxValueAge,
+		StaleValue:         staleValue,
+		MaxTimestampAge:    cfg.MaxTimestampAge,
+		TimestampAgeAction: cfg.TimestampAgeAction,
+	}, nil
+}
+
+// companionsFor returns the companion series of a sample of the metric exported with the given name: its age with
+// emit_age, the raw value with emit_raw, the availability, and the rate and the delta of counters, unless they are
+// nil for the sample.
+func companionsFor(cfg *config.MetricConfig, name string, receiveTime time.Time, raw float64, avail *availability, rate, delta *float64) []Companion {
+	var companions []Companion
+	if cfg.EmitAge {
+		companions = append(companions, Companion{
+			Description: cfg.AgeDescriptionFor(name),
+			Value:       func(t time.Time) float64 { return t.Sub(receiveTime).Seconds() },
+		})
+	}
+	if cfg.EmitRaw {
+		companions = append(companions, Companion{Description: cfg.RawDescriptionFor(name), Value: constValue(raw), Timestamped: true})
+	}
+	if avail != nil {
+		companions = append(companions, Companion{Description: cfg.AvailabilityDescriptionFor(name), Value: avail.Ratio})
+	}
+	if rate != nil {
+		companions = append(companions, Companion{Description: cfg.RateDescriptionFor(name), Value: constValue(*rate), Timestamped: true})
+	}
+	if delta != nil {
+		companions = append(companions, Companion{Description: cfg.DeltaDescriptionFor(name), Value: constValue(*delta), Timestamped: true})
+	}
+	return companions
+}
+
+// parseIntegerValue parses the given value of a metric configured with integer_value. In contrast to parseMetric,
+// the value is never converted to float64, so integers beyond the float64 precision are kept exactly.
+func (p *Parser) parseIntegerValue(cfg *config.MetricConfig, metricID string, value, payload interface{}) (int64, error) {
+	var intValue int64
+	var err error
+	if cfg.RawExpression != "" {
+		intValue, err = p.evalExpressionInt(metricID, cfg.PrometheusName, cfg.RawExpression, value, intValue, payload)
+	} else {
+		if cfg.PayloadEncoding == config.PayloadEncodingBase64 {
+			value, err = decodeBinaryValue(cfg.BinaryFormat, value)
+		}
+		if err == nil {
+			intValue, err = toExactInt64(value)
+		}
+		if err == nil && cfg.Expression != "" {
+			intValue, err = p.evalExpressionInt(metricID, cfg.PrometheusName, cfg.Expression, value, intValue, payload)
+		}
+	}
+	if err != nil {
+		if cfg.ErrorValue != nil {
+			return int64(*cfg.ErrorValue), nil
+		}
+		return 0, err
+	}
+	return intValue, nil
+}
+
+// readMetricState parses the metric state from the state store.
+// If there is no stored state, an empty state is returned which is marked to be seeded by enforceMonotonicy.
+func (p *Parser) readMetricState(metricID string) (*metricState, error) {
+	state := &metricState{}
+	var data []byte
+	err := p.retryStateIO(stateRead, metricID, func() error {
+		var err error
+		data, err = p.store.Read(metricID)
+		return err
+	})
+	if err != nil {
+		// There is no state for new metrics.
+		if errors.Is(err, os.ErrNotExist) {
+			state.unseeded = true
+			return state, nil
+		}
+		return state, fmt.Errorf("failed to read state %q: %w", metricID, err)
+	}
+
+	err = yaml.UnmarshalStrict(data, &state.dynamic)
+	state.lastWritten = now()
+	return state, err
+}
+
+// writeMetricState writes back the metric's current state to the state store.
+func (p *Parser) writeMetricState(metricID string, state *metricState) error {
+	out, err := yaml.Marshal(state.dynamic)
+	if err != nil {
+		return err
+	}
+	if err := p.retryStateIO(stateWrite, metricID, func() error { return p.store.Write(metricID, out) }); err != nil {
+		return fmt.Errorf("failed to write state %q: %w", metricID, err)
+	}
+	p.stateSizes.set(metricID, len(out))
+	return nil
+}
+
+// WarmState reads all states from the state store, so the first sample of each metric after a restart does not have
+// to wait for it. States which fail to load are skipped and read again when they are needed.
+func (p *Parser) WarmState() error {
+	keys, err := p.store.List()
+	if err != nil {
+		return fmt.Errorf("failed to list states: %w", err)
+	}
+	for _, key := range keys {
+		if _, found := p.states[key]; found {
+			continue
+		}
+		state, err := p.readMetricState(key)
+		if err != nil {
+			p.logger.Warn("Failed to warm up state", zap.String("metricID", key), zap.Error(err))
+			continue
+		}
+		if state.unseeded {
+			// The state was deleted in the meantime.
+			continue
+		}
+		p.states[key] = state
+	}
+	return nil
+}
+
+// RenameState moves the state stored for oldID to newID, e.g. after the prom_name of a metric or the device id scheme
+// changed, so the offset of force_monotonicy carries over. If there is no state for newID yet, the old state is taken
+// as it is. Otherwise, the new state is kept and the offset of the old state is added to it. Renaming a missing
+// state does nothing.
+func (p *Parser) RenameState(oldID, newID string) error {
+	p.pause.mu.Lock()
+	defer p.pause.mu.Unlock()
+	return p.renameState(oldID, newID)
+}
+
+// MigrateRenamedStates renames the states stored for the renamed_from name of a config to its prom_name, see
+// RenameState. It runs on startup before WarmState, so the offsets of force_monotonicy carry over a rename. All
+// states are attempted, the first error is returned.
+func (p *Parser) MigrateRenamedStates() error {
+	renamed := make(map[string]string)
+	for _, cfgs := range p.metricConfigs {
+		for _, cfg := range cfgs {
+			if cfg.RenamedFrom != "" {
+				renamed[safeMetricIDPart(cfg.RenamedFrom)] = safeMetricIDPart(cfg.PrometheusName)
+			}
+		}
+	}
+	for _, cfg := range p.patternConfigs {
+		if cfg.RenamedFrom != "" {
+			renamed[safeMetricIDPart(cfg.RenamedFrom)] = safeMetricIDPart(cfg.PrometheusName)
+		}
+	}
+	if len(renamed) == 0 {
+		return nil
+	}
+	keys, err := p.store.List()
+	if err != nil {
+		return fmt.Errorf("failed to list states: %w", err)
+	}
+
+	p.pause.mu.Lock()
+	defer p.pause.mu.Unlock()
+	var firstErr error
+	for _, key := range keys {
+		// The parts of a metricID never contain a dash, the prom_name is the last one.
+		parts := strings.Split(key, "-")
+		name, found := renamed[parts[len(parts)-1]]
+		if len(parts) != 4 || !found {
+			continue
+		}
+		newKey := strings.Join(append(parts[:3], name), "-")
+		p.logger.Info("Migrating state of renamed metric", zap.String("from", key), zap.String("to", newKey))
+		if err := p.renameState(key, newKey); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// renameState implements RenameState, the caller holds the lock of the pause control.
+func (p *Parser) renameState(oldID, newID string) error {
+	if oldID == newID {
+		return nil
+	}
+	// The states are not read through getMetricState, which would write a missing state right away.
+	loadState := func(metricID string) (*metricState, error) {
+		if state, found := p.states[metricID]; found {
+			return state, nil
+		}
+		return p.readMetricState(metricID)
+	}
+	oldState, err := loadState(oldID)
+	if err != nil {
+		return err
+	}
+	if oldState.unseeded {
+		return nil
+	}
+	newState, err := loadState(newID)
+	if err != nil {
+		return err
+	}
+	if newState.unseeded {
+		newState.dynamic = oldState.dynamic
+		newState.unseeded = false
+	} else {
+		newState.dynamic.Offset += oldState.dynamic.Offset
+	}
+	if err := p.writeMetricState(newID, newState); err != nil {
+		return err
+	}
+	newState.lastWritten = now()
+	p.states[newID] = newState
+	delete(p.states, oldID)
+	if err := p.store.Delete(oldID); err != nil {
+		return fmt.Errorf("failed to delete state %q: %w", oldID, err)
+	}
+	p.stateSizes.delete(oldID)
+	return nil
+}
+
+// Pause makes the parser skip all samples until Resume is called, e.g. for a controlled cutover to another instance
+// sharing the state store. The sample in progress is completed first, then all states are written to the state
+// store, regardless of when they were written last.
+func (p *Parser) Pause() error {
+	p.pause.mu.Lock()
+	defer p.pause.mu.Unlock()
+	p.pause.paused = true
+	p.pause.gauge.Set(1)
+	return p.flushAllStates()
+}
+
+// Resume continues parsing after Pause.
+func (p *Parser) Resume() {
+	p.pause.mu.Lock()
+	defer p.pause.mu.Unlock()
+	p.pause.paused = false
+	p.pause.gauge.Set(0)
+}
+
+// Paused reports whether the parser is paused.
+func (p *Parser) Paused() bool {
+	p.pause.mu.Lock()
+	defer p.pause.mu.Unlock()
+	return p.pause.paused
+}
+
+// FlushState writes all states to the state store, regardless of when they were written last. It works while the
+// parser is paused too.
+func (p *Parser) FlushState() error {
+	p.pause.mu.Lock()
+	defer p.pause.mu.Unlock()
+	return p.flushAllStates()
+}
+
+// flushAllStates writes all states to the state store. All states are attempted, the first error is returned. Writes
+// waiting for their retry are attempted right away.
+func (p *Parser) flushAllStates() error {
+	var firstErr error
+	for _, key := range sortedStateKeys(p.states) {
+		if retry, found := p.stateIORetries[stateIOKey{stateWrite, key}]; found {
+			retry.retryAt = time.Time{}
+		}
+		state := p.states[key]
+		if err := p.writeMetricState(key, state); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		state.lastWritten = now()
+	}
+	return firstErr
 }
 
 // getMetricState returns the state of the given metric.
-// The state is read from and written back to disk as needed.
+// The state is read from and written back to the state store as needed. If the state can not be written back,
+// the error is returned and the flush is attempted again on the first call after the backoff of retryStateIO.
 func (p *Parser) getMetricState(metricID string) (*metricState, error) {
-	var err error
+	state, err := p.loadMetricState(metricID)
+	if err != nil {
+		return nil, err
+	}
+	return state, p.flushMetricState(metricID, state)
+}
+
+// loadMetricState returns the state of the given metric, reading it from the state store on first use.
+func (p *Parser) loadMetricState(metricID string) (*metricState, error) {
 	state, found := p.states[metricID]
 	if !found {
+		var err error
 		if state, err = p.readMetricState(metricID); err != nil {
 			return nil, err
 		}
 		p.states[metricID] = state
 	}
-	// Write the state back to disc every minute.
-	if now().Sub(state.lastWritten) >= time.Minute {
-		if err = p.writeMetricState(metricID, state); err == nil {
-			state.lastWritten = now()
+	return state, nil
+}
+
+// flushMetricState writes the state back to disc every minute. While a failed write waits for its retry, the flush
+// is skipped, the state is kept in memory until then.
+func (p *Parser) flushMetricState(metricID string, state *metricState) error {
+	if now().Sub(state.lastWritten) < time.Minute {
+		return nil
+	}
+	if retry, found := p.stateIORetries[stateIOKey{stateWrite, metricID}]; found && now().Before(retry.retryAt) {
+		return nil
+	}
+	err := p.writeMetricState(metricID, state)
+	if err == nil {
+		state.lastWritten = now()
+	}
+	return err
+}
+
+// resetFlush triggers flushing the state after a counter reset and reports whether the flush is due right away. With
+// a reset_flush_window, only the first reset within the window forces a flush. The flush of later resets is postponed
+// until the window passed, so a flapping counter does not write its state for every sample. The offset is always
+// up to date in memory and written with the postponed flush.
+func resetFlush(cfg *config.MetricConfig, ms *metricState) bool {
+	if cfg.ResetFlushWindow > 0 {
+		if windowEnd := ms.lastResetFlush.Add(cfg.ResetFlushWindow); now().Before(windowEnd) {
+			// flushMetricState writes states written a minute ago or earlier.
+			if due := windowEnd.Add(-time.Minute); due.Before(ms.lastWritten) {
+				ms.lastWritten = due
+			}
+			return false
 		}
 	}
-	return state, err
+	ms.lastResetFlush = now()
+	// Trigger flushing the new state to disk.
+	ms.lastWritten = time.Time{}
+	return true
 }
 
 // enforceMonotonicy makes sure the given values never decrease from one call to the next.
-// If the current value is smaller than the last one, a consistent offset is added.
-func (p *Parser) enforceMonotonicy(metricID string, value float64) (float64, error) {
+// If the current value is smaller than the last one, a consistent offset is added. A metric without stored state
+// starts with the configured initial_offset.
+func (p *Parser) enforceMonotonicy(cfg *config.MetricConfig, metricID string, value float64) (float64, error) {
 	ms, err := p.getMetricState(metricID)
 	if err != nil {
 		return value, err
 	}
+	// The state of a new metric was written with offset 0 by getMetricState. The seeded offset is written below
+	// right away, since a restart would reload the state without seeding it again.
+	seeded := ms.unseeded
+	if seeded {
+		ms.unseeded = false
+		ms.dynamic.Offset = cfg.InitialOffset
+	}
 	// When the source metric is reset, the last adjusted value becomes the new offset.
+	var flushNow bool
 	if value < ms.dynamic.LastRawValue {
 		ms.dynamic.Offset += ms.dynamic.LastRawValue
-		// Trigger flushing the new state to disk.
-		ms.lastWritten = time.Time{}
+		if cfg.ClampMonotonicOffset > 0 && ms.dynamic.Offset > cfg.ClampMonotonicOffset {
+			// A flapping source must not let the offset grow without bound. The series starts over instead.
+			p.logger.Warn("Monotonic offset exceeds clamp_monotonic_offset, resetting the series",
+				zap.String("metricID", metricID), zap.Float64("offset", ms.dynamic.Offset), zap.Float64("max", cfg.ClampMonotonicOffset))
+			ms.dynamic.Offset = 0
+		}
+		flushNow = resetFlush(cfg, ms)
 	}
 
 	ms.dynamic.LastRawValue = value
+	if seeded || (flushNow && cfg.SyncOnReset) {
+		// Failures are logged and counted by writeMetricState. The flush is retried with the next value.
+		if err := p.writeMetricState(metricID, ms); err == nil {
+			ms.lastWritten = now()
+		} else {
+			ms.lastWritten = time.Time{}
+		}
+	}
 	return value + ms.dynamic.Offset, nil
 }
 
+// maxExactFloat is the largest magnitude up to which float64 represents every integer exactly.
+const maxExactFloat = 1 << 53
+
+// checkCounterPrecision counts counter values beyond maxExactFloat. Small increments of such a counter are lost,
+// e.g. 2^53 + 1 equals 2^53, so the source should be reset or exported with integer_value.
+func (p *Parser) checkCounterPrecision(cfg *config.MetricConfig, value float64) {
+	if math.Abs(value) > maxExactFloat {
+		p.precisionLost.WithLabelValues(cfg.PrometheusName).Inc()
+	}
+}
+
+// bucketValue returns the increase of the value since the start of the current reset_interval bucket. Buckets are
+// aligned to multiples of the interval since the zero time, so hourly and daily buckets start at full UTC hours and
+// at midnight UTC. When a bucket rolls over, the last value of the previous bucket becomes the new baseline. The
+// first value of a metric without state and values below the baseline, e.g. after a reset of the source, start the
+// bucket over.
+func (p *Parser) bucketValue(cfg *config.MetricConfig, metricID string, value float64) (float64, error) {
+	ms, err := p.getMetricState(metricID)
+	if err != nil {
+		return value, err
+	}
+	bucket := now().Truncate(cfg.ResetInterval)
+	switch {
+	case ms.dynamic.BucketStart.IsZero():
+		ms.dynamic.BucketBaseline = value
+	case bucket.After(ms.dynamic.BucketStart):
+		ms.dynamic.BucketBaseline = ms.dynamic.BucketLastValue
+	}
+	if !bucket.Equal(ms.dynamic.BucketStart) {
+		ms.dynamic.BucketStart = bucket
+		// Trigger flushing the new bucket to disk.
+		ms.lastWritten = time.Time{}
+	}
+	if value < ms.dynamic.BucketBaseline {
+		ms.dynamic.BucketBaseline = 0
+	}
+	ms.dynamic.BucketLastValue = value
+	return value - ms.dynamic.BucketBaseline, nil
+}
+
+// monotonicOffset returns the offset force_monotonicy currently adds to the values of the metric.
+// The state is not loaded for this, so the offset is 0 until the state was used otherwise.
+func (p *Parser) monotonicOffset(metricID string) float64 {
+	if ms, ok := p.states[metricID]; ok {
+		return ms.dynamic.Offset
+	}
+	return 0
+}
+
+// pushWindow appends the value to the window of the given metric, which retains the last size values.
+func (p *Parser) pushWindow(metricID string, size int, value float64) error {
+	ms, err := p.getMetricState(metricID)
+	if err != nil {
+		return err
+	}
+	window := append(ms.dynamic.Window, value)
+	if len(window) > size {
+		window = append(window[:0], window[len(window)-size:]...)
+	}
+	ms.dynamic.Window = window
+	return nil
+}
+
+// median3 returns the median of the last three values of the metric, including the given one. A single spike is
+// dropped this way, while a step change shows up with one sample delay. Until three values are seen, the given value
+// is returned.
+func (p *Parser) median3(metricID string, value float64) (float64, error) {
+	ms, err := p.getMetricState(metricID)
+	if err != nil {
+		return value, err
+	}
+	window := append(ms.dynamic.DespikeWindow, value)
+	if len(window) > 3 {
+		window = append(window[:0], window[len(window)-3:]...)
+	}
+	ms.dynamic.DespikeWindow = window
+	if len(window) < 3 {
+		return value, nil
+	}
+	a, b, c := window[0], window[1], window[2]
+	return math.Max(math.Min(a, b), math.Min(math.Max(a, b), c)), nil
+}
+
+// sampleTimestamp returns the timestamp of the sample from the timestamp_field of the payload, Unix seconds or an
+// RFC 3339 string. Prometheus rejects samples older than the latest one of a series, so samples older than the latest
+// timestamp of the metric by more than timestamp_grace are dropped.
+func (p *Parser) sampleTimestamp(cfg *config.MetricConfig, metricID string, payload interface{}) (time.Time, error) {
+	var ts time.Time
+	switch v := payloadField(payload, p.separator)(cfg.TimestampField).(type) {
+	case nil:
+		return time.Time{}, fmt.Errorf("missing timestamp_field %q", cfg.TimestampField)
+	case string:
+		var err error
+		if ts, err = time.Parse(time.RFC3339Nano, v); err != nil {
+			return time.Time{}, fmt.Errorf("invalid timestamp_field %q: %w", cfg.TimestampField, err)
+		}
+	case float64, json.Number:
+		sec, frac := math.Modf(toFloat64(v))
+		ts = time.Unix(int64(sec), int64(frac*1e9))
+	default:
+		return time.Time{}, fmt.Errorf("invalid timestamp_field %q: %v is neither a number nor a string", cfg.TimestampField, v)
+	}
+
+	ms, err := p.getMetricState(metricID)
+	if err != nil {
+		return time.Time{}, err
+	}
+	last := ms.dynamic.LastTimestamp
+	if !last.IsZero() && last.Sub(ts) > cfg.TimestampGrace {
+		p.logger.Warn("Dropped out-of-order sample", zap.String("metricID", metricID), zap.Time("timestamp", ts), zap.Time("latest", last))
+		return time.Time{}, errSkipSample
+	}
+	if ts.After(last) {
+		ms.dynamic.LastTimestamp = ts
+	}
+	return ts, nil
+}
+
+// observeAvailability records a sample of the metric for its availability and returns the tracker.
+func (p *Parser) observeAvailability(cfg *config.MetricConfig, metricID string) (*availability, error) {
+	ms, err := p.loadMetricState(metricID)
+	if err != nil {
+		return nil, err
+	}
+	if ms.availability == nil {
+		ms.availability = newAvailability(p.availabilityWindow, cfg.ExpectedInterval)
+	}
+	ms.availability.observe(now())
+	return ms.availability, nil
+}
+
+// suppressUnchanged skips the sample, if its value differs at most min_change from the last emitted value. With a
+// heartbeat_interval, the value is emitted anyway once the last emitted sample is older than the interval.
+func (p *Parser) suppressUnchanged(cfg *config.MetricConfig, metricID string, value float64) error {
+	ms, err := p.getMetricState(metricID)
+	if err != nil {
+		return err
+	}
+	last := ms.dynamic.LastEmittedValue
+	if last != nil && math.Abs(value-*last) <= *cfg.MinChange &&
+		(cfg.HeartbeatInterval == 0 || now().Sub(ms.dynamic.LastEmitTime) < cfg.HeartbeatInterval) {
+		return errSkipSample
+	}
+	ms.dynamic.LastEmittedValue = &value
+	ms.dynamic.LastEmitTime = now()
+	return nil
+}
+
+// deltaValue returns the increase of the counter since its previous sample and remembers the value for the next one.
+// The first sample of a metric has no increase. A decreasing value is a counter reset, the increase is the value then,
+// like with emit_rate.
+func (p *Parser) deltaValue(metricID string, value float64) (float64, error) {
+	ms, err := p.getMetricState(metricID)
+	if err != nil {
+		return 0, err
+	}
+	last := ms.dynamic.LastDeltaValue
+	ms.dynamic.LastDeltaValue = &value
+	if last == nil {
+		return 0, nil
+	}
+	if value < *last {
+		return value, nil
+	}
+	return value - *last, nil
+}
+
+// rateValue returns the per-second increase of the counter since its previous sample at the given time and remembers
+// both for the next one. There is no rate for the first sample of a metric or if no time passed. A decreasing value
+// is a counter reset, the increase is the value then, like with the rate function of PromQL.
+func (p *Parser) rateValue(metricID string, value float64, at time.Time) (float64, bool, error) {
+	ms, err := p.getMetricState(metricID)
+	if err != nil {
+		return 0, false, err
+	}
+	last, lastAt := ms.dynamic.LastRateValue, ms.dynamic.LastRateTime
+	ms.dynamic.LastRateValue, ms.dynamic.LastRateTime = &value, at
+	elapsed := at.Sub(lastAt).Seconds()
+	if last == nil || elapsed <= 0 {
+		return 0, false, nil
+	}
+	increase := value - *last
+	if increase < 0 {
+		increase = value
+	}
+	return increase / elapsed, true, nil
+}
+
+// Bounds of the delay before an expression which failed to compile is compiled again.
+const (
+	compileRetryMin = time.Second
+	compileRetryMax = 5 * time.Minute
+)
+
+// compileProgram compiles the code for the given environment into the metric's state. If the code failed to compile
+// before, the error is returned again until the retry delay passed. The delay doubles with each failed attempt, so a
+// broken expression is neither compiled nor logged for every sample under high message rates.
+func (p *Parser) compileProgram(ms *metricState, metricID, kind, code string, env map[string]interface{}, opts ...expr.Option) error {
+	if ms.compileErr != nil && now().Before(ms.compileRetryAt) {
+		return ms.compileErr
+	}
+	program, err := expr.Compile(code, append([]expr.Option{expr.Env(env)}, opts...)...)
+	if err != nil {
+		delay := compileRetryMin
+		for i := 0; i < ms.compileFailures && delay < compileRetryMax; i++ {
+			delay *= 2
+		}
+		if delay > compileRetryMax {
+			delay = compileRetryMax
+		}
+		ms.compileFailures++
+		ms.compileRetryAt = now().Add(delay)
+		ms.compileErr = fmt.Errorf("failed to compile %s %q: %w", kind, code, err)
+		p.logger.Warn("Failed to compile "+kind, zap.String("metricID", metricID), zap.String("code", code), zap.Error(err), zap.Duration("retryIn", delay))
+		return ms.compileErr
+	}
+	if p.exprTimeout > 0 {
+		env = ms.interruptible(env)
+	}
+	ms.program, ms.env = program, env
+	ms.compileErr, ms.compileFailures = nil, 0
+	return nil
+}
+
 // evalExpressionValue runs the given code in the metric's environment and returns the result.
 // In case of an error, the original value is returned.
-func (p *Parser) evalExpressionValue(metricID, code string, raw_value interface{}, value float64) (float64, error) {
+func (p *Parser) evalExpressionValue(metricID, metricName, code string, raw_value interface{}, value float64, payload interface{}) (float64, error) {
 	ms, err := p.getMetricState(metricID)
 	if err != nil {
 		return value, err
 	}
 	if ms.program == nil {
-		ms.env = defaultExprEnv()
-		// Update the environment
-		ms.env[env_raw_value] = raw_value
-		ms.env[env_value] = value
-		ms.env[env_last_value] = ms.dynamic.LastExprValue
-		ms.env[env_last_raw_value] = ms.dynamic.LastExprRawValue
-		ms.env[env_last_result] = ms.dynamic.LastExprResult
-		if ms.dynamic.LastExprTimestamp.IsZero() {
-			ms.env[env_elapsed] = time.Duration(0)
-		} else {
-			ms.env[env_elapsed] = now().Sub(ms.dynamic.LastExprTimestamp)
-		}
-		ms.program, err = expr.Compile(code, expr.Env(ms.env), expr.AsFloat64())
-		if err != nil {
-			return value, fmt.Errorf("failed to compile expression %q: %w", code, err)
+		if err = p.compileProgram(ms, metricID, "expression", code, defaultExprEnv(), expr.AsFloat64()); err != nil {
+			return value, err
 		}
 		// Trigger flushing the new state to disk.
 		ms.lastWritten = time.Time{}
 	}
 
-	result, err := expr.Run(ms.program, ms.env)
+	// Update the environment
+	ms.env[env_metric_name] = metricName
+	ms.env[env_raw_value] = raw_value
+	ms.env[env_raw_string] = rawString(raw_value)
+	ms.setFunc(env_field, payloadField(payload, p.separator))
+	ms.env[env_offset] = p.monotonicOffset(metricID)
+	ms.env[env_value] = value
+	ms.env[env_last_value] = ms.dynamic.LastExprValue
+	ms.env[env_last_raw_value] = ms.dynamic.LastExprRawValue
+	ms.env[env_last_result] = ms.dynamic.LastExprResult
+	ms.setFunc(env_percentile, windowPercentile(ms.dynamic.Window))
+	if ms.dynamic.LastExprTimestamp.IsZero() {
+		ms.env[env_elapsed] = time.Duration(0)
+	} else {
+		ms.env[env_elapsed] = now().Sub(ms.dynamic.LastExprTimestamp)
+	}
+
+	result, err := p.runProgram(ms)
 	if err != nil {
 		return value, fmt.Errorf("failed to evaluate expression %q: %w", code, err)
 	}
@@ -427,25 +2060,220 @@ func (p *Parser) evalExpressionValue(metricID, code string, raw_value interface{
 	return ret, nil
 }
 
-// evalExpressionLabel runs the given code in the metric's environment and returns the result.
+// evalExpressionInt runs the given code in the metric's environment and returns the integer result.
 // In case of an error, the original value is returned.
-func (p *Parser) evalExpressionLabel(metricID, label, code string, rawValue interface{}, value float64) (string, error) {
+func (p *Parser) evalExpressionInt(metricID, metricName, code string, rawValue interface{}, value int64, payload interface{}) (int64, error) {
+	ms, err := p.getMetricState(metricID)
+	if err != nil {
+		return value, err
+	}
+	if ms.program == nil {
+		env := defaultExprEnv()
+		env[env_value] = int64(0)
+		env[env_last_value] = int64(0)
+		env[env_last_result] = int64(0)
+		if err = p.compileProgram(ms, metricID, "expression", code, env, expr.AsInt64()); err != nil {
+			return value, err
+		}
+		// Trigger flushing the new state to disk.
+		ms.lastWritten = time.Time{}
+	}
+
+	// Update the environment
+	ms.env[env_metric_name] = metricName
+	ms.env[env_raw_value] = rawValue
+	ms.env[env_raw_string] = rawString(rawValue)
+	ms.setFunc(env_field, payloadField(payload, p.separator))
+	ms.env[env_offset] = p.monotonicOffset(metricID)
+	ms.env[env_value] = value
+	ms.env[env_last_value] = ms.dynamic.LastExprIntValue
+	ms.env[env_last_raw_value] = ms.dynamic.LastExprRawValue
+	ms.env[env_last_result] = ms.dynamic.LastExprIntResult
+	if ms.dynamic.LastExprTimestamp.IsZero() {
+		ms.env[env_elapsed] = time.Duration(0)
+	} else {
+		ms.env[env_elapsed] = now().Sub(ms.dynamic.LastExprTimestamp)
+	}
+
+	result, err := p.runProgram(ms)
+	if err != nil {
+		return value, fmt.Errorf("failed to evaluate expression %q: %w", code, err)
+	}
+	// Type was statically checked above.
+	ret := result.(int64)
+
+	// Update the dynamic state
+	ms.dynamic.LastExprIntResult = ret
+	ms.dynamic.LastExprRawValue = rawValue
+	ms.dynamic.LastExprIntValue = value
+	ms.dynamic.LastExprTimestamp = now()
+
+	return ret, nil
+}
+
+// evalExpressionCondition runs the given boolean code in the metric's environment and returns the result.
+func (p *Parser) evalExpressionCondition(metricID, metricName, code string, rawValue interface{}, value float64, payload interface{}) (bool, error) {
+	ms, err := p.getMetricState("when@" + metricID)
+	if err != nil {
+		return false, err
+	}
+	if ms.program == nil {
+		if err = p.compileProgram(ms, metricID, "condition", code, defaultExprEnv(), expr.AsBool()); err != nil {
+			return false, err
+		}
+	}
+
+	// Update the environment
+	ms.env[env_metric_name] = metricName
+	ms.env[env_raw_value] = rawValue
+	ms.env[env_raw_string] = rawString(rawValue)
+	ms.setFunc(env_field, payloadField(payload, p.separator))
+	ms.env[env_offset] = p.monotonicOffset(metricID)
+	ms.env[env_value] = value
+	ms.env[env_last_value] = ms.dynamic.LastExprValue
+	ms.env[env_last_raw_value] = ms.dynamic.LastExprRawValue
+	if ms.dynamic.LastExprTimestamp.IsZero() {
+		ms.env[env_elapsed] = time.Duration(0)
+	} else {
+		ms.env[env_elapsed] = now().Sub(ms.dynamic.LastExprTimestamp)
+	}
+
+	result, err := p.runProgram(ms)
+	if err != nil {
+		return false, fmt.Errorf("failed to evaluate condition %q: %w", code, err)
+	}
+
+	// Update the dynamic state
+	ms.dynamic.LastExprValue = value
+	ms.dynamic.LastExprTimestamp = now()
+
+	// Type was statically checked above.
+	return result.(bool), nil
+}
+
+// countElements returns the number of elements of the array value for which the filter of the config yields true, or
+// of all elements without a filter. The filter is evaluated for each element with the element as raw_value, as value
+// if it is a number, and field accessing the fields of the element. Other values than arrays are an error.
+func (p *Parser) countElements(cfg *config.MetricConfig, metricID string, value interface{}) (float64, error) {
+	elements, ok := value.([]interface{})
+	if !ok {
+		return 0, fmt.Errorf("array_count requires an array, got %T ('%v')", value, value)
+	}
+	if cfg.Filter == "" {
+		return float64(len(elements)), nil
+	}
+	ms, err := p.getMetricState("filter@" + metricID)
+	if err != nil {
+		return 0, err
+	}
+
+	if ms.program == nil {
+		if err = p.compileProgram(ms, metricID, "filter", cfg.Filter, defaultExprEnv(), expr.AsBool()); err != nil {
+			return 0, err
+		}
+	}
+
+	count := 0
+	for _, element := range elements {
+		number, _ := element.(float64)
+		ms.env[env_metric_name] = cfg.PrometheusName
+		ms.env[env_raw_value] = element
+		ms.env[env_raw_string] = rawString(element)
+		ms.env[env_value] = number
+		ms.setFunc(env_field, payloadField(element, p.separator))
+		result, err := p.runProgram(ms)
+		if err != nil {
+			return 0, fmt.Errorf("failed to evaluate filter %q: %w", cfg.Filter, err)
+		}
+		// Type was statically checked above.
+		if result.(bool) {
+			count++
+		}
+	}
+	return float64(count), nil
+}
+
+// errorValue returns the value of a sample which could not be converted. The error_expression takes precedence
+// over the error_value. Without both, parseErr is returned.
+func (p *Parser) errorValue(cfg *config.MetricConfig, metricID string, rawValue, payload interface{}, parseErr error) (float64, error) {
+	if cfg.ErrorExpression != "" {
+		return p.evalErrorExpression(metricID, cfg.PrometheusName, cfg.ErrorExpression, rawValue, payload)
+	}
+	if cfg.ErrorValue != nil {
+		return *cfg.ErrorValue, nil
+	}
+	return 0, parseErr
+}
+
+// storeGoodValue remembers the last successfully converted value of a metric with an error_expression.
+func (p *Parser) storeGoodValue(metricID string, value float64) error {
+	ms, err := p.getMetricState("error@" + metricID)
+	if err != nil {
+		return err
+	}
+	ms.dynamic.LastExprValue = value
+	ms.dynamic.LastExprTimestamp = now()
+	return nil
+}
+
+// evalErrorExpression runs the error_expression of a metric for a value which could not be converted. Within the
+// expression, last_value is the last successfully converted value and elapsed the time since then.
+func (p *Parser) evalErrorExpression(metricID, metricName, code string, rawValue, payload interface{}) (float64, error) {
+	ms, err := p.getMetricState("error@" + metricID)
+	if err != nil {
+		return 0, err
+	}
+	if ms.program == nil {
+		if err = p.compileProgram(ms, metricID, "error expression", code, defaultExprEnv(), expr.AsFloat64()); err != nil {
+			return 0, err
+		}
+	}
+
+	// Update the environment
+	ms.env[env_metric_name] = metricName
+	ms.env[env_raw_value] = rawValue
+	ms.env[env_raw_string] = rawString(rawValue)
+	ms.setFunc(env_field, payloadField(payload, p.separator))
+	ms.env[env_offset] = p.monotonicOffset(metricID)
+	ms.env[env_last_value] = ms.dynamic.LastExprValue
+	ms.env[env_last_result] = ms.dynamic.LastExprResult
+	if ms.dynamic.LastExprTimestamp.IsZero() {
+		ms.env[env_elapsed] = time.Duration(0)
+	} else {
+		ms.env[env_elapsed] = now().Sub(ms.dynamic.LastExprTimestamp)
+	}
+
+	result, err := p.runProgram(ms)
+	if err != nil {
+		return 0, fmt.Errorf("failed to evaluate error expression %q: %w", code, err)
+	}
+	// Type was statically checked above.
+	ret := result.(float64)
+	ms.dynamic.LastExprResult = ret
+	return ret, nil
+}
+
+// evalExpressionLabel runs the given code in the metric's environment and returns the result.
+// In case of an error, the original value is returned. NaN and infinite results are replaced by nanValue, if set.
+func (p *Parser) evalExpressionLabel(metricID, metricName, label, code string, nanValue *string, rawValue interface{}, value float64, payload interface{}) (string, error) {
 	ms, err := p.getMetricState(label + "@" + metricID)
 	if err != nil {
 		return "", err
 	}
 	if ms.program == nil {
-		ms.env = defaultExprEnv()
-		ms.program, err = expr.Compile(code, expr.Env(ms.env))
-		if err != nil {
-			return "", fmt.Errorf("failed to compile dynamic label expression %q: %w", code, err)
+		if err = p.compileProgram(ms, metricID, "dynamic label expression", code, defaultExprEnv()); err != nil {
+			return "", err
 		}
 		// Trigger flushing the new state to disk.
 		ms.lastWritten = time.Time{}
 	}
 
 	// Update the environment
+	ms.env[env_metric_name] = metricName
 	ms.env[env_raw_value] = rawValue
+	ms.env[env_raw_string] = rawString(rawValue)
+	ms.setFunc(env_field, payloadField(payload, p.separator))
+	ms.env[env_offset] = p.monotonicOffset(metricID)
 	ms.env[env_value] = value
 	ms.env[env_last_value] = ms.dynamic.LastExprValue
 	ms.env[env_last_raw_value] = ms.dynamic.LastExprRawValue
@@ -456,13 +2284,16 @@ func (p *Parser) evalExpressionLabel(metricID, label, code string, rawValue inte
 		ms.env[env_elapsed] = now().Sub(ms.dynamic.LastExprTimestamp)
 	}
 
-	result, err := expr.Run(ms.program, ms.env)
+	result, err := p.runProgram(ms)
 	if err != nil {
 		return "", fmt.Errorf("failed to evaluate dynamic label expression %q: %w", code, err)
 	}
 
 	// convert to string
 	ret := fmt.Sprint(result)
+	if f, ok := result.(float64); ok && nanValue != nil && (math.IsNaN(f) || math.IsInf(f, 0)) {
+		ret = *nanValue
+	}
 
 	// Update the dynamic state
 	ms.dynamic.LastExprResultString = ret
@@ -471,3 +2302,63 @@ func (p *Parser) evalExpressionLabel(metricID, label, code string, rawValue inte
 
 	return ret, nil
 }
+
+// errExpressionTimeout is returned by evaluations exceeding the expression timeout.
+var errExpressionTimeout = errors.New("expression timeout exceeded")
+
+// runProgram evaluates the compiled program of the given metric state within the configured expression timeout.
+func (p *Parser) runProgram(ms *metricState) (interface{}, error) {
+	if p.exprTimeout > 0 {
+		ms.deadline = time.Now().Add(p.exprTimeout)
+	}
+	return expr.Run(ms.program, ms.env)
+}
+
+// interruptible returns a copy of the environment whose functions are replaced by wrappers, which fail with
+// errExpressionTimeout once the deadline of the state passed, before and after each call. This stops an evaluation at
+// its next function call. The expression VM can not be stopped in between, evaluations without function calls are
+// bounded by its memory budget. The wrappers are built once per program, functions replaced for each evaluation are
+// set with setFunc.
+func (ms *metricState) interruptible(env map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(env))
+	ms.funcs = make(map[string]reflect.Value)
+	for k, v := range env {
+		fn := reflect.ValueOf(v)
+		if fn.Kind() != reflect.Func {
+			out[k] = v
+			continue
+		}
+		ms.funcs[k] = fn
+		k, variadic := k, fn.Type().IsVariadic()
+		out[k] = reflect.MakeFunc(fn.Type(), func(args []reflect.Value) []reflect.Value {
+			ms.checkDeadline()
+			var results []reflect.Value
+			if variadic {
+				results = ms.funcs[k].CallSlice(args)
+			} else {
+				results = ms.funcs[k].Call(args)
+			}
+			ms.checkDeadline()
+			return results
+		}).Interface()
+	}
+	return out
+}
+
+// checkDeadline panics with errExpressionTimeout if the deadline of the current evaluation passed, which makes the
+// expression VM return the error.
+func (ms *metricState) checkDeadline() {
+	if !ms.deadline.IsZero() && !time.Now().Before(ms.deadline) {
+		panic(errExpressionTimeout)
+	}
+}
+
+// setFunc sets a function of the environment which changes with each evaluation, e.g. the access to the fields of
+// the current payload. If the environment is interruptible, the wrapper built for the function calls it from now on.
+func (ms *metricState) setFunc(key string, fn interface{}) {
+	if _, ok := ms.funcs[key]; ok {
+		ms.funcs[key] = reflect.ValueOf(fn)
+		return
+	}
+	ms.env[key] = fn
+}
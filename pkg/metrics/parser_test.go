@@ -1,13 +1,23 @@
 package metrics
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
 	"reflect"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/expr-lang/expr"
 	"github.com/hikhvar/mqtt2prometheus/pkg/config"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
 )
 
 var testNowElapsed time.Duration
@@ -129,6 +139,38 @@ func TestParser_parseMetric(t *testing.T) {
 				LabelsKeys:  []string{"dynamic-label"},
 			},
 		},
+		{
+			name: "string value with mapped dynamic label",
+			fields: fields{
+				map[string][]*config.MetricConfig{
+					"door": {
+						{
+							PrometheusName: "door",
+							ValueType:      "gauge",
+							DynamicLabels:  map[string]string{"status": "raw_value", "unmapped": `"x" + string(raw_value)`},
+							LabelValueMapping: map[string]map[string]string{
+								"status":   {"0": "closed", "1": "open"},
+								"unmapped": {"0": "closed", "1": "open"},
+							},
+						},
+					},
+				},
+			},
+			args: args{
+				metricPath: "door",
+				deviceID:   "dht22",
+				value:      "1",
+			},
+			want: Metric{
+				Description: prometheus.NewDesc("door", "", []string{"sensor", "topic", "status", "unmapped"}, nil),
+				ValueType:   prometheus.GaugeValue,
+				Value:       1,
+				IngestTime:  testNow(),
+				Topic:       "",
+				Labels:      map[string]string{"status": "open", "unmapped": "x1"},
+				LabelsKeys:  []string{"status", "unmapped"},
+			},
+		},
 		{
 			name: "scaled string value",
 			fields: fields{
@@ -200,6 +242,108 @@ func TestParser_parseMetric(t *testing.T) {
 				Topic:       "",
 			},
 		},
+		{
+			name: "base64 big-endian float32 value",
+			fields: fields{
+				map[string][]*config.MetricConfig{
+					"pressure": {
+						{
+							PrometheusName:  "pressure",
+							ValueType:       "gauge",
+							PayloadEncoding: config.PayloadEncodingBase64,
+							BinaryFormat:    "float32_be",
+						},
+					},
+				},
+			},
+			args: args{
+				metricPath: "pressure",
+				deviceID:   "dht22",
+				value:      "QawAAA==",
+			},
+			want: Metric{
+				Description: prometheus.NewDesc("pressure", "", []string{"sensor", "topic"}, nil),
+				ValueType:   prometheus.GaugeValue,
+				Value:       21.5,
+				IngestTime:  testNow(),
+				Topic:       "",
+			},
+		},
+		{
+			name: "base64 little-endian uint16 value",
+			fields: fields{
+				map[string][]*config.MetricConfig{
+					"pressure": {
+						{
+							PrometheusName:  "pressure",
+							ValueType:       "gauge",
+							PayloadEncoding: config.PayloadEncodingBase64,
+							BinaryFormat:    "uint16_le",
+						},
+					},
+				},
+			},
+			args: args{
+				metricPath: "pressure",
+				deviceID:   "dht22",
+				value:      "AQI=",
+			},
+			want: Metric{
+				Description: prometheus.NewDesc("pressure", "", []string{"sensor", "topic"}, nil),
+				ValueType:   prometheus.GaugeValue,
+				Value:       513,
+				IngestTime:  testNow(),
+				Topic:       "",
+			},
+		},
+		{
+			name: "base64 big-endian int16 value",
+			fields: fields{
+				map[string][]*config.MetricConfig{
+					"pressure": {
+						{
+							PrometheusName:  "pressure",
+							ValueType:       "gauge",
+							PayloadEncoding: config.PayloadEncodingBase64,
+							BinaryFormat:    "int16_be",
+						},
+					},
+				},
+			},
+			args: args{
+				metricPath: "pressure",
+				deviceID:   "dht22",
+				value:      "//4=",
+			},
+			want: Metric{
+				Description: prometheus.NewDesc("pressure", "", []string{"sensor", "topic"}, nil),
+				ValueType:   prometheus.GaugeValue,
+				Value:       -2,
+				IngestTime:  testNow(),
+				Topic:       "",
+			},
+		},
+		{
+			name: "base64 value with wrong size",
+			fields: fields{
+				map[string][]*config.MetricConfig{
+					"pressure": {
+						{
+							PrometheusName:  "pressure",
+							ValueType:       "gauge",
+							PayloadEncoding: config.PayloadEncodingBase64,
+							BinaryFormat:    "float32_be",
+						},
+					},
+				},
+			},
+			args: args{
+				metricPath: "pressure",
+				deviceID:   "dht22",
+				value:      "AQI=",
+			},
+			wantErr: true,
+		},
 		{
 			name: "float value",
 			fields: fields{
@@ -741,7 +885,7 @@ func TestParser_parseMetric(t *testing.T) {
 			config := configs[0]
 
 			id := metricID("", tt.args.metricPath, tt.args.deviceID, config.PrometheusName)
-			got, err := p.parseMetric(config, id, tt.args.value)
+			got, err := p.parseMetric(config, id, tt.args.value, nil)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("parseMetric() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -813,6 +957,21 @@ func TestParser_evalExpression(t *testing.T) {
 			values:     []float64{1.1, 2.5, 3.9},
 			results:    []float64{1, 3, 4},
 		},
+		{
+			expression: "round(value)",
+			values:     []float64{0.5, 1.5, -2.5},
+			results:    []float64{1, 2, -3},
+		},
+		{
+			expression: "round_even(value)",
+			values:     []float64{0.5, 1.5, 2.5, -2.5, 2.6},
+			results:    []float64{0, 2, 2, -2, 3},
+		},
+		{
+			expression: "round_to(value, 2)",
+			values:     []float64{21.456, -1.125, 3},
+			results:    []float64{21.46, -1.13, 3},
+		},
 		{
 			expression: "ceil(value)",
 			values:     []float64{1.1, 2.9, 4.0},
@@ -838,6 +997,81 @@ func TestParser_evalExpression(t *testing.T) {
 			values:     []float64{1, -2, 3, -4},
 			results:    []float64{1, 0, 3, 0},
 		},
+		{
+			expression: "min(value, 0, -1)",
+			values:     []float64{1, -2, 3, -4},
+			results:    []float64{-1, -2, -1, -4},
+		},
+		{
+			expression: "max(value, 0, 1, 2.5, int(2))",
+			values:     []float64{1, -2, 3, -4},
+			results:    []float64{2.5, 2.5, 3, 2.5},
+		},
+		{
+			expression: "min(value) + max(value)",
+			values:     []float64{1, -2},
+			results:    []float64{2, -4},
+		},
+		{
+			expression: "bit(value, 0) + 10 * bit(value, 2)",
+			values:     []float64{0b101, 0b100, 0b010, 0b001},
+			results:    []float64{11, 10, 0, 1},
+		},
+		{
+			expression: "band(bshr(value, 4), 0xF)",
+			values:     []float64{0xAB, 0x1F0, 0x0F},
+			results:    []float64{0xA, 0xF, 0},
+		},
+		{
+			expression: "bor(value, 1) + bxor(value, 3)",
+			values:     []float64{0, 2, 4},
+			results:    []float64{4, 4, 12},
+		},
+		{
+			expression: "bshl(value, 3)",
+			values:     []float64{1, 5, -1},
+			results:    []float64{8, 40, -8},
+		},
+		{
+			expression: "bshr(value, 1)",
+			values:     []float64{6, -4},
+			results:    []float64{3, -2},
+		},
+		{
+			expression: "c_to_f(value)",
+			values:     []float64{0, 100, -40},
+			results:    []float64{32, 212, -40},
+		},
+		{
+			expression: "c_to_f(int(value))",
+			values:     []float64{37},
+			results:    []float64{98.6},
+		},
+		{
+			expression: "c_to_k(value)",
+			values:     []float64{0, -273.15},
+			results:    []float64{273.15, 0},
+		},
+		{
+			expression: "f_to_c(value)",
+			values:     []float64{32, 212, -40},
+			results:    []float64{0, 100, -40},
+		},
+		{
+			expression: "f_to_k(value)",
+			values:     []float64{32, 212},
+			results:    []float64{273.15, 373.15},
+		},
+		{
+			expression: "k_to_c(value)",
+			values:     []float64{273.15, 0},
+			results:    []float64{0, -273.15},
+		},
+		{
+			expression: "k_to_f(value)",
+			values:     []float64{273.15, 373.15},
+			results:    []float64{32, 212},
+		},
 	}
 
 	for _, tt := range tests {
@@ -851,7 +1085,7 @@ func TestParser_evalExpression(t *testing.T) {
 
 			p := NewParser(nil, ".", stateDir)
 			for i, value := range tt.values {
-				got, err := p.evalExpressionValue(id, tt.expression, value, value)
+				got, err := p.evalExpressionValue(id, "", tt.expression, value, value, nil)
 				want := tt.results[i]
 				if err != nil {
 					t.Errorf("evaluating the %dth value '%v' failed: %v", i, value, err)
@@ -865,3 +1099,1878 @@ func TestParser_evalExpression(t *testing.T) {
 		})
 	}
 }
+
+func TestParser_expressionTimeout(t *testing.T) {
+	stateDir, err := os.MkdirTemp("", "parser_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(stateDir)
+	now = testNow
+
+	cfg := &config.MetricConfig{
+		PrometheusName: "temperature",
+		ValueType:      "gauge",
+		OmitTimestamp:  true,
+		Expression:     "sleep()",
+	}
+	p := NewParser(nil, ".", stateDir, WithExpressionTimeout(10*time.Millisecond))
+	// Sneak a slow function into the environment of a precompiled program.
+	slowState := func() *metricState {
+		env := defaultExprEnv()
+		env["sleep"] = func() float64 {
+			time.Sleep(200 * time.Millisecond)
+			return 1
+		}
+		program, err := expr.Compile(cfg.Expression, expr.Env(env), expr.AsFloat64())
+		if err != nil {
+			t.Fatal(err)
+		}
+		ms := &metricState{program: program, lastWritten: now()}
+		ms.env = ms.interruptible(env)
+		return ms
+	}
+
+	p.states["timeout"] = slowState()
+	if _, err := p.parseMetric(cfg, "timeout", 12.6, nil); !errors.Is(err, errExpressionTimeout) {
+		t.Errorf("parseMetric() error = %v, want %v", err, errExpressionTimeout)
+	}
+
+	cfg.ErrorValue = floatP(42)
+	p.states["timeout_error_value"] = slowState()
+	got, err := p.parseMetric(cfg, "timeout_error_value", 12.6, nil)
+	if err != nil {
+		t.Fatalf("parseMetric() unexpected error = %v", err)
+	}
+	if got.Value != 42 {
+		t.Errorf("parseMetric() got = %v, want error value %v", got.Value, 42)
+	}
+}
+
+func TestMetricState_interruptible(t *testing.T) {
+	ms := &metricState{}
+	var calls int
+	ms.env = ms.interruptible(map[string]interface{}{
+		"expire": func() float64 {
+			ms.deadline = time.Now()
+			return 1
+		},
+		"count": func(values ...float64) float64 {
+			calls++
+			return float64(len(values))
+		},
+		"field": func() float64 { return 0 },
+		"value": 2.0,
+	})
+	program, err := expr.Compile("count(value, value) + field() + count()", expr.Env(ms.env), expr.AsFloat64())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ms.deadline = time.Now().Add(time.Hour)
+	// Functions replaced for an evaluation are called through their wrapper.
+	ms.setFunc("field", func() float64 { return 1 })
+	got, err := expr.Run(program, ms.env)
+	if err != nil || got != 3.0 || calls != 2 {
+		t.Fatalf("Run() = %v, %v with %d calls, want 3 with 2 calls", got, err, calls)
+	}
+	// The evaluation stops right after the call, which exceeded the deadline.
+	calls = 0
+	ms.setFunc("field", ms.funcs["expire"].Interface())
+	if _, err := expr.Run(program, ms.env); !errors.Is(err, errExpressionTimeout) {
+		t.Errorf("Run() error = %v, want %v", err, errExpressionTimeout)
+	}
+	if calls != 1 {
+		t.Errorf("count() was called %d times, want 1 before the deadline passed", calls)
+	}
+}
+
+func TestParser_Descriptions(t *testing.T) {
+	p := NewParser([]config.BlockConfig{
+		{
+			Metrics: []config.MetricConfig{
+				{PrometheusName: "temperature", MQTTName: "temperature", Help: "Temperature"},
+				{PrometheusName: "humidity", MQTTName: "humidity"},
+				{PrometheusName: "door", MQTTName: "state", DynamicLabels: map[string]string{"status": "raw_value"}},
+			},
+		},
+		{
+			Metrics: []config.MetricConfig{
+				{PrometheusName: "temperature", MQTTName: "temperature", Help: "Temperature"},
+				{PrometheusName: "temperature_fahrenheit", MQTTName: "temperature", Expression: "c_to_f(value)"},
+			},
+		},
+	}, ".", "")
+
+	want := []*prometheus.Desc{
+		prometheus.NewDesc("humidity", "", []string{"sensor", "topic"}, nil),
+		prometheus.NewDesc("door", "", []string{"sensor", "topic", "status"}, nil),
+		prometheus.NewDesc("temperature", "Temperature", []string{"sensor", "topic"}, nil),
+		prometheus.NewDesc("temperature_fahrenheit", "", []string{"sensor", "topic"}, nil),
+	}
+	got := p.Descriptions()
+	if len(got) != len(want) {
+		t.Fatalf("Descriptions() returned %d descriptors, want %d: %v", len(got), len(want), got)
+	}
+	for i := range want {
+		if got[i].String() != want[i].String() {
+			t.Errorf("Descriptions()[%d] = %v, want %v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestParser_percentile(t *testing.T) {
+	now = testNow
+
+	tests := []struct {
+		expression string
+		values     []float64
+		results    []float64
+	}{
+		{
+			expression: "percentile(50)",
+			values:     []float64{1, 5, 3, 100, 4},
+			results:    []float64{1, 3, 3, 5, 4},
+		},
+		{
+			expression: "percentile(0) + percentile(100)",
+			values:     []float64{2, 8, 4, 1},
+			results:    []float64{4, 10, 10, 9},
+		},
+		{
+			expression: "percentile(25)",
+			values:     []float64{10, 20, 30},
+			results:    []float64{10, 12.5, 15},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expression, func(t *testing.T) {
+			stateDir, err := os.MkdirTemp("", "parser_test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(stateDir)
+
+			p := NewParser(nil, ".", stateDir)
+			cfg := &config.MetricConfig{
+				PrometheusName: "temperature",
+				ValueType:      "gauge",
+				Expression:     tt.expression,
+				WindowSize:     3,
+			}
+			for i, value := range tt.values {
+				got, err := p.parseMetric(cfg, "percentile", value, nil)
+				if err != nil {
+					t.Fatalf("parseMetric() error = %v", err)
+				}
+				if got.Value != tt.results[i] {
+					t.Errorf("unexpected result for %dth value, got %v, want %v", i, got.Value, tt.results[i])
+				}
+			}
+			if got := p.states["percentile"].dynamic.Window; len(got) != 3 {
+				t.Errorf("window holds %d values, want %d", len(got), 3)
+			}
+		})
+	}
+}
+
+func TestParser_negativeCounter(t *testing.T) {
+	now = testNow
+
+	tests := []struct {
+		name       string
+		cfg        config.MetricConfig
+		value      interface{}
+		want       float64
+		wantCounts float64
+	}{
+		{
+			name:       "counter",
+			cfg:        config.MetricConfig{PrometheusName: "energy", ValueType: "counter"},
+			value:      -5.0,
+			want:       -5,
+			wantCounts: 1,
+		},
+		{
+			name:       "clamped counter",
+			cfg:        config.MetricConfig{PrometheusName: "energy", ValueType: "counter", ClampNegative: true},
+			value:      -5.0,
+			want:       0,
+			wantCounts: 1,
+		},
+		{
+			name:       "negative expression result",
+			cfg:        config.MetricConfig{PrometheusName: "energy", ValueType: "counter", Expression: "value - 10", ClampNegative: true},
+			value:      4.0,
+			want:       0,
+			wantCounts: 1,
+		},
+		{
+			name:       "positive counter",
+			cfg:        config.MetricConfig{PrometheusName: "energy", ValueType: "counter"},
+			value:      5.0,
+			want:       5,
+			wantCounts: 0,
+		},
+		{
+			name:       "gauge",
+			cfg:        config.MetricConfig{PrometheusName: "temperature", ValueType: "gauge", ClampNegative: true},
+			value:      -5.0,
+			want:       -5,
+			wantCounts: 0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stateDir, err := os.MkdirTemp("", "parser_test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(stateDir)
+
+			p := NewParser(nil, ".", stateDir)
+			p.negativeCounters = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test"}, []string{"metric"})
+			got, err := p.parseMetric(&tt.cfg, "negative", tt.value, nil)
+			if err != nil {
+				t.Fatalf("parseMetric() error = %v", err)
+			}
+			if got.Value != tt.want {
+				t.Errorf("parseMetric() got = %v, want %v", got.Value, tt.want)
+			}
+			if got := testutil.ToFloat64(p.negativeCounters.WithLabelValues(tt.cfg.PrometheusName)); got != tt.wantCounts {
+				t.Errorf("negative counter values = %v, want %v", got, tt.wantCounts)
+			}
+		})
+	}
+}
+
+func TestParser_counterPrecisionLost(t *testing.T) {
+	now = testNow
+	p := NewParser(nil, ".", "", WithStateStore(NewMemoryStateStore()))
+	p.precisionLost = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test"}, []string{"metric"})
+	counter := &config.MetricConfig{PrometheusName: "energy", ValueType: "counter", ForceMonotonicy: true}
+	gauge := &config.MetricConfig{PrometheusName: "temperature", ValueType: "gauge"}
+
+	// The source resets below 2^53, but the offset drives the counter past it.
+	for _, v := range []float64{1 << 52, 1<<52 - 2, 10, 1<<53 + 2, 1 << 60} {
+		if _, err := p.parseMetric(counter, "energy", v, nil); err != nil {
+			t.Fatalf("parseMetric() error = %v", err)
+		}
+		if _, err := p.parseMetric(gauge, "temperature", v, nil); err != nil {
+			t.Fatalf("parseMetric() error = %v", err)
+		}
+	}
+	if got := testutil.ToFloat64(p.precisionLost.WithLabelValues("energy")); got != 3 {
+		t.Errorf("lost precision of the counter %v times, want 3", got)
+	}
+	if got := testutil.ToFloat64(p.precisionLost.WithLabelValues("temperature")); got != 0 {
+		t.Errorf("lost precision of the gauge %v times, want 0", got)
+	}
+
+	// The fast path for plain configs counts as well.
+	plain := &config.MetricConfig{PrometheusName: "requests", ValueType: "counter"}
+	if !isPlainConfig(plain) {
+		t.Fatal("expected a plain config")
+	}
+	if _, err := p.parseMetric(plain, "requests", 1<<53+2.0, nil); err != nil {
+		t.Fatalf("parseMetric() error = %v", err)
+	}
+	if got := testutil.ToFloat64(p.precisionLost.WithLabelValues("requests")); got != 1 {
+		t.Errorf("lost precision of the plain counter %v times, want 1", got)
+	}
+}
+
+func TestParser_logger(t *testing.T) {
+	now = testNow
+
+	tests := []struct {
+		name       string
+		cfg        config.MetricConfig
+		failures   int
+		payload    string
+		wantLevel  zapcore.Level
+		wantMsg    string
+		wantFields map[string]interface{}
+	}{
+		{
+			name:      "skipped sample",
+			cfg:       config.MetricConfig{PrometheusName: "temperature", MQTTName: "temperature", ValueType: "gauge", When: "value > 100"},
+			payload:   `{"temperature": 20}`,
+			wantLevel: zapcore.DebugLevel,
+			wantMsg:   "Skipped sample",
+			wantFields: map[string]interface{}{
+				"metricID": "dht22-livingroom_dht22-temperature-temperature",
+				"topic":    "livingroom/dht22",
+			},
+		},
+		{
+			name:      "compile failure",
+			cfg:       config.MetricConfig{PrometheusName: "temperature", MQTTName: "temperature", ValueType: "gauge", Expression: "value +"},
+			payload:   `{"temperature": 20}`,
+			wantLevel: zapcore.WarnLevel,
+			wantMsg:   "Failed to compile expression",
+			wantFields: map[string]interface{}{
+				"metricID": "dht22-livingroom_dht22-temperature-temperature",
+				"code":     "value +",
+			},
+		},
+		{
+			name:      "state store failure",
+			cfg:       config.MetricConfig{PrometheusName: "energy", MQTTName: "energy", ValueType: "counter", ForceMonotonicy: true},
+			failures:  1,
+			payload:   `{"energy": 20}`,
+			wantLevel: zapcore.WarnLevel,
+			wantMsg:   "State store operation failed",
+			wantFields: map[string]interface{}{
+				"metricID":  "dht22-livingroom_dht22-energy-energy",
+				"operation": stateRead,
+				"attempt":   int64(1),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			core, logs := observer.New(zapcore.DebugLevel)
+			store := &flakyStore{MemoryStateStore: NewMemoryStateStore(), failures: tt.failures}
+			p := NewParser([]config.BlockConfig{{Metrics: []config.MetricConfig{tt.cfg}}}, ".", "",
+				WithStateStore(store), WithLogger(zap.New(core)))
+			p.stateIOErrors = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test"}, []string{"operation"})
+
+			// Errors are returned as well, only the log entries are checked here.
+			_, _ = NewJSONObjectExtractor(p, nil)("livingroom/dht22", []byte(tt.payload), "dht22", MessageInfo{})
+
+			entries := logs.FilterMessage(tt.wantMsg).All()
+			if len(entries) != 1 {
+				t.Fatalf("got %d log entries %q, want 1: %v", len(entries), tt.wantMsg, logs.All())
+			}
+			if entries[0].Level != tt.wantLevel {
+				t.Errorf("got level %v, want %v", entries[0].Level, tt.wantLevel)
+			}
+			fields := entries[0].ContextMap()
+			for k, want := range tt.wantFields {
+				if got := fields[k]; got != want {
+					t.Errorf("field %q = %v, want %v", k, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestParser_dynamicLabelOrder(t *testing.T) {
+	now = testNow
+	p := NewParser(nil, ".", "", WithStateStore(NewMemoryStateStore()))
+	cfg := &config.MetricConfig{
+		PrometheusName: "temperature",
+		ValueType:      "gauge",
+		DynamicLabels: map[string]string{
+			"d": `field("missing").d`,
+			"b": `field("missing").b`,
+			"c": `field("missing").c`,
+			"a": `field("missing").a`,
+		},
+	}
+	// Every label fails, so the error names the label which was evaluated first.
+	for i := 0; i < 20; i++ {
+		_, err := p.parseMetric(cfg, "order", 1.0, nil)
+		if err == nil {
+			t.Fatal("parseMetric() expected an error")
+		}
+		if want := `failed to evaluate dynamic label expression "field(\"missing\").a"`; !strings.Contains(err.Error(), want) {
+			t.Fatalf("parseMetric() error = %v, want it to contain %s", err, want)
+		}
+	}
+}
+
+func TestParser_rawString(t *testing.T) {
+	now = testNow
+	cfg := &config.MetricConfig{
+		PrometheusName: "enabled",
+		ValueType:      "gauge",
+		RawExpression:  `raw_string in ["on", "1", "true", "2.5"] ? 1 : 0`,
+	}
+	tests := []struct {
+		raw  interface{}
+		want float64
+	}{
+		{raw: "on", want: 1},
+		{raw: "off", want: 0},
+		{raw: 1.0, want: 1},
+		{raw: 2.5, want: 1},
+		{raw: 2.0, want: 0},
+		{raw: true, want: 1},
+		{raw: false, want: 0},
+		{raw: json.Number("1"), want: 1},
+		{raw: nil, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%T %v", tt.raw, tt.raw), func(t *testing.T) {
+			p := NewParser(nil, ".", "", WithStateStore(NewMemoryStateStore()))
+			got, err := p.parseMetric(cfg, "raw_string", tt.raw, nil)
+			if err != nil {
+				t.Fatalf("parseMetric() error = %v", err)
+			}
+			if got.Value != tt.want {
+				t.Errorf("parseMetric() got = %v, want %v", got.Value, tt.want)
+			}
+		})
+	}
+}
+
+func TestParser_roundTo(t *testing.T) {
+	now = testNow
+	intP := func(i int) *int { return &i }
+
+	tests := []struct {
+		name    string
+		roundTo *int
+		scale   float64
+		value   interface{}
+		want    float64
+	}{
+		{name: "unset", value: 21.456, want: 21.456},
+		{name: "0 places", roundTo: intP(0), value: 21.5, want: 22},
+		{name: "0 places negative", roundTo: intP(0), value: -21.5, want: -22},
+		{name: "2 places", roundTo: intP(2), value: 21.456, want: 21.46},
+		{name: "2 places from string", roundTo: intP(2), value: "21.454", want: 21.45},
+		{name: "after scaling", roundTo: intP(2), scale: 0.001, value: 21456.0, want: 21.46},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewParser(nil, ".", "", WithStateStore(NewMemoryStateStore()))
+			cfg := &config.MetricConfig{
+				PrometheusName: "temperature",
+				ValueType:      "gauge",
+				MQTTValueScale: tt.scale,
+				RoundTo:        tt.roundTo,
+			}
+			got, err := p.parseMetric(cfg, "round", tt.value, nil)
+			if err != nil {
+				t.Fatalf("parseMetric() error = %v", err)
+			}
+			if got.Value != tt.want {
+				t.Errorf("parseMetric() got = %v, want %v", got.Value, tt.want)
+			}
+		})
+	}
+}
+
+func TestParser_labelThresholds(t *testing.T) {
+	now = testNow
+	p := NewParser(nil, ".", "", WithStateStore(NewMemoryStateStore()))
+	cfg := &config.MetricConfig{
+		PrometheusName: "cpu_usage",
+		ValueType:      "gauge",
+		LabelThresholds: map[string][]config.LabelThreshold{
+			"severity": {
+				{Below: floatP(50), Value: "ok"},
+				{Below: floatP(80), Value: "warn"},
+				{Value: "crit"},
+			},
+		},
+		DynamicLabels: map[string]string{"host": `"srv1"`},
+	}
+	if got, want := cfg.DynamicLabelsKeys(), []string{"host", "severity"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("DynamicLabelsKeys() = %v, want %v", got, want)
+	}
+	for value, want := range map[float64]string{-1: "ok", 0: "ok", 49.9: "ok", 50: "warn", 79: "warn", 80: "crit", 100: "crit"} {
+		got, err := p.parseMetric(cfg, "thresholds", value, nil)
+		if err != nil {
+			t.Fatalf("parseMetric() error = %v", err)
+		}
+		if got.Labels["severity"] != want || got.Labels["host"] != "srv1" {
+			t.Errorf("value %v got labels %v, want severity %q", value, got.Labels, want)
+		}
+	}
+}
+
+func TestParser_offset(t *testing.T) {
+	now = testNow
+	values := []float64{5, 8, 2, 3}
+
+	t.Run("dynamic label after monotonicy", func(t *testing.T) {
+		p := NewParser(nil, ".", "", WithStateStore(NewMemoryStateStore()))
+		cfg := &config.MetricConfig{
+			PrometheusName:  "energy",
+			ValueType:       "counter",
+			ForceMonotonicy: true,
+			DynamicLabels:   map[string]string{"offset": "offset"},
+		}
+		wantValues := []float64{5, 8, 10, 11}
+		wantOffsets := []string{"0", "0", "8", "8"}
+		for i, v := range values {
+			got, err := p.parseMetric(cfg, "energy", v, nil)
+			if err != nil {
+				t.Fatalf("parseMetric() error = %v", err)
+			}
+			if got.Value != wantValues[i] || got.Labels["offset"] != wantOffsets[i] {
+				t.Errorf("%dth value got %v with offset %q, want %v with offset %q", i, got.Value, got.Labels["offset"], wantValues[i], wantOffsets[i])
+			}
+		}
+	})
+
+	t.Run("condition before monotonicy", func(t *testing.T) {
+		p := NewParser(nil, ".", "", WithStateStore(NewMemoryStateStore()))
+		cfg := &config.MetricConfig{
+			PrometheusName:  "energy",
+			ValueType:       "counter",
+			ForceMonotonicy: true,
+			When:            "offset == 0",
+		}
+		// The reset is detected with the third value, so the condition fails from the fourth value on.
+		wantSkipped := []bool{false, false, false, true}
+		for i, v := range values {
+			_, err := p.parseMetric(cfg, "energy", v, nil)
+			if skipped := errors.Is(err, errSkipSample); skipped != wantSkipped[i] {
+				t.Errorf("%dth value skipped = %v, want %v (error %v)", i, skipped, wantSkipped[i], err)
+			}
+		}
+	})
+}
+
+func TestParser_pipeline(t *testing.T) {
+	now = testNow
+	tests := []struct {
+		name     string
+		pipeline []string
+		want     float64
+	}{
+		{name: "default order", want: 30},
+		{name: "scale first", pipeline: []string{config.PipelineScale, config.PipelineExpression, config.PipelineWhen, config.PipelineForceMonotonicy}, want: 21},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewParser(nil, ".", "", WithStateStore(NewMemoryStateStore()))
+			cfg := &config.MetricConfig{
+				PrometheusName: "temperature",
+				ValueType:      "gauge",
+				Expression:     "value + 1",
+				MQTTValueScale: 10,
+				Pipeline:       tt.pipeline,
+			}
+			got, err := p.parseMetric(cfg, "pipeline", 2.0, nil)
+			if err != nil {
+				t.Fatalf("parseMetric() error = %v", err)
+			}
+			if got.Value != tt.want {
+				t.Errorf("parseMetric() got = %v, want %v", got.Value, tt.want)
+			}
+		})
+	}
+}
+
+func TestParser_strictMapping(t *testing.T) {
+	now = testNow
+	tests := []struct {
+		name   string
+		strict bool
+		value  interface{}
+		want   float64
+	}{
+		{name: "mapped string", strict: true, value: "on", want: 1},
+		// Decoded with UseNumber, numbers are json.Number strings which are parsed as float without strict mode.
+		{name: "json number", strict: true, value: json.Number("5"), want: -1},
+		{name: "json number without strict mode", value: json.Number("5"), want: 5},
+		{name: "number", strict: true, value: 5.0, want: -1},
+		{name: "bool", strict: true, value: true, want: -1},
+		{name: "number without strict mode", value: 5.0, want: 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewParser(nil, ".", "", WithStateStore(NewMemoryStateStore()))
+			cfg := &config.MetricConfig{
+				PrometheusName: "state",
+				ValueType:      "gauge",
+				StringValueMapping: &config.StringValueMappingConfig{
+					Map: map[string]float64{"on": 1, "off": 0},
+				},
+				StrictMapping: tt.strict,
+				ErrorValue:    floatP(-1),
+			}
+			got, err := p.parseMetric(cfg, "strict", tt.value, nil)
+			if err != nil {
+				t.Fatalf("parseMetric() error = %v", err)
+			}
+			if got.Value != tt.want {
+				t.Errorf("parseMetric() got = %v, want %v", got.Value, tt.want)
+			}
+		})
+	}
+
+	p := NewParser(nil, ".", "", WithStateStore(NewMemoryStateStore()))
+	cfg := &config.MetricConfig{
+		PrometheusName: "state",
+		ValueType:      "gauge",
+		StringValueMapping: &config.StringValueMappingConfig{
+			Map: map[string]float64{"on": 1},
+		},
+		StrictMapping: true,
+	}
+	if _, err := p.parseMetric(cfg, "strict", 5.0, nil); err == nil {
+		t.Errorf("parseMetric() expected an error for an unmapped number without error_value")
+	}
+}
+
+func TestParser_initialOffset(t *testing.T) {
+	now = testNow
+	cfg := &config.MetricConfig{
+		PrometheusName:  "energy",
+		ValueType:       "counter",
+		ForceMonotonicy: true,
+		InitialOffset:   1000,
+	}
+	parse := func(p Parser, value float64) float64 {
+		t.Helper()
+		got, err := p.parseMetric(cfg, "energy", value, nil)
+		if err != nil {
+			t.Fatalf("parseMetric() error = %v", err)
+		}
+		return got.Value
+	}
+
+	store := NewMemoryStateStore()
+	p := NewParser(nil, ".", "", WithStateStore(store))
+	if got := parse(p, 5); got != 1005 {
+		t.Errorf("fresh metric got %v, want 1005", got)
+	}
+	// The seeded offset is stored with the first sample.
+	if got := parse(NewParser(nil, ".", "", WithStateStore(store)), 6); got != 1006 {
+		t.Errorf("after a restart following the first sample got %v, want 1006", got)
+	}
+	// A reset adds to the seeded offset.
+	parse(p, 8)
+	if got := parse(p, 2); got != 1010 {
+		t.Errorf("after a reset got %v, want 1010", got)
+	}
+	// The changed state is flushed with the next value.
+	parse(p, 3)
+
+	// The stored offset takes precedence over the initial offset after a restart.
+	restarted := NewParser(nil, ".", "", WithStateStore(store))
+	if got := parse(restarted, 4); got != 1012 {
+		t.Errorf("after a restart got %v, want 1012", got)
+	}
+}
+
+func TestParser_syncOnReset(t *testing.T) {
+	now = testNow
+	for _, sync := range []bool{true, false} {
+		t.Run(fmt.Sprintf("sync_on_reset %v", sync), func(t *testing.T) {
+			stateDir, err := os.MkdirTemp("", "parser_test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(stateDir)
+
+			store := NewFileStateStore(stateDir)
+			p := NewParser(nil, ".", stateDir, WithStateStore(store))
+			cfg := &config.MetricConfig{
+				PrometheusName:  "energy",
+				ValueType:       "counter",
+				ForceMonotonicy: true,
+				SyncOnReset:     sync,
+			}
+			for _, v := range []float64{5, 8, 2} {
+				if _, err := p.parseMetric(cfg, "energy", v, nil); err != nil {
+					t.Fatalf("parseMetric() error = %v", err)
+				}
+			}
+			data, err := store.Read("energy")
+			if err != nil {
+				t.Fatalf("Read() error = %v", err)
+			}
+			if got := strings.Contains(string(data), "value_offset: 8"); got != sync {
+				t.Errorf("state after the reset contains the new offset = %v, want %v:\n%s", got, sync, data)
+			}
+		})
+	}
+}
+
+func TestParser_clampMonotonicOffset(t *testing.T) {
+	now = testNow
+	core, logs := observer.New(zapcore.WarnLevel)
+	p := NewParser(nil, ".", "", WithStateStore(NewMemoryStateStore()), WithLogger(zap.New(core)))
+	cfg := &config.MetricConfig{
+		PrometheusName:       "energy",
+		ValueType:            "counter",
+		ForceMonotonicy:      true,
+		ClampMonotonicOffset: 25,
+	}
+	// A flapping sensor alternates between 10 and 0, each drop is detected as a reset.
+	values := []float64{10, 0, 10, 0, 10, 0, 10}
+	want := []float64{10, 10, 20, 20, 30, 0, 10}
+	for i, v := range values {
+		got, err := p.parseMetric(cfg, "energy", v, nil)
+		if err != nil {
+			t.Fatalf("parseMetric() error = %v", err)
+		}
+		if got.Value != want[i] {
+			t.Errorf("%dth value got %v, want %v", i, got.Value, want[i])
+		}
+	}
+	if got := logs.FilterMessageSnippet("clamp_monotonic_offset").Len(); got != 1 {
+		t.Errorf("got %d warnings, want 1", got)
+	}
+}
+
+func TestParser_valueFormatRegex(t *testing.T) {
+	now = testNow
+	tests := []struct {
+		name       string
+		value      interface{}
+		errorValue *float64
+		want       float64
+		wantErr    bool
+	}{
+		{name: "matching", value: "21.5", want: 21.5},
+		{name: "not matching", value: "21.5garbage", wantErr: true},
+		{name: "not matching with error value", value: "0x15", errorValue: floatP(-1), want: -1},
+		{name: "numbers are not checked", value: 1e3, want: 1000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewParser(nil, ".", "", WithStateStore(NewMemoryStateStore()))
+			cfg := &config.MetricConfig{
+				PrometheusName:   "temperature",
+				ValueType:        "gauge",
+				ValueFormatRegex: config.MustNewRegexp(`^-?[0-9]+(\.[0-9]+)?$`),
+				ErrorValue:       tt.errorValue,
+			}
+			got, err := p.parseMetric(cfg, "format", tt.value, nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseMetric() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got.Value != tt.want {
+				t.Errorf("parseMetric() got = %v, want %v", got.Value, tt.want)
+			}
+		})
+	}
+}
+
+func TestParser_jsonNumber(t *testing.T) {
+	now = testNow
+	tests := []struct {
+		name       string
+		value      json.Number
+		errorValue *float64
+		want       float64
+		wantErr    bool
+	}{
+		{name: "integer", value: "42", want: 42},
+		{name: "float", value: "21.5", want: 21.5},
+		{name: "invalid", value: "4x2", wantErr: true},
+		{name: "invalid with error value", value: "4x2", errorValue: floatP(-1), want: -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewParser(nil, ".", "", WithStateStore(NewMemoryStateStore()))
+			cfg := &config.MetricConfig{
+				PrometheusName: "counter",
+				ValueType:      "counter",
+				ErrorValue:     tt.errorValue,
+			}
+			got, err := p.parseMetric(cfg, "number", tt.value, nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseMetric() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got.Value != tt.want {
+				t.Errorf("parseMetric() got = %v, want %v", got.Value, tt.want)
+			}
+		})
+	}
+
+	// Beyond 2^53, only the integer conversion is exact.
+	if got := toInt64(json.Number("9007199254740993")); got != 9007199254740993 {
+		t.Errorf("toInt64() got = %v, want 9007199254740993", got)
+	}
+	if got := toFloat64(json.Number("21.5")); got != 21.5 {
+		t.Errorf("toFloat64() got = %v, want 21.5", got)
+	}
+}
+
+func TestParser_boolValues(t *testing.T) {
+	now = testNow
+	tests := []struct {
+		name       string
+		trueValue  *float64
+		falseValue *float64
+		wantTrue   float64
+		wantFalse  float64
+	}{
+		{name: "defaults", wantTrue: 1, wantFalse: 0},
+		{name: "custom false", falseValue: floatP(-1), wantTrue: 1, wantFalse: -1},
+		{name: "custom true and false", trueValue: floatP(100), falseValue: floatP(0.5), wantTrue: 100, wantFalse: 0.5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewParser(nil, ".", "", WithStateStore(NewMemoryStateStore()))
+			cfg := &config.MetricConfig{
+				PrometheusName: "enabled",
+				ValueType:      "gauge",
+				TrueValue:      tt.trueValue,
+				FalseValue:     tt.falseValue,
+			}
+			for value, want := range map[bool]float64{true: tt.wantTrue, false: tt.wantFalse} {
+				got, err := p.parseMetric(cfg, "enabled", value, nil)
+				if err != nil {
+					t.Fatalf("parseMetric() error = %v", err)
+				}
+				if got.Value != want {
+					t.Errorf("parseMetric(%v) got = %v, want %v", value, got.Value, want)
+				}
+			}
+		})
+	}
+}
+
+func TestParser_Parse(t *testing.T) {
+	now = testNow
+	p := NewParser([]config.BlockConfig{{
+		Metrics: []config.MetricConfig{
+			{
+				PrometheusName: "temperature_fahrenheit",
+				MQTTName:       "temperature",
+				ValueType:      "gauge",
+				OmitTimestamp:  true,
+				Expression:     "c_to_f(value)",
+			},
+			{
+				PrometheusName:  "kitchen_temperature",
+				MQTTName:        "temperature",
+				ValueType:       "gauge",
+				OmitTimestamp:   true,
+				TopicPathFilter: config.MustNewRegexp("^kitchen/"),
+			},
+			{
+				PrometheusName: "switch",
+				MQTTName:       "state",
+				ValueType:      "gauge",
+				OmitTimestamp:  true,
+				When:           "value > 0",
+				StringValueMapping: &config.StringValueMappingConfig{
+					Map: map[string]float64{"ON": 1, "OFF": 0},
+				},
+			},
+		},
+	}}, ".", "", WithStateStore(NewMemoryStateStore()))
+
+	tests := []struct {
+		name    string
+		topic   string
+		field   string
+		value   interface{}
+		want    map[string]float64
+		wantErr bool
+	}{
+		{name: "all matching configs", topic: "kitchen/sensor", field: "temperature", value: 20.0, want: map[string]float64{"temperature_fahrenheit": 68, "kitchen_temperature": 20}},
+		{name: "topic filtered", topic: "garage/sensor", field: "temperature", value: 20.0, want: map[string]float64{"temperature_fahrenheit": 68}},
+		{name: "unknown field", topic: "kitchen/sensor", field: "humidity", value: 50.0, want: map[string]float64{}},
+		{name: "skipped sample", topic: "kitchen/sensor", field: "state", value: "OFF", want: map[string]float64{}},
+		{name: "mapped string", topic: "kitchen/sensor", field: "state", value: "ON", want: map[string]float64{"switch": 1}},
+		{name: "invalid value", topic: "kitchen/sensor", field: "temperature", value: "warm", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := p.Parse(tt.topic, "sensor", tt.field, tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Parse() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			values := make(map[string]float64, len(got))
+			for _, m := range got {
+				if m.Topic != tt.topic {
+					t.Errorf("Parse() got topic %q, want %q", m.Topic, tt.topic)
+				}
+				values[m.Description.String()] = m.Value
+			}
+			want := make(map[string]float64, len(tt.want))
+			for name, v := range tt.want {
+				want[prometheus.NewDesc(name, "", []string{"sensor", "topic"}, nil).String()] = v
+			}
+			if !reflect.DeepEqual(values, want) {
+				t.Errorf("Parse() got %v, want %v", values, want)
+			}
+		})
+	}
+}
+
+func TestParser_resetInterval(t *testing.T) {
+	now = testNow
+	defer func() { testNowElapsed = 0 }()
+	p := NewParser(nil, ".", "", WithStateStore(NewMemoryStateStore()))
+	cfg := &config.MetricConfig{
+		PrometheusName: "requests_hour",
+		ValueType:      "counter",
+		ResetInterval:  time.Hour,
+	}
+	// testNow is 22:08:41, the first bucket ends at 23:00.
+	steps := []struct {
+		elapsed time.Duration
+		value   float64
+		want    float64
+	}{
+		{elapsed: 0, value: 100, want: 0},
+		{elapsed: 10 * time.Minute, value: 110, want: 10},
+		{elapsed: 52 * time.Minute, value: 115, want: 5},
+		{elapsed: 55 * time.Minute, value: 117, want: 7},
+		{elapsed: 3 * time.Hour, value: 130, want: 13},
+		{elapsed: 3*time.Hour + time.Minute, value: 4, want: 4},
+	}
+	for _, s := range steps {
+		testNowElapsed = s.elapsed
+		got, err := p.parseMetric(cfg, "requests", s.value, nil)
+		if err != nil {
+			t.Fatalf("parseMetric() error = %v", err)
+		}
+		if got.Value != s.want {
+			t.Errorf("parseMetric(%v) after %v got = %v, want %v", s.value, s.elapsed, got.Value, s.want)
+		}
+	}
+}
+
+func TestParser_decimalSeparator(t *testing.T) {
+	now = testNow
+	tests := []struct {
+		separator string
+		value     string
+		want      float64
+		wantErr   bool
+	}{
+		{separator: ",", value: "23,5", want: 23.5},
+		{separator: ",", value: "1.234,56", want: 1234.56},
+		{separator: ",", value: "-1 234 567,8", want: -1234567.8},
+		{separator: ",", value: "1.234", want: 1234},
+		{separator: ".", value: "1,234.56", want: 1234.56},
+		{separator: ".", value: "23.5", want: 23.5},
+		{separator: "", value: "23.5", want: 23.5},
+		{separator: "", value: "23,5", wantErr: true},
+		{separator: ",", value: "warm", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.separator+" "+tt.value, func(t *testing.T) {
+			p := NewParser(nil, ".", "", WithStateStore(NewMemoryStateStore()))
+			cfg := &config.MetricConfig{
+				PrometheusName:   "temperature",
+				ValueType:        "gauge",
+				DecimalSeparator: tt.separator,
+			}
+			got, err := p.parseMetric(cfg, "temperature", tt.value, nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseMetric() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got.Value != tt.want {
+				t.Errorf("parseMetric() got = %v, want %v", got.Value, tt.want)
+			}
+		})
+	}
+}
+
+func TestPlainConfigFields(t *testing.T) {
+	typ := reflect.TypeOf(config.MetricConfig{})
+	for name := range plainConfigFields {
+		if _, ok := typ.FieldByName(name); !ok {
+			t.Errorf("plainConfigFields names %q, which is no field of config.MetricConfig", name)
+		}
+	}
+	// Options not in the list, like ones added later, take the general path.
+	if isPlainConfig(&config.MetricConfig{PrometheusName: "temperature", EmitRate: true}) {
+		t.Errorf("config with emit_rate is plain")
+	}
+}
+
+func TestParser_plainValueParity(t *testing.T) {
+	now = testNow
+	places := 2
+	cfgs := []*config.MetricConfig{
+		{PrometheusName: "temperature", ValueType: "gauge"},
+		{PrometheusName: "temperature", ValueType: "gauge", OmitTimestamp: true, ConstantLabels: map[string]string{"room": "kitchen"}},
+		{PrometheusName: "power", ValueType: "gauge", MQTTValueScale: 0.001, RoundTo: &places, Help: "power in kW"},
+		{PrometheusName: "energy", ValueType: "counter", ClampNegative: true},
+		{PrometheusName: "energy", ValueType: "counter"},
+		{PrometheusName: "reading", MQTTNameLabel: "field", TopicLabels: []config.TopicLabels{{Labels: map[string]string{"site": "hq"}}}},
+	}
+	for _, cfg := range cfgs {
+		for _, value := range []float64{21.5, -3.25, 0, 12345.678} {
+			p := NewParser(nil, ".", "", WithStateStore(NewMemoryStateStore()))
+			if !isPlainConfig(cfg) {
+				t.Fatalf("config %v is not plain", cfg)
+			}
+			fast, err := p.parseMetric(cfg, "metric", value, nil)
+			if err != nil {
+				t.Fatalf("parseMetric() error = %v", err)
+			}
+			// json.Number values take the general path.
+			general, err := p.parseMetric(cfg, "metric", json.Number(strconv.FormatFloat(value, 'f', -1, 64)), nil)
+			if err != nil {
+				t.Fatalf("parseMetric() error = %v", err)
+			}
+			if fast.Description.String() != general.Description.String() {
+				t.Errorf("%s(%v): got description %v, want %v", cfg.PrometheusName, value, fast.Description, general.Description)
+			}
+			fast.Description, general.Description = nil, nil
+			if !reflect.DeepEqual(fast, general) {
+				t.Errorf("%s(%v): fast path got %+v, general path %+v", cfg.PrometheusName, value, fast, general)
+			}
+		}
+	}
+}
+
+// objectPayloadConfigs configures most fields of objectPayload.
+var objectPayloadConfigs = []config.BlockConfig{{
+	Metrics: []config.MetricConfig{
+		{PrometheusName: "temperature", MQTTName: "temperature", ValueType: "gauge", OmitTimestamp: true},
+		{PrometheusName: "humidity", MQTTName: "humidity", ValueType: "gauge", OmitTimestamp: true, Expression: "value / 100"},
+		{PrometheusName: "state", MQTTName: "state", ValueType: "gauge", OmitTimestamp: true,
+			StringValueMapping: &config.StringValueMappingConfig{Map: map[string]float64{"ON": 1, "OFF": 0}}},
+		{PrometheusName: "voltage", MQTTName: "power.voltage", ValueType: "gauge", OmitTimestamp: true},
+		{PrometheusName: "energy", MQTTName: "power.energy", ValueType: "counter", OmitTimestamp: true, IntegerValue: true},
+		{PrometheusName: "channel", MQTTNamePattern: config.MustNewRegexp("^channel_[0-9]+$"), MQTTNameLabel: "field",
+			ValueType: "gauge", OmitTimestamp: true},
+	},
+}}
+
+const objectPayload = `{"temperature": 21.5, "humidity": 45, "state": "ON", "power": {"voltage": 230.1, "energy": 9007199254740993},
+	"channel_1": 1, "channel_2": 0, "missing": null, "list": [1, 2]}`
+
+func TestParser_ParseObjectPayload(t *testing.T) {
+	now = testNow
+	p := NewParser(objectPayloadConfigs, ".", "", WithStateStore(NewMemoryStateStore()))
+	got, err := p.ParseObjectPayload("devices/sensor", "sensor", []byte(objectPayload))
+	if err != nil {
+		t.Fatalf("ParseObjectPayload() error = %v", err)
+	}
+
+	// The result equals the one of the JSON object extractor, apart from the order.
+	want, err := NewJSONObjectExtractor(p, nil)("devices/sensor", []byte(objectPayload), "sensor", MessageInfo{})
+	if err != nil {
+		t.Fatalf("extractor() error = %v", err)
+	}
+	if len(got) != 7 || len(got) != len(want) {
+		t.Fatalf("ParseObjectPayload() got %d metrics, the extractor %d, want 7", len(got), len(want))
+	}
+	key := func(m Metric) string { return m.Description.String() + fmt.Sprint(m.Labels) }
+	byKey := make(map[string]Metric, len(want))
+	for _, m := range want {
+		byKey[key(m)] = m
+	}
+	for _, m := range got {
+		w, ok := byKey[key(m)]
+		if !ok {
+			t.Errorf("unexpected metric %v", m)
+			continue
+		}
+		if m.Value != w.Value || !reflect.DeepEqual(m.IntValue, w.IntValue) || m.Topic != w.Topic {
+			t.Errorf("got metric %+v, the extractor got %+v", m, w)
+		}
+	}
+	for _, m := range got {
+		if m.IntValue != nil && *m.IntValue != 9007199254740993 {
+			t.Errorf("got integer value %d, want 9007199254740993", *m.IntValue)
+		}
+	}
+
+	// Without integer_value configs, the numbers are decoded as float64 right away.
+	p = NewParser([]config.BlockConfig{{Metrics: objectPayloadConfigs[0].Metrics[:4]}}, ".", "", WithStateStore(NewMemoryStateStore()))
+	got, err = p.ParseObjectPayload("devices/sensor", "sensor", []byte(objectPayload))
+	if err != nil {
+		t.Fatalf("ParseObjectPayload() error = %v", err)
+	}
+	values := make([]float64, 0, len(got))
+	for _, m := range got {
+		values = append(values, m.Value)
+	}
+	// Ordered by the field path.
+	if want := []float64{0.45, 230.1, 1, 21.5}; !reflect.DeepEqual(values, want) {
+		t.Errorf("ParseObjectPayload() got values %v, want %v", values, want)
+	}
+
+	if _, err := p.ParseObjectPayload("devices/sensor", "sensor", []byte(`[1, 2]`)); err == nil {
+		t.Errorf("ParseObjectPayload() of an array got no error")
+	}
+}
+
+func BenchmarkParser_ParseObjectPayload(b *testing.B) {
+	now = testNow
+	// A large object with many configured fields.
+	var cfgs []config.MetricConfig
+	fields := make(map[string]interface{})
+	for i := 0; i < 100; i++ {
+		name := fmt.Sprintf("field_%d", i)
+		cfgs = append(cfgs, config.MetricConfig{PrometheusName: name, MQTTName: name, ValueType: "gauge", OmitTimestamp: true})
+		fields[name] = float64(i)
+	}
+	payload, err := json.Marshal(fields)
+	if err != nil {
+		b.Fatal(err)
+	}
+	p := NewParser([]config.BlockConfig{{Metrics: cfgs}}, ".", "", WithStateStore(NewMemoryStateStore()))
+	b.Run("ParseObjectPayload", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := p.ParseObjectPayload("devices/sensor", "sensor", payload); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("JSONObjectExtractor", func(b *testing.B) {
+		extract := NewJSONObjectExtractor(p, nil)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := extract("devices/sensor", payload, "sensor", MessageInfo{}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkParser_parseMetric(b *testing.B) {
+	now = testNow
+	p := NewParser(nil, ".", "", WithStateStore(NewMemoryStateStore()))
+	cfgs := map[string]*config.MetricConfig{
+		"plain": {
+			PrometheusName: "temperature",
+			ValueType:      "gauge",
+			ConstantLabels: map[string]string{"room": "kitchen"},
+			MQTTValueScale: 0.1,
+		},
+		"expression": {
+			PrometheusName: "temperature",
+			ValueType:      "gauge",
+			Expression:     "value * 0.1",
+		},
+	}
+	for name, cfg := range cfgs {
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := p.parseMetric(cfg, "temperature", 215.0, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkParser_expressionTimeout(b *testing.B) {
+	now = testNow
+	cfg := &config.MetricConfig{
+		PrometheusName: "temperature",
+		ValueType:      "gauge",
+		Expression:     "round(max(value, 0) * 0.1)",
+	}
+	for _, timeout := range []time.Duration{0, time.Second} {
+		b.Run(fmt.Sprintf("timeout %s", timeout), func(b *testing.B) {
+			p := NewParser(nil, ".", "", WithStateStore(NewMemoryStateStore()), WithExpressionTimeout(timeout))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := p.parseMetric(cfg, "temperature", 215.0, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestParser_nanLabelValue(t *testing.T) {
+	now = testNow
+	placeholder, omitted := "unknown", ""
+	tests := []struct {
+		name     string
+		nanValue *string
+		value    float64
+		want     string
+	}{
+		{name: "finite", nanValue: &placeholder, value: 2, want: "0.5"},
+		{name: "NaN unchanged", value: 0, want: "NaN"},
+		{name: "NaN placeholder", nanValue: &placeholder, value: 0, want: "unknown"},
+		{name: "NaN omitted", nanValue: &omitted, value: 0, want: ""},
+		{name: "infinite placeholder", nanValue: &placeholder, value: -1, want: "unknown"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewParser(nil, ".", "", WithStateStore(NewMemoryStateStore()))
+			cfg := &config.MetricConfig{
+				PrometheusName: "ratio",
+				ValueType:      "gauge",
+				// 0/0 is NaN, -1 yields 1/0, which is +Inf.
+				DynamicLabels: map[string]string{"inverse": "value == -1 ? 1 / (value + 1) : value / value / value"},
+				NaNLabelValue: tt.nanValue,
+			}
+			got, err := p.parseMetric(cfg, "ratio", tt.value, nil)
+			if err != nil {
+				t.Fatalf("parseMetric() error = %v", err)
+			}
+			if got.Labels["inverse"] != tt.want {
+				t.Errorf("parseMetric() got label %q, want %q", got.Labels["inverse"], tt.want)
+			}
+		})
+	}
+}
+
+func TestParser_stripSuffixes(t *testing.T) {
+	now = testNow
+	suffixes := []config.StripSuffix{
+		{Suffix: "%", Scale: 0.01},
+		{Suffix: "s"},
+		{Suffix: "ms", Scale: 0.001},
+	}
+	tests := []struct {
+		value   string
+		want    float64
+		wantErr bool
+	}{
+		{value: "45%", want: 0.45},
+		{value: "45 %", want: 0.45},
+		{value: "12ms", want: 0.012},
+		{value: "3s", want: 3},
+		{value: "1.2e3", want: 1200},
+		{value: "21.5", want: 21.5},
+		{value: "12kg", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			p := NewParser(nil, ".", "", WithStateStore(NewMemoryStateStore()))
+			cfg := &config.MetricConfig{
+				PrometheusName: "latency",
+				ValueType:      "gauge",
+				StripSuffixes:  suffixes,
+			}
+			got, err := p.parseMetric(cfg, "latency", tt.value, nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseMetric() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got.Value != tt.want {
+				t.Errorf("parseMetric() got = %v, want %v", got.Value, tt.want)
+			}
+		})
+	}
+}
+
+func TestParser_despike(t *testing.T) {
+	now = testNow
+	p := NewParser(nil, ".", "", WithStateStore(NewMemoryStateStore()))
+	cfg := &config.MetricConfig{
+		PrometheusName: "temperature",
+		ValueType:      "gauge",
+		Despike:        config.DespikeMedian3,
+		MQTTValueScale: 10,
+	}
+	var got []float64
+	for _, v := range []float64{21, 21.5, 85, 21.5, 22, 30, 30} {
+		m, err := p.parseMetric(cfg, "despike", v, nil)
+		if err != nil {
+			t.Fatalf("parseMetric() error = %v", err)
+		}
+		got = append(got, m.Value)
+	}
+	// The spike of 85 is dropped, the step to 30 shows up one sample late.
+	want := []float64{210, 215, 215, 215, 220, 220, 300}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseMetric() got %v, want %v", got, want)
+	}
+}
+
+func TestParser_errorExpression(t *testing.T) {
+	now = testNow
+	defer func() { testNowElapsed = 0 }()
+	p := NewParser(nil, ".", "", WithStateStore(NewMemoryStateStore()))
+	cfg := &config.MetricConfig{
+		PrometheusName:  "temperature",
+		ValueType:       "gauge",
+		ErrorValue:      floatP(-100),
+		ErrorExpression: "elapsed.Minutes() < 5 ? last_value : -1",
+		MQTTValueScale:  10,
+	}
+	tests := []struct {
+		elapsed time.Duration
+		value   interface{}
+		want    float64
+	}{
+		{value: "21.5", want: 215},
+		{value: "garbage", want: 215},
+		{elapsed: time.Minute, value: true, want: 10},
+		{elapsed: 2 * time.Minute, value: map[string]interface{}{}, want: 10},
+		{elapsed: 7 * time.Minute, value: "garbage", want: -10},
+	}
+	for _, tt := range tests {
+		testNowElapsed = tt.elapsed
+		got, err := p.parseMetric(cfg, "temperature", tt.value, nil)
+		if err != nil {
+			t.Fatalf("parseMetric(%v) error = %v", tt.value, err)
+		}
+		if got.Value != tt.want {
+			t.Errorf("parseMetric(%v) after %v got = %v, want %v", tt.value, tt.elapsed, got.Value, tt.want)
+		}
+	}
+}
+
+func TestParser_MatchConfigs(t *testing.T) {
+	p := NewParser([]config.BlockConfig{{
+		Metrics: []config.MetricConfig{
+			{PrometheusName: "temperature", MQTTName: "temperature", ValueType: "gauge", SensorNameFilter: *config.MustNewRegexp("^dht")},
+			{PrometheusName: "temperature_any", MQTTName: "temperature", ValueType: "gauge"},
+			{PrometheusName: "temp_pattern", MQTTNamePattern: config.MustNewRegexp("^temp"), ValueType: "gauge"},
+		},
+	}}, ".", "", WithStateStore(NewMemoryStateStore()))
+
+	type match struct {
+		name    string
+		matched bool
+		reason  string
+	}
+	tests := []struct {
+		mqttName string
+		deviceID string
+		want     []match
+	}{
+		{
+			mqttName: "temperature",
+			deviceID: "dht22",
+			want: []match{
+				{"temperature", true, `mqtt_name "temperature", sensor_name_filter "^dht" matches device "dht22"`},
+				{"temperature_any", true, `mqtt_name "temperature", no sensor_name_filter`},
+				{"temp_pattern", true, `mqtt_name_pattern "^temp" matches "temperature", no sensor_name_filter`},
+			},
+		},
+		{
+			mqttName: "temperature",
+			deviceID: "bme280",
+			want: []match{
+				{"temperature", false, `mqtt_name "temperature", sensor_name_filter "^dht" does not match device "bme280"`},
+				{"temperature_any", true, `mqtt_name "temperature", no sensor_name_filter`},
+				{"temp_pattern", true, `mqtt_name_pattern "^temp" matches "temperature", no sensor_name_filter`},
+			},
+		},
+		{
+			mqttName: "humidity",
+			deviceID: "dht22",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mqttName+" "+tt.deviceID, func(t *testing.T) {
+			var got []match
+			for _, m := range p.MatchConfigs(tt.mqttName, tt.deviceID) {
+				got = append(got, match{m.Config.PrometheusName, m.Matched, m.Reason})
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("MatchConfigs() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParser_Pause(t *testing.T) {
+	now = testNow
+	metrics := []config.BlockConfig{{Metrics: []config.MetricConfig{
+		{PrometheusName: "energy_total", MQTTName: "energy", ValueType: "counter", ForceMonotonicy: true},
+	}}}
+	store := NewMemoryStateStore()
+	p := NewParser(metrics, ".", "", WithStateStore(store))
+	parse := func(value float64) []Metric {
+		t.Helper()
+		mc, err := p.Parse("devices/meter", "meter", "energy", value)
+		if err != nil {
+			t.Fatalf("Parse() error = %v", err)
+		}
+		return mc
+	}
+	storedOffset := func() float64 {
+		t.Helper()
+		keys, err := store.List()
+		if err != nil || len(keys) != 1 {
+			t.Fatalf("List() = %v, %v, want a single state", keys, err)
+		}
+		restarted := NewParser(metrics, ".", "", WithStateStore(store))
+		state, err := restarted.readMetricState(keys[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return state.dynamic.Offset
+	}
+
+	parse(10)
+	// The counter reset is not written back yet, since the state was written less than a minute ago.
+	if mc := parse(5); len(mc) != 1 || mc[0].Value != 15 {
+		t.Fatalf("Parse() = %v, want 15", mc)
+	}
+	if got := storedOffset(); got != 0 {
+		t.Fatalf("stored offset = %v before pause, want 0", got)
+	}
+
+	if err := p.Pause(); err != nil {
+		t.Fatalf("Pause() error = %v", err)
+	}
+	if !p.Paused() || testutil.ToFloat64(defaultInstrumentation.pausedMetric) != 1 {
+		t.Errorf("Paused() = %v, gauge = %v, want paused", p.Paused(), testutil.ToFloat64(defaultInstrumentation.pausedMetric))
+	}
+	if got := storedOffset(); got != 10 {
+		t.Errorf("stored offset = %v after pause, want 10", got)
+	}
+	if mc := parse(1); len(mc) != 0 {
+		t.Errorf("Parse() while paused = %v, want no metrics", mc)
+	}
+	if err := p.FlushState(); err != nil {
+		t.Errorf("FlushState() while paused error = %v", err)
+	}
+
+	p.Resume()
+	if p.Paused() || testutil.ToFloat64(defaultInstrumentation.pausedMetric) != 0 {
+		t.Errorf("Paused() = %v, gauge = %v, want resumed", p.Paused(), testutil.ToFloat64(defaultInstrumentation.pausedMetric))
+	}
+	// The sample skipped while paused did not touch the state.
+	if mc := parse(6); len(mc) != 1 || mc[0].Value != 16 {
+		t.Errorf("Parse() after resume = %v, want 16", mc)
+	}
+}
+
+func TestParser_metricName(t *testing.T) {
+	now = testNow
+	expression := `metric_name == "temperature_fahrenheit" ? c_to_f(value) : value`
+	metrics := []config.BlockConfig{{Metrics: []config.MetricConfig{
+		{PrometheusName: "temperature_celsius", MQTTName: "temperature", ValueType: "gauge", Expression: expression, DynamicLabels: map[string]string{"metric": "metric_name"}},
+		{PrometheusName: "temperature_fahrenheit", MQTTName: "temperature", ValueType: "gauge", Expression: expression, DynamicLabels: map[string]string{"metric": "metric_name"}},
+	}}}
+	p := NewParser(metrics, ".", "", WithStateStore(NewMemoryStateStore()))
+	mc, err := p.Parse("livingroom/dht22", "dht22", "temperature", 20.0)
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	want := map[string]float64{"temperature_celsius": 20, "temperature_fahrenheit": 68}
+	if len(mc) != len(want) {
+		t.Fatalf("Parse() got %d metrics, want %d", len(mc), len(want))
+	}
+	for _, m := range mc {
+		name := m.Labels["metric"]
+		// Both configs have the same labels, so their descriptions differ by name only.
+		if m.Description.String() != metrics[0].Metrics[0].PrometheusDescriptionFor(name).String() {
+			t.Errorf("metric label %q does not match the metric %s", name, m.Description)
+		}
+		if m.Value != want[name] {
+			t.Errorf("metric %s = %v, want %v", name, m.Value, want[name])
+		}
+	}
+}
+
+func TestParser_transforms(t *testing.T) {
+	now = testNow
+	config.RegisterTransform("square", config.Transform{
+		Apply: func(value float64, _ map[string]float64) float64 { return value * value },
+	})
+	cfg := config.MetricConfig{
+		PrometheusName: "humidity",
+		ValueType:      "gauge",
+		// The expression runs first, the transforms after the pipeline.
+		Expression: "value + 1",
+		Transforms: []config.TransformConfig{
+			{Name: "scale", Params: map[string]float64{"factor": 0.1}},
+			{Name: "square"},
+			{Name: "clamp", Params: map[string]float64{"max": 100}},
+			{Name: "round", Params: map[string]float64{"places": 1}},
+		},
+	}
+	p := NewParser(nil, ".", "", WithStateStore(NewMemoryStateStore()))
+	tests := []struct {
+		value string
+		want  float64
+	}{
+		{value: "42", want: 18.5},
+		{value: "-43", want: 17.6},
+		{value: "500", want: 100},
+	}
+	for _, tt := range tests {
+		m, err := p.parseMetric(&cfg, "humidity", tt.value, nil)
+		if err != nil {
+			t.Fatalf("parseMetric(%s) error = %v", tt.value, err)
+		}
+		if m.Value != tt.want {
+			t.Errorf("parseMetric(%s) = %v, want %v", tt.value, m.Value, tt.want)
+		}
+	}
+
+	invalid := config.MetricConfig{
+		PrometheusName: "humidity",
+		Transforms:     []config.TransformConfig{{Name: "scale"}},
+	}
+	if _, err := p.parseMetric(&invalid, "invalid", "42", nil); err == nil || !strings.Contains(err.Error(), `requires the parameter "factor"`) {
+		t.Errorf("parseMetric() error = %v, want the missing parameter", err)
+	}
+}
+
+func TestParser_calibration(t *testing.T) {
+	now = testNow
+	table, err := config.NewCalibrationTable([][2]float64{{0, -10}, {512, 20}, {1023, 50}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.MetricConfig{
+		PrometheusName: "temperature",
+		ValueType:      "gauge",
+		Calibration:    table,
+		ErrorValue:     floatP(-1),
+		EmitRaw:        true,
+	}
+	p := NewParser(nil, ".", "", WithStateStore(NewMemoryStateStore()))
+	tests := []struct {
+		value   interface{}
+		want    float64
+		wantRaw float64
+	}{
+		{value: 128.0, want: -2.5, wantRaw: 128},
+		{value: "767.5", want: 35, wantRaw: 767.5},
+		// Beyond the ends of the table the value is clamped.
+		{value: -12.0, want: -10, wantRaw: -12},
+		{value: 2048.0, want: 50, wantRaw: 2048},
+		// The error value is served as it is.
+		{value: "broken", want: -1, wantRaw: -1},
+	}
+	for _, tt := range tests {
+		m, err := p.parseMetric(&cfg, "temperature", tt.value, nil)
+		if err != nil {
+			t.Fatalf("parseMetric(%v) error = %v", tt.value, err)
+		}
+		if raw := m.Companions[0].Value(now()); m.Value != tt.want || raw != tt.wantRaw {
+			t.Errorf("parseMetric(%v) = %v (raw %v), want %v (raw %v)", tt.value, m.Value, raw, tt.want, tt.wantRaw)
+		}
+	}
+}
+
+func TestParser_arrayCount(t *testing.T) {
+	now = testNow
+	alarms := []interface{}{
+		map[string]interface{}{"code": "E1", "severity": "critical"},
+		map[string]interface{}{"code": "W7", "severity": "warning"},
+		map[string]interface{}{"code": "E3", "severity": "critical"},
+	}
+	tests := []struct {
+		name       string
+		filter     string
+		errorValue *float64
+		value      interface{}
+		want       float64
+		wantErr    string
+	}{
+		{name: "all elements", value: alarms, want: 3},
+		{name: "empty array", filter: `field("severity") == "critical"`, value: []interface{}{}, want: 0},
+		{name: "matching objects", filter: `field("severity") == "critical"`, value: alarms, want: 2},
+		{name: "matching numbers", filter: "value > 10", value: []interface{}{5.0, 12.0, 30.0, "high"}, want: 2},
+		{name: "matching strings", filter: `raw_string startsWith "E"`, value: []interface{}{"E1", "W7", "E3", "E4"}, want: 3},
+		{name: "not an array", value: 3.0, wantErr: "array_count requires an array, got float64"},
+		{name: "not an array with error_value", errorValue: floatP(-1), value: "none", want: -1},
+		{name: "filter not a condition", filter: "value + 1", value: alarms, wantErr: "failed to compile filter"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.MetricConfig{
+				PrometheusName: "active_alarms",
+				ValueType:      "gauge",
+				ArrayCount:     true,
+				Filter:         tt.filter,
+				ErrorValue:     tt.errorValue,
+			}
+			p := NewParser(nil, ".", "", WithStateStore(NewMemoryStateStore()))
+			m, err := p.parseMetric(&cfg, "alarms", tt.value, map[string]interface{}{"alarms": tt.value})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("parseMetric() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseMetric() error = %v", err)
+			}
+			if m.Value != tt.want {
+				t.Errorf("parseMetric() = %v, want %v", m.Value, tt.want)
+			}
+		})
+	}
+
+	// The JSON extractor passes arrays of the payload on as they are.
+	p := NewParser([]config.BlockConfig{{Metrics: []config.MetricConfig{{
+		PrometheusName: "active_alarms",
+		MQTTName:       "alarms",
+		ValueType:      "gauge",
+		ArrayCount:     true,
+		Filter:         `field("severity") == "critical"`,
+	}}}}, ".", "", WithStateStore(NewMemoryStateStore()))
+	got, err := NewJSONObjectExtractor(p, nil)("devices/boiler", []byte(`{"alarms": [{"severity": "critical"}, {"severity": "warning"}, {"severity": "critical"}]}`), "boiler", MessageInfo{})
+	if err != nil {
+		t.Fatalf("extractor() error = %v", err)
+	}
+	if len(got) != 1 || got[0].Value != 2 {
+		t.Errorf("extractor() got %v, want one metric of value 2", got)
+	}
+
+	// In the metric-per-topic mode, the payload is the array.
+	got, err = NewMetricPerTopicExtractor(p, config.MustNewRegexp("devices/(?P<deviceid>.*)/(?P<metricname>.*)"))("devices/boiler/alarms", []byte(`[{"severity": "critical"}, {"severity": "warning"}]`), "boiler", MessageInfo{})
+	if err != nil {
+		t.Fatalf("extractor() error = %v", err)
+	}
+	if len(got) != 1 || got[0].Value != 1 {
+		t.Errorf("extractor() got %v, want one metric of value 1", got)
+	}
+}
+
+func TestParser_emitDeltaErrorValue(t *testing.T) {
+	now = testNow
+	defer func() { testNowElapsed = 0 }()
+	cfg := config.MetricConfig{
+		PrometheusName: "energy_total",
+		ValueType:      "counter",
+		OmitTimestamp:  true,
+		ErrorValue:     floatP(0),
+		EmitDelta:      true,
+		EmitRate:       true,
+	}
+	p := NewParser(nil, ".", "", WithStateStore(NewMemoryStateStore()))
+	samples := []struct {
+		elapsed   time.Duration
+		value     string
+		wantDelta *float64
+		wantRate  *float64
+	}{
+		{elapsed: 0, value: "100", wantDelta: floatP(0)},
+		// The error value is no reset of the counter, the sample has neither delta nor rate.
+		{elapsed: 30 * time.Second, value: "broken"},
+		{elapsed: time.Minute, value: "160", wantDelta: floatP(60), wantRate: floatP(1)},
+	}
+	for _, s := range samples {
+		testNowElapsed = s.elapsed
+		m, err := p.parseMetric(&cfg, "energy", s.value, nil)
+		if err != nil {
+			t.Fatalf("parseMetric() error = %v", err)
+		}
+		var gotDelta, gotRate *float64
+		for _, companion := range m.Companions {
+			switch companion.Description.String() {
+			case cfg.DeltaDescriptionFor(cfg.PrometheusName).String():
+				gotDelta = floatP(companion.Value(now()))
+			case cfg.RateDescriptionFor(cfg.PrometheusName).String():
+				gotRate = floatP(companion.Value(now()))
+			}
+		}
+		if !reflect.DeepEqual(gotDelta, s.wantDelta) || !reflect.DeepEqual(gotRate, s.wantRate) {
+			t.Errorf("sample %q: got delta %v and rate %v, want %v and %v", s.value, gotDelta, gotRate, s.wantDelta, s.wantRate)
+		}
+	}
+}
+
+func TestParser_minChange(t *testing.T) {
+	now = testNow
+	defer func() { testNowElapsed = 0 }()
+	samples := []struct {
+		elapsed time.Duration
+		value   float64
+	}{
+		{0, 20},
+		{10 * time.Second, 20},
+		{20 * time.Second, 20.4},
+		// The change is measured from the last emitted value, so slow drifts show up too.
+		{30 * time.Second, 20.6},
+		{40 * time.Second, 20.6},
+		{100 * time.Second, 20.6},
+		{110 * time.Second, 20.6},
+	}
+	tests := []struct {
+		name      string
+		heartbeat time.Duration
+		want      []float64
+	}{
+		{name: "without heartbeat", want: []float64{20, 20.6}},
+		{name: "with heartbeat", heartbeat: time.Minute, want: []float64{20, 20.6, 20.6}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewParser(nil, ".", "", WithStateStore(NewMemoryStateStore()))
+			cfg := &config.MetricConfig{
+				PrometheusName:    "temperature",
+				ValueType:         "gauge",
+				MinChange:         floatP(0.5),
+				HeartbeatInterval: tt.heartbeat,
+			}
+			var got []float64
+			for _, s := range samples {
+				testNowElapsed = s.elapsed
+				m, err := p.parseMetric(cfg, "temperature", s.value, nil)
+				if errors.Is(err, errSkipSample) {
+					continue
+				}
+				if err != nil {
+					t.Fatalf("parseMetric(%v) error = %v", s.value, err)
+				}
+				got = append(got, m.Value)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("emitted values = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParser_compileRetry(t *testing.T) {
+	now = testNow
+	defer func() { testNowElapsed = 0 }()
+	core, logs := observer.New(zapcore.WarnLevel)
+	p := NewParser(nil, ".", "", WithStateStore(NewMemoryStateStore()), WithLogger(zap.New(core)))
+	cfg := &config.MetricConfig{
+		PrometheusName: "temperature",
+		ValueType:      "gauge",
+		Expression:     "value +",
+		ErrorValue:     floatP(-1),
+	}
+	parse := func(n int) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			m, err := p.parseMetric(cfg, "temperature", 20.0, nil)
+			if err != nil || m.Value != -1 {
+				t.Fatalf("parseMetric() = %v, %v, want the error_value", m.Value, err)
+			}
+		}
+	}
+	attempts := func() int { return logs.FilterMessage("Failed to compile expression").Len() }
+
+	parse(1000)
+	if got := attempts(); got != 1 {
+		t.Fatalf("got %d compile attempts, want 1", got)
+	}
+	// The delay doubles with each failed attempt.
+	for i, tt := range []struct {
+		elapsed      time.Duration
+		wantAttempts int
+	}{
+		{elapsed: 999 * time.Millisecond, wantAttempts: 1},
+		{elapsed: time.Second, wantAttempts: 2},
+		{elapsed: 2 * time.Second, wantAttempts: 2},
+		{elapsed: 3 * time.Second, wantAttempts: 3},
+		{elapsed: 6 * time.Second, wantAttempts: 3},
+		{elapsed: 7 * time.Second, wantAttempts: 4},
+	} {
+		testNowElapsed = tt.elapsed
+		parse(100)
+		if got := attempts(); got != tt.wantAttempts {
+			t.Errorf("%d: got %d compile attempts after %v, want %d", i, got, tt.elapsed, tt.wantAttempts)
+		}
+	}
+
+	// Without error_value, the cached compile error is returned.
+	cfg.ErrorValue = nil
+	if _, err := p.parseMetric(cfg, "temperature", 20.0, nil); err == nil || !strings.Contains(err.Error(), `failed to compile expression "value +"`) {
+		t.Errorf("parseMetric() error = %v, want the compile error", err)
+	}
+}
+
+// countingStore counts the writes to the wrapped store.
+type countingStore struct {
+	*MemoryStateStore
+	writes int
+}
+
+func (c *countingStore) Write(key string, data []byte) error {
+	c.writes++
+	return c.MemoryStateStore.Write(key, data)
+}
+
+func TestParser_resetFlushWindow(t *testing.T) {
+	now = testNow
+	defer func() { testNowElapsed = 0 }()
+	tests := []struct {
+		name       string
+		window     time.Duration
+		wantWrites int
+	}{
+		// Every reset is written right away with sync_on_reset.
+		{name: "without window", wantWrites: 32},
+		// The resets at 1s and 31s force a flush, the ones in between are flushed once at 31s.
+		{name: "with window", window: 30 * time.Second, wantWrites: 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &countingStore{MemoryStateStore: NewMemoryStateStore()}
+			p := NewParser(nil, ".", "", WithStateStore(store))
+			cfg := &config.MetricConfig{
+				PrometheusName:   "energy_total",
+				ValueType:        "counter",
+				ForceMonotonicy:  true,
+				SyncOnReset:      true,
+				ResetFlushWindow: tt.window,
+			}
+			// The counter flaps between 10 and 5 every second for a minute.
+			var last float64
+			for i := 0; i < 60; i++ {
+				testNowElapsed = time.Duration(i) * time.Second
+				value := 10.0
+				if i%2 == 1 {
+					value = 5
+				}
+				m, err := p.parseMetric(cfg, "energy", value, nil)
+				if err != nil {
+					t.Fatalf("parseMetric() error = %v", err)
+				}
+				if m.Value < last {
+					t.Fatalf("value decreased from %v to %v", last, m.Value)
+				}
+				last = m.Value
+			}
+			if store.writes != tt.wantWrites {
+				t.Errorf("got %d state writes, want %d", store.writes, tt.wantWrites)
+			}
+
+			// The postponed flush writes the current offset.
+			testNowElapsed = 61 * time.Second
+			if _, err := p.parseMetric(cfg, "energy", 10.0, nil); err != nil {
+				t.Fatalf("parseMetric() error = %v", err)
+			}
+			restarted := NewParser(nil, ".", "", WithStateStore(store))
+			stored, err := restarted.readMetricState("energy")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := p.states["energy"].dynamic.Offset; stored.dynamic.Offset != want {
+				t.Errorf("stored offset = %v, want %v", stored.dynamic.Offset, want)
+			}
+		})
+	}
+}
+
+func TestParser_timestampField(t *testing.T) {
+	samples := []struct {
+		name      string
+		timestamp interface{}
+		want      time.Time
+		wantSkip  bool
+	}{
+		{name: "first", timestamp: float64(1700000100), want: time.Unix(1700000100, 0)},
+		{name: "in order", timestamp: "2023-11-14T22:16:00Z", want: time.Unix(1700000160, 0)},
+		{name: "within grace", timestamp: float64(1700000140), want: time.Unix(1700000140, 0)},
+		// More than the grace older than the latest timestamp, not than the previous sample.
+		{name: "stale", timestamp: float64(1700000125), wantSkip: true},
+		{name: "fractional seconds", timestamp: json.Number("1700000170.5"), want: time.Unix(1700000170, 5e8)},
+	}
+	p := NewParser(nil, ".", "", WithStateStore(NewMemoryStateStore()))
+	cfg := &config.MetricConfig{
+		PrometheusName: "temperature",
+		ValueType:      "gauge",
+		TimestampField: "ts",
+		TimestampGrace: 30 * time.Second,
+	}
+	for _, s := range samples {
+		t.Run(s.name, func(t *testing.T) {
+			m, err := p.parseMetric(cfg, "temperature", 20.0, map[string]interface{}{"ts": s.timestamp})
+			if s.wantSkip {
+				if !errors.Is(err, errSkipSample) {
+					t.Errorf("parseMetric() error = %v, want %v", err, errSkipSample)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseMetric() error = %v", err)
+			}
+			if !m.IngestTime.Equal(s.want) {
+				t.Errorf("IngestTime = %v, want %v", m.IngestTime, s.want)
+			}
+		})
+	}
+	if _, err := p.parseMetric(cfg, "temperature", 20.0, map[string]interface{}{}); err == nil || !strings.Contains(err.Error(), "missing timestamp_field") {
+		t.Errorf("parseMetric() without timestamp error = %v, want missing timestamp_field", err)
+	}
+}
@@ -0,0 +1,32 @@
+package metrics
+
+import (
+	"fmt"
+
+	"github.com/hikhvar/mqtt2prometheus/pkg/config"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// protobufJSON renders decoded messages with the field names of the .proto file. Unset fields are included with their
+// zero value, since proto3 does not encode zero values at all.
+var protobufJSON = protojson.MarshalOptions{UseProtoNames: true, EmitUnpopulated: true}
+
+// NewProtobufObjectExtractor decodes protobuf payloads of the given message type and hands them as JSON object to the
+// JSON object extractor. Thus, field paths are the same as for JSON payloads.
+func NewProtobufObjectExtractor(p Parser, metricNameRegex *config.Regexp, desc protoreflect.MessageDescriptor) Extractor {
+	extract := NewJSONObjectExtractor(p, metricNameRegex)
+	return func(topic string, payload []byte, deviceID string, info MessageInfo) (MetricCollection, error) {
+		msg := dynamicpb.NewMessage(desc)
+		if err := proto.Unmarshal(payload, msg); err != nil {
+			return nil, fmt.Errorf("failed to decode protobuf message %q: %w", desc.FullName(), err)
+		}
+		decoded, err := protobufJSON.Marshal(msg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to convert protobuf message %q: %w", desc.FullName(), err)
+		}
+		return extract(topic, decoded, deviceID, info)
+	}
+}
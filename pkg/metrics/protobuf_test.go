@@ -0,0 +1,105 @@
+package metrics
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/hikhvar/mqtt2prometheus/pkg/config"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// readingDescriptor describes
+//
+//	message Reading {
+//	  message Environment { double humidity = 1; }
+//	  double temperature = 1;
+//	  int64 counter = 2;
+//	  Environment env = 3;
+//	}
+func readingDescriptor(t *testing.T) protoreflect.MessageDescriptor {
+	t.Helper()
+	field := func(name string, number int32, typ descriptorpb.FieldDescriptorProto_Type) *descriptorpb.FieldDescriptorProto {
+		return &descriptorpb.FieldDescriptorProto{
+			Name:   proto.String(name),
+			Number: proto.Int32(number),
+			Label:  descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+			Type:   typ.Enum(),
+		}
+	}
+	env := field("env", 3, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE)
+	env.TypeName = proto.String(".sensors.Reading.Environment")
+	fd, err := protodesc.NewFile(&descriptorpb.FileDescriptorProto{
+		Name:    proto.String("reading.proto"),
+		Package: proto.String("sensors"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{{
+			Name: proto.String("Reading"),
+			Field: []*descriptorpb.FieldDescriptorProto{
+				field("temperature", 1, descriptorpb.FieldDescriptorProto_TYPE_DOUBLE),
+				field("counter", 2, descriptorpb.FieldDescriptorProto_TYPE_INT64),
+				env,
+			},
+			NestedType: []*descriptorpb.DescriptorProto{{
+				Name:  proto.String("Environment"),
+				Field: []*descriptorpb.FieldDescriptorProto{field("humidity", 1, descriptorpb.FieldDescriptorProto_TYPE_DOUBLE)},
+			}},
+		}},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fd.Messages().ByName("Reading")
+}
+
+func TestNewProtobufObjectExtractor(t *testing.T) {
+	now = testNow
+	desc := readingDescriptor(t)
+
+	msg := dynamicpb.NewMessage(desc)
+	msg.Set(desc.Fields().ByName("temperature"), protoreflect.ValueOfFloat64(21.5))
+	msg.Set(desc.Fields().ByName("counter"), protoreflect.ValueOfInt64(1234))
+	envDesc := desc.Fields().ByName("env").Message()
+	env := dynamicpb.NewMessage(envDesc)
+	env.Set(envDesc.Fields().ByName("humidity"), protoreflect.ValueOfFloat64(55))
+	msg.Set(desc.Fields().ByName("env"), protoreflect.ValueOfMessage(env))
+	payload, err := proto.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewParser([]config.BlockConfig{{
+		Metrics: []config.MetricConfig{
+			{PrometheusName: "temperature", MQTTName: "temperature", ValueType: "gauge"},
+			{PrometheusName: "counter", MQTTName: "counter", ValueType: "counter"},
+			{PrometheusName: "humidity", MQTTName: "env.humidity", ValueType: "gauge"},
+		},
+	}}, ".", "", WithStateStore(NewMemoryStateStore()))
+
+	got, err := NewProtobufObjectExtractor(p, nil, desc)("sensors/livingroom", payload, "livingroom", MessageInfo{})
+	if err != nil {
+		t.Fatalf("extractor() error = %v", err)
+	}
+	if len(got) != 3 {
+		t.Fatalf("extractor() got %d metrics, want 3: %v", len(got), got)
+	}
+	want := []float64{21.5, 55, 1234}
+	var gotValues []float64
+	for _, m := range got {
+		gotValues = append(gotValues, m.Value)
+	}
+	sort.Float64s(gotValues)
+	for i := range want {
+		if gotValues[i] != want[i] {
+			t.Errorf("extractor() got values %v, want %v", gotValues, want)
+			break
+		}
+	}
+
+	if _, err := NewProtobufObjectExtractor(p, nil, desc)("sensors/livingroom", []byte{0xff}, "livingroom", MessageInfo{}); err == nil {
+		t.Errorf("extractor() expected an error for an invalid payload")
+	}
+}
@@ -0,0 +1,130 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/hikhvar/mqtt2prometheus/pkg/config"
+)
+
+func TestRedisStateStore(t *testing.T) {
+	server := miniredis.RunT(t)
+	store, err := NewRedisStateStore("redis://" + server.Addr() + "/0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	if _, err := store.Read("missing"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Read() of missing state error = %v, want %v", err, os.ErrNotExist)
+	}
+	for _, key := range []string{"b", "a"} {
+		if err := store.Write(key, []byte("value_offset: 1\n")); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+	}
+	if got, err := server.Get(redisStateKeyPrefix + "a"); err != nil || got != "value_offset: 1\n" {
+		t.Errorf("redis key = %q, %v", got, err)
+	}
+	if keys, err := store.List(); err != nil || !reflect.DeepEqual(keys, []string{"a", "b"}) {
+		t.Errorf("List() = %v, %v, want [a b]", keys, err)
+	}
+	if err := store.Delete("a"); err != nil {
+		t.Errorf("Delete() error = %v", err)
+	}
+	if keys, err := store.List(); err != nil || !reflect.DeepEqual(keys, []string{"b"}) {
+		t.Errorf("List() = %v, %v, want [b]", keys, err)
+	}
+}
+
+func TestRedisStateStore_timeout(t *testing.T) {
+	redisTimeout = 50 * time.Millisecond
+	defer func() { redisTimeout = 5 * time.Second }()
+
+	// A server which accepts connections but never answers.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	store, err := NewRedisStateStore("redis://" + listener.Addr().String() + "/0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	start := time.Now()
+	if _, err := store.Read("energy"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Read() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if err := store.Write("energy", []byte("value_offset: 1\n")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Write() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("requests took %s, want them to time out after %s", elapsed, redisTimeout)
+	}
+}
+
+func TestParser_redisStateStore(t *testing.T) {
+	now = testNow
+
+	server := miniredis.RunT(t)
+	addr := server.Addr()
+	cfg := &config.MetricConfig{
+		PrometheusName:  "energy",
+		ValueType:       "counter",
+		ForceMonotonicy: true,
+		OmitTimestamp:   true,
+	}
+	newParser := func() *Parser {
+		store, err := NewRedisStateStore("redis://" + addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { store.Close() })
+		p := NewParser(nil, ".", "", WithStateStore(store))
+		return &p
+	}
+
+	first := newParser()
+	for _, v := range []float64{5, 2} {
+		if _, err := first.parseMetric(cfg, "energy", v, nil); err != nil {
+			t.Fatalf("parseMetric() error = %v", err)
+		}
+	}
+	if err := first.writeMetricState("energy", first.states["energy"]); err != nil {
+		t.Fatalf("writeMetricState() error = %v", err)
+	}
+
+	// A second replica continues with the shared offset.
+	second := newParser()
+	got, err := second.parseMetric(cfg, "energy", 3.0, nil)
+	if err != nil {
+		t.Fatalf("parseMetric() error = %v", err)
+	}
+	if got.Value != 8 {
+		t.Errorf("parseMetric() got = %v, want %v", got.Value, 8)
+	}
+
+	// Connection errors are reported instead of treating the state as missing.
+	server.Close()
+	third := newParser()
+	if _, err := third.parseMetric(cfg, "energy", 4.0, nil); err == nil || errors.Is(err, os.ErrNotExist) {
+		t.Errorf("parseMetric() error = %v, want connection error", err)
+	}
+}
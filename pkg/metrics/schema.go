@@ -0,0 +1,31 @@
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hikhvar/mqtt2prometheus/pkg/config"
+)
+
+// NewSchemaValidatingExtractor checks JSON payloads against the schema of their topic before passing them to the
+// extractor. Payloads which are no valid JSON or violate the schema are dropped with an error and counted in
+// mqtt2prometheus_schema_validation_errors_total. Payloads of topics without schema are passed on as they are.
+func NewSchemaValidatingExtractor(schemaFor func(topic string) *config.JSONSchema, extractor Extractor) Extractor {
+	validationErrors := defaultInstrumentation.schemaValidationErrorMetric
+	return func(topic string, payload []byte, deviceID string, info MessageInfo) (MetricCollection, error) {
+		schema := schemaFor(topic)
+		if schema == nil {
+			return extractor(topic, payload, deviceID, info)
+		}
+		var decoded interface{}
+		if err := json.Unmarshal(payload, &decoded); err != nil {
+			validationErrors.WithLabelValues(topic).Inc()
+			return nil, fmt.Errorf("failed to decode payload for schema validation: %w", err)
+		}
+		if err := schema.Validate(decoded); err != nil {
+			validationErrors.WithLabelValues(topic).Inc()
+			return nil, fmt.Errorf("payload violates the payload_schema: %w", err)
+		}
+		return extractor(topic, payload, deviceID, info)
+	}
+}
@@ -0,0 +1,66 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/hikhvar/mqtt2prometheus/pkg/config"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestNewSchemaValidatingExtractor(t *testing.T) {
+	now = testNow
+	schema, err := config.CompileJSONSchema([]byte(`{
+		"type": "object",
+		"required": ["temperature"],
+		"properties": {"temperature": {"type": "number", "minimum": -40, "maximum": 85}}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := []config.BlockConfig{{Metrics: []config.MetricConfig{
+		{PrometheusName: "temperature", MQTTName: "temperature", ValueType: "gauge", TopicPathFilter: config.MustNewRegexp(".*")},
+	}}}
+	p := NewParser(metrics, ".", "", WithStateStore(NewMemoryStateStore()))
+	schemaFor := func(topic string) *config.JSONSchema {
+		if topic == "schema/unchecked" {
+			return nil
+		}
+		return schema
+	}
+	extract := NewSchemaValidatingExtractor(schemaFor, NewJSONObjectExtractor(p, nil))
+	topic := "schema/dht22"
+	counter := defaultInstrumentation.schemaValidationErrorMetric.WithLabelValues(topic)
+
+	tests := []struct {
+		payload    string
+		wantValue  float64
+		wantErr    string
+		wantErrors float64
+	}{
+		{payload: `{"temperature": 21.5}`, wantValue: 21.5},
+		{payload: `{"temperature": 120}`, wantErr: "must be <= 85 but found 120", wantErrors: 1},
+		{payload: `{"humidity": 40}`, wantErr: "missing properties: 'temperature'", wantErrors: 2},
+		{payload: `{"temperature":`, wantErr: "failed to decode payload", wantErrors: 3},
+		{payload: `{"temperature": 22}`, wantValue: 22, wantErrors: 3},
+	}
+	for _, tt := range tests {
+		mc, err := extract(topic, []byte(tt.payload), "dht22", MessageInfo{})
+		if tt.wantErr == "" {
+			if err != nil || len(mc) != 1 || mc[0].Value != tt.wantValue {
+				t.Errorf("extract(%s) = %v, %v, want %v", tt.payload, mc, err, tt.wantValue)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), tt.wantErr) || len(mc) != 0 {
+			t.Errorf("extract(%s) = %v, %v, want error %q", tt.payload, mc, err, tt.wantErr)
+		}
+		if got := testutil.ToFloat64(counter); got != tt.wantErrors {
+			t.Errorf("after %s: schema validation errors = %v, want %v", tt.payload, got, tt.wantErrors)
+		}
+	}
+
+	// Topics without a schema are passed through unchecked.
+	mc, err := extract("schema/unchecked", []byte(`{"temperature": 120}`), "dht22", MessageInfo{})
+	if err != nil || len(mc) != 1 || mc[0].Value != 120 {
+		t.Errorf("extract() without schema = %v, %v, want 120", mc, err)
+	}
+}
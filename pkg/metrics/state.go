@@ -0,0 +1,463 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hikhvar/mqtt2prometheus/pkg/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+const (
+	// Upper bound of the delay before a failed state store operation is attempted again
+	stateIOBackoffMax = time.Minute
+
+	stateRead  = "read"
+	stateWrite = "write"
+
+	stateFileExtension = ".yaml"
+)
+
+// Backoff before the first retry of a failed state store operation. It doubles with every failed retry.
+var stateIOBackoff = 100 * time.Millisecond
+
+// StateStore persists the serialized state of metrics. The keys are metric ids, which are safe to use in file paths.
+type StateStore interface {
+	// Read returns the state stored for the key. If there is none, an error wrapping os.ErrNotExist is returned.
+	Read(key string) ([]byte, error)
+	// Write replaces the state stored for the key.
+	Write(key string, data []byte) error
+	// List returns the keys of all stored states in lexical order.
+	List() ([]string, error)
+	// Delete removes the state stored for the key. Deleting a missing state is not an error.
+	Delete(key string) error
+}
+
+// FileStateStore keeps one YAML file per state in a directory of the local file system.
+type FileStateStore struct {
+	dir string
+	// Set if each file is locked while it is read or written, see WithFileLocking
+	locking bool
+}
+
+// FileStateStoreOption configures optional behaviour of a FileStateStore.
+type FileStateStoreOption func(*FileStateStore)
+
+// WithFileLocking makes the store hold an advisory lock (flock) of a state file while reading or writing it: a shared
+// one to read, an exclusive one to write. Processes sharing the directory, e.g. replicas with a common volume, then
+// never read a partially written state or interleave their writes. The last write still wins, the lock does not span
+// from reading a state to writing it back. Whether locks are seen across hosts depends on the file system, see the
+// Readme.
+func WithFileLocking() FileStateStoreOption {
+	return func(s *FileStateStore) {
+		s.locking = true
+	}
+}
+
+func NewFileStateStore(dir string, opts ...FileStateStoreOption) *FileStateStore {
+	s := &FileStateStore{dir: strings.TrimRight(dir, "/")}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+func (s *FileStateStore) fileName(key string) string {
+	return fmt.Sprintf("%s/%s%s", s.dir, key, stateFileExtension)
+}
+
+func (s *FileStateStore) Read(key string) ([]byte, error) {
+	if !s.locking {
+		return os.ReadFile(s.fileName(key))
+	}
+	f, err := os.Open(s.fileName(key))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err := lockFile(f, false); err != nil {
+		return nil, fmt.Errorf("failed to lock %q: %w", f.Name(), err)
+	}
+	return io.ReadAll(f)
+}
+
+func (s *FileStateStore) Write(key string, data []byte) error {
+	if !s.locking {
+		return os.WriteFile(s.fileName(key), data, 0644)
+	}
+	// The file is truncated only once the lock is held, so readers never see it empty.
+	f, err := os.OpenFile(s.fileName(key), os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if err := lockFile(f, true); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to lock %q: %w", f.Name(), err)
+	}
+	if err := f.Truncate(0); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (s *FileStateStore) List() ([]string, error) {
+	files, err := filepath.Glob(s.fileName("*"))
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(files))
+	for _, f := range files {
+		keys = append(keys, strings.TrimSuffix(filepath.Base(f), stateFileExtension))
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (s *FileStateStore) Delete(key string) error {
+	if err := os.Remove(s.fileName(key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// MemoryStateStore keeps the states in memory only. They are lost when the process exits.
+type MemoryStateStore struct {
+	mu     sync.Mutex
+	states map[string][]byte
+}
+
+func NewMemoryStateStore() *MemoryStateStore {
+	return &MemoryStateStore{states: make(map[string][]byte)}
+}
+
+func (s *MemoryStateStore) Read(key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.states[key]
+	if !ok {
+		return nil, fmt.Errorf("state %q: %w", key, os.ErrNotExist)
+	}
+	return append([]byte(nil), data...), nil
+}
+
+func (s *MemoryStateStore) Write(key string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.states[key] = append([]byte(nil), data...)
+	return nil
+}
+
+func (s *MemoryStateStore) List() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make([]string, 0, len(s.states))
+	for k := range s.states {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (s *MemoryStateStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.states, key)
+	return nil
+}
+
+// WithStateStore replaces the default state files in the state directory with the given store.
+func WithStateStore(store StateStore) ParserOption {
+	return func(p *Parser) {
+		p.store = store
+	}
+}
+
+// stateIORetry is the schedule of the next attempt of a failed state store operation.
+type stateIORetry struct {
+	err      error
+	failures int
+	retryAt  time.Time
+}
+
+// stateIOKey identifies a state store operation on the state of a metric.
+type stateIOKey struct {
+	operation, metricID string
+}
+
+// retryStateIO runs the given state store operation on the state of metricID. A failed operation is counted, logged
+// and scheduled for a retry after stateIOBackoff, which doubles with each failed attempt up to stateIOBackoffMax.
+// Until then, the error is returned again without running the operation, so the handling of a message never waits
+// for a backoff. A missing state is not a failure.
+func (p *Parser) retryStateIO(operation, metricID string, fn func() error) error {
+	key := stateIOKey{operation, metricID}
+	retry, found := p.stateIORetries[key]
+	if found && now().Before(retry.retryAt) {
+		return retry.err
+	}
+	err := fn()
+	if err == nil || errors.Is(err, os.ErrNotExist) {
+		delete(p.stateIORetries, key)
+		return err
+	}
+	if !found {
+		retry = &stateIORetry{}
+		p.stateIORetries[key] = retry
+	}
+	delay := stateIOBackoff
+	for i := 0; i < retry.failures && delay < stateIOBackoffMax; i++ {
+		delay *= 2
+	}
+	if delay > stateIOBackoffMax {
+		delay = stateIOBackoffMax
+	}
+	retry.failures++
+	retry.retryAt = now().Add(delay)
+	retry.err = err
+	p.stateIOErrors.WithLabelValues(operation).Inc()
+	p.logger.Warn("State store operation failed", zap.String("metricID", metricID), zap.String("operation", operation),
+		zap.Int("attempt", retry.failures), zap.Error(err), zap.Duration("retryIn", delay))
+	return err
+}
+
+// persistedMetric is the last metric emitted for a config with persist_last_value. The description is identified by
+// its string form, which covers the name, the help, the labels and the const labels.
+type persistedMetric struct {
+	DeviceID    string            `yaml:"device_id"`
+	Description string            `yaml:"description"`
+	Value       float64           `yaml:"value"`
+	IngestTime  time.Time         `yaml:"ingest_time,omitempty"`
+	Topic       string            `yaml:"topic"`
+	Labels      map[string]string `yaml:"labels,omitempty"`
+	LabelsKeys  []string          `yaml:"labels_keys,omitempty"`
+	ReceiveTime time.Time         `yaml:"receive_time,omitempty"`
+	IntValue    *int64            `yaml:"int_value,omitempty"`
+	// The values of the timestamped companions by the string form of their description, e.g. the raw value
+	CompanionValues map[string]float64 `yaml:"companion_values,omitempty"`
+}
+
+// persistLastValue remembers the metric in the state of metricID. Like the rest of the state, it is written back
+// to the state store every minute.
+func (p *Parser) persistLastValue(metricID, deviceID string, m Metric) error {
+	p.pause.mu.Lock()
+	defer p.pause.mu.Unlock()
+	ms, err := p.loadMetricState(metricID)
+	if err != nil {
+		return err
+	}
+	last := &persistedMetric{
+		DeviceID:    deviceID,
+		Description: m.Description.String(),
+		Value:       m.Value,
+		IngestTime:  m.IngestTime,
+		Topic:       m.Topic,
+		Labels:      m.Labels,
+		LabelsKeys:  m.LabelsKeys,
+		ReceiveTime: m.ReceiveTime,
+		IntValue:    m.IntValue,
+	}
+	for _, companion := range m.Companions {
+		// The others are computed at scrape time.
+		if companion.Timestamped {
+			if last.CompanionValues == nil {
+				last.CompanionValues = make(map[string]float64)
+			}
+			last.CompanionValues[companion.Description.String()] = companion.Value(m.ReceiveTime)
+		}
+	}
+	ms.dynamic.LastEmitted = last
+	return p.flushMetricState(metricID, ms)
+}
+
+// LastValues returns the metrics remembered for configs with persist_last_value by the device id. Together with
+// WarmState, this allows to serve the last known values after a restart until fresh samples arrive. Metrics of
+// configs which changed or are no longer configured are left out. The companions and the max_value_age handling
+// are set up from the current config, like for a parsed sample. The availability starts over.
+func (p *Parser) LastValues() map[string]MetricCollection {
+	type descConfig struct {
+		desc *prometheus.Desc
+		cfg  *config.MetricConfig
+		name string
+	}
+	descs := make(map[string]descConfig)
+	add := func(cfg *config.MetricConfig) {
+		if !cfg.PersistLastValue {
+			return
+		}
+		for _, name := range cfg.PrometheusNames() {
+			d := cfg.PrometheusDescriptionFor(name)
+			descs[d.String()] = descConfig{desc: d, cfg: cfg, name: name}
+		}
+	}
+	for _, cfgs := range p.metricConfigs {
+		for _, cfg := range cfgs {
+			add(cfg)
+		}
+	}
+	for _, cfg := range p.patternConfigs {
+		add(cfg)
+	}
+
+	values := make(map[string]MetricCollection)
+	for _, key := range sortedStateKeys(p.states) {
+		last := p.states[key].dynamic.LastEmitted
+		if last == nil {
+			continue
+		}
+		dc, ok := descs[last.Description]
+		if !ok {
+			continue
+		}
+		companionValue := func(desc *prometheus.Desc) *float64 {
+			if v, ok := last.CompanionValues[desc.String()]; ok {
+				return &v
+			}
+			return nil
+		}
+		var raw float64
+		if v := companionValue(dc.cfg.RawDescriptionFor(dc.name)); v != nil {
+			raw = *v
+		}
+		var avail *availability
+		if dc.cfg.ExpectedInterval > 0 {
+			ms := p.states[key]
+			if ms.availability == nil {
+				ms.availability = newAvailability(p.availabilityWindow, dc.cfg.ExpectedInterval)
+			}
+			avail = ms.availability
+		}
+		var staleValue *float64
+		if dc.cfg.MaxValueAge > 0 {
+			staleValue = dc.cfg.ErrorValue
+		}
+		values[last.DeviceID] = append(values[last.DeviceID], Metric{
+			Description: dc.desc,
+			Value:       last.Value,
+			ValueType:   dc.cfg.PrometheusValueType(),
+			IngestTime:  last.IngestTime,
+			Topic:       last.Topic,
+			Labels:      last.Labels,
+			LabelsKeys:  last.LabelsKeys,
+			LabelOrder:  labelOrder(dc.cfg),
+			IntValue:    last.IntValue,
+			ReceiveTime: last.ReceiveTime,
+			Companions: companionsFor(dc.cfg, dc.name, last.ReceiveTime, raw, avail,
+				companionValue(dc.cfg.RateDescriptionFor(dc.name)), companionValue(dc.cfg.DeltaDescriptionFor(dc.name))),
+			MaxValueAge:        dc.cfg.MaxValueAge,
+			StaleValue:         staleValue,
+			MaxTimestampAge:    dc.cfg.MaxTimestampAge,
+			TimestampAgeAction: dc.cfg.TimestampAgeAction,
+		})
+	}
+	return values
+}
+
+// sortedStateKeys returns the keys of the states in lexical order.
+func sortedStateKeys(states map[string]*metricState) []string {
+	keys := make([]string, 0, len(states))
+	for k := range states {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var (
+	stateFilesDesc = prometheus.NewDesc("mqtt2prometheus_state_files", "Number of stored metric states", nil, nil)
+	stateBytesDesc = prometheus.NewDesc("mqtt2prometheus_state_bytes", "Total size of all stored metric states in bytes", nil, nil)
+)
+
+// stateSizes tracks the size of each stored state, so the state collector does not scan the store on every
+// collection. It is filled by a scan of the store on first use and kept up to date by the writes and deletions of the
+// parser. States written or deleted by other processes sharing the store are only seen by the first scan.
+type stateSizes struct {
+	mu      sync.Mutex
+	scanned bool
+	sizes   map[string]int
+}
+
+func newStateSizes() *stateSizes {
+	return &stateSizes{sizes: make(map[string]int)}
+}
+
+// set records the size of the state written for the key.
+func (s *stateSizes) set(key string, size int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sizes[key] = size
+}
+
+// delete forgets the state of the key.
+func (s *stateSizes) delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sizes, key)
+}
+
+// totals returns the number and the total size of the stored states. The store is scanned on the first call and
+// again after a failed scan.
+func (s *stateSizes) totals(store StateStore, logger *zap.Logger) (count, size int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.scanned {
+		keys, err := store.List()
+		if err != nil {
+			return 0, 0, err
+		}
+		for _, key := range keys {
+			data, err := store.Read(key)
+			if err != nil {
+				// The state may have been deleted in the meantime.
+				if !errors.Is(err, os.ErrNotExist) {
+					logger.Warn("Failed to read state", zap.String("metricID", key), zap.Error(err))
+				}
+				continue
+			}
+			s.sizes[key] = len(data)
+		}
+		s.scanned = true
+	}
+	for _, n := range s.sizes {
+		size += n
+	}
+	return len(s.sizes), size, nil
+}
+
+// stateCollector reports the number and the total size of the stored states, see stateSizes.
+type stateCollector struct {
+	store  StateStore
+	sizes  *stateSizes
+	logger *zap.Logger
+}
+
+// StateCollector returns a collector for the number and the total size of the states in the parser's state store.
+func (p *Parser) StateCollector() prometheus.Collector {
+	return &stateCollector{store: p.store, sizes: p.stateSizes, logger: p.logger}
+}
+
+func (c *stateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- stateFilesDesc
+	ch <- stateBytesDesc
+}
+
+func (c *stateCollector) Collect(ch chan<- prometheus.Metric) {
+	count, size, err := c.sizes.totals(c.store, c.logger)
+	if err != nil {
+		c.logger.Warn("Failed to list states", zap.Error(err))
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(stateFilesDesc, prometheus.GaugeValue, float64(count))
+	ch <- prometheus.MustNewConstMetric(stateBytesDesc, prometheus.GaugeValue, float64(size))
+}
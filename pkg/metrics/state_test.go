@@ -0,0 +1,558 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hikhvar/mqtt2prometheus/pkg/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// flakyStore fails the first failures operations before delegating to an in-memory store.
+type flakyStore struct {
+	*MemoryStateStore
+	failures int
+}
+
+func (f *flakyStore) fail() error {
+	if f.failures > 0 {
+		f.failures--
+		return errors.New("stale NFS file handle")
+	}
+	return nil
+}
+
+func (f *flakyStore) Read(key string) ([]byte, error) {
+	if err := f.fail(); err != nil {
+		return nil, err
+	}
+	return f.MemoryStateStore.Read(key)
+}
+
+func (f *flakyStore) Write(key string, data []byte) error {
+	if err := f.fail(); err != nil {
+		return err
+	}
+	return f.MemoryStateStore.Write(key, data)
+}
+
+func TestParser_stateIORetry(t *testing.T) {
+	now = testNow
+	defer func() { testNowElapsed = 0 }()
+
+	store := &flakyStore{MemoryStateStore: NewMemoryStateStore()}
+	p := NewParser(nil, ".", "", WithStateStore(store))
+	p.stateIOErrors = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test"}, []string{"operation"})
+	cfg := &config.MetricConfig{
+		PrometheusName:  "energy",
+		ValueType:       "counter",
+		ForceMonotonicy: true,
+	}
+
+	// The first sample reads the missing state and flushes the new one. The read is retried by later samples after
+	// the backoff, which doubles with each failure. In between, samples fail without touching the store.
+	store.failures = 2
+	steps := []struct {
+		at         time.Duration
+		wantErr    bool
+		wantErrors float64
+	}{
+		{at: 0, wantErr: true, wantErrors: 1},
+		{at: stateIOBackoff / 2, wantErr: true, wantErrors: 1},
+		{at: stateIOBackoff, wantErr: true, wantErrors: 2},
+		{at: 2 * stateIOBackoff, wantErr: true, wantErrors: 2},
+		{at: 3 * stateIOBackoff, wantErrors: 2},
+	}
+	for _, step := range steps {
+		testNowElapsed = step.at
+		_, err := p.parseMetric(cfg, "energy", 5.0, nil)
+		if (err != nil) != step.wantErr {
+			t.Fatalf("parseMetric() after %s error = %v, wantErr %v", step.at, err, step.wantErr)
+		}
+		if got := testutil.ToFloat64(p.stateIOErrors.WithLabelValues(stateRead)); got != step.wantErrors {
+			t.Errorf("after %s: counted %v read errors, want %v", step.at, got, step.wantErrors)
+		}
+	}
+	if _, err := store.Read("energy"); err != nil {
+		t.Errorf("state was not written: %v", err)
+	}
+
+	// A failed flush is skipped by the samples during the backoff, but retried right away by an explicit flush.
+	store.failures = 1
+	testNowElapsed += 2 * time.Minute
+	if _, err := p.parseMetric(cfg, "energy", 6.0, nil); err == nil {
+		t.Errorf("parseMetric() with failing flush error = nil, want error")
+	}
+	if _, err := p.parseMetric(cfg, "energy", 7.0, nil); err != nil {
+		t.Errorf("parseMetric() during the backoff of the flush error = %v", err)
+	}
+	if got := testutil.ToFloat64(p.stateIOErrors.WithLabelValues(stateWrite)); got != 1 {
+		t.Errorf("counted %v write errors, want 1", got)
+	}
+	if err := p.FlushState(); err != nil {
+		t.Fatalf("FlushState() error = %v", err)
+	}
+	if data, err := store.Read("energy"); err != nil || !strings.Contains(string(data), "last_raw_value: 7") {
+		t.Errorf("stored state = %q, %v, want the last raw value 7", data, err)
+	}
+}
+
+func TestStateStores(t *testing.T) {
+	stateDir, err := os.MkdirTemp("", "state_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(stateDir)
+
+	stores := map[string]StateStore{
+		"file":         NewFileStateStore(stateDir + "/"),
+		"file locking": NewFileStateStore(stateDir, WithFileLocking()),
+		"memory":       NewMemoryStateStore(),
+	}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			if _, err := store.Read("missing"); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("Read() of missing state error = %v, want %v", err, os.ErrNotExist)
+			}
+			for _, key := range []string{"b", "a"} {
+				if err := store.Write(key, []byte("value_offset: 1\n")); err != nil {
+					t.Fatalf("Write() error = %v", err)
+				}
+			}
+			got, err := store.Read("a")
+			if err != nil || string(got) != "value_offset: 1\n" {
+				t.Errorf("Read() = %q, %v", got, err)
+			}
+			if keys, err := store.List(); err != nil || !reflect.DeepEqual(keys, []string{"a", "b"}) {
+				t.Errorf("List() = %v, %v, want [a b]", keys, err)
+			}
+			if err := store.Delete("a"); err != nil {
+				t.Errorf("Delete() error = %v", err)
+			}
+			if err := store.Delete("a"); err != nil {
+				t.Errorf("Delete() of missing state error = %v", err)
+			}
+			if keys, err := store.List(); err != nil || !reflect.DeepEqual(keys, []string{"b"}) {
+				t.Errorf("List() = %v, %v, want [b]", keys, err)
+			}
+		})
+	}
+}
+
+func TestFileStateStore_locking(t *testing.T) {
+	stateDir, err := os.MkdirTemp("", "state_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(stateDir)
+
+	// Two replicas sharing the state directory, each with its own store.
+	parsers := []Parser{
+		NewParser(nil, ".", stateDir, WithStateStore(NewFileStateStore(stateDir, WithFileLocking()))),
+		NewParser(nil, ".", stateDir, WithStateStore(NewFileStateStore(stateDir, WithFileLocking()))),
+	}
+	const (
+		metricID   = "energy"
+		iterations = 100
+		// Large states take several writes, which widens the window for a torn read.
+		windowSize = 1024
+	)
+	window := make([]float64, windowSize)
+	for i := range window {
+		window[i] = float64(i)
+	}
+	if err := parsers[0].writeMetricState(metricID, &metricState{dynamic: dynamicState{Offset: 1, Window: window}}); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*len(parsers))
+	for i, p := range parsers {
+		wg.Add(1)
+		go func(replica int, p Parser) {
+			defer wg.Done()
+			for n := 1; n <= iterations; n++ {
+				state := &metricState{dynamic: dynamicState{Offset: float64(replica*iterations + n), Window: window}}
+				if err := p.writeMetricState(metricID, state); err != nil {
+					errs <- err
+					return
+				}
+				read, err := p.readMetricState(metricID)
+				if err != nil {
+					errs <- err
+					return
+				}
+				// A partially written state would lack the offset or a part of the window.
+				if read.dynamic.Offset == 0 || len(read.dynamic.Window) != windowSize {
+					errs <- fmt.Errorf("replica %d read a torn state with offset %v and %d window values", replica, read.dynamic.Offset, len(read.dynamic.Window))
+					return
+				}
+			}
+		}(i, p)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestParser_memoryStateStore(t *testing.T) {
+	now = testNow
+	store := NewMemoryStateStore()
+	cfg := &config.MetricConfig{
+		PrometheusName:  "energy",
+		ValueType:       "counter",
+		ForceMonotonicy: true,
+		OmitTimestamp:   true,
+	}
+
+	p := NewParser(nil, ".", "", WithStateStore(store))
+	for _, v := range []float64{5, 2} {
+		if _, err := p.parseMetric(cfg, "energy", v, nil); err != nil {
+			t.Fatalf("parseMetric() error = %v", err)
+		}
+	}
+	if err := p.writeMetricState("energy", p.states["energy"]); err != nil {
+		t.Fatalf("writeMetricState() error = %v", err)
+	}
+
+	// A new parser continues with the offset and last value from the shared store. So the next reset adds up.
+	p = NewParser(nil, ".", "", WithStateStore(store))
+	got, err := p.parseMetric(cfg, "energy", 1.0, nil)
+	if err != nil {
+		t.Fatalf("parseMetric() error = %v", err)
+	}
+	if got.Value != 8 {
+		t.Errorf("parseMetric() got = %v, want %v", got.Value, 8)
+	}
+}
+
+func TestParser_StateCollector(t *testing.T) {
+	stateDir, err := os.MkdirTemp("", "state_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(stateDir)
+
+	// The states stored before are counted by the first collection.
+	store := &listingStore{StateStore: NewFileStateStore(stateDir)}
+	for key, data := range map[string]string{"a": "value_offset: 1\n", "b": "value_offset: 12\n", "c": ""} {
+		if err := store.Write(key, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p := NewParser(nil, ".", stateDir, WithStateStore(store))
+	collector := p.StateCollector()
+
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(`
+# HELP mqtt2prometheus_state_bytes Total size of all stored metric states in bytes
+# TYPE mqtt2prometheus_state_bytes gauge
+mqtt2prometheus_state_bytes 33
+# HELP mqtt2prometheus_state_files Number of stored metric states
+# TYPE mqtt2prometheus_state_files gauge
+mqtt2prometheus_state_files 3
+`)); err != nil {
+		t.Errorf("three states: %v", err)
+	}
+
+	// Later collections pick up the writes and deletions of the parser without scanning the store again.
+	if err := p.writeMetricState("c", &metricState{dynamic: dynamicState{Offset: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.writeMetricState("d", &metricState{dynamic: dynamicState{Offset: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.RenameState("a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	var want int
+	for _, key := range []string{"b", "c", "d"} {
+		data, err := store.Read(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want += len(data)
+	}
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(fmt.Sprintf(`
+# HELP mqtt2prometheus_state_bytes Total size of all stored metric states in bytes
+# TYPE mqtt2prometheus_state_bytes gauge
+mqtt2prometheus_state_bytes %d
+# HELP mqtt2prometheus_state_files Number of stored metric states
+# TYPE mqtt2prometheus_state_files gauge
+mqtt2prometheus_state_files 3
+`, want))); err != nil {
+		t.Errorf("after writes: %v", err)
+	}
+	if store.lists != 1 {
+		t.Errorf("the store was listed %d times, want 1", store.lists)
+	}
+}
+
+// listingStore counts the listings of the wrapped store.
+type listingStore struct {
+	StateStore
+	lists int
+}
+
+func (s *listingStore) List() ([]string, error) {
+	s.lists++
+	return s.StateStore.List()
+}
+
+func TestParser_WarmState(t *testing.T) {
+	now = testNow
+	stateDir, err := os.MkdirTemp("", "state_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(stateDir)
+
+	store := NewFileStateStore(stateDir)
+	for key, state := range map[string]string{
+		"energy":  "value_offset: 100\nlast_raw_value: 50\n",
+		"counter": "value_offset: 7\nlast_raw_value: 3\n",
+	} {
+		if err := store.Write(key, []byte(state)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	p := NewParser(nil, ".", stateDir, WithStateStore(store))
+	if err := p.WarmState(); err != nil {
+		t.Fatalf("WarmState() error = %v", err)
+	}
+	if len(p.states) != 2 || p.states["energy"].dynamic.Offset != 100 || p.states["counter"].dynamic.Offset != 7 {
+		t.Fatalf("WarmState() got states %v, want the offsets 100 and 7", p.states)
+	}
+
+	// The state is used from memory, even if the file is gone by now.
+	if err := os.RemoveAll(stateDir); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.MetricConfig{PrometheusName: "energy", ValueType: "counter", ForceMonotonicy: true}
+	got, err := p.parseMetric(cfg, "energy", 60.0, nil)
+	if err != nil {
+		t.Fatalf("parseMetric() error = %v", err)
+	}
+	if got.Value != 160 {
+		t.Errorf("parseMetric() got = %v, want 160", got.Value)
+	}
+}
+
+func TestParser_RenameState(t *testing.T) {
+	now = testNow
+	cfg := &config.MetricConfig{PrometheusName: "energy", ValueType: "counter", ForceMonotonicy: true}
+	tests := []struct {
+		name       string
+		states     map[string]string
+		value      float64
+		wantOffset float64
+		want       float64
+	}{
+		{
+			name:       "new state missing",
+			states:     map[string]string{"old": "value_offset: 100\nlast_raw_value: 50\n"},
+			value:      60,
+			wantOffset: 100,
+			want:       160,
+		},
+		{
+			name: "new state exists",
+			states: map[string]string{
+				"old": "value_offset: 100\nlast_raw_value: 50\n",
+				"new": "value_offset: 5\nlast_raw_value: 55\n",
+			},
+			value:      60,
+			wantOffset: 105,
+			want:       165,
+		},
+		{
+			name:       "old state missing",
+			states:     map[string]string{"new": "value_offset: 5\nlast_raw_value: 55\n"},
+			value:      60,
+			wantOffset: 5,
+			want:       65,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := NewMemoryStateStore()
+			for key, state := range tt.states {
+				if err := store.Write(key, []byte(state)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			p := NewParser(nil, ".", "", WithStateStore(store))
+			if err := p.RenameState("old", "new"); err != nil {
+				t.Fatalf("RenameState() error = %v", err)
+			}
+			if keys, _ := store.List(); !reflect.DeepEqual(keys, []string{"new"}) {
+				t.Errorf("got stored states %v, want only the new one", keys)
+			}
+
+			// A fresh parser sees the migrated state.
+			p = NewParser(nil, ".", "", WithStateStore(store))
+			got, err := p.parseMetric(cfg, "new", tt.value, nil)
+			if err != nil {
+				t.Fatalf("parseMetric() error = %v", err)
+			}
+			if offset := p.states["new"].dynamic.Offset; offset != tt.wantOffset {
+				t.Errorf("got offset %v, want %v", offset, tt.wantOffset)
+			}
+			if got.Value != tt.want {
+				t.Errorf("parseMetric() got = %v, want %v", got.Value, tt.want)
+			}
+		})
+	}
+}
+
+func TestParser_MigrateRenamedStates(t *testing.T) {
+	now = testNow
+	metrics := []config.BlockConfig{{Metrics: []config.MetricConfig{{
+		PrometheusName:  "energy_total",
+		MQTTName:        "energy",
+		ValueType:       "counter",
+		ForceMonotonicy: true,
+		RenamedFrom:     "energy",
+	}}}}
+	store := NewMemoryStateStore()
+	for key, state := range map[string]string{
+		"dht22-devices_dht22-energy-energy":         "value_offset: 100\nlast_raw_value: 50\n",
+		"dht22-devices_dht22-power-energy_peak":     "value_offset: 7\nlast_raw_value: 1\n",
+		"shelly-devices_shelly-energy-energy":       "value_offset: 10\nlast_raw_value: 5\n",
+		"shelly-devices_shelly-energy-energy_total": "value_offset: 1\nlast_raw_value: 6\n",
+	} {
+		if err := store.Write(key, []byte(state)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p := NewParser(metrics, ".", "", WithStateStore(store))
+	if err := p.MigrateRenamedStates(); err != nil {
+		t.Fatalf("MigrateRenamedStates() error = %v", err)
+	}
+	keys, _ := store.List()
+	if want := []string{"dht22-devices_dht22-energy-energy_total", "dht22-devices_dht22-power-energy_peak", "shelly-devices_shelly-energy-energy_total"}; !reflect.DeepEqual(keys, want) {
+		t.Fatalf("got stored states %v, want %v", keys, want)
+	}
+	for key, want := range map[string]float64{"dht22-devices_dht22-energy-energy_total": 100, "shelly-devices_shelly-energy-energy_total": 11} {
+		if offset := p.states[key].dynamic.Offset; offset != want {
+			t.Errorf("%s: got offset %v, want %v", key, offset, want)
+		}
+	}
+}
+
+func TestParser_LastValues(t *testing.T) {
+	now = testNow
+	defer func() { testNowElapsed = 0 }()
+	metrics := []config.BlockConfig{{Metrics: []config.MetricConfig{
+		{PrometheusName: "temperature", MQTTName: "temperature", ValueType: "gauge", PersistLastValue: true, MQTTNameLabel: "field"},
+		{PrometheusName: "humidity", MQTTName: "humidity", ValueType: "gauge"},
+	}}}
+	store := NewMemoryStateStore()
+	p := NewParser(metrics, ".", "", WithStateStore(store))
+	extract := NewJSONObjectExtractor(p, nil)
+	for i, payload := range []string{`{"temperature": 21.5, "humidity": 40}`, `{"temperature": 22}`, `{"temperature": 23}`} {
+		testNowElapsed = time.Duration(i) * 45 * time.Second
+		if _, err := extract("livingroom/dht22", []byte(payload), "dht22", MessageInfo{}); err != nil {
+			t.Fatalf("extractor() error = %v", err)
+		}
+	}
+
+	// The state was written back 90s after the first sample, not after the second one.
+	restarted := NewParser(metrics, ".", "", WithStateStore(store))
+	if err := restarted.WarmState(); err != nil {
+		t.Fatalf("WarmState() error = %v", err)
+	}
+	got := restarted.LastValues()
+	want := map[string]MetricCollection{"dht22": {{
+		Description: p.metricConfigs["temperature"][0].PrometheusDescription(),
+		Value:       23,
+		ValueType:   prometheus.GaugeValue,
+		IngestTime:  testNow(),
+		Topic:       "livingroom/dht22",
+		Labels:      map[string]string{"field": "temperature"},
+		LabelsKeys:  []string{"field"},
+	}}}
+	// The time zone of the decoded ingest time may differ.
+	if len(got["dht22"]) == 1 && got["dht22"][0].IngestTime.Equal(want["dht22"][0].IngestTime) {
+		got["dht22"][0].IngestTime = want["dht22"][0].IngestTime
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("LastValues() got = %v, want %v", got, want)
+	}
+}
+
+func TestParser_LastValuesCompanions(t *testing.T) {
+	now = testNow
+	defer func() { testNowElapsed = 0 }()
+	metrics := []config.BlockConfig{{Metrics: []config.MetricConfig{{
+		PrometheusName:   "energy_total",
+		MQTTName:         "energy",
+		ValueType:        "counter",
+		OmitTimestamp:    true,
+		PersistLastValue: true,
+		MQTTValueScale:   2,
+		EmitRaw:          true,
+		EmitDelta:        true,
+		EmitAge:          true,
+		MaxValueAge:      5 * time.Minute,
+		ErrorValue:       floatP(-1),
+	}}}}
+	store := NewMemoryStateStore()
+	p := NewParser(metrics, ".", "", WithStateStore(store))
+	extract := NewJSONObjectExtractor(p, nil)
+	for i, payload := range []string{`{"energy": 100}`, `{"energy": 130}`, `{"energy": 160}`} {
+		testNowElapsed = time.Duration(i) * 45 * time.Second
+		if _, err := extract("meters/meter", []byte(payload), "meter", MessageInfo{}); err != nil {
+			t.Fatalf("extractor() error = %v", err)
+		}
+	}
+	if err := p.FlushState(); err != nil {
+		t.Fatalf("FlushState() error = %v", err)
+	}
+
+	restarted := NewParser(metrics, ".", "", WithStateStore(store))
+	if err := restarted.WarmState(); err != nil {
+		t.Fatalf("WarmState() error = %v", err)
+	}
+	c := NewCollector(time.Hour, metrics, nil)
+	for deviceID, mc := range restarted.LastValues() {
+		c.Observe(deviceID, mc)
+	}
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(c)
+	gather := func() map[string]float64 {
+		families, err := reg.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		values := make(map[string]float64)
+		for _, mf := range families {
+			for _, m := range mf.GetMetric() {
+				values[mf.GetName()] = m.GetGauge().GetValue() + m.GetCounter().GetValue()
+			}
+		}
+		return values
+	}
+
+	// The restored sample is exposed like the last parsed one, with its companions.
+	testNowElapsed = 2 * time.Minute
+	want := map[string]float64{"energy_total": 320, "energy_total_raw": 160, "energy_total_delta": 60, "energy_total_age_seconds": 30}
+	if got := gather(); !reflect.DeepEqual(got, want) {
+		t.Errorf("after restart got %v, want %v", got, want)
+	}
+	// It becomes stale after max_value_age.
+	testNowElapsed = 90*time.Second + 6*time.Minute
+	want = map[string]float64{"energy_total": -1, "energy_total_age_seconds": 360}
+	if got := gather(); !reflect.DeepEqual(got, want) {
+		t.Errorf("after max_value_age got %v, want %v", got, want)
+	}
+}
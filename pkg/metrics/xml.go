@@ -0,0 +1,93 @@
+package metrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/hikhvar/mqtt2prometheus/pkg/config"
+)
+
+// xmlTextKey holds the text of elements which have attributes or child elements as well.
+const xmlTextKey = "#text"
+
+// NewXMLObjectExtractor decodes XML payloads and hands them as JSON object to the JSON object extractor. The children
+// and attributes of the root element become the fields of the object. Nested elements are nested objects, repeated
+// elements are arrays and the text of leaf elements is the value.
+func NewXMLObjectExtractor(p Parser, metricNameRegex *config.Regexp) Extractor {
+	extract := NewJSONObjectExtractor(p, metricNameRegex)
+	return func(topic string, payload []byte, deviceID string, info MessageInfo) (MetricCollection, error) {
+		decoded, err := decodeXML(payload)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode xml payload: %w", err)
+		}
+		obj, err := json.Marshal(decoded)
+		if err != nil {
+			return nil, fmt.Errorf("failed to convert xml payload: %w", err)
+		}
+		return extract(topic, obj, deviceID, info)
+	}
+}
+
+// decodeXML returns the content of the root element of the XML document.
+func decodeXML(payload []byte) (interface{}, error) {
+	dec := xml.NewDecoder(bytes.NewReader(payload))
+	for {
+		tok, err := dec.Token()
+		if errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("no root element found")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if start, ok := tok.(xml.StartElement); ok {
+			return decodeXMLElement(dec, start)
+		}
+	}
+}
+
+// decodeXMLElement decodes the element opened by start, up to and including its end element.
+func decodeXMLElement(dec *xml.Decoder, start xml.StartElement) (interface{}, error) {
+	fields := make(map[string]interface{})
+	for _, attr := range start.Attr {
+		fields[attr.Name.Local] = attr.Value
+	}
+	var text strings.Builder
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			child, err := decodeXMLElement(dec, t)
+			if err != nil {
+				return nil, err
+			}
+			name := t.Name.Local
+			switch existing := fields[name].(type) {
+			case nil:
+				fields[name] = child
+			case []interface{}:
+				fields[name] = append(existing, child)
+			default:
+				fields[name] = []interface{}{existing, child}
+			}
+		case xml.CharData:
+			text.Write(t)
+		case xml.EndElement:
+			value := strings.TrimSpace(text.String())
+			if len(fields) == 0 {
+				return value, nil
+			}
+			if value != "" {
+				fields[xmlTextKey] = value
+			}
+			return fields, nil
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package metrics
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hikhvar/mqtt2prometheus/pkg/config"
+)
+
+func TestDecodeXML(t *testing.T) {
+	got, err := decodeXML([]byte(`<?xml version="1.0"?>
+<reading device="boiler">
+  <temperature unit="C">65.5</temperature>
+  <pressure>1.8</pressure>
+  <zone><valve>open</valve></zone>
+  <zone><valve>closed</valve></zone>
+</reading>`))
+	if err != nil {
+		t.Fatalf("decodeXML() error = %v", err)
+	}
+	want := map[string]interface{}{
+		"device":      "boiler",
+		"temperature": map[string]interface{}{"unit": "C", "#text": "65.5"},
+		"pressure":    "1.8",
+		"zone": []interface{}{
+			map[string]interface{}{"valve": "open"},
+			map[string]interface{}{"valve": "closed"},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("decodeXML() got = %v, want %v", got, want)
+	}
+
+	if _, err := decodeXML([]byte(`<reading><pressure>1.8</reading>`)); err == nil {
+		t.Errorf("decodeXML() expected an error for malformed xml")
+	}
+}
+
+func TestNewXMLObjectExtractor(t *testing.T) {
+	now = testNow
+	p := NewParser([]config.BlockConfig{{
+		Metrics: []config.MetricConfig{
+			{PrometheusName: "pressure", MQTTName: "circuit.pressure", ValueType: "gauge", OmitTimestamp: true},
+			{PrometheusName: "temperature", MQTTName: "circuit.temperature.#text", ValueType: "gauge", OmitTimestamp: true},
+		},
+	}}, ".", "", WithStateStore(NewMemoryStateStore()))
+
+	got, err := NewXMLObjectExtractor(p, nil)("heating/boiler", []byte(`<status>
+  <circuit>
+    <pressure>1.8</pressure>
+    <temperature unit="C">65.5</temperature>
+  </circuit>
+</status>`), "boiler", MessageInfo{})
+	if err != nil {
+		t.Fatalf("extractor() error = %v", err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("extractor() got %d metrics, want 2: %v", len(got), got)
+	}
+	values := map[string]float64{}
+	for _, m := range got {
+		values[m.Description.String()] = m.Value
+	}
+	want := map[string]float64{
+		p.metricConfigs["circuit.pressure"][0].PrometheusDescription().String():          1.8,
+		p.metricConfigs["circuit.temperature.#text"][0].PrometheusDescription().String(): 65.5,
+	}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("extractor() got = %v, want %v", values, want)
+	}
+}
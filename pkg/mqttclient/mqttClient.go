@@ -6,7 +6,7 @@ import (
 )
 
 type SubscribeOptions struct {
-	Topic             string
+	Topics            []string
 	QoS               byte
 	OnMessageReceived mqtt.MessageHandler
 	Logger            *zap.Logger
@@ -18,8 +18,12 @@ func Subscribe(connectionOptions *mqtt.ClientOptions, subscribeOptions Subscribe
 		logger := subscribeOptions.Logger
 		oldConnect(client)
 		logger.Info("Connected to MQTT Broker")
-		logger.Info("Will subscribe to topic", zap.String("topic", subscribeOptions.Topic))
-		if token := client.Subscribe(subscribeOptions.Topic, subscribeOptions.QoS, subscribeOptions.OnMessageReceived); token.Wait() && token.Error() != nil {
+		logger.Info("Will subscribe to topics", zap.Strings("topics", subscribeOptions.Topics))
+		filters := make(map[string]byte, len(subscribeOptions.Topics))
+		for _, topic := range subscribeOptions.Topics {
+			filters[topic] = subscribeOptions.QoS
+		}
+		if token := client.SubscribeMultiple(filters, subscribeOptions.OnMessageReceived); token.Wait() && token.Error() != nil {
 			logger.Error("Could not subscribe", zap.Error(token.Error()))
 		}
 	}